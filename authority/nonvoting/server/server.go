@@ -37,6 +37,7 @@ import (
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/katzenpost/core/crypto/sign"
 	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/core/utils"
 	"github.com/katzenpost/katzenpost/core/wire"
 )
 
@@ -57,8 +58,9 @@ type Server struct {
 	logBackend *log.Backend
 	log        *logging.Logger
 
-	state     *state
-	listeners []net.Listener
+	state         *state
+	listeners     []net.Listener
+	listenersLock sync.Mutex
 
 	fatalErrCh chan error
 	haltedCh   chan interface{}
@@ -157,16 +159,74 @@ func (s *Server) listenWorker(l net.Listener) {
 	// NOTREACHED
 }
 
+// RestartListeners replaces the listeners with ones bound to newAddrs,
+// while the state worker and keys remain live.  All of the new addresses
+// are bound before the old listeners are closed, so a bad address leaves
+// the authority listening on the old addresses.  A listener that is already
+// bound to one of newAddrs is kept.
+func (s *Server) RestartListeners(newAddrs []string) error {
+	if len(newAddrs) == 0 {
+		return fmt.Errorf("authority: no listener addresses")
+	}
+	for _, v := range newAddrs {
+		if err := utils.EnsureAddrIPPort(v); err != nil {
+			return fmt.Errorf("authority: address '%v' is invalid: %v", v, err)
+		}
+	}
+
+	s.listenersLock.Lock()
+	defer s.listenersLock.Unlock()
+
+	current := make(map[string]net.Listener)
+	for _, l := range s.listeners {
+		if l != nil {
+			current[l.Addr().String()] = l
+		}
+	}
+
+	var listeners, started []net.Listener
+	for _, v := range newAddrs {
+		if l, ok := current[v]; ok {
+			delete(current, v)
+			listeners = append(listeners, l)
+			continue
+		}
+		l, err := net.Listen("tcp", v)
+		if err != nil {
+			for _, l := range started {
+				l.Close()
+			}
+			return fmt.Errorf("authority: failed to start listener '%v': %v", v, err)
+		}
+		started = append(started, l)
+		listeners = append(listeners, l)
+	}
+
+	// Close the listeners that are not kept, and start the new ones.
+	for _, l := range current {
+		l.Close()
+	}
+	for _, l := range started {
+		s.Add(1)
+		go s.listenWorker(l)
+	}
+	s.listeners = listeners
+	s.cfg.Server.Addresses = newAddrs
+	return nil
+}
+
 func (s *Server) halt() {
 	s.log.Notice("Starting graceful shutdown.")
 
 	// Halt the listeners.
+	s.listenersLock.Lock()
 	for idx, l := range s.listeners {
 		if l != nil {
 			l.Close()
 		}
 		s.listeners[idx] = nil
 	}
+	s.listenersLock.Unlock()
 
 	// Wait for all the connections to terminate.
 	s.WaitGroup.Wait()
@@ -0,0 +1,110 @@
+// server_test.go - Non-voting authority server tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/authority/nonvoting/client"
+	"github.com/katzenpost/katzenpost/authority/nonvoting/server/config"
+	"github.com/katzenpost/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/katzenpost/core/crypto/nike/ecdh"
+	"github.com/katzenpost/katzenpost/core/crypto/pem"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/epochtime"
+	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/core/sphinx/geo"
+	"github.com/katzenpost/katzenpost/core/wire"
+)
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestRestartListeners(t *testing.T) {
+	require := require.New(t)
+
+	dataDir := t.TempDir()
+	require.NoError(os.Chmod(dataDir, 0700))
+	for _, name := range []string{"mix.public.pem", "provider.public.pem"} {
+		_, idKey := cert.Scheme.NewKeypair()
+		require.NoError(pem.ToFile(filepath.Join(dataDir, name), idKey))
+	}
+
+	oldAddr := freeAddr(t)
+	cfg := &config.Config{
+		Server:         &config.Server{Addresses: []string{oldAddr}, DataDir: dataDir},
+		Logging:        &config.Logging{Level: "ERROR"},
+		Debug:          &config.Debug{Layers: 1, MinNodesPerLayer: 1},
+		Mixes:          []*config.Node{{IdentityKeyPem: "mix.public.pem"}},
+		Providers:      []*config.Node{{Identifier: "provider", IdentityKeyPem: "provider.public.pem"}},
+		SphinxGeometry: geo.GeometryFromUserForwardPayloadLength(ecdh.NewEcdhNike(rand.Reader), 2000, true, 5),
+	}
+	require.NoError(cfg.FixupAndValidate())
+
+	s, err := New(cfg)
+	require.NoError(err)
+	defer s.Shutdown()
+	st := s.state
+
+	logBackend, err := log.New("", "ERROR", false)
+	require.NoError(err)
+	linkKey, _ := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+	get := func(addr string) error {
+		c, err := client.New(&client.Config{
+			LogBackend:           logBackend,
+			Address:              "tcp://" + addr,
+			AuthorityIdentityKey: s.IdentityKey(),
+			AuthorityLinkKey:     s.linkKey.PublicKey(),
+			LinkKey:              linkKey,
+		})
+		require.NoError(err)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		epoch, _, _ := epochtime.Now()
+		_, _, err = c.Get(ctx, epoch+1)
+		return err
+	}
+
+	// No document exists for the next epoch, so the authority answers with
+	// an error rather than failing to respond.
+	before := get(oldAddr)
+	require.Error(before)
+	require.Contains(before.Error(), "rejected by authority")
+
+	// A bad address does not disturb the existing listener.
+	require.Error(s.RestartListeners([]string{"not an address"}))
+	require.Equal(before, get(oldAddr))
+
+	newAddr := freeAddr(t)
+	require.NoError(s.RestartListeners([]string{newAddr}))
+	require.Equal(before, get(newAddr))
+	require.True(st == s.state)
+
+	_, err = net.DialTimeout("tcp", oldAddr, time.Second)
+	require.Error(err)
+}
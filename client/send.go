@@ -263,6 +263,12 @@ func (s *Session) BlockingSendUnreliableMessageWithContext(ctx context.Context,
 
 // BlockingSendReliableMessage sends a message with automatic message retransmission enabled
 func (s *Session) BlockingSendReliableMessage(recipient, provider string, message []byte) ([]byte, error) {
+	return s.BlockingSendReliableMessageWithContext(context.Background(), recipient, provider, message)
+}
+
+// BlockingSendReliableMessageWithContext is BlockingSendReliableMessage,
+// giving up waiting for the reply when ctx is done.
+func (s *Session) BlockingSendReliableMessageWithContext(ctx context.Context, recipient, provider string, message []byte) ([]byte, error) {
 	msg, err := s.composeMessage(recipient, provider, message, true)
 	if err != nil {
 		return nil, err
@@ -289,12 +295,14 @@ func (s *Session) BlockingSendReliableMessage(recipient, provider string, messag
 		return nil, ErrMessageNotSent
 	}
 
-	// XXX: may block forever
+	// XXX: may block forever without a ctx deadline
 	select {
 	case reply := <-replyWaitChan:
 		return reply, nil
 	case <-s.HaltCh():
 		return nil, ErrHalted
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 	// unreachable
 }
@@ -26,6 +26,8 @@ type ServiceDescriptor struct {
 	Name string
 	// Provider name.
 	Provider string
+	// Parameters advertised by the service in the Provider's descriptor.
+	Parameters map[string]interface{}
 }
 
 // FindServices is a helper function for finding Provider-side services in the PKI document.
@@ -35,8 +37,9 @@ func FindServices(capability string, doc *pki.Document) []ServiceDescriptor {
 		for cap := range provider.Kaetzchen {
 			if cap == capability {
 				serviceID := ServiceDescriptor{
-					Name:     provider.Kaetzchen[cap]["endpoint"].(string),
-					Provider: provider.Name,
+					Name:       provider.Kaetzchen[cap]["endpoint"].(string),
+					Provider:   provider.Name,
+					Parameters: provider.Kaetzchen[cap],
 				}
 				services = append(services, serviceID)
 			}
@@ -52,6 +52,7 @@ const (
 	noOp       commandID = 0
 	disconnect commandID = 1
 	sendPacket commandID = 2
+	rekey      commandID = 3
 
 	// Implementation defined commands.
 	retreiveMessage      commandID = 16
@@ -652,6 +653,29 @@ func sendPacketFromBytes(b []byte) (Command, error) {
 	return r, nil
 }
 
+// Rekey is a de-serialized rekey command.  It signals that the sender has
+// re-derived its transmit key from the enclosed shared random value, and that
+// all subsequent commands are encrypted with the new key.
+type Rekey struct {
+	SharedRandom []byte
+}
+
+// ToBytes serializes the Rekey and returns the resulting slice.
+func (c *Rekey) ToBytes() []byte {
+	out := make([]byte, cmdOverhead, cmdOverhead+len(c.SharedRandom))
+	out[0] = byte(rekey)
+	binary.BigEndian.PutUint32(out[2:6], uint32(len(c.SharedRandom)))
+	out = append(out, c.SharedRandom...)
+	return out
+}
+
+func rekeyFromBytes(b []byte) (Command, error) {
+	r := new(Rekey)
+	r.SharedRandom = make([]byte, 0, len(b))
+	r.SharedRandom = append(r.SharedRandom, b...)
+	return r, nil
+}
+
 // RetrieveMessage is a de-serialized retrieve_message command.
 type RetrieveMessage struct {
 	Sequence uint32
@@ -851,6 +875,8 @@ func (c *Commands) FromBytes(b []byte) (Command, error) {
 	switch commandID(id) {
 	case sendPacket:
 		return sendPacketFromBytes(b)
+	case rekey:
+		return rekeyFromBytes(b)
 	case retreiveMessage:
 		return retreiveMessageFromBytes(b)
 	case message:
@@ -102,6 +102,25 @@ func TestSendPacket(t *testing.T) {
 	require.Equal([]byte(payload), cmd.SphinxPacket, "SendPacket: FromBytes() SphinxPacket")
 }
 
+func TestRekey(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	srv := make([]byte, 32)
+	_, err := rand.Reader.Read(srv)
+	require.NoError(err)
+
+	cmd := &Rekey{SharedRandom: srv}
+	b := cmd.ToBytes()
+	require.Equal(cmdOverhead+len(srv), len(b), "Rekey: ToBytes() length")
+
+	cmds := NewPKICommands()
+	c, err := cmds.FromBytes(b)
+	require.NoError(err, "Rekey: FromBytes() failed")
+	require.IsType(cmd, c, "Rekey: FromBytes() invalid type")
+	require.Equal(srv, c.(*Rekey).SharedRandom, "Rekey: FromBytes() SharedRandom")
+}
+
 func TestRetrieveMessage(t *testing.T) {
 	t.Parallel()
 	const seq = 0xbeefbeef
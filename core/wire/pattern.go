@@ -0,0 +1,231 @@
+// pattern.go - Wire protocol configurable handshake patterns.
+// Copyright (C) 2023  The Katzenpost Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/katzenpost/nyquist"
+	"github.com/katzenpost/nyquist/pattern"
+)
+
+// HandshakePattern is the name of the Noise handshake pattern used to
+// establish a Session.
+type HandshakePattern string
+
+const (
+	// HandshakePatternDefault selects the Katzenpost wire protocol
+	// handshake, which is a fixed length pqXX exchange.
+	HandshakePatternDefault HandshakePattern = ""
+
+	// HandshakePatternXX selects a length prefixed pqXX handshake.
+	HandshakePatternXX HandshakePattern = "XX"
+
+	// HandshakePatternIX selects a length prefixed pqIX handshake.
+	HandshakePatternIX HandshakePattern = "IX"
+
+	// HandshakePatternIK selects a length prefixed pqIK handshake.  The
+	// initiator MUST know the responder's static key a priori.
+	HandshakePatternIK HandshakePattern = "IK"
+)
+
+var (
+	handshakePatterns = map[HandshakePattern]pattern.Pattern{
+		HandshakePatternDefault: pattern.PqXX,
+		HandshakePatternXX:      pattern.PqXX,
+		HandshakePatternIX:      pattern.PqIX,
+		HandshakePatternIK:      pattern.PqIK,
+	}
+
+	errHandshakeIncomplete = errors.New("wire/session: handshake did not authenticate the peer")
+)
+
+// String returns the name of the handshake pattern.
+func (p HandshakePattern) String() string {
+	if p == HandshakePatternDefault {
+		return "default"
+	}
+	return string(p)
+}
+
+// NoisePattern returns the nyquist pattern corresponding to the
+// handshake pattern.
+func (p HandshakePattern) NoisePattern() (pattern.Pattern, error) {
+	pat, ok := handshakePatterns[p]
+	if !ok {
+		return nil, fmt.Errorf("wire/session: unsupported handshake pattern: %s", string(p))
+	}
+	return pat, nil
+}
+
+// requiresPeerKey returns true iff the initiator must know the responder's
+// static key before the handshake.
+func (p HandshakePattern) requiresPeerKey() bool {
+	pat, ok := handshakePatterns[p]
+	if !ok {
+		return false
+	}
+	return hasPreMessageStatic(pat, 1)
+}
+
+func hasToken(msg pattern.Message, token pattern.Token) bool {
+	for _, v := range msg {
+		if v == token {
+			return true
+		}
+	}
+	return false
+}
+
+// patternHandshake conducts a handshake for any of the supported
+// HandshakePatterns.  Unlike the default handshake, the message sizes are not
+// fixed, so each handshake message is prefixed with its length.  Each side
+// sends its authenticateMessage in the first message it writes once the peer
+// is able to learn its static key.
+func (s *Session) patternHandshake(handshake *nyquist.HandshakeState) error {
+	ourSide := 1
+	if s.isInitiator {
+		ourSide = 0
+	}
+	sentStatic := hasPreMessageStatic(s.protocol.Pattern, ourSide)
+	sentAuth := false
+
+	var err error
+	for i, msg := range s.protocol.Pattern.Messages() {
+		isWriter := (i%2 == 0) == s.isInitiator
+		if !isWriter {
+			if err = s.readPatternMessage(handshake, i); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if hasToken(msg, pattern.Token_s) {
+			sentStatic = true
+		}
+		var rawAuth []byte
+		if sentStatic && !sentAuth {
+			ourAuth := &authenticateMessage{ad: s.additionalData}
+			if !s.isInitiator {
+				ourAuth.unixTime = uint32(time.Now().Unix()) // XXX: Add noise.
+			}
+			rawAuth = ourAuth.ToBytes(make([]byte, 0, authLen))
+			sentAuth = true
+		}
+
+		var hsMsg []byte
+		if i == 0 {
+			hsMsg = append(hsMsg, s.version)
+		}
+		hdrOffset := len(hsMsg)
+		hsMsg = append(hsMsg, 0, 0, 0, 0)
+		hsMsg, err = handshake.WriteMessage(hsMsg, rawAuth)
+		switch err {
+		case nil, nyquist.ErrDone:
+		default:
+			return err
+		}
+		binary.BigEndian.PutUint32(hsMsg[hdrOffset:], uint32(len(hsMsg)-hdrOffset-4))
+		if _, err = s.conn.Write(hsMsg); err != nil {
+			return err
+		}
+	}
+
+	if handshake.GetStatus().Err != nyquist.ErrDone {
+		return errors.New("wire/session: weird handshake failure")
+	}
+	if s.peerCredentials == nil {
+		return errHandshakeIncomplete
+	}
+	return nil
+}
+
+func (s *Session) readPatternMessage(handshake *nyquist.HandshakeState, idx int) error {
+	if idx == 0 && !s.versionByteRead {
+		var version [1]byte
+		if _, err := io.ReadFull(s.conn, version[:]); err != nil {
+			return err
+		}
+		if version[0] != s.version {
+			return errors.New("wire/session: unsupported protocol version")
+		}
+	}
+
+	var hdr [4]byte
+	if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+		return err
+	}
+	msgLen := binary.BigEndian.Uint32(hdr[:])
+	if msgLen > maxMsgLen {
+		return errMsgSize
+	}
+	hsMsg := make([]byte, msgLen)
+	if _, err := io.ReadFull(s.conn, hsMsg); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	rawAuth, err := handshake.ReadMessage(nil, hsMsg)
+	switch err {
+	case nil, nyquist.ErrDone:
+	default:
+		return err
+	}
+	if len(rawAuth) == 0 {
+		return nil
+	}
+	if len(rawAuth) != authLen || s.peerCredentials != nil {
+		return errAuthenticationFailed
+	}
+	peerAuth := authenticateMessageFromBytes(rawAuth)
+
+	// Authenticate the peer.
+	remoteStatic := handshake.GetStatus().KEM.RemoteStatic
+	if remoteStatic == nil {
+		return errAuthenticationFailed
+	}
+	peerAuthenticationKEMKey, err := s.protocol.KEM.ParsePublicKey(remoteStatic.Bytes())
+	if err != nil {
+		return err
+	}
+	s.peerCredentials = &PeerCredentials{
+		AdditionalData: peerAuth.ad,
+		PublicKey: &publicKey{
+			publicKey: peerAuthenticationKEMKey,
+			KEM:       s.protocol.KEM,
+		},
+	}
+	if !s.authenticator.IsPeerValid(s.peerCredentials) {
+		return errAuthenticationFailed
+	}
+
+	if s.isInitiator {
+		// Cache the clock skew.
+		peerClock := time.Unix(int64(peerAuth.unixTime), 0)
+		s.clockSkew = now.Sub(peerClock)
+	}
+	return nil
+}
+
+func hasPreMessageStatic(pat pattern.Pattern, side int) bool {
+	preMessages := pat.PreMessages()
+	return len(preMessages) > side && hasToken(preMessages[side], pattern.Token_s)
+}
@@ -31,7 +31,6 @@ import (
 	"github.com/katzenpost/nyquist/cipher"
 	"github.com/katzenpost/nyquist/hash"
 	"github.com/katzenpost/nyquist/kem"
-	"github.com/katzenpost/nyquist/pattern"
 	"github.com/katzenpost/nyquist/seec"
 
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
@@ -51,20 +50,21 @@ const (
 	authLen = 1 + MaxAdditionalDataLength + 4
 )
 
-var (
-	prologue = []byte{0x03} // Prologue indicates version 3.
-)
-
 const (
 	stateInit        uint32 = 0
 	stateEstablished uint32 = 1
 	stateInvalid     uint32 = 2
 )
 
+// channelBindingLabel separates the channel binding from other uses of the
+// handshake hash.
+var channelBindingLabel = []byte("katzenpost-wire-channel-binding")
+
 var (
 	errInvalidState         = errors.New("wire/session: invalid state")
 	errAuthenticationFailed = errors.New("wire/session: authentication failed")
 	errMsgSize              = errors.New("wire/session: invalid message size")
+	errInvalidSharedRandom  = errors.New("wire/session: invalid shared random")
 )
 
 type authenticateMessage struct {
@@ -141,6 +141,19 @@ type Session struct {
 
 	additionalData       []byte
 	authenticationKEMKey kem.Keypair
+	peerKEMKey           kem.PublicKey
+	handshakePattern     HandshakePattern
+
+	minVersion uint8
+	maxVersion uint8
+	version    uint8
+	prologue   []byte
+
+	// versionByteRead is set when the responder read the version byte
+	// of the first handshake message of a legacy peer while negotiating.
+	versionByteRead bool
+
+	handshakeHash []byte
 
 	randReader io.Reader
 
@@ -165,14 +178,23 @@ func (s *Session) handshake() error {
 		atomic.CompareAndSwapUint32(&s.state, stateInit, stateInvalid)
 	}()
 
+	if err := s.negotiateVersion(); err != nil {
+		return err
+	}
+	return s.noiseHandshake()
+}
+
+// noiseHandshake runs the handshake of the negotiated version.
+func (s *Session) noiseHandshake() error {
 	cfg := &nyquist.HandshakeConfig{
 		Protocol:       s.protocol,
 		Rng:            rand.Reader,
-		Prologue:       prologue,
+		Prologue:       s.prologue,
 		MaxMessageSize: maxMsgLen,
 		KEM: &nyquist.KEMConfig{
-			LocalStatic: s.authenticationKEMKey,
-			GenKey:      seec.GenKeyPRPAES,
+			LocalStatic:  s.authenticationKEMKey,
+			RemoteStatic: s.peerKEMKey,
+			GenKey:       seec.GenKeyPRPAES,
 		},
 		IsInitiator: s.isInitiator,
 	}
@@ -182,13 +204,36 @@ func (s *Session) handshake() error {
 		return err
 	}
 	defer handshake.Reset()
+
+	if s.handshakePattern != HandshakePatternDefault {
+		err = s.patternHandshake(handshake)
+	} else {
+		err = s.defaultHandshake(handshake)
+	}
+	if err != nil {
+		return err
+	}
+
+	status := handshake.GetStatus()
+	s.handshakeHash = append([]byte{}, status.HandshakeHash...)
+	if s.isInitiator {
+		s.tx, s.rx = status.CipherStates[0], status.CipherStates[1]
+	} else {
+		s.rx, s.tx = status.CipherStates[0], status.CipherStates[1]
+	}
+	atomic.StoreUint32(&s.state, stateEstablished)
+	return nil
+}
+
+func (s *Session) defaultHandshake(handshake *nyquist.HandshakeState) error {
+	var err error
 	var (
-		prologueLen = 1
-		keyLen      = nyquist.SymmetricKeySize
+		versionLen = 1
+		keyLen     = nyquist.SymmetricKeySize
 
 		// client
-		// -> (prologue), e
-		msg1Len = prologueLen + s.protocol.KEM.PublicKeySize()
+		// -> (version), e
+		msg1Len = versionLen + s.protocol.KEM.PublicKeySize()
 
 		// server
 		// -> ekem, s, (auth)
@@ -204,9 +249,9 @@ func (s *Session) handshake() error {
 	)
 
 	if s.isInitiator {
-		// -> (prologue), e
+		// -> (version), e
 		msg1 := make([]byte, 0, msg1Len)
-		msg1 = append(msg1, prologue...)
+		msg1 = append(msg1, s.version)
 		msg1, err = handshake.WriteMessage(msg1, nil)
 		if err != nil {
 			return err
@@ -277,12 +322,17 @@ func (s *Session) handshake() error {
 			return err
 		}
 	} else {
-		// -> (prologue), e
+		// -> (version), e
 		msg1 := make([]byte, msg1Len)
-		if _, err = io.ReadFull(s.conn, msg1); err != nil {
+		off := 0
+		if s.versionByteRead {
+			msg1[0] = s.version
+			off = 1
+		}
+		if _, err = io.ReadFull(s.conn, msg1[off:]); err != nil {
 			return err
 		}
-		if subtle.ConstantTimeCompare(prologue, msg1[0:1]) != 1 {
+		if subtle.ConstantTimeCompare([]byte{s.version}, msg1[0:1]) != 1 {
 			return errors.New("wire/session: unsupported protocol version")
 		}
 		msg1 = msg1[1:]
@@ -352,14 +402,6 @@ func (s *Session) handshake() error {
 			return err
 		}
 	}
-
-	status := handshake.GetStatus()
-	if s.isInitiator {
-		s.tx, s.rx = status.CipherStates[0], status.CipherStates[1]
-	} else {
-		s.rx, s.tx = status.CipherStates[0], status.CipherStates[1]
-	}
-	atomic.StoreUint32(&s.state, stateEstablished)
 	return nil
 }
 
@@ -401,8 +443,18 @@ func (s *Session) Initialize(conn net.Conn) error {
 	return nil
 }
 
-// SendCommand sends the wire protocol command cmd.
+// SendCommand sends the wire protocol command cmd.  It may be called
+// concurrently with other sends, including Rekey.
 func (s *Session) SendCommand(cmd commands.Command) error {
+	s.txKeyMutex.Lock()
+	defer s.txKeyMutex.Unlock()
+	return s.sendCommandLocked(cmd)
+}
+
+// sendCommandLocked encrypts and writes cmd.  The caller MUST hold
+// txKeyMutex exclusively, so that frames hit the wire in the order their
+// nonces were assigned.
+func (s *Session) sendCommandLocked(cmd commands.Command) error {
 	if atomic.LoadUint32(&s.state) != stateEstablished {
 		return errInvalidState
 	}
@@ -422,25 +474,17 @@ func (s *Session) SendCommand(cmd commands.Command) error {
 	var ctHdr [4]byte
 	binary.BigEndian.PutUint32(ctHdr[:], uint32(ctLen))
 	toSend := make([]byte, 0, macLen+4+ctLen)
-	s.txKeyMutex.RLock()
-	var err error
-	toSend, err = s.tx.EncryptWithAd(toSend, nil, ctHdr[:])
-	s.txKeyMutex.RUnlock()
+	toSend, err := s.tx.EncryptWithAd(toSend, nil, ctHdr[:])
 	if err != nil {
 		return err
 	}
 
 	// Build the Ciphertext.
-	s.txKeyMutex.RLock()
 	toSend, err = s.tx.EncryptWithAd(toSend, nil, pt)
-	s.txKeyMutex.RUnlock()
 	if err != nil {
 		return err
 	}
-
-	s.txKeyMutex.Lock()
 	s.tx.Rekey()
-	s.txKeyMutex.Unlock()
 
 	_, err = s.conn.Write(toSend)
 	if err != nil {
@@ -497,11 +541,75 @@ func (s *Session) recvCommandImpl() (commands.Command, error) {
 	s.rxKeyMutex.Unlock()
 
 	// Parse and return the command.
-	return s.commands.FromBytes(pt)
+	cmd, err := s.commands.FromBytes(pt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rekey commands are handled by the session and never returned, the
+	// next command from the peer is encrypted with the new key.
+	if rekey, ok := cmd.(*commands.Rekey); ok {
+		s.rxKeyMutex.Lock()
+		err = s.deriveKey(s.rx, rekey.SharedRandom)
+		s.rxKeyMutex.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return s.recvCommandImpl()
+	}
+	return cmd, nil
+}
+
+// Rekey rotates the transmit key of an established session, mixing in
+// newSharedRandom, and sends a rekey command so that the peer rotates the
+// matching receive key.  The connection is preserved.  Each side rotates
+// its own transmit key, so both peers should call Rekey when the network
+// shared random value changes.
+//
+// The transmit key is held across sending the rekey command and deriving
+// the new key, so a concurrent SendCommand is encrypted either entirely
+// before or entirely after the rotation.
+func (s *Session) Rekey(newSharedRandom []byte) error {
+	if len(newSharedRandom) == 0 {
+		return errInvalidSharedRandom
+	}
+
+	s.txKeyMutex.Lock()
+	defer s.txKeyMutex.Unlock()
+	if err := s.sendCommandLocked(&commands.Rekey{SharedRandom: newSharedRandom}); err != nil {
+		return err
+	}
+	if err := s.deriveKey(s.tx, newSharedRandom); err != nil {
+		atomic.StoreUint32(&s.state, stateInvalid)
+		return err
+	}
+	return nil
+}
+
+// deriveKey replaces the key of cs with one derived from the current key
+// and sharedRandom.  Both peers hold identical CipherStates for a given
+// direction, so this yields the same key on each side.  The caller MUST
+// hold the appropriate key mutex.
+func (s *Session) deriveKey(cs *nyquist.CipherState, sharedRandom []byte) error {
+	var zeroes [nyquist.SymmetricKeySize]byte
+	keyMaterial, err := cs.EncryptWithAd(nil, sharedRandom, zeroes[:])
+	if err != nil {
+		return err
+	}
+	h := s.protocol.Hash.New()
+	h.Write(keyMaterial)
+	cs.InitializeKey(h.Sum(nil)[:nyquist.SymmetricKeySize])
+	return nil
 }
 
 // Close terminates a session.
 func (s *Session) Close() {
+	// Close the connection first, so that a send blocked in Write while
+	// holding txKeyMutex is released.
+	if s.conn != nil {
+		s.conn.Close()
+	}
+
 	// The Noise library doesn't have a way to explcitly clear cryptographic
 	// state.  Without an underlying crypto break, Rekey() is backtracking
 	// resistant.
@@ -518,9 +626,6 @@ func (s *Session) Close() {
 
 	// FIXME XXX s.authenticationKEMKey.Reset()
 	s.authenticationKEMKey = nil
-	if s.conn != nil {
-		s.conn.Close()
-	}
 	atomic.StoreUint32(&s.state, stateInvalid)
 }
 
@@ -547,6 +652,31 @@ func (s *Session) ClockSkew() time.Duration {
 	return s.clockSkew
 }
 
+// Version returns the protocol version negotiated with the peer.  This call
+// MUST only be called from a session that has successfully completed
+// Initialize().
+func (s *Session) Version() uint8 {
+	if atomic.LoadUint32(&s.state) != stateEstablished {
+		panic("wire/session: Version() call in invalid state")
+	}
+	return s.version
+}
+
+// ExportChannelBinding returns a value unique to this session, derived from
+// the hash of the handshake transcript, on which both peers agree.  Higher
+// layers may mix it into signatures or tokens to bind them to the session,
+// so that they can not be replayed over another.  This call MUST only be
+// called from a session that has successfully completed Initialize().
+func (s *Session) ExportChannelBinding() []byte {
+	if atomic.LoadUint32(&s.state) != stateEstablished {
+		panic("wire/session: ExportChannelBinding() call in invalid state")
+	}
+	h := s.protocol.Hash.New()
+	h.Write(channelBindingLabel)
+	h.Write(s.handshakeHash)
+	return h.Sum(nil)
+}
+
 // NewPKISession creates a new session to be used with the PKI (authority).
 // Unlike NewSession, NewPKISession does not require that you pass in
 // a Sphinx geometry.
@@ -563,24 +693,41 @@ func NewPKISession(cfg *SessionConfig, isInitiator bool) (*Session, error) {
 	if cfg.RandomReader == nil {
 		return nil, errors.New("wire/session: missing RandomReader")
 	}
+	handshakePattern, err := cfg.HandshakePattern.NoisePattern()
+	if err != nil {
+		return nil, err
+	}
+	if isInitiator && cfg.HandshakePattern.requiresPeerKey() && cfg.PeerPublicKey == nil {
+		return nil, errors.New("wire/session: missing PeerPublicKey")
+	}
+	minVersion, maxVersion, err := versionRangeFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
 
 	s := &Session{
 		protocol: &nyquist.Protocol{
-			Pattern: pattern.PqXX,
+			Pattern: handshakePattern,
 			KEM:     DefaultScheme.KEM,
 			Cipher:  cipher.ChaChaPoly,
 			Hash:    hash.BLAKE2b,
 		},
-		authenticator:  cfg.Authenticator,
-		additionalData: cfg.AdditionalData,
-		randReader:     cfg.RandomReader,
-		isInitiator:    isInitiator,
-		state:          stateInit,
-		rxKeyMutex:     new(sync.RWMutex),
-		txKeyMutex:     new(sync.RWMutex),
-		commands:       commands.NewPKICommands(),
+		authenticator:    cfg.Authenticator,
+		additionalData:   cfg.AdditionalData,
+		handshakePattern: cfg.HandshakePattern,
+		minVersion:       minVersion,
+		maxVersion:       maxVersion,
+		randReader:       cfg.RandomReader,
+		isInitiator:      isInitiator,
+		state:            stateInit,
+		rxKeyMutex:       new(sync.RWMutex),
+		txKeyMutex:       new(sync.RWMutex),
+		commands:         commands.NewPKICommands(),
 	}
 	s.authenticationKEMKey = cfg.AuthenticationKey.(*privateKey).privateKey
+	if isInitiator && cfg.PeerPublicKey != nil {
+		s.peerKEMKey = cfg.PeerPublicKey.(*publicKey).publicKey
+	}
 
 	return s, nil
 }
@@ -602,24 +749,41 @@ func NewSession(cfg *SessionConfig, isInitiator bool) (*Session, error) {
 	if cfg.RandomReader == nil {
 		return nil, errors.New("wire/session: missing RandomReader")
 	}
+	handshakePattern, err := cfg.HandshakePattern.NoisePattern()
+	if err != nil {
+		return nil, err
+	}
+	if isInitiator && cfg.HandshakePattern.requiresPeerKey() && cfg.PeerPublicKey == nil {
+		return nil, errors.New("wire/session: missing PeerPublicKey")
+	}
+	minVersion, maxVersion, err := versionRangeFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
 
 	s := &Session{
 		protocol: &nyquist.Protocol{
-			Pattern: pattern.PqXX,
+			Pattern: handshakePattern,
 			KEM:     DefaultScheme.KEM,
 			Cipher:  cipher.ChaChaPoly,
 			Hash:    hash.BLAKE2b,
 		},
-		authenticator:  cfg.Authenticator,
-		additionalData: cfg.AdditionalData,
-		randReader:     cfg.RandomReader,
-		isInitiator:    isInitiator,
-		state:          stateInit,
-		rxKeyMutex:     new(sync.RWMutex),
-		txKeyMutex:     new(sync.RWMutex),
-		commands:       commands.NewCommands(cfg.Geometry),
+		authenticator:    cfg.Authenticator,
+		additionalData:   cfg.AdditionalData,
+		handshakePattern: cfg.HandshakePattern,
+		minVersion:       minVersion,
+		maxVersion:       maxVersion,
+		randReader:       cfg.RandomReader,
+		isInitiator:      isInitiator,
+		state:            stateInit,
+		rxKeyMutex:       new(sync.RWMutex),
+		txKeyMutex:       new(sync.RWMutex),
+		commands:         commands.NewCommands(cfg.Geometry),
 	}
 	s.authenticationKEMKey = cfg.AuthenticationKey.(*privateKey).privateKey
+	if isInitiator && cfg.PeerPublicKey != nil {
+		s.peerKEMKey = cfg.PeerPublicKey.(*publicKey).publicKey
+	}
 
 	return s, nil
 }
@@ -645,4 +809,22 @@ type SessionConfig struct {
 	// Geometry is the geometry of the Sphinx cryptographic packets
 	// that we will use with our wire protocol.
 	Geometry *geo.Geometry
+
+	// HandshakePattern is the Noise handshake pattern used to establish the
+	// session.  The zero value selects the default Katzenpost handshake, and
+	// both peers MUST be configured with the same pattern.
+	HandshakePattern HandshakePattern
+
+	// PeerPublicKey is the responder's static authentication key, which the
+	// initiator MUST provide for patterns where it is known a priori (IK).
+	PeerPublicKey PublicKey
+
+	// MinVersion and MaxVersion bound the protocol versions that may be
+	// negotiated with the peer, which settle on the highest version both
+	// support.  Zero values select MinProtocolVersion and ProtocolVersion.
+	// An initiator with a MaxVersion of 3 speaks v3 as peers that predate
+	// negotiation do, and only a higher MaxVersion sends a version hello,
+	// so it should only be raised once the peers are upgraded.
+	MinVersion uint8
+	MaxVersion uint8
 }
@@ -338,3 +338,477 @@ func TestErrorInvalidStateClockSkew(t *testing.T) {
 	}
 	require.Panics(t, f)
 }
+
+func TestSessionHandshakePatterns(t *testing.T) {
+	t.Parallel()
+
+	nike := ecdh.NewEcdhNike(rand.Reader)
+	geometry := geo.GeometryFromUserForwardPayloadLength(nike, 3000, true, 5)
+
+	for _, handshakePattern := range []HandshakePattern{
+		HandshakePatternDefault,
+		HandshakePatternXX,
+		HandshakePatternIX,
+		HandshakePatternIK,
+	} {
+		handshakePattern := handshakePattern
+		t.Run(handshakePattern.String(), func(t *testing.T) {
+			t.Parallel()
+			require := require.New(t)
+
+			authKEMKeyAlice, authKEMKeyAlicePub := DefaultScheme.GenerateKeypair(rand.Reader)
+			credsAlice := &PeerCredentials{
+				AdditionalData: []byte("alice@example.com"),
+				PublicKey:      authKEMKeyAlicePub,
+			}
+			authKEMKeyBob, authKEMKeyBobPub := DefaultScheme.GenerateKeypair(rand.Reader)
+			credsBob := &PeerCredentials{
+				AdditionalData: []byte("katzenpost.example.com"),
+				PublicKey:      authKEMKeyBobPub,
+			}
+
+			sAlice, err := NewSession(&SessionConfig{
+				Geometry:          geometry,
+				Authenticator:     &stubAuthenticator{creds: credsBob},
+				AdditionalData:    credsAlice.AdditionalData,
+				AuthenticationKey: authKEMKeyAlice,
+				RandomReader:      rand.Reader,
+				HandshakePattern:  handshakePattern,
+				PeerPublicKey:     authKEMKeyBobPub,
+			}, true)
+			require.NoError(err)
+			sBob, err := NewSession(&SessionConfig{
+				Geometry:          geometry,
+				Authenticator:     &stubAuthenticator{creds: credsAlice},
+				AdditionalData:    credsBob.AdditionalData,
+				AuthenticationKey: authKEMKeyBob,
+				RandomReader:      rand.Reader,
+				HandshakePattern:  handshakePattern,
+			}, false)
+			require.NoError(err)
+
+			connAlice, connBob := net.Pipe()
+			var wg sync.WaitGroup
+			wg.Add(2)
+			exchange := func(s *Session, conn net.Conn, isAlice bool) {
+				defer wg.Done()
+				defer s.Close()
+
+				err := s.Initialize(conn)
+				require.NoError(err)
+				creds, err := s.PeerCredentials()
+				require.NoError(err)
+
+				toSend, toRecv := []byte("hello bob"), []byte("hello alice")
+				if !isAlice {
+					toSend, toRecv = toRecv, toSend
+					require.Equal(credsAlice.AdditionalData, creds.AdditionalData)
+				} else {
+					require.Equal(credsBob.AdditionalData, creds.AdditionalData)
+					err = s.SendCommand(&commands.SendPacket{SphinxPacket: toSend})
+					require.NoError(err)
+				}
+				cmd, err := s.RecvCommand()
+				require.NoError(err)
+				require.IsType(&commands.SendPacket{}, cmd)
+				require.Equal(toRecv, cmd.(*commands.SendPacket).SphinxPacket)
+				if !isAlice {
+					err = s.SendCommand(&commands.SendPacket{SphinxPacket: toSend})
+					require.NoError(err)
+				}
+			}
+			go exchange(sAlice, connAlice, true)
+			go exchange(sBob, connBob, false)
+			wg.Wait()
+		})
+	}
+}
+
+func TestSessionHandshakePatternErrors(t *testing.T) {
+	t.Parallel()
+
+	authKEMKey, _ := DefaultScheme.GenerateKeypair(rand.Reader)
+	cfg := &SessionConfig{
+		Authenticator:     &stubAuthenticator{},
+		AuthenticationKey: authKEMKey,
+		RandomReader:      rand.Reader,
+		HandshakePattern:  HandshakePattern("NN"),
+	}
+	_, err := NewPKISession(cfg, true)
+	require.Error(t, err)
+
+	// IK requires the initiator to know the responder's static key.
+	cfg.HandshakePattern = HandshakePatternIK
+	_, err = NewPKISession(cfg, true)
+	require.Error(t, err)
+	_, err = NewPKISession(cfg, false)
+	require.NoError(t, err)
+}
+
+func TestSessionRekey(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	nike := ecdh.NewEcdhNike(rand.Reader)
+	geometry := geo.GeometryFromUserForwardPayloadLength(nike, 3000, true, 5)
+
+	authKEMKeyAlice, authKEMKeyAlicePub := DefaultScheme.GenerateKeypair(rand.Reader)
+	credsAlice := &PeerCredentials{
+		AdditionalData: []byte("alice@example.com"),
+		PublicKey:      authKEMKeyAlicePub,
+	}
+	authKEMKeyBob, authKEMKeyBobPub := DefaultScheme.GenerateKeypair(rand.Reader)
+	credsBob := &PeerCredentials{
+		AdditionalData: []byte("katzenpost.example.com"),
+		PublicKey:      authKEMKeyBobPub,
+	}
+
+	sAlice, err := NewSession(&SessionConfig{
+		Geometry:          geometry,
+		Authenticator:     &stubAuthenticator{creds: credsBob},
+		AdditionalData:    credsAlice.AdditionalData,
+		AuthenticationKey: authKEMKeyAlice,
+		RandomReader:      rand.Reader,
+	}, true)
+	require.NoError(err)
+	sBob, err := NewSession(&SessionConfig{
+		Geometry:          geometry,
+		Authenticator:     &stubAuthenticator{creds: credsAlice},
+		AdditionalData:    credsBob.AdditionalData,
+		AuthenticationKey: authKEMKeyBob,
+		RandomReader:      rand.Reader,
+	}, false)
+	require.NoError(err)
+
+	require.Equal(errInvalidSharedRandom, sAlice.Rekey(nil))
+
+	sharedRandom := make([]byte, 32)
+	_, err = rand.Read(sharedRandom)
+	require.NoError(err)
+
+	const nrPackets = 10
+	packet := func(i int) []byte {
+		return []byte{byte(i), 'k', 'a', 't', 'z', 'e', 'n'}
+	}
+
+	connAlice, connBob := net.Pipe()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer sAlice.Close()
+		err := sAlice.Initialize(connAlice)
+		require.NoError(err)
+		for i := 0; i < nrPackets; i++ {
+			if i == nrPackets/2 {
+				err = sAlice.Rekey(sharedRandom)
+				require.NoError(err)
+			}
+			err = sAlice.SendCommand(&commands.SendPacket{SphinxPacket: packet(i)})
+			require.NoError(err)
+		}
+		cmd, err := sAlice.RecvCommand()
+		require.NoError(err)
+		require.IsType(&commands.NoOp{}, cmd)
+	}()
+	go func() {
+		defer wg.Done()
+		defer sBob.Close()
+		err := sBob.Initialize(connBob)
+		require.NoError(err)
+		for i := 0; i < nrPackets; i++ {
+			cmd, err := sBob.RecvCommand()
+			require.NoError(err)
+			require.IsType(&commands.SendPacket{}, cmd)
+			require.Equal(packet(i), cmd.(*commands.SendPacket).SphinxPacket)
+		}
+		err = sBob.Rekey(sharedRandom)
+		require.NoError(err)
+		err = sBob.SendCommand(&commands.NoOp{})
+		require.NoError(err)
+	}()
+	wg.Wait()
+}
+
+func TestSessionRekeyConcurrentSend(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	newSession := func(ad string, isInitiator bool) *Session {
+		key, _ := DefaultScheme.GenerateKeypair(rand.Reader)
+		s, err := NewPKISession(&SessionConfig{
+			Authenticator:     acceptAllAuthenticator{},
+			AdditionalData:    []byte(ad),
+			AuthenticationKey: key,
+			RandomReader:      rand.Reader,
+		}, isInitiator)
+		require.NoError(err)
+		return s
+	}
+	sAlice := newSession("alice", true)
+	sBob := newSession("bob", false)
+
+	sharedRandom := make([]byte, 32)
+	_, err := rand.Read(sharedRandom)
+	require.NoError(err)
+
+	const nrSenders, nrPackets, nrRekeys = 4, 50, 20
+	connAlice, connBob := net.Pipe()
+	initErr := make(chan error, 1)
+	go func() {
+		initErr <- sBob.Initialize(connBob)
+	}()
+	require.NoError(sAlice.Initialize(connAlice))
+	require.NoError(<-initErr)
+	defer sAlice.Close()
+	defer sBob.Close()
+
+	// Senders race each other and the Rekey for the transmit key, Bob must
+	// decrypt every packet regardless of how they interleave.
+	sendErr := make(chan error, nrSenders+1)
+	for i := 0; i < nrSenders; i++ {
+		go func(sender int) {
+			for j := 0; j < nrPackets; j++ {
+				if err := sAlice.SendCommand(&commands.SendPacket{SphinxPacket: []byte{byte(sender), byte(j)}}); err != nil {
+					sendErr <- err
+					return
+				}
+			}
+			sendErr <- nil
+		}(i)
+	}
+	go func() {
+		for i := 0; i < nrRekeys; i++ {
+			if err := sAlice.Rekey(sharedRandom); err != nil {
+				sendErr <- err
+				return
+			}
+		}
+		sendErr <- nil
+	}()
+
+	next := make([]int, nrSenders)
+	for i := 0; i < nrSenders*nrPackets; i++ {
+		cmd, err := sBob.RecvCommand()
+		require.NoError(err)
+		require.IsType(&commands.SendPacket{}, cmd)
+		pkt := cmd.(*commands.SendPacket).SphinxPacket
+		require.Equal(byte(next[pkt[0]]), pkt[1])
+		next[pkt[0]]++
+	}
+	for i := 0; i < nrSenders+1; i++ {
+		require.NoError(<-sendErr)
+	}
+}
+
+func TestSessionVersionNegotiation(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name                 string
+		aliceMin, aliceMax   uint8
+		bobMin, bobMax       uint8
+		version              uint8
+		aliceError, bobError string
+	}{
+		{name: "matched", version: ProtocolVersion},
+		{name: "downgrade", aliceMin: 3, aliceMax: 5, bobMin: 3, bobMax: 4, version: 4},
+		{
+			name:     "no overlap",
+			aliceMin: 5, aliceMax: 6, bobMin: 3, bobMax: 4,
+			aliceError: "wire/session: peer supports only v3-v4, we require ≥v5",
+			bobError:   "wire/session: peer requires ≥v5, we support only v3-v4",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			require := require.New(t)
+
+			authKEMKeyAlice, authKEMKeyAlicePub := DefaultScheme.GenerateKeypair(rand.Reader)
+			authKEMKeyBob, authKEMKeyBobPub := DefaultScheme.GenerateKeypair(rand.Reader)
+			sAlice, err := NewPKISession(&SessionConfig{
+				Authenticator:     &stubAuthenticator{creds: &PeerCredentials{AdditionalData: []byte("bob"), PublicKey: authKEMKeyBobPub}},
+				AdditionalData:    []byte("alice"),
+				AuthenticationKey: authKEMKeyAlice,
+				RandomReader:      rand.Reader,
+				MinVersion:        tc.aliceMin,
+				MaxVersion:        tc.aliceMax,
+			}, true)
+			require.NoError(err)
+			sBob, err := NewPKISession(&SessionConfig{
+				Authenticator:     &stubAuthenticator{creds: &PeerCredentials{AdditionalData: []byte("alice"), PublicKey: authKEMKeyAlicePub}},
+				AdditionalData:    []byte("bob"),
+				AuthenticationKey: authKEMKeyBob,
+				RandomReader:      rand.Reader,
+				MinVersion:        tc.bobMin,
+				MaxVersion:        tc.bobMax,
+			}, false)
+			require.NoError(err)
+
+			connAlice, connBob := net.Pipe()
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- sBob.Initialize(connBob)
+			}()
+			aliceErr := sAlice.Initialize(connAlice)
+			defer sAlice.Close()
+			defer sBob.Close()
+			bobErr := <-errCh
+
+			if tc.aliceError != "" {
+				require.ErrorIs(aliceErr, ErrNoCommonVersion)
+				require.EqualError(aliceErr, tc.aliceError)
+				require.ErrorIs(bobErr, ErrNoCommonVersion)
+				require.EqualError(bobErr, tc.bobError)
+				return
+			}
+			require.NoError(aliceErr)
+			require.NoError(bobErr)
+			require.Equal(tc.version, sAlice.Version())
+			require.Equal(tc.version, sBob.Version())
+		})
+	}
+
+	authKEMKey, _ := DefaultScheme.GenerateKeypair(rand.Reader)
+	_, err := NewPKISession(&SessionConfig{
+		Authenticator:     &stubAuthenticator{},
+		AuthenticationKey: authKEMKey,
+		RandomReader:      rand.Reader,
+		MinVersion:        5,
+		MaxVersion:        4,
+	}, true)
+	require.Error(t, err)
+}
+
+// legacyInitialize runs the handshake of s as a peer that predates version
+// negotiation does: v3 with the prologue 0x03, started by the version byte
+// 0x03 and the ephemeral key of the initiator.
+func legacyInitialize(s *Session, conn net.Conn) error {
+	s.conn = conn
+	s.setLegacyVersion()
+	if err := s.noiseHandshake(); err != nil {
+		return err
+	}
+	return s.finalizeHandshake()
+}
+
+func TestSessionVersionLegacyPeer(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name          string
+		legacyAlice   bool
+		min, max      uint8
+		err           string
+		legacyFailure bool
+	}{
+		{name: "legacy responder"},
+		{name: "legacy initiator", legacyAlice: true},
+		{name: "legacy initiator, upgraded responder", legacyAlice: true, min: 3, max: 5},
+		{
+			name: "legacy responder, upgraded initiator", min: 3, max: 4,
+			err: errLegacyPeer.Error(), legacyFailure: true,
+		},
+		{
+			name: "legacy responder, v4 initiator", min: 4, max: 4,
+			err: "wire/session: peer supports only v3, we require ≥v4", legacyFailure: true,
+		},
+		{
+			name: "legacy initiator, v4 responder", legacyAlice: true, min: 4, max: 4,
+			err: "wire/session: peer supports only v3, we require ≥v4", legacyFailure: true,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			require := require.New(t)
+
+			authKEMKeyAlice, authKEMKeyAlicePub := DefaultScheme.GenerateKeypair(rand.Reader)
+			authKEMKeyBob, authKEMKeyBobPub := DefaultScheme.GenerateKeypair(rand.Reader)
+			sAlice, err := NewPKISession(&SessionConfig{
+				Authenticator:     &stubAuthenticator{creds: &PeerCredentials{AdditionalData: []byte("bob"), PublicKey: authKEMKeyBobPub}},
+				AdditionalData:    []byte("alice"),
+				AuthenticationKey: authKEMKeyAlice,
+				RandomReader:      rand.Reader,
+			}, true)
+			require.NoError(err)
+			sBob, err := NewPKISession(&SessionConfig{
+				Authenticator:     &stubAuthenticator{creds: &PeerCredentials{AdditionalData: []byte("alice"), PublicKey: authKEMKeyAlicePub}},
+				AdditionalData:    []byte("bob"),
+				AuthenticationKey: authKEMKeyBob,
+				RandomReader:      rand.Reader,
+			}, false)
+			require.NoError(err)
+			defer sAlice.Close()
+			defer sBob.Close()
+
+			// the upgraded peer is configured with the version range of
+			// the test case
+			legacy, upgraded := sBob, sAlice
+			if tc.legacyAlice {
+				legacy, upgraded = sAlice, sBob
+			}
+			if tc.max != 0 {
+				upgraded.minVersion, upgraded.maxVersion = tc.min, tc.max
+			}
+
+			connLegacy, connUpgraded := net.Pipe()
+			errCh := make(chan error, 1)
+			go func() {
+				err := legacyInitialize(legacy, connLegacy)
+				if err != nil {
+					// as the legacy servers do, hang up on failure
+					connLegacy.Close()
+				}
+				errCh <- err
+			}()
+			upgradedErr := upgraded.Initialize(connUpgraded)
+			if upgradedErr != nil {
+				connUpgraded.Close()
+			}
+			legacyErr := <-errCh
+
+			if tc.err != "" {
+				require.EqualError(upgradedErr, tc.err)
+				require.Error(legacyErr)
+				return
+			}
+			require.NoError(upgradedErr)
+			require.NoError(legacyErr)
+			require.Equal(legacyVersion, upgraded.Version())
+			require.Equal(legacyVersion, legacy.Version())
+		})
+	}
+}
+
+func TestSessionChannelBinding(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	binding := func(conn net.Conn) []byte {
+		return conn.(*sessionConn).s.ExportChannelBinding()
+	}
+	client1, server1, err := TestPair(DefaultScheme)
+	require.NoError(err)
+	defer client1.Close()
+	defer server1.Close()
+	client2, server2, err := TestPair(DefaultScheme)
+	require.NoError(err)
+	defer client2.Close()
+	defer server2.Close()
+
+	require.Equal(binding(client1), binding(server1))
+	require.Equal(binding(client2), binding(server2))
+	require.NotEqual(binding(client1), binding(client2))
+	require.NotEmpty(binding(client1))
+
+	authKEMKey, _ := DefaultScheme.GenerateKeypair(rand.Reader)
+	s, err := NewPKISession(&SessionConfig{
+		Authenticator:     &stubAuthenticator{},
+		AuthenticationKey: authKEMKey,
+		RandomReader:      rand.Reader,
+	}, true)
+	require.NoError(err)
+	require.Panics(func() { s.ExportChannelBinding() })
+}
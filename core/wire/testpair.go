@@ -0,0 +1,141 @@
+// testpair.go - Wire protocol in-memory session pairs for testing.
+// Copyright (C) 2023  The Katzenpost Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package wire
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/wire/commands"
+)
+
+// maxPairPayload is the largest payload carried by a single command of a
+// TestPair conn.
+const maxPairPayload = maxMsgLen - macLen - 6
+
+type acceptAllAuthenticator struct{}
+
+func (acceptAllAuthenticator) IsPeerValid(*PeerCredentials) bool {
+	return true
+}
+
+// TestPair returns two net.Conns connected by an in-memory pipe, over which
+// a full wire protocol handshake has been performed with fresh keys
+// generated by scheme.  Everything written to one conn is encrypted by its
+// Session and decrypted by the peer's.  It is intended for tests of higher
+// layers that would otherwise require real sockets.
+func TestPair(scheme Scheme) (clientConn, serverConn net.Conn, err error) {
+	a, b := net.Pipe()
+	return pairOver(scheme, a, b)
+}
+
+// pairOver performs the TestPair handshake over the connected conns a and b.
+func pairOver(scheme Scheme, a, b net.Conn) (clientConn, serverConn net.Conn, err error) {
+	clientKey, _ := scheme.GenerateKeypair(rand.Reader)
+	serverKey, _ := scheme.GenerateKeypair(rand.Reader)
+
+	newSession := func(key PrivateKey, ad string, isInitiator bool) (*Session, error) {
+		return NewPKISession(&SessionConfig{
+			Authenticator:     acceptAllAuthenticator{},
+			AdditionalData:    []byte(ad),
+			AuthenticationKey: key,
+			RandomReader:      rand.Reader,
+		}, isInitiator)
+	}
+	clientSession, err := newSession(clientKey, "client", true)
+	if err != nil {
+		return nil, nil, err
+	}
+	serverSession, err := newSession(serverKey, "server", false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- serverSession.Initialize(b)
+	}()
+	if err = clientSession.Initialize(a); err != nil {
+		// Unblock the server side of the handshake.
+		a.Close()
+		b.Close()
+		<-errCh
+		return nil, nil, err
+	}
+	if err = <-errCh; err != nil {
+		a.Close()
+		b.Close()
+		return nil, nil, err
+	}
+	return &sessionConn{Conn: a, s: clientSession}, &sessionConn{Conn: b, s: serverSession}, nil
+}
+
+// sessionConn is a net.Conn that carries the stream written to it as
+// SendPacket commands of an established Session.
+type sessionConn struct {
+	net.Conn
+	s *Session
+
+	rLock sync.Mutex
+	rbuf  []byte
+
+	wLock sync.Mutex
+}
+
+func (c *sessionConn) Read(p []byte) (int, error) {
+	c.rLock.Lock()
+	defer c.rLock.Unlock()
+	for len(c.rbuf) == 0 {
+		cmd, err := c.s.RecvCommand()
+		if err != nil {
+			return 0, err
+		}
+		pkt, ok := cmd.(*commands.SendPacket)
+		if !ok {
+			return 0, errors.New("wire/session: unexpected command")
+		}
+		c.rbuf = pkt.SphinxPacket
+	}
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *sessionConn) Write(p []byte) (int, error) {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+	n := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxPairPayload {
+			chunk = chunk[:maxPairPayload]
+		}
+		if err := c.s.SendCommand(&commands.SendPacket{SphinxPacket: chunk}); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+func (c *sessionConn) Close() error {
+	c.s.Close()
+	return c.Conn.Close()
+}
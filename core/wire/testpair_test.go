@@ -0,0 +1,87 @@
+// testpair_test.go - Wire protocol in-memory session pair tests.
+// Copyright (C) 2023  The Katzenpost Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package wire
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recordingConn records the bytes written to the underlying conn.
+type recordingConn struct {
+	net.Conn
+
+	sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.Lock()
+	c.written.Write(p)
+	c.Unlock()
+	return c.Conn.Write(p)
+}
+
+func TestTestPair(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	a, b := net.Pipe()
+	ra, rb := &recordingConn{Conn: a}, &recordingConn{Conn: b}
+	clientConn, serverConn, err := pairOver(DefaultScheme, ra, rb)
+	require.NoError(err)
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	ping := bytes.Repeat([]byte("ping from the client "), 100)
+	pong := bytes.Repeat([]byte("pong from the server "), 100)
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := clientConn.Write(ping)
+		errCh <- err
+	}()
+	buf := make([]byte, len(ping))
+	_, err = io.ReadFull(serverConn, buf)
+	require.NoError(err)
+	require.Equal(ping, buf)
+	require.NoError(<-errCh)
+
+	go func() {
+		_, err := serverConn.Write(pong)
+		errCh <- err
+	}()
+	buf = make([]byte, len(pong))
+	_, err = io.ReadFull(clientConn, buf)
+	require.NoError(err)
+	require.Equal(pong, buf)
+	require.NoError(<-errCh)
+
+	// the plaintext never appears on the wire
+	require.False(bytes.Contains(ra.written.Bytes(), []byte("ping from the client")))
+	require.False(bytes.Contains(rb.written.Bytes(), []byte("pong from the server")))
+
+	clientConn, serverConn, err = TestPair(DefaultScheme)
+	require.NoError(err)
+	clientConn.Close()
+	serverConn.Close()
+}
@@ -0,0 +1,237 @@
+// version.go - Wire protocol version negotiation.
+// Copyright (C) 2023  The Katzenpost Authors.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package wire
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// ProtocolVersion is the wire protocol version spoken by default.
+	ProtocolVersion uint8 = 3
+
+	// MinProtocolVersion is the oldest wire protocol version accepted by
+	// default.
+	MinProtocolVersion uint8 = 3
+
+	// legacyVersion is the version spoken by peers that predate version
+	// negotiation.  They start the handshake with the version byte 0x03
+	// and bind only that byte into the prologue.
+	legacyVersion uint8 = 3
+
+	// helloMarker starts the version hello of a peer that negotiates,
+	// and is never sent first by a legacy peer.
+	helloMarker byte = 0xff
+
+	versionRangeLen = 2
+)
+
+// ErrNoCommonVersion is the error returned when the peers do not support
+// any protocol version in common.  The returned error is a *VersionError
+// wrapping ErrNoCommonVersion.
+var ErrNoCommonVersion = errors.New("wire/session: no common protocol version")
+
+// errLegacyPeer is the error returned when a peer that predates version
+// negotiation hangs up on our version hello.
+var errLegacyPeer = errors.New("wire/session: peer supports only v3 and does not negotiate, MaxVersion must be 3 to reach it")
+
+// VersionError describes a failed version negotiation.
+type VersionError struct {
+	// MinVersion and MaxVersion are the versions supported by us.
+	MinVersion, MaxVersion uint8
+
+	// PeerMinVersion and PeerMaxVersion are the versions supported by
+	// the peer.
+	PeerMinVersion, PeerMaxVersion uint8
+}
+
+func (e *VersionError) Error() string {
+	if e.PeerMaxVersion < e.MinVersion {
+		return fmt.Sprintf("wire/session: peer supports only %s, we require ≥v%d", versionRange(e.PeerMinVersion, e.PeerMaxVersion), e.MinVersion)
+	}
+	return fmt.Sprintf("wire/session: peer requires ≥v%d, we support only %s", e.PeerMinVersion, versionRange(e.MinVersion, e.MaxVersion))
+}
+
+func (e *VersionError) Unwrap() error {
+	return ErrNoCommonVersion
+}
+
+func versionRange(min, max uint8) string {
+	if min == max {
+		return fmt.Sprintf("v%d", min)
+	}
+	return fmt.Sprintf("v%d-v%d", min, max)
+}
+
+// selectVersion returns the highest version supported by both ranges, or
+// false if there is none.
+func selectVersion(min, max, peerMin, peerMax uint8) (uint8, bool) {
+	if peerMax < max {
+		max = peerMax
+	}
+	if peerMin > min {
+		min = peerMin
+	}
+	return max, min <= max
+}
+
+// negotiateVersion agrees on the protocol version with the peer before
+// the handshake, and sets the prologue that binds it.
+//
+// Peers that predate negotiation send the version byte 0x03 followed by
+// the first handshake message, with the prologue 0x03.  This is spoken
+// as is while v3 is the highest version we support, so that either side
+// may be upgraded first.  Otherwise the initiator sends a hello, the
+// marker byte and its version range, which the responder answers with its
+// own range.  Both ranges are then bound into the handshake prologue, so
+// a version downgrade by an attacker causes the handshake to fail.
+func (s *Session) negotiateVersion() error {
+	if s.isInitiator {
+		if s.maxVersion == legacyVersion {
+			s.setLegacyVersion()
+			return nil
+		}
+		return s.sendVersionHello()
+	}
+
+	var first [1]byte
+	if _, err := io.ReadFull(s.conn, first[:]); err != nil {
+		return err
+	}
+	switch first[0] {
+	case legacyVersion:
+		if s.minVersion > legacyVersion {
+			return &VersionError{
+				MinVersion:     s.minVersion,
+				MaxVersion:     s.maxVersion,
+				PeerMinVersion: legacyVersion,
+				PeerMaxVersion: legacyVersion,
+			}
+		}
+		s.setLegacyVersion()
+		s.versionByteRead = true
+		return nil
+	case helloMarker:
+		return s.answerVersionHello()
+	default:
+		return errors.New("wire/session: unsupported protocol version")
+	}
+}
+
+// setLegacyVersion selects v3 as spoken by peers that predate
+// negotiation.
+func (s *Session) setLegacyVersion() {
+	s.version = legacyVersion
+	s.prologue = []byte{legacyVersion}
+}
+
+// helloLen returns the length of the version hello, which is padded to
+// the length of the first handshake message of a legacy peer, so that a
+// legacy responder reads it whole and hangs up rather than waiting for
+// more.
+func (s *Session) helloLen() int {
+	return 1 + s.protocol.KEM.PublicKeySize()
+}
+
+func (s *Session) sendVersionHello() error {
+	ours := []byte{s.minVersion, s.maxVersion}
+	hello := make([]byte, s.helloLen())
+	hello[0] = helloMarker
+	copy(hello[1:], ours)
+	if _, err := s.conn.Write(hello); err != nil {
+		return err
+	}
+	reply := make([]byte, 1+versionRangeLen)
+	if _, err := io.ReadFull(s.conn, reply); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if s.minVersion > legacyVersion {
+				return &VersionError{
+					MinVersion:     s.minVersion,
+					MaxVersion:     s.maxVersion,
+					PeerMinVersion: legacyVersion,
+					PeerMaxVersion: legacyVersion,
+				}
+			}
+			return errLegacyPeer
+		}
+		return err
+	}
+	if reply[0] != helloMarker {
+		return errors.New("wire/session: invalid version hello reply")
+	}
+	return s.agreeVersion(ours, reply[1:])
+}
+
+func (s *Session) answerVersionHello() error {
+	hello := make([]byte, s.helloLen()-1)
+	if _, err := io.ReadFull(s.conn, hello); err != nil {
+		return err
+	}
+	ours := []byte{s.minVersion, s.maxVersion}
+	if _, err := s.conn.Write(append([]byte{helloMarker}, ours...)); err != nil {
+		return err
+	}
+	return s.agreeVersion(ours, hello[:versionRangeLen])
+}
+
+// agreeVersion selects the highest version in both ranges, and binds
+// them into the prologue.
+func (s *Session) agreeVersion(ours, theirs []byte) error {
+	if theirs[0] > theirs[1] {
+		return errors.New("wire/session: invalid peer version range")
+	}
+
+	version, ok := selectVersion(s.minVersion, s.maxVersion, theirs[0], theirs[1])
+	if !ok {
+		return &VersionError{
+			MinVersion:     s.minVersion,
+			MaxVersion:     s.maxVersion,
+			PeerMinVersion: theirs[0],
+			PeerMaxVersion: theirs[1],
+		}
+	}
+	s.version = version
+
+	// (version, initiator range, responder range)
+	s.prologue = []byte{version}
+	if s.isInitiator {
+		s.prologue = append(append(s.prologue, ours...), theirs...)
+	} else {
+		s.prologue = append(append(s.prologue, theirs...), ours...)
+	}
+	return nil
+}
+
+// versionRangeFromConfig returns the supported version range of cfg.
+func versionRangeFromConfig(cfg *SessionConfig) (uint8, uint8, error) {
+	min, max := cfg.MinVersion, cfg.MaxVersion
+	if max == 0 {
+		max = ProtocolVersion
+	}
+	if min == 0 {
+		min = MinProtocolVersion
+		if min > max {
+			min = max
+		}
+	}
+	if min > max {
+		return 0, 0, errors.New("wire/session: MinVersion exceeds MaxVersion")
+	}
+	return min, max, nil
+}
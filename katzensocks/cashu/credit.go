@@ -0,0 +1,185 @@
+package cashu
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	// ErrUnknownCredit is returned for a handle that was never reserved
+	// or has already been settled.
+	ErrUnknownCredit = errors.New("cashu: unknown credit handle")
+
+	// ErrProofReserved is returned when a proof is already locked by
+	// another reservation.
+	ErrProofReserved = errors.New("cashu: proof is already reserved")
+)
+
+// CreditHandle identifies a reservation made by a Ledger.
+type CreditHandle uint64
+
+// Settlement is the outcome of a closed reservation: the value Used is
+// to be redeemed and the value Refunded returned to the payer.
+type Settlement struct {
+	Handle   CreditHandle
+	Tokens   *Tokens
+	Unit     string
+	Reserved int64
+	Used     int64
+	Refunded int64
+}
+
+type credit struct {
+	tokens   *Tokens
+	unit     string
+	reserved int64
+	used     int64
+}
+
+// Ledger meters the value of tokens in two phases. Reserve validates
+// tokens and locks their value as credit, which Commit consumes as it is
+// used, so that a gateway charges for what was actually relayed instead
+// of redeeming the full token upfront. A reservation is settled when its
+// credit is fully consumed, or by Release, which refunds the remainder.
+type Ledger struct {
+	sync.Mutex
+
+	next     CreditHandle
+	credits  map[CreditHandle]*credit
+	reserved map[string]CreditHandle
+
+	// Settle, if set, is called with each settled reservation, outside
+	// of the Ledger's lock.
+	Settle func(*Settlement)
+}
+
+// NewLedger returns an empty Ledger.
+func NewLedger() *Ledger {
+	return &Ledger{
+		credits:  make(map[CreditHandle]*credit),
+		reserved: make(map[string]CreditHandle),
+	}
+}
+
+// Reserve validates t and locks its value as credit. The proofs of t
+// can not be reserved again until the reservation is settled.
+func (l *Ledger) Reserve(t *Tokens) (CreditHandle, error) {
+	amount, unit, err := t.Amount()
+	if err != nil {
+		return 0, err
+	}
+	if amount <= 0 {
+		return 0, fmt.Errorf("%w: no value to reserve", errInvalidToken)
+	}
+	secrets := make(map[string]struct{})
+	for _, tok := range t.Token {
+		for _, p := range tok.Proofs {
+			if p.Amount <= 0 || p.Secret == "" {
+				return 0, errInvalidToken
+			}
+			if _, ok := secrets[p.Secret]; ok {
+				return 0, fmt.Errorf("%w: duplicate proof", errInvalidToken)
+			}
+			secrets[p.Secret] = struct{}{}
+		}
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	for secret := range secrets {
+		if _, ok := l.reserved[secret]; ok {
+			return 0, ErrProofReserved
+		}
+	}
+	l.next++
+	h := l.next
+	for secret := range secrets {
+		l.reserved[secret] = h
+	}
+	l.credits[h] = &credit{tokens: t, unit: unit, reserved: amount}
+	return h, nil
+}
+
+// Available returns the credit of h that has not been consumed, and its
+// unit.
+func (l *Ledger) Available(h CreditHandle) (int64, string, error) {
+	l.Lock()
+	defer l.Unlock()
+	c, ok := l.credits[h]
+	if !ok {
+		return 0, "", ErrUnknownCredit
+	}
+	return c.reserved - c.used, c.unit, nil
+}
+
+// Commit consumes unitsUsed of the credit of h and returns the credit
+// that remains. Nothing is consumed if unitsUsed exceeds the remaining
+// credit. The reservation is settled once its credit is fully consumed.
+func (l *Ledger) Commit(h CreditHandle, unitsUsed int64) (int64, error) {
+	if unitsUsed < 0 {
+		return 0, errors.New("cashu: negative usage")
+	}
+	l.Lock()
+	c, ok := l.credits[h]
+	if !ok {
+		l.Unlock()
+		return 0, ErrUnknownCredit
+	}
+	remaining := c.reserved - c.used
+	if unitsUsed > remaining {
+		l.Unlock()
+		return remaining, fmt.Errorf("%w: have %d %s, need %d", ErrInsufficientAmount, remaining, c.unit, unitsUsed)
+	}
+	c.used += unitsUsed
+	remaining -= unitsUsed
+	var s *Settlement
+	if remaining == 0 {
+		s = l.close(h, c)
+	}
+	l.Unlock()
+
+	l.settle(s)
+	return remaining, nil
+}
+
+// Release settles the reservation of h, refunding the credit that was not
+// consumed.
+func (l *Ledger) Release(h CreditHandle) (*Settlement, error) {
+	l.Lock()
+	c, ok := l.credits[h]
+	if !ok {
+		l.Unlock()
+		return nil, ErrUnknownCredit
+	}
+	s := l.close(h, c)
+	l.Unlock()
+
+	l.settle(s)
+	return s, nil
+}
+
+// close removes the reservation of h and unlocks its proofs. The caller
+// MUST hold the lock.
+func (l *Ledger) close(h CreditHandle, c *credit) *Settlement {
+	delete(l.credits, h)
+	for _, tok := range c.tokens.Token {
+		for _, p := range tok.Proofs {
+			delete(l.reserved, p.Secret)
+		}
+	}
+	return &Settlement{
+		Handle:   h,
+		Tokens:   c.tokens,
+		Unit:     c.unit,
+		Reserved: c.reserved,
+		Used:     c.used,
+		Refunded: c.reserved - c.used,
+	}
+}
+
+func (l *Ledger) settle(s *Settlement) {
+	if s != nil && l.Settle != nil {
+		l.Settle(s)
+	}
+}
@@ -0,0 +1,108 @@
+package cashu
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func creditTokens(secrets ...string) *Tokens {
+	proofs := []Proof{}
+	for _, s := range secrets {
+		proofs = append(proofs, Proof{ID: "k", Amount: 8, Secret: s, C: "c"})
+	}
+	return &Tokens{Token: []Token{{Mint: "https://mint.example", Proofs: proofs}}}
+}
+
+func TestLedgerPartialConsumption(t *testing.T) {
+	require := require.New(t)
+	l := NewLedger()
+	settled := []*Settlement{}
+	l.Settle = func(s *Settlement) { settled = append(settled, s) }
+
+	h, err := l.Reserve(creditTokens("a", "b"))
+	require.NoError(err)
+	remaining, err := l.Commit(h, 5)
+	require.NoError(err)
+	require.Equal(int64(11), remaining)
+	remaining, err = l.Commit(h, 3)
+	require.NoError(err)
+	require.Equal(int64(8), remaining)
+
+	// overcommitting consumes nothing
+	remaining, err = l.Commit(h, 9)
+	require.ErrorIs(err, ErrInsufficientAmount)
+	require.Equal(int64(8), remaining)
+	available, unit, err := l.Available(h)
+	require.NoError(err)
+	require.Equal(int64(8), available)
+	require.Equal(UnitSat, unit)
+	require.Empty(settled)
+
+	// the proofs stay locked while reserved
+	_, err = l.Reserve(creditTokens("b", "c"))
+	require.ErrorIs(err, ErrProofReserved)
+}
+
+func TestLedgerFullConsumption(t *testing.T) {
+	require := require.New(t)
+	l := NewLedger()
+	settled := []*Settlement{}
+	l.Settle = func(s *Settlement) { settled = append(settled, s) }
+
+	h, err := l.Reserve(creditTokens("a"))
+	require.NoError(err)
+	remaining, err := l.Commit(h, 8)
+	require.NoError(err)
+	require.Zero(remaining)
+
+	require.Len(settled, 1)
+	require.Equal(h, settled[0].Handle)
+	require.Equal(int64(8), settled[0].Used)
+	require.Zero(settled[0].Refunded)
+
+	_, err = l.Commit(h, 1)
+	require.ErrorIs(err, ErrUnknownCredit)
+	_, err = l.Release(h)
+	require.ErrorIs(err, ErrUnknownCredit)
+}
+
+func TestLedgerRelease(t *testing.T) {
+	require := require.New(t)
+	l := NewLedger()
+	settled := []*Settlement{}
+	l.Settle = func(s *Settlement) { settled = append(settled, s) }
+
+	tokens := creditTokens("a", "b")
+	h, err := l.Reserve(tokens)
+	require.NoError(err)
+	_, err = l.Commit(h, 6)
+	require.NoError(err)
+
+	s, err := l.Release(h)
+	require.NoError(err)
+	require.Equal(&Settlement{Handle: h, Tokens: tokens, Unit: UnitSat, Reserved: 16, Used: 6, Refunded: 10}, s)
+	require.Equal([]*Settlement{s}, settled)
+
+	_, _, err = l.Available(h)
+	require.ErrorIs(err, ErrUnknownCredit)
+
+	// released proofs may be reserved again
+	_, err = l.Reserve(creditTokens("b"))
+	require.NoError(err)
+}
+
+func TestLedgerReserveInvalid(t *testing.T) {
+	require := require.New(t)
+	l := NewLedger()
+
+	_, err := l.Reserve(&Tokens{})
+	require.Error(err)
+	_, err = l.Reserve(creditTokens("a", "a"))
+	require.Error(err)
+
+	mixed := creditTokens("a")
+	mixed.Token = append(mixed.Token, Token{Mint: "https://mint.example", Unit: UnitUSD, Proofs: []Proof{{Amount: 1, Secret: "b"}}})
+	_, err = l.Reserve(mixed)
+	require.ErrorIs(err, ErrMixedUnits)
+}
@@ -0,0 +1,75 @@
+package cashu
+
+import (
+	"strings"
+)
+
+// RedeemPolicy describes how a gateway redeems tokens, which determines
+// the mint round trips a redemption takes.
+type RedeemPolicy struct {
+	// HomeMint is the mint holding the gateway's balance. Proofs of
+	// other mints are melted to pay an invoice of the home mint.
+	HomeMint string
+
+	// SwapProofs swaps proofs of the home mint for fresh ones, so that
+	// the payer can no longer spend them.
+	SwapProofs bool
+
+	// CachedKeysets are the IDs of the keysets whose keys are known, so
+	// that they need not be fetched.
+	CachedKeysets map[string]bool
+}
+
+// EstimateRoundTrips returns the number of mint HTTP round trips that
+// redeeming t under policy requires, so that the caller can decide
+// whether a redemption fits in its latency budget. For each distinct
+// mint it counts a keyset fetch unless all its keysets are cached, then
+// either a swap at the home mint, or a melt quote and a melt at a foreign
+// mint, plus a mint quote at the home mint for the invoice it pays.
+func (t *Tokens) EstimateRoundTrips(policy RedeemPolicy) int {
+	type mintProofs struct {
+		uncachedKeyset bool
+		proofs         int
+	}
+	mints := make(map[string]*mintProofs)
+	for _, tok := range t.Token {
+		mint := normalizeMint(tok.Mint)
+		m, ok := mints[mint]
+		if !ok {
+			m = new(mintProofs)
+			mints[mint] = m
+		}
+		for _, p := range tok.Proofs {
+			m.proofs++
+			if !policy.CachedKeysets[p.ID] {
+				m.uncachedKeyset = true
+			}
+		}
+	}
+
+	home := normalizeMint(policy.HomeMint)
+	trips := 0
+	for mint, m := range mints {
+		if m.proofs == 0 {
+			continue
+		}
+		if m.uncachedKeyset {
+			trips++
+		}
+		switch {
+		case mint == home:
+			if policy.SwapProofs {
+				trips++
+			}
+		default:
+			// mint quote at home, melt quote and melt at the foreign mint
+			trips += 3
+		}
+	}
+	return trips
+}
+
+// normalizeMint returns a comparable form of a mint URL.
+func normalizeMint(mint string) string {
+	return strings.ToLower(strings.TrimRight(mint, "/"))
+}
@@ -0,0 +1,38 @@
+package cashu
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimateRoundTrips(t *testing.T) {
+	require := require.New(t)
+
+	home := "https://mint.example/"
+	single := &Tokens{Token: []Token{
+		{Mint: "https://mint.example", Proofs: []Proof{{ID: "k1", Amount: 2}, {ID: "k1", Amount: 8}}},
+	}}
+	multi := &Tokens{Token: []Token{
+		{Mint: "https://mint.example", Proofs: []Proof{{ID: "k1", Amount: 2}}},
+		{Mint: "https://other.example", Proofs: []Proof{{ID: "k2", Amount: 4}}},
+		{Mint: "https://third.example", Proofs: []Proof{{ID: "k3", Amount: 1}}},
+	}}
+
+	// single mint, keys known, no swap: nothing to ask the mint
+	policy := RedeemPolicy{HomeMint: home, CachedKeysets: map[string]bool{"k1": true}}
+	require.Equal(0, single.EstimateRoundTrips(policy))
+	// unknown keyset
+	require.Equal(1, single.EstimateRoundTrips(RedeemPolicy{HomeMint: home}))
+
+	// swapping at the home mint
+	policy.SwapProofs = true
+	require.Equal(1, single.EstimateRoundTrips(policy))
+
+	// each foreign mint costs a keyset fetch and a melt
+	require.Equal(1+(1+3)*2, multi.EstimateRoundTrips(policy))
+	policy.CachedKeysets["k2"] = true
+	require.Equal(1+3+(1+3), multi.EstimateRoundTrips(policy))
+
+	require.Equal(0, (&Tokens{}).EstimateRoundTrips(policy))
+}
@@ -0,0 +1,34 @@
+package cashu
+
+import (
+	"fmt"
+)
+
+// Pricer holds the price of a request in each accepted unit.
+type Pricer map[string]int64
+
+// DefaultPricer charges one satoshi per request.
+var DefaultPricer = Pricer{UnitSat: 1}
+
+// Price returns the price of a request in unit.
+func (p Pricer) Price(unit string) (int64, error) {
+	price, ok := p[unit]
+	if !ok || price <= 0 {
+		return 0, fmt.Errorf("cashu: unit %q is not accepted", unit)
+	}
+	return price, nil
+}
+
+// Requests returns the number of requests paid for by t. Tokens mixing
+// units are refused rather than converted.
+func (p Pricer) Requests(t *Tokens) (int64, error) {
+	amount, unit, err := t.Amount()
+	if err != nil {
+		return 0, err
+	}
+	price, err := p.Price(unit)
+	if err != nil {
+		return 0, err
+	}
+	return amount / price, nil
+}
@@ -0,0 +1,105 @@
+package cashu
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultRedemptionTTL is how long the result of a redemption is
+// remembered for replays of the same request.
+const DefaultRedemptionTTL = 10 * time.Minute
+
+// ErrRequestReplayed is returned when a request ID is replayed with a
+// token other than the one it was first redeemed with.
+var ErrRequestReplayed = errors.New("cashu: request ID replayed with a different token")
+
+// Receiver redeems Cashu tokens. CashuApiClient is a Receiver.
+type Receiver interface {
+	Receive(params ReceiveParameters) (*ReceiveResponse, error)
+}
+
+// IdempotentReceiver redeems tokens at most once per session and request
+// ID. A request that is replayed with the same token while its result is
+// remembered returns that result without redeeming the token again. Failed
+// redemptions are not remembered so that they may be retried.
+type IdempotentReceiver struct {
+	sync.Mutex
+
+	receiver    Receiver
+	ttl         time.Duration
+	redemptions map[redemptionKey]*redemption
+}
+
+// redemptionKey scopes a client chosen request ID to the session it was
+// sent for.
+type redemptionKey struct {
+	session string
+	request string
+}
+
+type redemption struct {
+	token   string
+	done    chan struct{}
+	resp    *ReceiveResponse
+	err     error
+	expires time.Time
+}
+
+// NewIdempotentReceiver returns an IdempotentReceiver that remembers
+// results for ttl.
+func NewIdempotentReceiver(receiver Receiver, ttl time.Duration) *IdempotentReceiver {
+	return &IdempotentReceiver{
+		receiver:    receiver,
+		ttl:         ttl,
+		redemptions: make(map[redemptionKey]*redemption),
+	}
+}
+
+// Receive redeems the token in params unless requestID has already been
+// redeemed for sessionID, in which case the remembered result is returned.
+// Concurrent calls with the same sessionID and requestID wait for the first
+// to complete. Replaying a request ID with a different token returns
+// ErrRequestReplayed.
+func (r *IdempotentReceiver) Receive(sessionID, requestID []byte, params ReceiveParameters) (*ReceiveResponse, error) {
+	key := redemptionKey{session: string(sessionID), request: string(requestID)}
+	token := ""
+	if params.Token != nil {
+		token = *params.Token
+	}
+
+	r.Lock()
+	r.prune(time.Now())
+	if red, ok := r.redemptions[key]; ok {
+		r.Unlock()
+		if red.token != token {
+			return nil, ErrRequestReplayed
+		}
+		<-red.done
+		return red.resp, red.err
+	}
+	red := &redemption{token: token, done: make(chan struct{})}
+	r.redemptions[key] = red
+	r.Unlock()
+
+	red.resp, red.err = r.receiver.Receive(params)
+
+	r.Lock()
+	if red.err != nil {
+		delete(r.redemptions, key)
+	} else {
+		red.expires = time.Now().Add(r.ttl)
+	}
+	r.Unlock()
+	close(red.done)
+	return red.resp, red.err
+}
+
+// prune forgets expired redemptions. The caller MUST hold the lock.
+func (r *IdempotentReceiver) prune(now time.Time) {
+	for key, red := range r.redemptions {
+		if !red.expires.IsZero() && now.After(red.expires) {
+			delete(r.redemptions, key)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package cashu
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// countingReceiver credits a fixed amount per redemption.
+type countingReceiver struct {
+	calls   int
+	balance int
+	fail    bool
+}
+
+func (c *countingReceiver) Receive(params ReceiveParameters) (*ReceiveResponse, error) {
+	c.calls++
+	if c.fail {
+		return nil, errors.New("mint unavailable")
+	}
+	resp := &ReceiveResponse{InitialBalance: c.balance, Balance: c.balance + 1}
+	c.balance++
+	return resp, nil
+}
+
+func TestIdempotentReceiverFresh(t *testing.T) {
+	require := require.New(t)
+	receiver := &countingReceiver{}
+	r := NewIdempotentReceiver(receiver, DefaultRedemptionTTL)
+
+	token := "cashuAtoken"
+	resp1, err := r.Receive([]byte("session"), []byte("request-1"), ReceiveParameters{Token: &token})
+	require.NoError(err)
+	resp2, err := r.Receive([]byte("session"), []byte("request-2"), ReceiveParameters{Token: &token})
+	require.NoError(err)
+	require.Equal(2, receiver.calls)
+	require.NotEqual(resp1, resp2)
+}
+
+func TestIdempotentReceiverReplay(t *testing.T) {
+	require := require.New(t)
+	receiver := &countingReceiver{}
+	r := NewIdempotentReceiver(receiver, DefaultRedemptionTTL)
+
+	token := "cashuAtoken"
+	resp1, err := r.Receive([]byte("session"), []byte("request-1"), ReceiveParameters{Token: &token})
+	require.NoError(err)
+	resp2, err := r.Receive([]byte("session"), []byte("request-1"), ReceiveParameters{Token: &token})
+	require.NoError(err)
+	require.Equal(1, receiver.calls)
+	require.Same(resp1, resp2)
+
+	// the result is forgotten once it expires
+	r.prune(time.Now().Add(2 * DefaultRedemptionTTL))
+	_, err = r.Receive([]byte("session"), []byte("request-1"), ReceiveParameters{Token: &token})
+	require.NoError(err)
+	require.Equal(2, receiver.calls)
+}
+
+func TestIdempotentReceiverRetryAfterFailure(t *testing.T) {
+	require := require.New(t)
+	receiver := &countingReceiver{fail: true}
+	r := NewIdempotentReceiver(receiver, DefaultRedemptionTTL)
+
+	token := "cashuAtoken"
+	_, err := r.Receive([]byte("session"), []byte("request-1"), ReceiveParameters{Token: &token})
+	require.Error(err)
+
+	receiver.fail = false
+	_, err = r.Receive([]byte("session"), []byte("request-1"), ReceiveParameters{Token: &token})
+	require.NoError(err)
+	require.Equal(2, receiver.calls)
+}
+
+func TestIdempotentReceiverScopedReplay(t *testing.T) {
+	require := require.New(t)
+	receiver := &countingReceiver{}
+	r := NewIdempotentReceiver(receiver, DefaultRedemptionTTL)
+
+	token, other := "cashuAtoken", "cashuAother"
+	_, err := r.Receive([]byte("session"), []byte("request-1"), ReceiveParameters{Token: &token})
+	require.NoError(err)
+
+	// a replayed request ID must carry the token it was first redeemed with
+	_, err = r.Receive([]byte("session"), []byte("request-1"), ReceiveParameters{Token: &other})
+	require.ErrorIs(err, ErrRequestReplayed)
+	require.Equal(1, receiver.calls)
+
+	// the same request ID from another session is a fresh redemption
+	_, err = r.Receive([]byte("other-session"), []byte("request-1"), ReceiveParameters{Token: &token})
+	require.NoError(err)
+	require.Equal(2, receiver.calls)
+}
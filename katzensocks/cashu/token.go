@@ -0,0 +1,211 @@
+package cashu
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// tokenPrefix is the prefix of a serialized V3 Cashu token.
+const tokenPrefix = "cashuA"
+
+const (
+	// UnitSat is the unit of proofs denominated in satoshis, and the unit
+	// of proofs that do not specify one.
+	UnitSat = "sat"
+
+	// UnitUSD is the unit of proofs denominated in US cents.
+	UnitUSD = "usd"
+)
+
+var (
+	errInvalidToken = errors.New("invalid cashu token")
+
+	// ErrMixedUnits is returned when amounts of different units would be
+	// combined.
+	ErrMixedUnits = errors.New("cashu: proofs of different units")
+
+	// ErrInsufficientAmount is returned when the proofs of a unit do not
+	// add up to the required amount.
+	ErrInsufficientAmount = errors.New("cashu: insufficient amount")
+)
+
+// Proof is a single ecash proof. Secret and C are bearer material and
+// must never be logged.
+type Proof struct {
+	ID     string `json:"id"`
+	Amount int64  `json:"amount"`
+	Secret string `json:"secret"`
+	C      string `json:"C"`
+}
+
+// Token is a set of proofs issued by a single mint.
+type Token struct {
+	Mint   string  `json:"mint"`
+	Proofs []Proof `json:"proofs"`
+	// Unit overrides the unit of the Tokens for these proofs.
+	Unit string `json:"unit,omitempty"`
+}
+
+// Tokens is a deserialized Cashu token, as returned by SendToken.
+type Tokens struct {
+	Token []Token `json:"token"`
+	Memo  string  `json:"memo,omitempty"`
+	// Unit is the unit of the proofs, UnitSat if empty.
+	Unit string `json:"unit,omitempty"`
+}
+
+// DecodeTokens deserializes a V3 Cashu token string.
+func DecodeTokens(s string) (*Tokens, error) {
+	s = strings.TrimRight(s, "\x00")
+	if !strings.HasPrefix(s, tokenPrefix) {
+		return nil, errInvalidToken
+	}
+	s = strings.TrimRight(s[len(tokenPrefix):], "=")
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	t := new(Tokens)
+	if err := json.Unmarshal(raw, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Encode serializes the Tokens as a V3 Cashu token string.
+func (t *Tokens) Encode() (string, error) {
+	raw, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	return tokenPrefix + base64.URLEncoding.EncodeToString(raw), nil
+}
+
+// UnitOf returns the unit of the proofs of tok, which is set on the token
+// or inherited from the Tokens.
+func (t *Tokens) UnitOf(tok *Token) string {
+	switch {
+	case tok.Unit != "":
+		return tok.Unit
+	case t.Unit != "":
+		return t.Unit
+	default:
+		return UnitSat
+	}
+}
+
+// Units returns the sorted set of units of the proofs.
+func (t *Tokens) Units() []string {
+	seen := make(map[string]struct{})
+	units := []string{}
+	for i := range t.Token {
+		unit := t.UnitOf(&t.Token[i])
+		if _, ok := seen[unit]; !ok {
+			seen[unit] = struct{}{}
+			units = append(units, unit)
+		}
+	}
+	sort.Strings(units)
+	return units
+}
+
+// TotalAmount returns the sum of the amounts of the proofs in unit.
+func (t *Tokens) TotalAmount(unit string) int64 {
+	var total int64
+	for i := range t.Token {
+		if t.UnitOf(&t.Token[i]) != unit {
+			continue
+		}
+		for _, p := range t.Token[i].Proofs {
+			total += p.Amount
+		}
+	}
+	return total
+}
+
+// Amount returns the sum of the amounts of all proofs and their unit. It
+// fails if the proofs are not all of the same unit, as amounts of
+// different units can not be added.
+func (t *Tokens) Amount() (int64, string, error) {
+	units := t.Units()
+	switch len(units) {
+	case 0:
+		return 0, UnitSat, nil
+	case 1:
+		return t.TotalAmount(units[0]), units[0], nil
+	default:
+		return 0, "", fmt.Errorf("%w: %v", ErrMixedUnits, units)
+	}
+}
+
+// SelectProofs returns proofs in unit, largest first, whose amounts add up
+// to at least amount. Proofs of other units are never selected.
+func (t *Tokens) SelectProofs(unit string, amount int64) ([]Proof, error) {
+	proofs := []Proof{}
+	for i := range t.Token {
+		if t.UnitOf(&t.Token[i]) == unit {
+			proofs = append(proofs, t.Token[i].Proofs...)
+		}
+	}
+	sort.SliceStable(proofs, func(i, j int) bool { return proofs[i].Amount > proofs[j].Amount })
+
+	var total int64
+	for i, p := range proofs {
+		if total >= amount {
+			return proofs[:i], nil
+		}
+		total += p.Amount
+	}
+	if total < amount {
+		return nil, fmt.Errorf("%w: have %d %s, need %d", ErrInsufficientAmount, total, unit, amount)
+	}
+	return proofs, nil
+}
+
+// Summary returns a one line description of the Tokens that is safe to
+// log, as it omits the proof secrets and signatures.
+func (t *Tokens) Summary() string {
+	proofs := 0
+	mints := make(map[string]struct{})
+	var mint string
+	for _, tok := range t.Token {
+		proofs += len(tok.Proofs)
+		mint = mintHost(tok.Mint)
+		mints[mint] = struct{}{}
+	}
+	if len(mints) != 1 {
+		mint = fmt.Sprintf("%d mints", len(mints))
+	} else {
+		mint = "mint " + mint
+	}
+	totals := []string{}
+	for _, unit := range t.Units() {
+		totals = append(totals, formatAmount(t.TotalAmount(unit), unit))
+	}
+	if len(totals) == 0 {
+		totals = append(totals, formatAmount(0, UnitSat))
+	}
+	return fmt.Sprintf("%d tokens, %s, total %s, %d proofs", len(t.Token), mint, strings.Join(totals, ", "), proofs)
+}
+
+func formatAmount(amount int64, unit string) string {
+	if unit == UnitSat {
+		return fmt.Sprintf("%d sats", amount)
+	}
+	return fmt.Sprintf("%d %s", amount, unit)
+}
+
+// mintHost returns the host of a mint URL, so that any credentials or
+// paths in the URL are not logged.
+func mintHost(mint string) string {
+	u, err := url.Parse(mint)
+	if err != nil || u.Host == "" {
+		return mint
+	}
+	return u.Host
+}
@@ -0,0 +1,110 @@
+package cashu
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokensSummary(t *testing.T) {
+	require := require.New(t)
+
+	tokens := &Tokens{
+		Token: []Token{
+			{
+				Mint: "https://mint.example/cashu",
+				Proofs: []Proof{
+					{ID: "009a1f293253e41e", Amount: 64, Secret: "secret-one", C: "02c0ffee01"},
+					{ID: "009a1f293253e41e", Amount: 32, Secret: "secret-two", C: "02c0ffee02"},
+					{ID: "009a1f293253e41e", Amount: 16, Secret: "secret-three", C: "02c0ffee03"},
+				},
+			},
+			{
+				Mint: "https://mint.example/cashu",
+				Proofs: []Proof{
+					{ID: "009a1f293253e41e", Amount: 8, Secret: "secret-four", C: "02c0ffee04"},
+					{ID: "009a1f293253e41e", Amount: 4, Secret: "secret-five", C: "02c0ffee05"},
+					{ID: "009a1f293253e41e", Amount: 4, Secret: "secret-six", C: "02c0ffee06"},
+				},
+			},
+		},
+	}
+	encoded, err := tokens.Encode()
+	require.NoError(err)
+	decoded, err := DecodeTokens(encoded)
+	require.NoError(err)
+	require.Equal(tokens, decoded)
+
+	summary := decoded.Summary()
+	require.Equal("2 tokens, mint mint.example, total 128 sats, 6 proofs", summary)
+	for _, tok := range decoded.Token {
+		for _, p := range tok.Proofs {
+			require.False(strings.Contains(summary, p.Secret))
+			require.False(strings.Contains(summary, p.C))
+		}
+	}
+}
+
+func TestDecodeTokensInvalid(t *testing.T) {
+	_, err := DecodeTokens("cashuB1234")
+	require.Error(t, err)
+}
+
+func TestTokensUnits(t *testing.T) {
+	require := require.New(t)
+
+	tokens := &Tokens{
+		Token: []Token{
+			{
+				Mint: "https://mint.example/cashu",
+				Proofs: []Proof{
+					{ID: "009a1f293253e41e", Amount: 64, Secret: "secret-one", C: "02c0ffee01"},
+					{ID: "009a1f293253e41e", Amount: 32, Secret: "secret-two", C: "02c0ffee02"},
+				},
+			},
+			{
+				Mint: "https://mint.example/cashu",
+				Unit: UnitUSD,
+				Proofs: []Proof{
+					{ID: "00ad268c4d1f5826", Amount: 8, Secret: "secret-three", C: "02c0ffee03"},
+					{ID: "00ad268c4d1f5826", Amount: 2, Secret: "secret-four", C: "02c0ffee04"},
+				},
+			},
+		},
+	}
+
+	// amounts of each unit are kept separate
+	require.Equal([]string{UnitSat, UnitUSD}, tokens.Units())
+	require.Equal(int64(96), tokens.TotalAmount(UnitSat))
+	require.Equal(int64(10), tokens.TotalAmount(UnitUSD))
+	require.Equal("2 tokens, mint mint.example, total 96 sats, 10 usd, 4 proofs", tokens.Summary())
+
+	// summing across units fails
+	_, _, err := tokens.Amount()
+	require.ErrorIs(err, ErrMixedUnits)
+	_, err = DefaultPricer.Requests(tokens)
+	require.ErrorIs(err, ErrMixedUnits)
+
+	// selection never crosses units
+	proofs, err := tokens.SelectProofs(UnitUSD, 9)
+	require.NoError(err)
+	require.Len(proofs, 2)
+	proofs, err = tokens.SelectProofs(UnitSat, 50)
+	require.NoError(err)
+	require.Equal([]Proof{tokens.Token[0].Proofs[0]}, proofs)
+	_, err = tokens.SelectProofs(UnitUSD, 11)
+	require.ErrorIs(err, ErrInsufficientAmount)
+
+	// a single unit bundle is priced in its unit
+	usd := &Tokens{Token: tokens.Token[1:], Unit: UnitSat}
+	amount, unit, err := usd.Amount()
+	require.NoError(err)
+	require.Equal(int64(10), amount)
+	require.Equal(UnitUSD, unit)
+	_, err = DefaultPricer.Requests(usd)
+	require.Error(err)
+	n, err := Pricer{UnitUSD: 2}.Requests(usd)
+	require.NoError(err)
+	require.Equal(int64(5), n)
+}
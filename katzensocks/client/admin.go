@@ -0,0 +1,82 @@
+// admin.go - katzensocks client admin endpoint
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// AdminSession describes an active session in the admin listing.
+type AdminSession struct {
+	// ID is the hex session id, as it appears in the logs.
+	ID            string            `json:"id"`
+	Gateway       string            `json:"gateway"`
+	Age           string            `json:"age"`
+	BytesSent     int64             `json:"bytes_sent"`
+	BytesReceived int64             `json:"bytes_received"`
+	Tags          map[string]string `json:"tags,omitempty"`
+}
+
+// AdminSessions returns the active sessions as of now, oldest first.
+func (c *Client) AdminSessions(now time.Time) []AdminSession {
+	sessions := c.Sessions()
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Created.Before(sessions[j].Created)
+	})
+	listing := make([]AdminSession, 0, len(sessions))
+	for _, s := range sessions {
+		listing = append(listing, AdminSession{
+			ID:            fmt.Sprintf("%x", s.ID),
+			Gateway:       s.Provider,
+			Age:           now.Sub(s.Created).Round(time.Second).String(),
+			BytesSent:     s.BytesSent,
+			BytesReceived: s.BytesReceived,
+			Tags:          s.Tags,
+		})
+	}
+	return listing
+}
+
+// AdminHandler serves the active sessions as JSON at /sessions.
+func (c *Client) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(c.AdminSessions(time.Now())); err != nil {
+			c.log.Errorf("Failed to encode sessions: %v", err)
+		}
+	})
+	return mux
+}
+
+// ListenAdmin listens on addr for the admin endpoint, which must be a
+// loopback address as the endpoint is not authenticated.
+func ListenAdmin(addr string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("admin address %s is not a loopback address", addr)
+	}
+	return net.Listen("tcp", addr)
+}
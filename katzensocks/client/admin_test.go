@@ -0,0 +1,84 @@
+// admin_test.go - katzensocks client admin endpoint tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/katzenpost/client/utils"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/op/go-logging.v1"
+)
+
+func TestAdminSessions(t *testing.T) {
+	require := require.New(t)
+
+	c := &Client{
+		sessionToDesc: make(map[string]*utils.ServiceDescriptor),
+		log:           logging.MustGetLogger("admin_test"),
+	}
+	id := c.newSessionTo(&utils.ServiceDescriptor{Provider: "gateway"}, "")
+	c.Lock()
+	c.sessionCreated[string(id)] = time.Now().Add(-90 * time.Second)
+	c.Unlock()
+
+	// the bytes of finished and ongoing connections are both counted
+	sc := c.countSession(id)
+	sc.sent.Add(5)
+	sc.received.Add(7)
+	c.uncountSession(id)
+	c.countSession(id).sent.Add(1)
+
+	w := httptest.NewRecorder()
+	c.AdminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/sessions", nil))
+	require.Equal("application/json", w.Header().Get("Content-Type"))
+	sessions := []AdminSession{}
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &sessions))
+	require.Len(sessions, 1)
+	require.Equal(fmt.Sprintf("%x", id), sessions[0].ID)
+	require.Equal("gateway", sessions[0].Gateway)
+	require.Equal("1m30s", sessions[0].Age)
+	require.Equal(int64(6), sessions[0].BytesSent)
+	require.Equal(int64(7), sessions[0].BytesReceived)
+
+	// forgotten sessions are not listed
+	c.Lock()
+	c.forgetSession(string(id))
+	c.Unlock()
+	require.Empty(c.AdminSessions(time.Now()))
+}
+
+func TestListenAdmin(t *testing.T) {
+	require := require.New(t)
+
+	for _, addr := range []string{"127.0.0.1:0", "[::1]:0", "localhost:0"} {
+		ln, err := ListenAdmin(addr)
+		if err == nil {
+			ln.Close()
+		} else {
+			require.NotContains(err.Error(), "not a loopback address")
+		}
+	}
+	for _, addr := range []string{"0.0.0.0:4245", ":4245", "192.0.2.1:4245", "example.com:4245"} {
+		_, err := ListenAdmin(addr)
+		require.ErrorContains(err, "not a loopback address", addr)
+	}
+}
@@ -0,0 +1,235 @@
+// audit.go - katzensocks client connection audit log
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/katzenpost/katzenpost/katzensocks/client/internal/instrument"
+	"github.com/katzenpost/katzenpost/katzensocks/socks5"
+)
+
+const (
+	// DefaultAuditMaxSize is the size at which the audit log is rotated.
+	DefaultAuditMaxSize = 10 << 20
+
+	// DefaultAuditMaxBackups is the number of rotated audit logs kept.
+	DefaultAuditMaxBackups = 5
+
+	redactedTarget = "[redacted]"
+)
+
+// Outcomes of an audited SOCKS connection.
+const (
+	OutcomeSucceeded   = "succeeded"
+	OutcomeNoGateway   = "no_gateway"
+	OutcomeTopupFailed = "topup_failed"
+	OutcomeDialFailed  = "dial_failed"
+	OutcomeProxyFailed = "proxy_failed"
+	OutcomeRejected    = "rejected"
+	OutcomeTimeout     = "timeout"
+)
+
+// AuditRecord is the record of one SOCKS connection in the audit log.
+type AuditRecord struct {
+	Time          time.Time `json:"time"`
+	Session       string    `json:"session"`
+	User          string    `json:"user,omitempty"`
+	Target        string    `json:"target"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+	Outcome       string    `json:"outcome"`
+}
+
+// AuditLog is an append only log of SOCKS connections, one JSON record
+// per line, kept apart from the debug log.  The log is rotated when it
+// reaches MaxSize, keeping up to MaxBackups rotated files named path.1
+// (newest) to path.N.
+type AuditLog struct {
+	sync.Mutex
+
+	path string
+	f    *os.File
+	size int64
+
+	// MaxSize is the size in bytes at which the log is rotated.
+	MaxSize int64
+
+	// MaxBackups is the number of rotated logs kept.
+	MaxBackups int
+
+	// RedactTargets omits the target host, keeping only the port.
+	RedactTargets bool
+}
+
+// NewAuditLog opens the audit log at path for appending.
+func NewAuditLog(path string) (*AuditLog, error) {
+	a := &AuditLog{
+		path:       path,
+		MaxSize:    DefaultAuditMaxSize,
+		MaxBackups: DefaultAuditMaxBackups,
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f, a.size = f, fi.Size()
+	return nil
+}
+
+// Log appends rec to the audit log, rotating it first if it is full.
+func (a *AuditLog) Log(rec *AuditRecord) error {
+	if a.RedactTargets {
+		r := *rec
+		r.Target = redact(r.Target)
+		rec = &r
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.Lock()
+	defer a.Unlock()
+	if a.f == nil {
+		return os.ErrClosed
+	}
+	if a.size > 0 && a.size+int64(len(line)) > a.MaxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.f.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+// rotate shifts the rotated logs and starts a new log.  The caller MUST
+// hold the lock.
+func (a *AuditLog) rotate() error {
+	if err := a.f.Close(); err != nil {
+		return err
+	}
+	a.f = nil
+	if a.MaxBackups > 0 {
+		os.Remove(a.backup(a.MaxBackups))
+		for i := a.MaxBackups - 1; i > 0; i-- {
+			os.Rename(a.backup(i), a.backup(i+1))
+		}
+		if err := os.Rename(a.path, a.backup(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(a.path); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+func (a *AuditLog) backup(i int) string {
+	return fmt.Sprintf("%s.%d", a.path, i)
+}
+
+// Close closes the audit log.
+func (a *AuditLog) Close() error {
+	a.Lock()
+	defer a.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Close()
+	a.f = nil
+	return err
+}
+
+func redact(target string) string {
+	scheme, hostport, ok := strings.Cut(target, "://")
+	if !ok {
+		hostport, scheme = target, ""
+	}
+	redacted := redactedTarget
+	if _, port, err := net.SplitHostPort(hostport); err == nil {
+		redacted = net.JoinHostPort(redactedTarget, port)
+	}
+	if scheme != "" {
+		redacted = scheme + "://" + redacted
+	}
+	return redacted
+}
+
+// auditUser returns the user authenticated by the SOCKS request, either
+// the "user" argument or a plain RFC1929 username.
+func auditUser(req *socks5.Request) string {
+	if user, ok := req.Args["user"]; ok {
+		return user
+	}
+	if !strings.Contains(req.Username, "=") {
+		return req.Username
+	}
+	return ""
+}
+
+// countingConn counts the bytes read from and written to a net.Conn, and
+// adds them to the counter of its session, if any.
+type countingConn struct {
+	net.Conn
+	read, written atomic.Int64
+	session       *sessionCounter
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	instrument.BytesSent(n)
+	if c.session != nil {
+		c.session.sent.Add(int64(n))
+		c.session.up.wait(n)
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	if c.session != nil {
+		c.session.down.wait(len(p))
+	}
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	instrument.BytesReceived(n)
+	if c.session != nil {
+		c.session.received.Add(int64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,138 @@
+// audit_test.go - katzensocks client audit log tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/katzenpost/katzensocks/socks5"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/op/go-logging.v1"
+)
+
+func readAuditRecords(t *testing.T, path string) []*AuditRecord {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	recs := []*AuditRecord{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		rec := new(AuditRecord)
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), rec))
+		recs = append(recs, rec)
+	}
+	require.NoError(t, scanner.Err())
+	return recs
+}
+
+func TestAuditLog(t *testing.T) {
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := NewAuditLog(path)
+	require.NoError(err)
+	c := &Client{Audit: a, log: logging.MustGetLogger("audit_test")}
+
+	// count the bytes of a proxied session
+	local, remote := net.Pipe()
+	counted := &countingConn{Conn: local}
+	go func() {
+		remote.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+		io.Copy(io.Discard, remote)
+	}()
+	buf := make([]byte, 18)
+	_, err = io.ReadFull(counted, buf)
+	require.NoError(err)
+	_, err = counted.Write([]byte("HTTP/1.0 200 OK\r\n"))
+	require.NoError(err)
+	local.Close()
+
+	now := time.Now().Truncate(time.Second)
+	c.audit(&AuditRecord{
+		Time:          now,
+		Session:       "0102",
+		User:          auditUser(&socks5.Request{Username: "alice"}),
+		Target:        "tcp://example.com:443",
+		BytesSent:     counted.read.Load(),
+		BytesReceived: counted.written.Load(),
+		Outcome:       OutcomeSucceeded,
+	})
+	a.RedactTargets = true
+	c.audit(&AuditRecord{
+		Time:    now,
+		User:    auditUser(&socks5.Request{Username: "app=mail;user=bob", Args: map[string]string{"app": "mail", "user": "bob"}}),
+		Target:  "udp://10.0.0.1:53",
+		Outcome: OutcomeNoGateway,
+	})
+	require.NoError(a.Close())
+
+	recs := readAuditRecords(t, path)
+	require.Len(recs, 2)
+	require.True(now.Equal(recs[0].Time))
+	require.Equal("0102", recs[0].Session)
+	require.Equal("alice", recs[0].User)
+	require.Equal("tcp://example.com:443", recs[0].Target)
+	require.Equal(int64(18), recs[0].BytesSent)
+	require.Equal(int64(17), recs[0].BytesReceived)
+	require.Equal(OutcomeSucceeded, recs[0].Outcome)
+
+	require.Equal("bob", recs[1].User)
+	require.Equal("udp://[redacted]:53", recs[1].Target)
+	require.Equal(OutcomeNoGateway, recs[1].Outcome)
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := NewAuditLog(path)
+	require.NoError(err)
+	a.MaxSize = 200
+	a.MaxBackups = 2
+
+	rec := &AuditRecord{Time: time.Now(), Session: "01", Target: "tcp://example.com:80", Outcome: OutcomeSucceeded}
+	for i := 0; i < 10; i++ {
+		require.NoError(a.Log(rec))
+	}
+	require.NoError(a.Close())
+
+	total := 0
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		fi, err := os.Stat(p)
+		require.NoError(err)
+		require.LessOrEqual(fi.Size(), a.MaxSize)
+		total += len(readAuditRecords(t, p))
+	}
+	_, err = os.Stat(path + ".3")
+	require.True(os.IsNotExist(err))
+	require.Less(total, 10)
+
+	// reopening appends to the current log
+	a, err = NewAuditLog(path)
+	require.NoError(err)
+	n := len(readAuditRecords(t, path))
+	require.NoError(a.Log(rec))
+	require.NoError(a.Close())
+	require.Len(readAuditRecords(t, path), n+1)
+}
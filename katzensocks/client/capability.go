@@ -0,0 +1,143 @@
+// capability.go - katzensocks gateway capabilities
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/katzenpost/katzenpost/client/utils"
+)
+
+// Capability is a feature offered by a katzensocks gateway.
+type Capability string
+
+const (
+	// CapabilityTCP is the ability to proxy TCP connections.
+	CapabilityTCP Capability = "tcp"
+	// CapabilityUDP is the ability to relay UDP datagrams.
+	CapabilityUDP Capability = "udp"
+	// CapabilityIPv6 is the ability to reach IPv6 targets.
+	CapabilityIPv6 Capability = "ipv6"
+	// CapabilityDNS is the ability to resolve target hostnames.
+	CapabilityDNS Capability = "dns"
+
+	// CapabilitiesParameter is the service descriptor parameter that lists
+	// the capabilities of a gateway, separated by commas.
+	CapabilitiesParameter = "capabilities"
+)
+
+var (
+	// legacyCapabilities are assumed for gateways that do not advertise
+	// their capabilities.
+	legacyCapabilities = []Capability{CapabilityTCP, CapabilityUDP, CapabilityIPv6, CapabilityDNS}
+
+	errNoCapableGateway = errors.New("No Gateway offers the required capabilities")
+)
+
+// ParseCapabilities parses a comma separated list of capabilities.
+func ParseCapabilities(s string) []Capability {
+	caps := []Capability{}
+	for _, c := range strings.Split(s, ",") {
+		c = strings.ToLower(strings.TrimSpace(c))
+		if c != "" {
+			caps = append(caps, Capability(c))
+		}
+	}
+	return caps
+}
+
+// GatewayCapabilities returns the set of capabilities advertised in the
+// gateway's service descriptor.
+func GatewayCapabilities(desc *utils.ServiceDescriptor) map[Capability]bool {
+	caps := make(map[Capability]bool)
+	var advertised []Capability
+	switch v := desc.Parameters[CapabilitiesParameter].(type) {
+	case string:
+		advertised = ParseCapabilities(v)
+	case []interface{}:
+		for _, c := range v {
+			if s, ok := c.(string); ok {
+				advertised = append(advertised, ParseCapabilities(s)...)
+			}
+		}
+	default:
+		advertised = legacyCapabilities
+	}
+	for _, c := range advertised {
+		caps[c] = true
+	}
+	return caps
+}
+
+// hasCapabilities returns true iff the gateway offers all of required.
+func hasCapabilities(desc *utils.ServiceDescriptor, required []Capability) bool {
+	caps := GatewayCapabilities(desc)
+	for _, c := range required {
+		if !caps[c] {
+			return false
+		}
+	}
+	return true
+}
+
+// TargetCapabilities returns the capabilities a gateway needs to reach tgt.
+func TargetCapabilities(tgt *url.URL) []Capability {
+	caps := []Capability{}
+	switch tgt.Scheme {
+	case "udp":
+		caps = append(caps, CapabilityUDP)
+	default:
+		caps = append(caps, CapabilityTCP)
+	}
+	addr, err := netip.ParseAddr(tgt.Hostname())
+	switch {
+	case err != nil:
+		caps = append(caps, CapabilityDNS)
+	case addr.Is6() && !addr.Is4In6():
+		caps = append(caps, CapabilityIPv6)
+	}
+	return caps
+}
+
+// selectGateway returns preferred if it offers the required capabilities,
+// otherwise a gateway from descs that does, chosen by selector, or at
+// random if selector is nil.
+func selectGateway(descs []*utils.ServiceDescriptor, preferred *utils.ServiceDescriptor, required []Capability, selector GatewaySelector) (*utils.ServiceDescriptor, error) {
+	if len(descs) == 0 && preferred == nil {
+		return nil, errNoGatewayDescriptor
+	}
+	if preferred != nil && hasCapabilities(preferred, required) {
+		return preferred, nil
+	}
+	capable := []*utils.ServiceDescriptor{}
+	for _, desc := range descs {
+		if hasCapabilities(desc, required) {
+			capable = append(capable, desc)
+		}
+	}
+	if len(capable) == 0 {
+		return nil, fmt.Errorf("%w: %v", errNoCapableGateway, required)
+	}
+	if selector == nil {
+		selector = Random{}
+	}
+	return selector.Select(capable), nil
+}
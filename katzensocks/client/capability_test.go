@@ -0,0 +1,130 @@
+// capability_test.go - katzensocks gateway capability tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/katzenpost/client"
+	"github.com/katzenpost/katzenpost/client/utils"
+	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/op/go-logging.v1"
+)
+
+func TestTargetCapabilities(t *testing.T) {
+	require := require.New(t)
+	for tgt, caps := range map[string][]Capability{
+		"tcp://127.0.0.1:80":     {CapabilityTCP},
+		"udp://127.0.0.1:53":     {CapabilityUDP},
+		"tcp://[2001:db8::1]:80": {CapabilityTCP, CapabilityIPv6},
+		"tcp://example.com:443":  {CapabilityTCP, CapabilityDNS},
+	} {
+		u, err := url.Parse(tgt)
+		require.NoError(err)
+		require.Equal(caps, TargetCapabilities(u), tgt)
+	}
+}
+
+func TestUDPAssociateSkipsTCPOnlyGateway(t *testing.T) {
+	require := require.New(t)
+
+	tcpOnly := &utils.ServiceDescriptor{
+		Name:       "+katzensocks",
+		Provider:   "tcp-only",
+		Parameters: map[string]interface{}{"endpoint": "+katzensocks", CapabilitiesParameter: "tcp"},
+	}
+	udpCapable := &utils.ServiceDescriptor{
+		Name:       "+katzensocks",
+		Provider:   "udp-capable",
+		Parameters: map[string]interface{}{"endpoint": "+katzensocks", CapabilitiesParameter: "tcp, udp"},
+	}
+	c := &Client{
+		descs:         []*utils.ServiceDescriptor{tcpOnly, udpCapable},
+		sessionToDesc: make(map[string]*utils.ServiceDescriptor),
+		log:           logging.MustGetLogger("capability_test"),
+	}
+
+	tgt, err := url.Parse("udp://127.0.0.1:53")
+	require.NoError(err)
+	for i := 0; i < 10; i++ {
+		id, err := c.NewSession(TargetCapabilities(tgt)...)
+		require.NoError(err)
+		require.Equal(udpCapable, c.sessionToDesc[string(id)])
+	}
+
+	// a selected gateway lacking the capability is skipped as well
+	c.desc = tcpOnly
+	id, err := c.NewSession(TargetCapabilities(tgt)...)
+	require.NoError(err)
+	require.Equal(udpCapable, c.sessionToDesc[string(id)])
+
+	// no gateway offers ipv6
+	c.RequiredCapabilities = []Capability{CapabilityIPv6}
+	_, err = c.NewSession(TargetCapabilities(tgt)...)
+	require.True(errors.Is(err, errNoCapableGateway))
+}
+
+func TestUpdateGateways(t *testing.T) {
+	require := require.New(t)
+
+	doc := func(providers ...string) *pki.Document {
+		d := &pki.Document{Epoch: 1}
+		for _, p := range providers {
+			d.Providers = append(d.Providers, &pki.MixDescriptor{Name: p, Kaetzchen: map[string]map[string]interface{}{"katzensocks": {"endpoint": "+katzensocks"}}})
+		}
+		return d
+	}
+	descs := testGateways("a", "b")
+	c := &Client{
+		descs:         descs,
+		desc:          descs[0],
+		pinned:        "a",
+		sessionToDesc: make(map[string]*utils.ServiceDescriptor),
+		log:           logging.MustGetLogger("capability_test"),
+	}
+	events := make(chan client.Event)
+	c.Go(func() { c.eventWorker(events) })
+	defer c.Halt()
+	pinned := func() *utils.ServiceDescriptor {
+		c.Lock()
+		defer c.Unlock()
+		return c.desc
+	}
+
+	// the pinned gateway is replaced while it is not published, as the
+	// documents are handled with no tunnel open
+	events <- &client.NewDocumentEvent{Document: doc("b", "c")}
+	require.Eventually(func() bool { return pinned() == nil }, time.Second, 10*time.Millisecond)
+	require.Len(c.descs, 2)
+	for i := 0; i < 5; i++ {
+		id, err := c.NewSession()
+		require.NoError(err)
+		require.NotEqual("a", c.sessionToDesc[string(id)].Provider)
+	}
+
+	// and used again once it is
+	events <- &client.NewDocumentEvent{Document: doc("a", "c")}
+	require.Eventually(func() bool { return pinned() != nil }, time.Second, 10*time.Millisecond)
+	require.Equal("a", c.desc.Provider)
+	id, err := c.NewSession()
+	require.NoError(err)
+	require.Equal("a", c.sessionToDesc[string(id)].Provider)
+}
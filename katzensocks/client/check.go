@@ -0,0 +1,141 @@
+// check.go - katzensocks client configuration check
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/katzenpost/katzenpost/client/config"
+	"github.com/katzenpost/katzenpost/client/utils"
+	"github.com/katzenpost/katzenpost/core/pki"
+)
+
+// CheckResult is the outcome of one step of a configuration check.
+type CheckResult struct {
+	Name   string
+	Detail string
+	Err    error
+}
+
+// CheckReport is the outcome of every step of a configuration check.
+type CheckReport []CheckResult
+
+// OK returns true iff every step of the check passed.
+func (r CheckReport) OK() bool {
+	for _, res := range r {
+		if res.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteTo writes a line for each step of the check to w.
+func (r CheckReport) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	for _, res := range r {
+		line := fmt.Sprintf("ok    %s: %s\n", res.Name, res.Detail)
+		if res.Err != nil {
+			line = fmt.Sprintf("FAIL  %s: %v\n", res.Name, res.Err)
+		}
+		n, err := io.WriteString(w, line)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// CheckConfig loads and validates cfgFile, fetches the PKI document with
+// it and verifies that gateway, or any gateway if it is empty, offers
+// katzensocks.  The steps after a failed one are skipped.
+func CheckConfig(ctx context.Context, cfgFile, gateway string) CheckReport {
+	report := CheckReport{}
+	cfg, err := config.LoadFile(cfgFile)
+	report = append(report, CheckResult{Name: "config", Detail: "loaded " + cfgFile, Err: err})
+	if err != nil {
+		return report
+	}
+	_, doc, err := GetPKIFromConfig(ctx, cfg)
+	if err != nil {
+		return append(report, CheckResult{Name: "pki", Err: err})
+	}
+	report = append(report, CheckResult{Name: "pki", Detail: fmt.Sprintf("fetched document for epoch %d", doc.Epoch)})
+	detail, err := checkGateway(doc, gateway)
+	return append(report, CheckResult{Name: "gateway", Detail: detail, Err: err})
+}
+
+// checkGateway verifies that gateway, or any gateway if it is empty,
+// offers katzensocks in doc.
+func checkGateway(doc *pki.Document, gateway string) (string, error) {
+	descs := utils.FindServices("katzensocks", doc)
+	if len(descs) == 0 {
+		return "", errNoGatewayDescriptor
+	}
+	providers := make([]string, 0, len(descs))
+	for _, desc := range descs {
+		if desc.Provider == gateway {
+			return "found " + gateway, nil
+		}
+		providers = append(providers, desc.Provider)
+	}
+	if gateway != "" {
+		return "", fmt.Errorf("%s offers no katzensocks service, gateways are: %s", gateway, strings.Join(providers, ", "))
+	}
+	return "found " + strings.Join(providers, ", "), nil
+}
+
+// CheckListeners verifies that none of the named listen addresses share a
+// port on the same or an unspecified host.  Unix sockets and empty
+// addresses are ignored.
+func CheckListeners(addrs map[string]string) CheckResult {
+	names := make([]string, 0, len(addrs))
+	for name := range addrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, a := range names {
+		for _, b := range names[i+1:] {
+			if listenersCollide(addrs[a], addrs[b]) {
+				return CheckResult{Name: "listeners", Err: fmt.Errorf("%s %s collides with %s %s", a, addrs[a], b, addrs[b])}
+			}
+		}
+	}
+	return CheckResult{Name: "listeners", Detail: fmt.Sprintf("%d addresses do not collide", len(names))}
+}
+
+func listenersCollide(a, b string) bool {
+	if a == "" || b == "" || strings.HasPrefix(a, unixScheme) || strings.HasPrefix(b, unixScheme) {
+		return a == b && a != ""
+	}
+	hostA, portA, errA := net.SplitHostPort(a)
+	hostB, portB, errB := net.SplitHostPort(b)
+	if errA != nil || errB != nil || portA != portB {
+		return false
+	}
+	unspecified := func(host string) bool {
+		ip := net.ParseIP(host)
+		return host == "" || ip != nil && ip.IsUnspecified()
+	}
+	return hostA == hostB || unspecified(hostA) || unspecified(hostB)
+}
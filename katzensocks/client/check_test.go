@@ -0,0 +1,76 @@
+// check_test.go - katzensocks client configuration check tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckConfig(t *testing.T) {
+	require := require.New(t)
+
+	report := CheckConfig(context.Background(), "testdata/missing.toml", "")
+	require.Len(report, 1)
+	require.False(report.OK())
+	buf := new(bytes.Buffer)
+	_, err := report.WriteTo(buf)
+	require.NoError(err)
+	require.Contains(buf.String(), "FAIL  config: ")
+}
+
+func TestCheckGateway(t *testing.T) {
+	require := require.New(t)
+
+	doc := &pki.Document{Providers: []*pki.MixDescriptor{
+		{Name: "provider1", Kaetzchen: map[string]map[string]interface{}{"katzensocks": {"endpoint": "+socks"}}},
+		{Name: "provider2", Kaetzchen: map[string]map[string]interface{}{"echo": {"endpoint": "+echo"}}},
+	}}
+	detail, err := checkGateway(doc, "")
+	require.NoError(err)
+	require.Equal("found provider1", detail)
+	_, err = checkGateway(doc, "provider1")
+	require.NoError(err)
+	_, err = checkGateway(doc, "provider2")
+	require.ErrorContains(err, "gateways are: provider1")
+	_, err = checkGateway(&pki.Document{}, "")
+	require.ErrorIs(err, errNoGatewayDescriptor)
+}
+
+func TestCheckListeners(t *testing.T) {
+	require := require.New(t)
+
+	for _, tc := range []struct {
+		a, b    string
+		collide bool
+	}{
+		{"127.0.0.1:4242", "127.0.0.1:4243", false},
+		{"127.0.0.1:4242", "127.0.0.1:4242", true},
+		{"127.0.0.1:4242", "[::1]:4242", false},
+		{"127.0.0.1:4242", ":4242", true},
+		{"[::]:4242", "127.0.0.1:4242", true},
+		{"unix:///run/socks.sock", "127.0.0.1:4242", false},
+		{"127.0.0.1:4242", "", false},
+	} {
+		res := CheckListeners(map[string]string{"bind": tc.a, "stats-addr": tc.b})
+		require.Equal(tc.collide, res.Err != nil, "%s and %s", tc.a, tc.b)
+	}
+}
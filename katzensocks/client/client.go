@@ -27,6 +27,7 @@ import (
 	"github.com/katzenpost/katzenpost/core/wire"
 	"github.com/katzenpost/katzenpost/core/worker"
 	"github.com/katzenpost/katzenpost/katzensocks/cashu"
+	"github.com/katzenpost/katzenpost/katzensocks/client/internal/instrument"
 	"github.com/katzenpost/katzenpost/katzensocks/common"
 	"github.com/katzenpost/katzenpost/katzensocks/server"
 	"github.com/katzenpost/katzenpost/katzensocks/socks5"
@@ -34,6 +35,7 @@ import (
 
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/url"
@@ -54,9 +56,18 @@ var (
 )
 
 func GetPKI(ctx context.Context, cfgFile string) (pki.Client, *pki.Document, error) {
-	c, err := GetClient(cfgFile)
+	cfg, err := config.LoadFile(cfgFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return GetPKIFromConfig(ctx, cfg)
+}
+
+// GetPKIFromConfig is like GetPKI, but uses an already parsed config.
+func GetPKIFromConfig(ctx context.Context, cfg *config.Config) (pki.Client, *pki.Document, error) {
+	c, err := GetClientFromConfig(cfg)
 	if err != nil {
-		panic(err)
+		return nil, nil, err
 	}
 	// generate a linkKey
 	linkKey, _ := wire.DefaultScheme.GenerateKeypair(rand.Reader)
@@ -65,16 +76,72 @@ func GetPKI(ctx context.Context, cfgFile string) (pki.Client, *pki.Document, err
 	return client.PKIBootstrap(ctx, c, linkKey)
 }
 
+// LoadConfig parses and validates a client config read from r, such as an
+// embedded katzensocks.toml.
+func LoadConfig(r io.Reader) (*config.Config, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return config.Load(b)
+}
+
 func GetClient(cfgFile string) (*client.Client, error) {
 	cfg, err := config.LoadFile(cfgFile)
 	if err != nil {
 		return nil, err
 	}
+	return GetClientFromConfig(cfg)
+}
+
+// GetClientFromConfig is like GetClient, but uses an already parsed config.
+func GetClientFromConfig(cfg *config.Config) (*client.Client, error) {
 	return client.New(cfg)
 }
 
 func GetSession(cfgFile string, delay, retry int) (*client.Session, error) {
-	cc, err := GetClient(cfgFile)
+	return GetSessionContext(context.Background(), cfgFile, delay, retry)
+}
+
+// GetSessionContext is like GetSession, but gives up connecting once ctx
+// is done, so that a hung bootstrap can be abandoned.
+func GetSessionContext(ctx context.Context, cfgFile string, delay, retry int) (*client.Session, error) {
+	cfg, err := config.LoadFile(cfgFile)
+	if err != nil {
+		return nil, err
+	}
+	policy := RetryPolicy{MaxRetries: retry, Delay: time.Duration(delay) * time.Second}
+	return getSession(ctx, cfg, func() RetryPolicy { return policy })
+}
+
+// GetSessionFromConfig is like GetSession, but uses an already parsed
+// config, so that no config file is needed.
+func GetSessionFromConfig(cfg *config.Config, delay, retry int) (*client.Session, error) {
+	policy := RetryPolicy{MaxRetries: retry, Delay: time.Duration(delay) * time.Second}
+	return GetSessionFromConfigWithRetryPolicy(cfg, func() RetryPolicy { return policy })
+}
+
+// GetSessionWithRetryPolicy is like GetSession, but reads the retry policy
+// before each wait so that it may be changed while connecting, for example
+// by passing Client.RetryPolicy.
+func GetSessionWithRetryPolicy(cfgFile string, policy func() RetryPolicy) (*client.Session, error) {
+	cfg, err := config.LoadFile(cfgFile)
+	if err != nil {
+		return nil, err
+	}
+	return GetSessionFromConfigWithRetryPolicy(cfg, policy)
+}
+
+// GetSessionFromConfigWithRetryPolicy is like GetSessionWithRetryPolicy,
+// but uses an already parsed config.
+func GetSessionFromConfigWithRetryPolicy(cfg *config.Config, policy func() RetryPolicy) (*client.Session, error) {
+	return getSession(context.Background(), cfg, policy)
+}
+
+// getSession connects to the mixnet with cfg, retrying as policy
+// prescribes, until ctx is done.
+func getSession(ctx context.Context, cfg *config.Config, policy func() RetryPolicy) (*client.Session, error) {
+	cc, err := GetClientFromConfig(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -83,39 +150,216 @@ func GetSession(cfgFile string, delay, retry int) (*client.Session, error) {
 	var session *client.Session
 	retries := 0
 	for session == nil {
-		session, err = cc.NewTOFUSession(context.Background())
+		session, err = cc.NewTOFUSession(ctx)
+		if err != nil && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		switch err {
 		case nil:
 		case pki.ErrNoDocument:
 			_, _, till := epochtime.Now()
 			l.Debug("No document, waiting %v for document", till)
-			<-time.After(till)
+			if err := sleepContext(ctx, till); err != nil {
+				return nil, err
+			}
 		default:
-			if retries == retry {
+			p := policy()
+			if p.MaxRetries >= 0 && retries >= p.MaxRetries {
 				return nil, errors.New("Failed to connect within retry limit")
 			}
+			reconnects.Add(1)
+			instrument.Reconnect()
 			l.Errorf("NewTOFUSession: %v", err)
-			l.Debugf("Waiting for %d seconds", delay)
-			<-time.After(time.Duration(delay) * time.Second)
+			wait := p.Wait(retries)
+			l.Debugf("Waiting for %v", wait)
+			if err := sleepContext(ctx, wait); err != nil {
+				return nil, err
+			}
 		}
 		retries += 1
 	}
-	session.WaitForDocument(context.Background())
+	if err := session.WaitForDocument(ctx); err != nil {
+		session.Shutdown()
+		return nil, ctx.Err()
+	}
 	return session, nil
 }
 
+// sleepContext waits for d, or returns the error of ctx if it is done
+// first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 type Client struct {
 	worker.Worker
 	sync.Mutex
 
 	desc          *utils.ServiceDescriptor
+	pinned        string
 	descs         []*utils.ServiceDescriptor
 	sessionToDesc map[string]*utils.ServiceDescriptor
+	sessionTags   map[string]map[string]string
 	log           *logging.Logger
 	s             *client.Session
 	msgCallbacks  map[[constants.MessageIDLength]byte]func(*client.MessageReplyEvent)
 	payloadLen    int
-	cashuClient   *cashu.CashuApiClient
+
+	// AdaptiveQUIC selects the QUIC tuning profile for each session from
+	// the round trips measured while the session is set up.
+	AdaptiveQUIC bool
+	pathStats    map[string]*common.PathStats
+
+	// QUICTuning, if set, overrides the QUIC parameters of every session,
+	// including those of the adaptive profile.
+	QUICTuning *common.QUICProfile
+
+	// CoerceIPv4 makes SOCKS5 replies always carry an IPv4 bound address.
+	CoerceIPv4 bool
+
+	// Compress requests compression of the proxied streams, where the
+	// gateway supports it.
+	Compress   bool
+	compressed map[string]bool
+
+	// KeepAlive is the idle period after which a tunnel sends a keepalive
+	// through the mixnet to keep its circuit warm, or zero to disable.
+	KeepAlive time.Duration
+
+	// RequiredCapabilities are required of every gateway selected for a
+	// session.
+	RequiredCapabilities []Capability
+
+	// StableSessionIDs derives the id of each new session from its
+	// gateway, the isolation key of its connections and the epoch, keyed
+	// with SessionIDSecret, and numbers the sessions sharing them, rather
+	// than choosing it at random.  The ids of reconnections can then be
+	// recognized in the logs, but so can they by the gateway.
+	StableSessionIDs bool
+	// SessionIDSecret keys the stable session ids, which are reproduced
+	// across restarts only if it is kept, as by LoadSessionIDSecret.  A
+	// random one is chosen if it is not set.
+	SessionIDSecret []byte
+	sessionSeqs     map[string]uint64
+
+	// OnGatewaySelected, if set, is called with the id of every new
+	// session and the name of the gateway selected for it.
+	OnGatewaySelected func(sessionID []byte, gateway string)
+
+	// NegotiationTimeout limits the SOCKS handshake, or is the socks5
+	// default if zero.  IdleTimeout closes SOCKS connections idle for that
+	// long, if non zero.
+	NegotiationTimeout time.Duration
+	IdleTimeout        time.Duration
+
+	// ConnectTimeout limits the round trips through the mixnet to set
+	// up a SOCKS connection, after which the SOCKS client is answered
+	// with TTL expired, if non zero.
+	ConnectTimeout time.Duration
+
+	// VerifyCredentials, if set, requires SOCKS clients to authenticate
+	// with credentials it accepts.
+	VerifyCredentials socks5.CredentialVerifier
+
+	// Audit, if set, records every SOCKS connection and HTTP CONNECT
+	// tunnel.
+	Audit *AuditLog
+
+	// Multiplex carries the TCP connections to a gateway as streams of
+	// one shared circuit, where the gateway offers CapabilityMux, instead
+	// of building a circuit per connection.
+	Multiplex    bool
+	circuitLock  sync.Mutex
+	circuits     []*circuit
+	buildCircuit func(desc *utils.ServiceDescriptor, tgt *url.URL, isolation string) (*circuit, error)
+
+	// MaxConnsPerIP limits the concurrent SOCKS connections and HTTP
+	// CONNECT tunnels from each source IP address, if non zero.
+	MaxConnsPerIP int
+	connsPerIP    map[string]int
+	stats         Stats
+
+	sessionCounters map[string]*sessionCounter
+	sessionTotals   map[string]SessionStats
+	sessionCreated  map[string]time.Time
+
+	// RateUp and RateDown limit the bytes per second each session relays
+	// to and from the targets, if non zero.
+	RateUp   int64
+	RateDown int64
+
+	// IsolateSOCKSAuth keeps connections that authenticated with different
+	// SOCKS usernames from sharing a multiplexed circuit, so that the
+	// traffic of different applications can not be linked by it.
+	IsolateSOCKSAuth bool
+
+	// DNSOverMix resolves the host names of targets by querying
+	// DNSResolver through the mixnet, rather than leaving them to the
+	// gateway.  The queries are carried by the multiplexed circuit of the
+	// isolation key of the connection, so a gateway that supports mux is
+	// required.
+	DNSOverMix  bool
+	DNSResolver string
+	dnsLock     sync.Mutex
+	dnsCache    map[dnsKey]dnsEntry
+	dnsDial     func(ctx context.Context, isolation string) (net.Conn, error)
+
+	// GatewaySelector chooses the gateway of each new session, unless one
+	// is set with SetGateway.  Gateways are chosen at random if it is nil.
+	GatewaySelector GatewaySelector
+
+	// policy, if set with SetPolicy, restricts the destinations of SOCKS
+	// connections.
+	policy *Policy
+
+	// Payment pays the gateways for sessions.  TopupThreshold, if non
+	// zero, is how long before a session relaying connections runs out
+	// it is topped up again, once Serve is called.
+	Payment        PaymentProvider
+	TopupThreshold time.Duration
+	paidUntil      map[string]time.Time
+	renewing       map[string]bool
+
+	// GatewayCooldown is how long a gateway is passed over for new
+	// sessions after it exhausted the retries of a request, or
+	// DefaultGatewayCooldown if zero.
+	GatewayCooldown time.Duration
+	unhealthy       map[string]time.Time
+
+	// MaxConns limits the concurrent SOCKS connections served by Serve,
+	// if non zero.
+	MaxConns int
+	conns    int
+	refusing int
+
+	// FailClosed resets every SOCKS connection when the connection to
+	// the mixnet is lost, and refuses new ones until it is restored, so
+	// that no traffic waits on or is retried over a broken session.
+	FailClosed bool
+	offline    bool
+	active     map[net.Conn]struct{}
+
+	// listeners are the listeners of Serve, closed by Drain.
+	listeners map[net.Listener]struct{}
+	draining  bool
+	// requests counts the forwarded HTTP requests in flight.
+	requests int
+
+	// SessionTTL evicts the sessions that relayed no connection for that
+	// long, once Serve is called, if non zero.
+	SessionTTL  time.Duration
+	lastActive  map[string]time.Time
+	workersOnce sync.Once
+
+	retryPolicy *RetryPolicy
+	sleep       func(time.Duration)
 }
 
 func NewClient(s *client.Session) (*Client, error) {
@@ -127,17 +371,85 @@ func NewClient(s *client.Session) (*Client, error) {
 	}
 	cashuClient := cashu.NewCashuApiClient(nil, cashuWalletUrl)
 
-	return &Client{descs: descs, s: s, log: l, payloadLen: s.SphinxGeometry().UserForwardPayloadLength,
+	c := &Client{descs: descs, s: s, log: l, payloadLen: s.SphinxGeometry().UserForwardPayloadLength,
 		msgCallbacks:  make(map[[constants.MessageIDLength]byte]func(*client.MessageReplyEvent)),
-		sessionToDesc: make(map[string]*utils.ServiceDescriptor), cashuClient: cashuClient}, nil
+		sessionToDesc: make(map[string]*utils.ServiceDescriptor), Payment: NewCashuPayment(cashuClient),
+		pathStats: make(map[string]*common.PathStats), compressed: make(map[string]bool)}
+	c.Go(func() { c.eventWorker(s.EventSink) })
+	return c, nil
+}
+
+// eventWorker handles the events of the session until the Client is
+// halted, whether or not any tunnel is open, so that changes of the
+// connectivity and of the PKI document are seen while idle.
+func (c *Client) eventWorker(events <-chan client.Event) {
+	c.log.Debugf("Started event sink worker")
+	defer func() {
+		c.log.Debugf("Event sink worker terminating gracefully.")
+	}()
+	for {
+		select {
+		case e := <-events:
+			c.handleEvent(e)
+		case <-c.HaltCh():
+			return
+		}
+	}
+}
+
+// handleEvent dispatches a session event to the reply callback of its
+// message, to connectionStatus or to updateGateways.
+func (c *Client) handleEvent(e client.Event) {
+	switch event := e.(type) {
+	case *client.MessageReplyEvent:
+		c.Lock()
+		callback, ok := c.msgCallbacks[*event.MessageID]
+		c.Unlock()
+		if ok {
+			callback(event)
+		} else {
+			c.log.Errorf("No callback for ReplyEvent")
+		}
+	case *client.ConnectionStatusEvent:
+		c.log.Notice(event.String())
+		c.connectionStatus(event.IsConnected)
+	case *client.NewDocumentEvent:
+		c.updateGateways(event.Document)
+	}
+}
+
+// blockingSend sends a request to the gateway and records the round trip
+// in the session's path measurements.
+func (c *Client) blockingSend(id []byte, desc *utils.ServiceDescriptor, serialized []byte) ([]byte, error) {
+	start := time.Now()
+	rawResp, err := c.s.BlockingSendUnreliableMessage(desc.Name, desc.Provider, serialized)
+	switch err {
+	case nil:
+		rtt := time.Since(start)
+		c.pathStatsFor(id).AddSample(rtt, false)
+		if o, ok := c.GatewaySelector.(latencyObserver); ok {
+			o.Observe(desc, rtt)
+		}
+	case client.ErrReplyTimeout:
+		c.pathStatsFor(id).AddSample(0, true)
+	}
+	return rawResp, err
+}
+
+func (c *Client) pathStatsFor(id []byte) *common.PathStats {
+	c.Lock()
+	defer c.Unlock()
+	stats, ok := c.pathStats[string(id)]
+	if !ok {
+		stats = common.NewPathStats()
+		c.pathStats[string(id)] = stats
+	}
+	return stats
 }
 
 // topup sends a TopupCommand and returns a channel. err nil means success.
 func (c *Client) Topup(id []byte) chan error {
-	const SATOSHIS_PER_REQUEST = 1
-	const DEPOSIT_LIGHTNING_SATS = 100
-
-	errCh := make(chan error)
+	errCh := make(chan error, 1)
 	go func() {
 		defer close(errCh)
 		c.Lock()
@@ -148,42 +460,28 @@ func (c *Client) Topup(id []byte) chan error {
 			return
 		}
 		c.Unlock()
-		// we check the balance to check if we need a lightning deposit
-		// get balance and print
-		balance, err := c.cashuClient.GetBalance()
-		if err != nil {
-			c.log.Error("topup cashu, Balance Error:", err)
-			return
-		}
-		if balance.Balance < SATOSHIS_PER_REQUEST {
-			// this should prompt the user to create a lightning invoice
-			// after creating the invoice with cashu.CreateInvoice and displaying to user
-			// it should call cashu.CheckInvoice repeatedly until the invoice is paid
-
-			// c.log.Infof("Balance too low: %d sats, creating Lightning invoice\n", balance.Balance)
-			// invoice_request := cashu.InvoiceRequest{Amount: DEPOSIT_LIGHTNING_SATS}
-			// resp, err := c.cashuClient.CreateInvoice(invoice_request)
-			// if err != nil {
-			// 	c.log.Error("topup cashu, CreateInvoice: %v", err)
-			// 	return
-			// }
-			// c.log.Infof("Invoice: %+v\n", resp.PaymentRequest)
+		// make sure the wallet can pay, but leave it to the gateway to
+		// refuse the session if it can not
+		ctx := context.Background()
+		if err := c.Payment.Topup(ctx); err != nil {
+			c.log.Errorf("topup payment: %v", err)
 		}
-
-		send_request := cashu.SendRequest{Amount: SATOSHIS_PER_REQUEST}
-		send_resp, err := c.cashuClient.SendToken(send_request)
 		nuts := make([]byte, 512)
-		if err != nil {
-			c.log.Error("topup cashu: %v", err)
-			//errCh <- err
-			//return
+		if token, err := c.Payment.Token(ctx, satoshisPerTopup); err != nil {
+			c.log.Errorf("topup payment token: %v", err)
 		} else {
-			// fill nuts with send_resp.Token from beginning
-			copy(nuts, send_resp.Token)
+			copy(nuts, token)
+		}
+
+		// The request ID lets the server recognize a retried topup so
+		// that the token is not redeemed twice.
+		requestID := make([]byte, 16)
+		if _, err := io.ReadFull(rand.Reader, requestID); err != nil {
+			panic(err)
 		}
 
 		// Send a TopupCommand to create a proxy session on the server
-		serialized, err := (&server.TopupCommand{ID: id, Nuts: nuts}).Marshal()
+		serialized, err := (&server.TopupCommand{ID: id, Nuts: nuts, RequestID: requestID}).Marshal()
 		if err != nil {
 			errCh <- err
 			return
@@ -196,8 +494,21 @@ func (c *Client) Topup(id []byte) chan error {
 			return
 		}
 
-		// blocks until reply arrives
-		rawResp, err := c.s.BlockingSendUnreliableMessage(desc.Name, desc.Provider, serialized)
+		// blocks until reply arrives, retrying the identical request if
+		// the reply is lost
+		start := time.Now()
+		var rawResp []byte
+		c.retry(func() bool {
+			rawResp, err = c.blockingSend(id, desc, serialized)
+			if err != client.ErrReplyTimeout {
+				return false
+			}
+			c.log.Debugf("Topup %x timed out, retrying", id)
+			return true
+		})
+		if err == client.ErrReplyTimeout {
+			c.markUnhealthy(desc)
+		}
 		if err != nil {
 			errCh <- err
 			return
@@ -210,14 +521,50 @@ func (c *Client) Topup(id []byte) chan error {
 		}
 		if p.Status != server.TopupSuccess {
 			errCh <- errors.New("Topup failure")
+			return
 		}
+		c.paid(id, start)
 	}()
 	return errCh
 }
 
+// dialError is returned by Dial when the gateway failed to connect to the
+// target, with the SOCKS5 reply code the gateway gave for the failure.
+type dialError struct {
+	reply socks5.ReplyCode
+}
+
+func (e *dialError) Error() string {
+	return fmt.Sprintf("Dial Failed: reply 0x%02x", byte(e.reply))
+}
+
+// replyCode returns the SOCKS5 reply code describing why dialing failed
+// with err.
+func replyCode(err error) socks5.ReplyCode {
+	var dErr *dialError
+	switch {
+	case errors.As(err, &dErr):
+		// gateways that predate DialResponse.Reply leave it zero
+		if dErr.reply == socks5.ReplySucceeded {
+			return socks5.ReplyGeneralFailure
+		}
+		return dErr.reply
+	case errors.Is(err, client.ErrReplyTimeout), errors.Is(err, errConnectTimeout):
+		return socks5.ReplyTTLExpired
+	default:
+		return socks5.ErrorToReplyCode(err)
+	}
+}
+
 // dial sends a DialCommand and returns a channel. err nil means success.
 func (c *Client) Dial(id []byte, tgt *url.URL) chan error {
-	errCh := make(chan error)
+	return c.dial(id, tgt, false)
+}
+
+// dial sends a DialCommand, requesting a multiplexed session if mux is
+// set, which the gateway must confirm.
+func (c *Client) dial(id []byte, tgt *url.URL, mux bool) chan error {
+	errCh := make(chan error, 1)
 	go func() {
 		c.Lock()
 		desc, ok := c.sessionToDesc[string(id)]
@@ -229,7 +576,7 @@ func (c *Client) Dial(id []byte, tgt *url.URL) chan error {
 		c.Unlock()
 
 		defer close(errCh)
-		serialized, err := (&server.DialCommand{ID: id, Target: tgt}).Marshal()
+		serialized, err := (&server.DialCommand{ID: id, Target: tgt, Compress: c.Compress, Mux: mux}).Marshal()
 		if err != nil {
 			panic(err)
 		}
@@ -238,7 +585,7 @@ func (c *Client) Dial(id []byte, tgt *url.URL) chan error {
 		// XXX: do not use blocking client because it serializes all the request/response pairs
 		// so there is no interleaving, which adds a lot of delay..
 		// implement a lower level client using minclient and do not use these blocking methods.
-		rawResp, err := c.s.BlockingSendUnreliableMessage(desc.Name, desc.Provider, serialized) // blocks until reply arrives
+		rawResp, err := c.blockingSend(id, desc, serialized) // blocks until reply arrives
 		if err != nil {
 			errCh <- err
 			return
@@ -250,10 +597,15 @@ func (c *Client) Dial(id []byte, tgt *url.URL) chan error {
 			errCh <- err
 			return
 		}
-		if p.Status == server.DialSuccess {
+		if p.Status == server.DialSuccess && mux && !p.Mux {
+			errCh <- errMuxRefused
+		} else if p.Status == server.DialSuccess {
+			c.Lock()
+			c.compressed[string(id)] = p.Compress
+			c.Unlock()
 			errCh <- nil
 		} else {
-			errCh <- errors.New("Dial Failed")
+			errCh <- &dialError{reply: socks5.ReplyCode(p.Reply)}
 		}
 	}()
 	return errCh
@@ -313,8 +665,7 @@ func (c *Client) Proxy(id []byte, conn net.Conn) (*common.QUICProxyConn, chan er
 	errCh := make(chan error, 3)
 
 	ctx := context.Background()
-	myId := append(id, []byte("client")...)
-	qconn := common.NewQUICProxyConn(myId)
+	qconn := c.newQUICProxyConn(id)
 
 	c.Lock()
 	desc, ok := c.sessionToDesc[string(id)]
@@ -339,6 +690,11 @@ func (c *Client) Proxy(id []byte, conn net.Conn) (*common.QUICProxyConn, chan er
 			errCh <- err
 			return
 		}
+		c.Lock()
+		if c.compressed[string(id)] {
+			proxyConn = common.NewCompressedConn(proxyConn)
+		}
+		c.Unlock()
 
 		var wg sync.WaitGroup
 		wg.Add(2)
@@ -371,41 +727,33 @@ func (c *Client) Proxy(id []byte, conn net.Conn) (*common.QUICProxyConn, chan er
 		errCh <- nil
 	})
 
-	// start a transport worker that receives packets for this qconn
-	c.Go(func() {
-		c.log.Debugf("Started kaetzchen proxy receive worker")
-		defer func() {
-			c.log.Debugf("Event sink worker terminating gracefully.")
-		}()
-		for {
-			select {
-			case e := <-c.s.EventSink:
-				switch event := e.(type) {
-				case *client.MessageReplyEvent:
-					c.Lock()
-					callback, ok := c.msgCallbacks[*event.MessageID]
-					c.Unlock()
-					if ok {
-						callback(event)
-					} else {
-						c.log.Errorf("No callback for ReplyEvent")
-					}
-				case *client.ConnectionStatusEvent:
-					c.log.Notice(event.String())
-				case *client.NewDocumentEvent:
-					// TODO update descriptors, kill sessions that use missing descriptors
-					c.log.Errorf("Got new document, but haven't implemented handlers")
-				}
-			// XXX: restart transport worker on new session
-			//case <-c.s.HaltCh():
-			case <-qconn.HaltCh():
-				return
-			case <-c.HaltCh():
-				return
-			}
-		}
-	})
+	c.transport(id, desc, qconn, errCh)
+	return qconn, errCh
+}
 
+// newQUICProxyConn returns the client end of the QUIC transport of the
+// session id, tuned as configured.
+func (c *Client) newQUICProxyConn(id []byte) *common.QUICProxyConn {
+	myId := append(id, []byte("client")...)
+	qconn := common.NewQUICProxyConn(myId)
+	if c.AdaptiveQUIC {
+		profile := common.SelectQUICProfile(c.pathStatsFor(id))
+		profile.Apply(qconn.Config())
+		c.log.Debugf("Using QUIC profile %s for session %x", profile.Name, id)
+	}
+	if c.QUICTuning != nil {
+		c.QUICTuning.Apply(qconn.Config())
+	}
+	if c.KeepAlive > 0 {
+		qconn.SetKeepAlive(c.KeepAlive)
+	}
+	return qconn
+}
+
+// transport starts the worker that carries the packets of qconn through
+// the mixnet to the gateway of session id until qconn or the Client is
+// halted.  The replies are passed back to qconn by eventWorker.
+func (c *Client) transport(id []byte, desc *utils.ServiceDescriptor, qconn *common.QUICProxyConn, errCh chan error) {
 	// start transport worker that sends packets
 	c.Go(func() {
 		c.log.Debugf("Started kaetzchen proxy send worker")
@@ -498,25 +846,87 @@ func (c *Client) Proxy(id []byte, conn net.Conn) (*common.QUICProxyConn, chan er
 			}
 		}
 	})
-	return qconn, errCh
 }
 
 func (c *Client) SocksHandler(conn net.Conn) {
 	defer conn.Close()
 
-	// Read the client's SOCKS handshake.
-	req, err := socks5.Handshake(conn)
+	// Read the client's SOCKS handshake, giving up if the Client halts.
+	ctx, cancelFn := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-c.HaltCh():
+			cancelFn()
+		case <-ctx.Done():
+		}
+	}()
+	req := socks5.NewRequest(conn)
+	req.CredentialVerifier = c.VerifyCredentials
+	// log each step with the session carrying the connection, once known
+	var rec *AuditRecord
+	req.OnEvent = func(ev socks5.SocksEvent) {
+		session := ""
+		if rec != nil {
+			session = rec.Session
+		}
+		c.log.Debugf("SOCKS %v session=%s", ev, session)
+	}
+	if c.NegotiationTimeout > 0 || c.IdleTimeout > 0 {
+		negotiate := c.NegotiationTimeout
+		if negotiate == 0 {
+			negotiate = socks5.DefaultNegotiationTimeout
+		}
+		req.SetDeadlines(negotiate, c.IdleTimeout)
+	}
+	start := time.Now()
+	err := req.Handshake(ctx)
+	cancelFn()
+	instrument.SocksNegotiation(time.Since(start))
 	if err != nil {
 		c.log.Errorf("client failed socks handshake: %s", err)
 		return
 	}
+	if !c.trackConn(conn) {
+		c.log.Warningf("Refusing connection to %s: the mixnet is unreachable", req.Target)
+		req.Reply(socks5.ReplyGeneralFailure)
+		return
+	}
+	defer c.untrackConn(conn)
+	conn = req.RelayConn()
 
 	c.log.Debugf("Got SOCKS5 request: %v", req)
 
+	source := sourceIP(conn.RemoteAddr())
+	if !c.acquireSource(source) {
+		c.log.Warningf("Rejecting connection from %s: more than %d connections", source, c.MaxConnsPerIP)
+		req.Reply(socks5.ReplyConnectionNotAllowed)
+		return
+	}
+	defer c.releaseSource(source)
+
+	// the gateways can not listen or resolve on behalf of the client
+	switch req.Command {
+	case socks5.BindCmd, socks5.ResolveCmd, socks5.ResolvePtrCmd:
+		c.log.Warningf("Rejecting unsupported command 0x%02x for %s", req.Command, req.Target)
+		req.Reply(socks5.ReplyCommandNotSupported)
+		return
+	}
+
+	// the target of a UDP ASSOCIATE is the address the client sends
+	// from, the policy is applied to each of its datagrams instead
+	if req.Command != socks5.UDPAssociateCmd {
+		host, _, err := net.SplitHostPort(req.Target)
+		if err != nil || !c.allows(host) {
+			c.log.Warningf("Rejecting connection to %s: not allowed by policy", req.Target)
+			req.Reply(socks5.ReplyConnectionNotAllowed)
+			return
+		}
+	}
+
 	// Extract the Target address
 	var target string
 
-	if req.Conn != nil {
+	if req.Command == socks5.UDPAssociateCmd {
 		target = "udp://" + req.Target
 	} else {
 		target = "tcp://" + req.Target
@@ -527,33 +937,115 @@ func (c *Client) SocksHandler(conn net.Conn) {
 		return
 	}
 
-	id, err := c.NewSession()
-	if err != nil {
-		c.log.Errorf("NewSession failure: %v", err)
-		return
+	rec = &AuditRecord{Time: time.Now(), User: auditUser(req), Target: target}
+	defer c.audit(rec)
+
+	isolation := ""
+	if c.IsolateSOCKSAuth {
+		isolation = req.Username
 	}
 
-	// send a topup command to create a session
-	err = <-c.Topup(id)
+	if c.DNSOverMix && req.Command != socks5.UDPAssociateCmd {
+		ctx, cancelFn := context.WithTimeout(context.Background(), DefaultDNSTimeout)
+		err := c.resolveTarget(ctx, tgtURL, isolation)
+		cancelFn()
+		if err != nil {
+			c.log.Errorf("Failed to resolve %v: %v", tgtURL, err)
+			rec.Outcome = OutcomeDialFailed
+			req.Reply(replyCode(err))
+			return
+		}
+		// the policy applies to the address the name resolved to as well
+		if !c.allows(tgtURL.Hostname()) {
+			c.log.Warningf("Rejecting connection to %s at %s: not allowed by policy", req.Target, tgtURL.Host)
+			rec.Outcome = OutcomeRejected
+			req.Reply(socks5.ReplyConnectionNotAllowed)
+			return
+		}
+	}
+	req.CoerceIPv4 = c.CoerceIPv4
+
+	// bound the round trips to set up the connection
+	connectCtx, cancelConnect := c.connectContext(context.Background())
+	defer cancelConnect()
+
+	gateway := c.gatewayHint(req.Args)
+
+	// carry the connection over a shared circuit, if a gateway can
+	if c.Multiplex && tgtURL.Scheme == "tcp" {
+		ci, err := c.circuitWithin(connectCtx, tgtURL, isolation, gateway)
+		switch err {
+		case nil:
+			c.proxyStream(connectCtx, ci, req, conn, tgtURL, rec)
+			return
+		case errNoCircuit:
+			c.log.Debugf("No multiplexing gateway for %v, building a circuit", tgtURL)
+		case errConnectTimeout:
+			c.log.Errorf("Timed out building a circuit for %v", tgtURL)
+			rec.Outcome = OutcomeTimeout
+			req.Reply(socks5.ReplyTTLExpired)
+			return
+		default:
+			c.log.Errorf("Failed to build circuit: %v", err)
+			rec.Outcome = OutcomeNoGateway
+			req.Reply(socks5.ReplyNetworkUnreachable)
+			return
+		}
+	}
+
+	// send a topup command to create a session, moving on to the next
+	// gateway while the selected one is unresponsive
+	var id []byte
+	for {
+		id, err = c.newSession(isolation, gateway, TargetCapabilities(tgtURL)...)
+		if err != nil {
+			c.log.Errorf("NewSession failure: %v", err)
+			rec.Outcome = OutcomeNoGateway
+			if errors.Is(err, errNoCapableGateway) {
+				req.Reply(socks5.ReplyConnectionNotAllowed)
+			}
+			return
+		}
+		rec.Session = fmt.Sprintf("%x", id)
+		c.TagSession(id, req.Args)
+		if err = awaitConnect(connectCtx, c.Topup(id)); err != client.ErrReplyTimeout {
+			break
+		}
+	}
+	if err == errConnectTimeout {
+		c.log.Errorf("Timed out topping up session %x", id)
+		rec.Outcome = OutcomeTimeout
+		req.Reply(socks5.ReplyTTLExpired)
+		return
+	}
 	if err != nil {
 		// XXX: on an error, send Cashu to self or unmark as pending
 		// if a malicious service takes the money and runs
 		// XXX: debug
 		c.log.Errorf("Failed to topup session %v: %v", id, err)
+		rec.Outcome = OutcomeTopupFailed
 		req.Reply(socks5.ReplyNetworkUnreachable)
 		return
 	}
 
 	// if the request is a UDPAssociate command, start a local UDP listener
 	if req.Command == socks5.UDPAssociateCmd {
-		req.Conn = socks5.ListenUDP()
+		req.Conn = req.BindUDP()
 	}
 
 	// dial the target // add to our conneciton map
-	err = <-c.Dial(id, tgtURL)
+	err = awaitConnect(connectCtx, c.Dial(id, tgtURL))
 
 	if err != nil {
-		c.log.Errorf("Failed to dial %v", tgtURL)
+		c.log.Errorf("Failed to dial %v: %v", tgtURL, err)
+		rec.Outcome = OutcomeDialFailed
+		if err == errConnectTimeout {
+			rec.Outcome = OutcomeTimeout
+		}
+		req.Reply(replyCode(err))
+		if req.Conn != nil {
+			req.Conn.Close()
+		}
 		return
 	}
 
@@ -566,19 +1058,45 @@ func (c *Client) SocksHandler(conn net.Conn) {
 		return
 	}
 
-	// start proxying data
-	qconn, errCh := c.Proxy(id, conn)
+	// start proxying data, which for UDP ASSOCIATE are the datagrams of
+	// the relay socket, for as long as the SOCKS connection lasts
+	relayed := conn
+	if req.Command == socks5.UDPAssociateCmd {
+		relay := newUDPRelay(req.Conn.(net.PacketConn), c.log, c.allows)
+		go func() {
+			io.Copy(io.Discard, conn)
+			relay.Close()
+		}()
+		relayed = relay
+	}
+	counted := &countingConn{Conn: relayed, session: c.countSession(id)}
+	defer c.uncountSession(id)
+	qconn, errCh := c.Proxy(id, counted)
 
 	// consume all errors
+	rec.Outcome = OutcomeSucceeded
 	for err := range errCh {
 		if err != nil {
 			c.log.Errorf("Proxy returned error: %v", err)
+			rec.Outcome = OutcomeProxyFailed
 			err = qconn.Close()
 			if err != nil {
 				c.log.Errorf("QUICProxyConn.Close failed with error: %v", err)
 			}
 		}
 	}
+	rec.BytesSent, rec.BytesReceived = counted.read.Load(), counted.written.Load()
+	c.log.Infof("Session %x to %v finished, tags: %v", id, tgtURL, req.Args)
+}
+
+// audit writes rec to the audit log, if there is one.
+func (c *Client) audit(rec *AuditRecord) {
+	if c.Audit == nil {
+		return
+	}
+	if err := c.Audit.Log(rec); err != nil {
+		c.log.Errorf("Failed to write audit record: %v", err)
+	}
 }
 
 // GetGateways returns the set of gateway services
@@ -605,6 +1123,7 @@ func (c *Client) SetGateway(provider string) error {
 		if desc.Provider == provider {
 			c.Lock()
 			c.desc = &desc
+			c.pinned = provider
 			c.Unlock()
 			return nil
 		}
@@ -612,31 +1131,150 @@ func (c *Client) SetGateway(provider string) error {
 	return errors.New("Gateway not found")
 }
 
-func (c *Client) NewSession() ([]byte, error) {
-	id := make([]byte, 32)
-	_, err := io.ReadFull(rand.Reader, id)
-	if err != nil {
-		panic(err)
+// updateGateways replaces the gateways new sessions are set up with by
+// those of doc.  If the gateway set with SetGateway is dropped, gateways
+// are selected as if none was set until it is published again.  Existing
+// sessions are left to finish with their gateways.  It is called by
+// eventWorker for every new document, whether or not a tunnel is open.
+func (c *Client) updateGateways(doc *pki.Document) {
+	found := utils.FindServices("katzensocks", doc)
+	descs := make([]*utils.ServiceDescriptor, 0, len(found))
+	published := make(map[string]*utils.ServiceDescriptor)
+	for i := range found {
+		descs = append(descs, &found[i])
+		published[found[i].Provider] = &found[i]
 	}
-	sessionID := string(id)
 
-	// map the id to the selected exit descriptor
 	c.Lock()
-	if _, ok := c.sessionToDesc[sessionID]; !ok {
-		if len(c.descs) == 0 {
-			return nil, errNoGatewayDescriptor
-		}
-		if c.desc != nil {
-			c.sessionToDesc[sessionID] = c.desc
-		} else {
-			m := rand.NewMath()
-			i := m.Intn(len(c.descs))
-			c.sessionToDesc[sessionID] = c.descs[i]
-			c.log.Debugf("Added session %x", sessionID)
+	defer c.Unlock()
+	for _, desc := range c.descs {
+		if _, ok := published[desc.Provider]; !ok {
+			c.log.Noticef("Gateway %s was dropped in epoch %d", desc.Provider, doc.Epoch)
 		}
 	}
+	c.descs = descs
+	if c.pinned == "" {
+		return
+	}
+	desc, ok := published[c.pinned]
+	switch {
+	case ok && c.desc == nil:
+		c.log.Noticef("Gateway %s is published again, using it for new sessions", c.pinned)
+	case !ok && c.desc != nil:
+		c.log.Warningf("Gateway %s was dropped, selecting another for new sessions", c.pinned)
+	}
+	c.desc = desc
+}
+
+// NewSession creates a new session id and maps it to a gateway that offers
+// the required capabilities in addition to the RequiredCapabilities of the
+// Client.  The gateway set with SetGateway is used if it is capable.
+func (c *Client) NewSession(required ...Capability) ([]byte, error) {
+	return c.newSession("", "", required...)
+}
+
+// newSession is NewSession for connections of the isolation key, preferring
+// gateway, if set, to the gateway set with SetGateway.
+func (c *Client) newSession(isolation, gateway string, required ...Capability) ([]byte, error) {
+	// map a new id to the selected exit descriptor
+	c.Lock()
+	required = append(required, c.RequiredCapabilities...)
+	descs, preferred := c.candidatesFor(gateway)
+	desc, err := selectGateway(descs, preferred, required, c.GatewaySelector)
+	if err != nil {
+		c.Unlock()
+		return nil, err
+	}
+	id := c.sessionID(desc, isolation)
+	c.addSession(string(id), desc)
 	c.Unlock()
+	c.gatewaySelected(id, desc)
 	return id, nil
 }
 
-// GetSessions returns the set of active sessions
+// newSessionTo creates a new session id, for connections of the isolation
+// key, mapped to the gateway desc.
+func (c *Client) newSessionTo(desc *utils.ServiceDescriptor, isolation string) []byte {
+	c.Lock()
+	id := c.sessionID(desc, isolation)
+	c.addSession(string(id), desc)
+	c.Unlock()
+	c.gatewaySelected(id, desc)
+	return id
+}
+
+// addSession maps the new session id to the gateway desc.  The caller
+// must hold the Client lock.
+func (c *Client) addSession(id string, desc *utils.ServiceDescriptor) {
+	c.sessionToDesc[id] = desc
+	if c.sessionCreated == nil {
+		c.sessionCreated = make(map[string]time.Time)
+	}
+	c.sessionCreated[id] = time.Now()
+	c.touchSession(id)
+	c.stats.SessionsCreated++
+	instrument.SessionCreated()
+	c.log.Debugf("Added session %x", id)
+}
+
+// gatewaySelected reports that the new session id is carried by the
+// gateway desc, in the log and to OnGatewaySelected.
+func (c *Client) gatewaySelected(id []byte, desc *utils.ServiceDescriptor) {
+	c.log.Infof("gateway_selected session_id=%x gateway_name=%s", id, desc.Provider)
+	if c.OnGatewaySelected != nil {
+		c.OnGatewaySelected(id, desc.Provider)
+	}
+}
+
+// SessionInfo describes a session of the Client.
+type SessionInfo struct {
+	ID       []byte
+	Provider string
+	Created  time.Time
+
+	// BytesSent and BytesReceived are the bytes the session relayed to
+	// and from the targets.
+	BytesSent     int64
+	BytesReceived int64
+
+	// Tags is opaque application metadata, such as the app name, user or
+	// purpose of the session.
+	Tags map[string]string
+}
+
+// TagSession attaches application metadata to the session id.
+func (c *Client) TagSession(id []byte, tags map[string]string) {
+	c.Lock()
+	defer c.Unlock()
+	if c.sessionTags == nil {
+		c.sessionTags = make(map[string]map[string]string)
+	}
+	t := make(map[string]string, len(tags))
+	for k, v := range tags {
+		t[k] = v
+	}
+	c.sessionTags[string(id)] = t
+}
+
+// Sessions returns the set of active sessions
+func (c *Client) Sessions() []SessionInfo {
+	c.Lock()
+	defer c.Unlock()
+	sessions := make([]SessionInfo, 0, len(c.sessionToDesc))
+	for id, desc := range c.sessionToDesc {
+		bytes := c.sessionTotals[id]
+		if sc, ok := c.sessionCounters[id]; ok {
+			bytes.BytesSent += sc.sent.Load()
+			bytes.BytesReceived += sc.received.Load()
+		}
+		sessions = append(sessions, SessionInfo{
+			ID:            []byte(id),
+			Provider:      desc.Provider,
+			Created:       c.sessionCreated[id],
+			BytesSent:     bytes.BytesSent,
+			BytesReceived: bytes.BytesReceived,
+			Tags:          c.sessionTags[id],
+		})
+	}
+	return sessions
+}
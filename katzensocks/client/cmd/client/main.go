@@ -1,34 +1,151 @@
 package main
 
 import (
-	"github.com/katzenpost/katzenpost/katzensocks/client"
+	"github.com/katzenpost/katzenpost/client/config"
 	"github.com/katzenpost/katzenpost/client/utils"
+	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/katzensocks/client"
+	"github.com/katzenpost/katzenpost/katzensocks/client/internal/instrument"
+	"github.com/katzenpost/katzenpost/katzensocks/common"
+	kquic "github.com/katzenpost/katzenpost/quic"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
 
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"context"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 var (
-	cfgFile = flag.String("cfg", "katzensocks.toml", "config file")
-	gateway = flag.String("gw", "", "gateway provider name, default uses random gateway for each connection")
-	pkiOnly = flag.Bool("list", false, "fetch and display pki and gateways, does not connect")
-	port    = flag.Int("port", 4242, "listener address")
-	retry   = flag.Int("retry", -1, "limit number of reconnection attempts")
-	delay   = flag.Int("delay", 30, "time to wait between connection attempts (seconds)>")
+	cfgFile          = flag.String("cfg", "katzensocks.toml", "config file")
+	profile          = flag.String("profile", "", "use the bind, port, gateway and retry settings of the [profiles.NAME] table of the config file, unless given as flags")
+	gateway          = flag.String("gw", "", "gateway provider name, default selects a gateway for each connection by gw-policy; SOCKS clients may select one per connection with the username gw=NAME")
+	gwCooldown       = flag.Duration("gw-cooldown", client.DefaultGatewayCooldown, "avoid a gateway for this long after it stops responding")
+	gwPolicy         = flag.String("gw-policy", "random", "how gateways are selected for each connection: random, round_robin or lowest_latency")
+	dataDir          = flag.String("data-dir", "", "directory to cache the PKI document in, so that it is reused across restarts within its epoch, and to keep the stable session id secret in")
+	pkiOnly          = flag.Bool("list", false, "fetch and display pki and gateways, does not connect")
+	listJSON         = flag.Bool("list-json", false, "fetch the pki and print a summary of it and the gateways as JSON, does not connect")
+	probe            = flag.Bool("probe", false, "connect, measure the round trip time to each gateway, print them and exit")
+	check            = flag.Bool("check", false, "validate the config file, gateway and listener flags, print a report and exit")
+	port             = flag.Int("port", 4242, "listener address")
+	httpConnect      = flag.Int("httpconnect", 0, "also serve an HTTP CONNECT proxy on this port of the bind address (0 disables)")
+	socksTLSCert     = flag.String("socks-tls-cert", "", "serve SOCKS over TLS with the certificate in this PEM file (requires socks-tls-key)")
+	socksTLSKey      = flag.String("socks-tls-key", "", "key in PEM of the socks-tls-cert certificate")
+	bind             = flag.String("bind", client.DefaultBindAddress, "SOCKS listener IP address, with or without a port, or unix:///path/to/socket")
+	socksBind        = flag.String("socks-bind", "", "SOCKS listener address, overriding bind")
+	httpConnectBind  = flag.String("httpconnect-bind", "", "HTTP CONNECT proxy IP address, with or without a port, overriding bind")
+	http3Port        = flag.Int("http3", 0, "also serve an HTTP/3 CONNECT proxy on this UDP port of the bind address (0 disables, unless systemd passes the UDP socket as fd 4)")
+	http3Bind        = flag.String("http3-bind", "", "HTTP/3 CONNECT proxy IP address, with or without a port, overriding bind")
+	http3Cert        = flag.String("http3-cert", "", "serve HTTP/3 with the certificate in this PEM file, whose SPKI pin is printed at startup for clients to pin, rather than with one generated at each start (requires http3-key)")
+	http3Key         = flag.String("http3-key", "", "key in PEM of the http3-cert certificate")
+	retry            = flag.Int("retry", -1, "limit number of reconnection attempts")
+	delay            = flag.Int("delay", 30, "time to wait before the first reconnection attempt (seconds)")
+	backoffMax       = flag.Duration("backoff-max", 10*time.Minute, "longest time to wait between connection attempts")
+	backoffFactor    = flag.Float64("backoff-factor", 2, "multiply the wait between connection attempts by this after each attempt")
+	quicIdleTimeout  = flag.Duration("quic-max-idle-timeout", common.DefaultMaxIdleTimeout, "close QUIC tunnels and HTTP/3 proxy connections idle for this long")
+	quicStreamWindow = flag.Uint64("quic-stream-window", common.DefaultInitialStreamReceiveWindow, "initial QUIC stream receive window in bytes")
+	quicMaxStreams   = flag.Int64("quic-max-streams", common.DefaultMaxIncomingStreams, "limit concurrent incoming QUIC streams")
+	adaptive         = flag.Bool("adaptive-quic", false, "select QUIC parameters from round trips measured at session setup")
+	coerce4          = flag.Bool("socks-ipv4-reply", false, "always send an IPv4 bound address in SOCKS5 replies")
+	compress         = flag.Bool("compress", false, "compress proxied streams, if the gateway supports it")
+	multiplex        = flag.Bool("multiplex", false, "carry TCP connections to a gateway over one shared circuit, if the gateway supports it")
+	stableIDs        = flag.Bool("stable-session-ids", false, "derive session ids from the gateway, SOCKS isolation and epoch, keyed with a secret kept in data-dir, so reconnections can be correlated in the logs, which the gateway can also do")
+	isolateAuth      = flag.Bool("isolate-socks-auth", false, "only share multiplexed circuits between connections with the same SOCKS username")
+	negotiateTimeout = flag.Duration("socks-negotiate-timeout", 0, "time a SOCKS client has to complete its handshake (0 is the default of 5s)")
+	connectTimeout   = flag.Duration("connect-timeout", 0, "answer SOCKS requests not connected through the mixnet within this long with TTL expired, e.g. 60s (0 waits indefinitely)")
+	idleTimeout      = flag.Duration("socks-idle-timeout", 0, "close SOCKS connections idle for this long (0 disables)")
+	keepalive        = flag.Duration("keepalive", 0, "send keepalives on tunnels idle for this long, e.g. 30s (0 disables)")
+	auditLog         = flag.String("audit-log", "", "append a record of every SOCKS connection to this file")
+	auditRedact      = flag.Bool("audit-redact", false, "omit target hosts from the audit log")
+	rateUp           = flag.Int64("rate-up", 0, "limit the bytes per second each session sends to its targets (0 is unlimited)")
+	rateDown         = flag.Int64("rate-down", 0, "limit the bytes per second each session receives from its targets (0 is unlimited)")
+	maxPerIP         = flag.Int("maxconns-per-ip", 0, "limit concurrent SOCKS connections from each source IP (0 is unlimited)")
+	maxConns         = flag.Int("maxconns", 0, "limit concurrent SOCKS connections, refusing any more (0 is unlimited)")
+	topupThreshold   = flag.Duration("topup-threshold", client.DefaultTopupThreshold, "top up sessions relaying connections this long before they run out (0 disables)")
+	sessionTTL       = flag.Duration("session-ttl", 0, "evict sessions idle for this long, e.g. 10m (0 disables)")
+	drainTimeout     = flag.Duration("drain-timeout", client.DefaultDrainTimeout, "on SIGINT or SIGTERM, time given to connections in flight to finish before they are reset")
+	failClosed       = flag.Bool("fail-closed", false, "reset SOCKS connections when the mixnet connection is lost, and refuse new ones until it is restored")
+	logLevel         = flag.String("log-level", "", "log level: ERROR, WARNING, NOTICE, INFO or DEBUG (default is the config file Logging Level, or NOTICE)")
+	logFile          = flag.String("log-file", "", "append logs to this file (default is the config file Logging File, or stderr)")
+	metricsAddr      = flag.String("metrics-addr", "", "serve prometheus metrics at http://<metrics-addr>/metrics, e.g. 127.0.0.1:4244")
+	healthAddr       = flag.String("health-addr", "", "serve readiness at http://<health-addr>/ready, 200 only while connected to the mixnet, and liveness at /live")
+	adminAddr        = flag.String("admin-addr", "", "serve the active sessions as JSON at http://<admin-addr>/sessions, on a loopback address only, e.g. 127.0.0.1:4245")
+	pacAddr          = flag.String("pac-addr", "", "serve a proxy auto-config file for browsers at http://<pac-addr>/proxy.pac, sending the destinations not allowed by the policy DIRECT")
+	statsAddr        = flag.String("stats-addr", "", "serve statistics as JSON at http://<stats-addr>/stats, e.g. 127.0.0.1:4243")
+	dnsOverMix       = flag.Bool("dns-over-mix", false, "resolve target host names through the mixnet rather than at the gateway (requires a gateway that supports mux)")
+	dnsResolver      = flag.String("dns-resolver", client.DefaultDNSResolver, "DNS server queried by dns-over-mix")
+	policyFile       = flag.String("policy", "", "file of destination CIDRs and host name globs, one per line, reloaded on SIGHUP")
+	policyMode       = flag.String("policy-mode", string(client.PolicyBlock), "whether the policy file lists the allowed (allow) or blocked (block) destinations")
+	require          = flag.String("require", "", "comma separated gateway capabilities to require (tcp, udp, ipv6, dns, mux)")
 )
 
-func showPKI() {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*delay) * time.Second)
+// loadConfig loads the config file with the logging of the log flags, and
+// sets the flags that were not given on the command line from the selected
+// profile.
+func loadConfig() (*config.Config, error) {
+	cfg, p, err := client.LoadProfile(*cfgFile, *profile)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.SetLogging(cfg, *logLevel, *logFile); err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return cfg, nil
+	}
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if p.Bind != "" && !set["bind"] {
+		*bind = p.Bind
+	}
+	if p.Port != 0 && !set["port"] {
+		*port = p.Port
+	}
+	if p.Gateway != "" && !set["gw"] {
+		*gateway = p.Gateway
+	}
+	if p.Retry != nil && !set["retry"] {
+		*retry = *p.Retry
+	}
+	if p.Delay != nil && !set["delay"] {
+		*delay = *p.Delay
+	}
+	return cfg, nil
+}
+
+func showPKI(cfg *config.Config) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*delay)*time.Second)
 	defer cancel()
 
-	_, doc, err := client.GetPKI(ctx, *cfgFile)
+	var doc *pki.Document
+	var err error
+	if *dataDir != "" {
+		_, doc, err = client.GetPKIFromConfigWithCache(ctx, cfg, filepath.Join(*dataDir, client.PKICacheFile))
+	} else {
+		_, doc, err = client.GetPKIFromConfig(ctx, cfg)
+	}
 	if err != nil {
 		panic(err)
 	}
+	if *listJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(client.SummarizePKI(doc)); err != nil {
+			panic(err)
+		}
+		return
+	}
 	// display the pki.Document
 	fmt.Println(doc.String())
 
@@ -39,18 +156,364 @@ func showPKI() {
 	}
 }
 
+// showProbes connects to the mixnet and prints the round trip time to
+// each gateway, fastest first.
+func showProbes(cfg *config.Config) {
+	s, err := client.GetSessionFromConfig(cfg, *delay, *retry)
+	if err != nil {
+		panic(err)
+	}
+	c, err := client.NewClient(s)
+	if err != nil {
+		panic(err)
+	}
+	for _, p := range c.ProbeGateways() {
+		if p.Err != nil {
+			fmt.Printf("%s\tunreachable: %v\n", p.Provider, p.Err)
+			continue
+		}
+		fmt.Printf("%s\t%v\n", p.Provider, p.RTT.Round(time.Millisecond))
+	}
+}
+
+// checkConfig prints a report of the config file, the gateway and the
+// listen addresses, and exits with status 1 if any is invalid.
+func checkConfig() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*delay)*time.Second)
+	defer cancel()
+
+	// the profile sets the flags checked below
+	report := client.CheckReport{}
+	if *profile != "" {
+		_, err := loadConfig()
+		report = append(report, client.CheckResult{Name: "profile", Detail: "using " + *profile, Err: err})
+	}
+	report = append(report, client.CheckConfig(ctx, *cfgFile, *gateway)...)
+	addr, err := socksAddress()
+	report = append(report, client.CheckResult{Name: "bind", Detail: addr, Err: err})
+	httpAddr := ""
+	if err == nil && *httpConnect != 0 {
+		httpAddr, err = httpConnectAddress()
+		report = append(report, client.CheckResult{Name: "httpconnect", Detail: httpAddr, Err: err})
+	}
+	http3Addr := ""
+	if err == nil && *http3Port != 0 {
+		http3Addr, err = http3Address()
+		report = append(report, client.CheckResult{Name: "http3", Detail: http3Addr, Err: err})
+	}
+	if err == nil {
+		report = append(report, client.CheckListeners(map[string]string{
+			"bind": addr, "httpconnect": httpAddr, "http3": http3Addr, "stats-addr": *statsAddr, "admin-addr": *adminAddr, "health-addr": *healthAddr, "metrics-addr": *metricsAddr, "pac-addr": *pacAddr,
+		}))
+	}
+	report.WriteTo(os.Stdout)
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
+
+// socksAddress returns the address of the SOCKS listener, which is the
+// socks-bind flag, or else the bind flag, with the port flag unless it
+// has a port.
+func socksAddress() (string, error) {
+	if *socksBind != "" {
+		return client.BindAddress(*socksBind, *port)
+	}
+	return client.BindAddress(*bind, *port)
+}
+
+// httpConnectAddress returns the address of the HTTP CONNECT proxy.
+func httpConnectAddress() (string, error) {
+	return proxyAddress("httpconnect-bind", *httpConnectBind, *httpConnect)
+}
+
+// http3Address returns the address of the HTTP/3 CONNECT proxy.
+func http3Address() (string, error) {
+	return proxyAddress("http3-bind", *http3Bind, *http3Port)
+}
+
+// proxyAddress returns the address of a proxy listening on port, which is
+// the override address of the named flag, with port unless it has a port.
+// Otherwise it is port on the IP address of the bind flag, or on the
+// default bind address if the bind flag is a Unix socket.
+func proxyAddress(name, override string, port int) (string, error) {
+	if override != "" {
+		if strings.HasPrefix(override, "unix://") {
+			return "", fmt.Errorf("%s %s: the proxy can not listen on a Unix socket", name, override)
+		}
+		return client.BindAddress(override, port)
+	}
+	addr, err := client.BindAddress(*bind, port)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(addr, "unix://") {
+		return client.BindAddress(client.DefaultBindAddress, port)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// checkBinds validates the addresses of the SOCKS listener and the HTTP
+// and HTTP/3 CONNECT proxies, which must not collide.
+func checkBinds() error {
+	socksAddr, err := socksAddress()
+	if err != nil {
+		return err
+	}
+	addrs := map[string]string{"socks-bind": socksAddr}
+	if *httpConnect != 0 {
+		if addrs["httpconnect-bind"], err = httpConnectAddress(); err != nil {
+			return err
+		}
+	}
+	if *http3Port != 0 {
+		if addrs["http3-bind"], err = http3Address(); err != nil {
+			return err
+		}
+	}
+	return client.CheckListeners(addrs).Err
+}
+
+// reloadPolicy reloads the policy file into c on every SIGHUP, keeping
+// the current policy if the file is invalid.
+func reloadPolicy(c *client.Client) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		policy, err := client.LoadPolicy(*policyFile, client.PolicyMode(*policyMode))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "keeping the current policy: %v\n", err)
+			continue
+		}
+		c.SetPolicy(policy)
+	}
+}
+
+// drainOnSignal waits for SIGINT or SIGTERM, then drains the SOCKS and
+// HTTP CONNECT listeners together, giving the connections in flight up to
+// drain-timeout to finish.  The HTTP/3 proxy refuses new tunnels and
+// requests while draining, and is closed once those in flight are drained.
+func drainOnSignal(c *client.Client, httpServer *http.Server, http3Server *http3.Server) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+	signal.Stop(stop)
+	ctx, cancelFn := context.WithTimeout(context.Background(), *drainTimeout)
+	defer cancelFn()
+
+	var wg sync.WaitGroup
+	if httpServer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := httpServer.Shutdown(ctx); err != nil {
+				fmt.Fprintf(os.Stderr, "HTTP CONNECT proxy did not drain: %v\n", err)
+			}
+		}()
+	}
+	if err := c.Drain(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "connections did not drain: %v\n", err)
+	}
+	wg.Wait()
+	if http3Server != nil {
+		http3Server.Close()
+	}
+}
+
+// systemdSockets returns the SOCKS listener and the HTTP/3 UDP socket
+// passed by systemd socket activation as fd 3 and fd 4, either of which is
+// nil if it was not passed.  More sockets than that are an error.
+func systemdSockets() (socks, udp *os.File, err error) {
+	files, err := client.SystemdFiles()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(files) > 2 {
+		for _, f := range files {
+			f.Close()
+		}
+		return nil, nil, fmt.Errorf("systemd passed %d sockets, only the SOCKS listener (fd 3) and the HTTP/3 UDP socket (fd 4) are supported", len(files))
+	}
+	if len(files) > 0 {
+		socks = files[0]
+	}
+	if len(files) > 1 {
+		udp = files[1]
+	}
+	return socks, udp, nil
+}
+
+// socksListener returns the SOCKS listener, wrapped in TLS if the
+// socks-tls flags are set.
+func socksListener(f *os.File) (net.Listener, error) {
+	ln, err := plainSOCKSListener(f)
+	if err != nil || (*socksTLSCert == "" && *socksTLSKey == "") {
+		return ln, err
+	}
+	tlsLn, err := client.ListenTLS(ln, *socksTLSCert, *socksTLSKey)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return tlsLn, nil
+}
+
+// plainSOCKSListener returns the SOCKS listener of the socket f passed by
+// systemd, or else listens on the socksAddress.
+func plainSOCKSListener(f *os.File) (net.Listener, error) {
+	if f == nil {
+		addr, err := socksAddress()
+		if err != nil {
+			return nil, err
+		}
+		return client.ListenSOCKS(addr)
+	}
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// quicTuning returns the QUIC parameters of the quic flags, whose defaults
+// are raised from those of quic-go (30s, 512KiB and 100) for the round
+// trips of the mixnet.  Unless all is set, only the flags given on the
+// command line are included, so that the tunnels keep the same defaults
+// from common.NewQUICProxyConn without overriding an adaptive profile.
+func quicTuning(all bool) *common.QUICProfile {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	p := &common.QUICProfile{Name: "flags"}
+	if all || set["quic-max-idle-timeout"] {
+		p.MaxIdleTimeout = *quicIdleTimeout
+	}
+	if all || set["quic-stream-window"] {
+		p.InitialStreamReceiveWindow = *quicStreamWindow
+	}
+	if all || set["quic-max-streams"] {
+		p.MaxIncomingStreams = *quicMaxStreams
+	}
+	return p
+}
+
+// listenQUIC returns the HTTP/3 CONNECT proxy of c and the UDP socket for
+// it to serve, which is the socket f passed by systemd, or else one bound
+// to http3Address.  The certificate of the http3-cert flag is used if it
+// is set, and its SPKI pin is printed for clients to verify the proxy
+// with, e.g. curl --pinnedpubkey.
+func listenQUIC(c *client.Client, f *os.File) (*http3.Server, net.PacketConn, error) {
+	tlsConf := kquic.GenerateTLSConfig()
+	persistent := *http3Cert != "" || *http3Key != ""
+	if persistent {
+		var err error
+		if tlsConf, err = kquic.LoadTLSConfig(*http3Cert, *http3Key); err != nil {
+			return nil, nil, err
+		}
+	}
+	pin, err := kquic.SPKIPin(tlsConf)
+	if err != nil {
+		return nil, nil, err
+	}
+	var conn net.PacketConn
+	if f != nil {
+		defer f.Close()
+		conn, err = net.FilePacketConn(f)
+	} else {
+		var addr string
+		if addr, err = http3Address(); err != nil {
+			return nil, nil, err
+		}
+		conn, err = net.ListenPacket("udp", addr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	quicConf := new(quic.Config)
+	quicTuning(true).Apply(quicConf)
+
+	note := ""
+	if !persistent {
+		note = ", which changes at each start unless http3-cert is set"
+	}
+	fmt.Fprintf(os.Stderr, "HTTP/3 CONNECT proxy on %s, certificate pin %s%s\n", conn.LocalAddr(), pin, note)
+	return &http3.Server{Handler: c.HTTPConnectHandler(), TLSConfig: tlsConf, QuicConfig: quicConf}, conn, nil
+}
+
+// servePAC serves the proxy auto-config file at pac-addr, naming the SOCKS
+// listener ln unless browsers can not use it, and the HTTP CONNECT proxy.
+func servePAC(c *client.Client, ln net.Listener) {
+	socksAddr := ""
+	if _, ok := ln.Addr().(*net.TCPAddr); ok && *socksTLSCert == "" {
+		socksAddr = ln.Addr().String()
+	}
+	httpAddr := ""
+	if *httpConnect != 0 {
+		var err error
+		if httpAddr, err = httpConnectAddress(); err != nil {
+			fmt.Fprintf(os.Stderr, "PAC endpoint failed: %v\n", err)
+			return
+		}
+	}
+	if socksAddr == "" && httpAddr == "" {
+		fmt.Fprintf(os.Stderr, "PAC endpoint failed: no listener usable by browsers\n")
+		return
+	}
+	if err := http.ListenAndServe(*pacAddr, c.PACHandler(socksAddr, httpAddr)); err != nil {
+		fmt.Fprintf(os.Stderr, "PAC endpoint failed: %v\n", err)
+	}
+}
+
 func main() {
 	flag.Parse()
-	if *pkiOnly {
-		showPKI()
+	if *check {
+		checkConfig()
 		return
 	}
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
+	cfg, err := loadConfig()
 	if err != nil {
 		panic(err)
 	}
+	if *pkiOnly || *listJSON {
+		showPKI(cfg)
+		return
+	}
+	if *probe {
+		showProbes(cfg)
+		return
+	}
+	if err := checkBinds(); err != nil {
+		panic(err)
+	}
+	socksFile, quicFile, err := systemdSockets()
+	if err != nil {
+		panic(err)
+	}
+	ln, err := socksListener(socksFile)
+	if err != nil {
+		panic(err)
+	}
+
+	// report not ready until the session is set up
+	readiness := new(client.Readiness)
+	if *healthAddr != "" {
+		go func() {
+			if err := http.ListenAndServe(*healthAddr, readiness.Handler()); err != nil {
+				fmt.Fprintf(os.Stderr, "health endpoint failed: %v\n", err)
+			}
+		}()
+	}
 
-	s, err := client.GetSession(*cfgFile, *delay, *retry)
+	// back off exponentially, with jitter, so that clients do not retry
+	// in lockstep
+	policy := client.RetryPolicy{
+		MaxRetries: *retry,
+		Delay:      time.Duration(*delay) * time.Second,
+		Multiplier: *backoffFactor,
+		MaxDelay:   *backoffMax,
+		Jitter:     true,
+	}
+	s, err := client.GetSessionFromConfigWithRetryPolicy(cfg, func() client.RetryPolicy { return policy })
 	if err != nil {
 		panic(err)
 	}
@@ -59,35 +522,137 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	readiness.SetClient(c)
+	c.AdaptiveQUIC = *adaptive
+	c.QUICTuning = quicTuning(false)
+	c.CoerceIPv4 = *coerce4
+	c.RequiredCapabilities = client.ParseCapabilities(*require)
+	c.Compress = *compress
+	c.KeepAlive = *keepalive
+	c.Multiplex = *multiplex
+	c.IsolateSOCKSAuth = *isolateAuth
+	c.StableSessionIDs = *stableIDs
+	if *stableIDs && *dataDir != "" {
+		secret, err := client.LoadSessionIDSecret(filepath.Join(*dataDir, client.SessionIDSecretFile))
+		if err != nil {
+			panic(err)
+		}
+		c.SessionIDSecret = secret
+	}
+	c.DNSOverMix = *dnsOverMix
+	c.DNSResolver = *dnsResolver
+	c.NegotiationTimeout = *negotiateTimeout
+	c.IdleTimeout = *idleTimeout
+	c.ConnectTimeout = *connectTimeout
+	c.MaxConnsPerIP = *maxPerIP
+	c.RateUp = *rateUp
+	c.RateDown = *rateDown
+	c.MaxConns = *maxConns
+	c.FailClosed = *failClosed
+	c.SessionTTL = *sessionTTL
+	c.TopupThreshold = *topupThreshold
+	c.GatewayCooldown = *gwCooldown
+	c.GatewaySelector, err = client.ParseGatewayPolicy(*gwPolicy)
 	if err != nil {
 		panic(err)
 	}
+	if *gateway != "" {
+		if err := c.SetGateway(*gateway); err != nil {
+			panic(err)
+		}
+	}
+	if *policyFile != "" {
+		policy, err := client.LoadPolicy(*policyFile, client.PolicyMode(*policyMode))
+		if err != nil {
+			panic(err)
+		}
+		c.SetPolicy(policy)
+		go reloadPolicy(c)
+	}
+	if *auditLog != "" {
+		c.Audit, err = client.NewAuditLog(*auditLog)
+		if err != nil {
+			panic(err)
+		}
+		c.Audit.RedactTargets = *auditRedact
+		defer c.Audit.Close()
+	}
+	if err != nil {
+		panic(err)
+	}
+	// warn early if the QUIC transport can not be used
+	if doc := s.CurrentDocument(); doc != nil {
+		go c.CheckUDP(context.Background(), client.QUICAddresses(doc), client.DefaultUDPProbeTimeout)
+	}
+
+	if *metricsAddr != "" {
+		instrument.StartPrometheusListener(*metricsAddr)
+	}
+	if *statsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/stats", c.StatsHandler())
+		go func() {
+			if err := http.ListenAndServe(*statsAddr, mux); err != nil {
+				fmt.Fprintf(os.Stderr, "stats endpoint failed: %v\n", err)
+			}
+		}()
+	}
+	if *adminAddr != "" {
+		adminLn, err := client.ListenAdmin(*adminAddr)
+		if err != nil {
+			panic(err)
+		}
+		go func() {
+			if err := http.Serve(adminLn, c.AdminHandler()); err != nil {
+				fmt.Fprintf(os.Stderr, "admin endpoint failed: %v\n", err)
+			}
+		}()
+	}
+	if *pacAddr != "" {
+		go servePAC(c, ln)
+	}
+
 	wg := new(sync.WaitGroup)
 	wg.Add(1)
 	go func() {
-		_ = socksAcceptLoop(c, ln)
+		_ = c.Serve(ln)
 		wg.Done()
 	}()
-	/*
-		TODO: Add a HTTP3 CONNECT proxy listener that uses QUIC Datagram to proxy QUIC UDP connections
+	var httpServer *http.Server
+	if *httpConnect != 0 {
+		addr, err := httpConnectAddress()
+		if err != nil {
+			panic(err)
+		}
+		httpServer = &http.Server{Addr: addr, Handler: c.HTTPConnectHandler()}
 		wg.Add(1)
 		go func() {
-			_ = httpAcceptLoop(s, ..
-	*/
-	// wait until loop has exited
-	wg.Wait()
-}
-
-func socksAcceptLoop(c *client.Client, ln net.Listener) error {
-	defer ln.Close()
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			if e, ok := err.(net.Error); ok && !e.Temporary() {
-				return err
+			defer wg.Done()
+			if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+				fmt.Fprintf(os.Stderr, "HTTP CONNECT proxy failed: %v\n", err)
 			}
-			continue
+		}()
+	}
+	var http3Server *http3.Server
+	if *http3Port != 0 || quicFile != nil {
+		var conn net.PacketConn
+		http3Server, conn, err = listenQUIC(c, quicFile)
+		if err != nil {
+			panic(err)
 		}
-		go c.SocksHandler(conn)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := http3Server.Serve(conn); err != http.ErrServerClosed {
+				fmt.Fprintf(os.Stderr, "HTTP/3 CONNECT proxy failed: %v\n", err)
+			}
+		}()
 	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		drainOnSignal(c, httpServer, http3Server)
+	}()
+	// wait until loop has exited
+	wg.Wait()
 }
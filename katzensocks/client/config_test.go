@@ -0,0 +1,95 @@
+// config_test.go - katzensocks client configuration tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	vServerConfig "github.com/katzenpost/katzenpost/authority/voting/server/config"
+	"github.com/katzenpost/katzenpost/client/config"
+	"github.com/katzenpost/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/katzenpost/core/crypto/nike/ecdh"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/sphinx/geo"
+	"github.com/katzenpost/katzenpost/core/wire"
+	"github.com/stretchr/testify/require"
+)
+
+// testConfig returns a client config of a mixnet with an unreachable
+// authority whose link key is linkKey.
+func testConfig(linkKey wire.PublicKey) *config.Config {
+	_, idKey := cert.Scheme.NewKeypair()
+	return &config.Config{
+		SphinxGeometry: geo.GeometryFromUserForwardPayloadLength(ecdh.NewEcdhNike(rand.Reader), 2000, true, 5),
+		Logging:        &config.Logging{Level: "ERROR"},
+		UpstreamProxy:  &config.UpstreamProxy{Type: "none"},
+		VotingAuthority: &config.VotingAuthority{
+			Peers: []*vServerConfig.Authority{{
+				Identifier:        "authority",
+				IdentityPublicKey: idKey,
+				LinkPublicKey:     linkKey,
+				Addresses:         []string{"127.0.0.1:30000"},
+			}},
+		},
+	}
+}
+
+func TestClientFromConfig(t *testing.T) {
+	require := require.New(t)
+
+	// build a katzensocks.toml in memory
+	_, linkKey := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+	in := testConfig(linkKey)
+	buf := new(bytes.Buffer)
+	require.NoError(toml.NewEncoder(buf).Encode(in))
+
+	cfg, err := LoadConfig(buf)
+	require.NoError(err)
+	require.Equal(in.SphinxGeometry, cfg.SphinxGeometry)
+	require.Len(cfg.VotingAuthority.Peers, 1)
+	require.Equal(linkKey.Bytes(), cfg.VotingAuthority.Peers[0].LinkPublicKey.Bytes())
+
+	c, err := GetClientFromConfig(cfg)
+	require.NoError(err)
+	require.NotNil(c.GetLogger("config_test"))
+	c.Shutdown()
+
+	_, err = LoadConfig(bytes.NewBufferString("[Logging]\nLevel = \"ERROR\"\n"))
+	require.Error(err)
+}
+
+func TestGetSessionContext(t *testing.T) {
+	require := require.New(t)
+
+	_, linkKey := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+	buf := new(bytes.Buffer)
+	require.NoError(toml.NewEncoder(buf).Encode(testConfig(linkKey)))
+	cfgFile := filepath.Join(t.TempDir(), "katzensocks.toml")
+	require.NoError(os.WriteFile(cfgFile, buf.Bytes(), 0600))
+
+	// retrying forever is abandoned once the context is done
+	ctx, cancelFn := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancelFn()
+	_, err := GetSessionContext(ctx, cfgFile, 1, -1)
+	require.ErrorIs(err, context.DeadlineExceeded)
+}
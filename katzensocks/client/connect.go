@@ -0,0 +1,68 @@
+// connect.go - katzensocks client connect timeouts
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"net/url"
+)
+
+// errConnectTimeout is returned when a connection is not set up within
+// ConnectTimeout.
+var errConnectTimeout = errors.New("timed out connecting through the mixnet")
+
+// connectContext returns the context bounding the set up of a connection
+// by ConnectTimeout, and by ctx.
+func (c *Client) connectContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.ConnectTimeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.ConnectTimeout)
+}
+
+// awaitConnect waits for the result of a round trip sent on errCh, or
+// returns errConnectTimeout once ctx is done.  The round trip is left to
+// finish in the background, so errCh must be buffered.
+func awaitConnect(ctx context.Context, errCh <-chan error) error {
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return errConnectTimeout
+	}
+}
+
+// circuitWithin is circuitFor, returning errConnectTimeout if ctx is done
+// first.  The circuit is still built, to be shared by later connections.
+func (c *Client) circuitWithin(ctx context.Context, tgt *url.URL, isolation, gateway string) (*circuit, error) {
+	type built struct {
+		ci  *circuit
+		err error
+	}
+	ch := make(chan built, 1)
+	go func() {
+		ci, err := c.circuitFor(tgt, isolation, gateway)
+		ch <- built{ci, err}
+	}()
+	select {
+	case b := <-ch:
+		return b.ci, b.err
+	case <-ctx.Done():
+		return nil, errConnectTimeout
+	}
+}
@@ -0,0 +1,54 @@
+// connect_test.go - katzensocks client connect timeout tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/katzenpost/client/utils"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/op/go-logging.v1"
+)
+
+func TestConnectTimeout(t *testing.T) {
+	require := require.New(t)
+
+	desc := &utils.ServiceDescriptor{Provider: "gateway", Parameters: map[string]interface{}{CapabilitiesParameter: "tcp,mux"}}
+	slow := make(chan struct{})
+	defer close(slow)
+	c := &Client{
+		Multiplex:      true,
+		ConnectTimeout: 100 * time.Millisecond,
+		descs:          []*utils.ServiceDescriptor{desc},
+		log:            logging.MustGetLogger("connect_test"),
+		buildCircuit: func(desc *utils.ServiceDescriptor, tgt *url.URL, isolation string) (*circuit, error) {
+			<-slow
+			return echoCircuit(t, desc)
+		},
+	}
+
+	// the SOCKS client is answered with TTL expired rather than left waiting
+	local, remote := net.Pipe()
+	defer local.Close()
+	go c.SocksHandler(remote)
+	start := time.Now()
+	require.EqualError(socksEcho(local, "", "hello"), "reply 6")
+	require.Less(time.Since(start), 5*time.Second)
+}
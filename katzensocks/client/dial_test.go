@@ -0,0 +1,41 @@
+// dial_test.go - katzensocks client dial failure tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/katzenpost/katzenpost/client"
+	"github.com/katzenpost/katzenpost/katzensocks/socks5"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplyCode(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal(socks5.ReplyConnectionRefused, replyCode(&dialError{reply: socks5.ReplyConnectionRefused}))
+	require.Equal(socks5.ReplyHostUnreachable, replyCode(fmt.Errorf("dial: %w", &dialError{reply: socks5.ReplyHostUnreachable})))
+	// a gateway that does not report a reason
+	require.Equal(socks5.ReplyGeneralFailure, replyCode(&dialError{}))
+	require.Equal(socks5.ReplyTTLExpired, replyCode(client.ErrReplyTimeout))
+	require.Equal(socks5.ReplyTTLExpired, replyCode(errConnectTimeout))
+	require.Equal(socks5.ReplyTTLExpired, replyCode(context.DeadlineExceeded))
+	require.Equal(socks5.ReplyGeneralFailure, replyCode(errors.New("Gateway descriptor missing")))
+}
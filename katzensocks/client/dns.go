@@ -0,0 +1,216 @@
+// dns.go - katzensocks client name resolution over the mixnet
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/katzensocks/common"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// DefaultDNSResolver is the resolver queried through the mixnet if
+	// DNSResolver is not set.
+	DefaultDNSResolver = "9.9.9.9:53"
+
+	// DefaultDNSTimeout is how long resolving a name through the mixnet
+	// may take.
+	DefaultDNSTimeout = 30 * time.Second
+
+	// maxDNSTTL caps the time an answer is cached.
+	maxDNSTTL = time.Hour
+)
+
+var errDNSMismatch = errors.New("DNS reply does not match the query")
+
+// dnsEntry is a cached answer.
+type dnsEntry struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+// dnsKey is the cache key of the answer for a name looked up by the
+// connections of an isolation key.
+type dnsKey struct {
+	isolation string
+	name      string
+}
+
+// resolveTarget replaces the host name of tgt with an address resolved
+// through the mixnet, so that the name is not resolved by the gateway.
+// The name is looked up on behalf of the connections of the isolation key.
+func (c *Client) resolveTarget(ctx context.Context, tgt *url.URL, isolation string) error {
+	host := tgt.Hostname()
+	if _, err := netip.ParseAddr(host); err == nil {
+		return nil
+	}
+	addrs, err := c.resolveOverMix(ctx, isolation, host)
+	if err != nil {
+		return err
+	}
+	tgt.Host = net.JoinHostPort(addrs[0].String(), tgt.Port())
+	return nil
+}
+
+// resolveOverMix resolves name by sending DNS queries over a stream
+// through the mixnet to the DNSResolver, on the circuit of the isolation
+// key.  Answers are cached for their TTL, separately for each isolation
+// key, so that lookups do not link the connections of different keys.
+func (c *Client) resolveOverMix(ctx context.Context, isolation, name string) ([]netip.Addr, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	key := dnsKey{isolation: isolation, name: name}
+	c.dnsLock.Lock()
+	e, ok := c.dnsCache[key]
+	c.dnsLock.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.addrs, nil
+	}
+
+	dial := c.dnsDial
+	if dial == nil {
+		dial = c.dialDNS
+	}
+	conn, err := dial(ctx, isolation)
+	if err != nil {
+		return nil, fmt.Errorf("dns: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	addrs := []netip.Addr{}
+	ttl := maxDNSTTL
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		a, t, err := queryDNS(conn, name+".", qtype)
+		if err != nil {
+			return nil, fmt.Errorf("dns: %w", err)
+		}
+		if len(a) != 0 && t < ttl {
+			ttl = t
+		}
+		addrs = append(addrs, a...)
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	c.dnsLock.Lock()
+	if c.dnsCache == nil {
+		c.dnsCache = make(map[dnsKey]dnsEntry)
+	}
+	c.dnsCache[key] = dnsEntry{addrs: addrs, expires: time.Now().Add(ttl)}
+	c.dnsLock.Unlock()
+	return addrs, nil
+}
+
+// dialDNS opens a stream to the DNSResolver over the circuit of the
+// isolation key.
+func (c *Client) dialDNS(ctx context.Context, isolation string) (net.Conn, error) {
+	resolver := c.DNSResolver
+	if resolver == "" {
+		resolver = DefaultDNSResolver
+	}
+	tgt := &url.URL{Scheme: "tcp", Host: resolver}
+	ci, err := c.circuitFor(tgt, isolation, "")
+	if err != nil {
+		return nil, err
+	}
+	conn, err := ci.mux.OpenStream(ctx, tgt)
+	if err != nil {
+		return nil, err
+	}
+	if ci.compress {
+		conn = common.NewCompressedConn(conn)
+	}
+	return conn, nil
+}
+
+// queryDNS sends a query for the qtype records of name over the DNS over
+// TCP connection rw, and returns the addresses answered, with the lowest
+// TTL of the answers.  A name that does not exist has no addresses.
+func queryDNS(rw io.ReadWriter, name string, qtype dnsmessage.Type) ([]netip.Addr, time.Duration, error) {
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	id := uint16(rand.NewMath().Intn(1 << 16))
+	q := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: n, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	query, err := q.AppendPack(make([]byte, 2, 514))
+	if err != nil {
+		return nil, 0, err
+	}
+	binary.BigEndian.PutUint16(query, uint16(len(query)-2))
+	if _, err = rw.Write(query); err != nil {
+		return nil, 0, err
+	}
+
+	hdr := make([]byte, 2)
+	if _, err = io.ReadFull(rw, hdr); err != nil {
+		return nil, 0, err
+	}
+	raw := make([]byte, binary.BigEndian.Uint16(hdr))
+	if _, err = io.ReadFull(rw, raw); err != nil {
+		return nil, 0, err
+	}
+	var m dnsmessage.Message
+	if err = m.Unpack(raw); err != nil {
+		return nil, 0, err
+	}
+	if m.Header.ID != id || !m.Header.Response {
+		return nil, 0, errDNSMismatch
+	}
+	switch m.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, nil
+	default:
+		return nil, 0, fmt.Errorf("server answered %v", m.Header.RCode)
+	}
+
+	addrs := []netip.Addr{}
+	ttl := maxDNSTTL
+	for _, a := range m.Answers {
+		switch r := a.Body.(type) {
+		case *dnsmessage.AResource:
+			addrs = append(addrs, netip.AddrFrom4(r.A))
+		case *dnsmessage.AAAAResource:
+			addrs = append(addrs, netip.AddrFrom16(r.AAAA))
+		default:
+			// CNAMEs are followed by the resolver
+			continue
+		}
+		if t := time.Duration(a.Header.TTL) * time.Second; t < ttl {
+			ttl = t
+		}
+	}
+	return addrs, ttl, nil
+}
@@ -0,0 +1,169 @@
+// dns_test.go - katzensocks client name resolution tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/katzenpost/katzenpost/client/utils"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+	"gopkg.in/op/go-logging.v1"
+)
+
+// serveDNS answers the DNS over TCP queries on conn from records, by name
+// and type, with the given TTL.
+func serveDNS(conn net.Conn, records map[string]map[dnsmessage.Type]string, ttl uint32) {
+	defer conn.Close()
+	for {
+		hdr := make([]byte, 2)
+		if _, err := io.ReadFull(conn, hdr); err != nil {
+			return
+		}
+		raw := make([]byte, binary.BigEndian.Uint16(hdr))
+		if _, err := io.ReadFull(conn, raw); err != nil {
+			return
+		}
+		var m dnsmessage.Message
+		if err := m.Unpack(raw); err != nil {
+			return
+		}
+		q := m.Questions[0]
+		m.Header.Response = true
+		types, ok := records[q.Name.String()]
+		if !ok {
+			m.Header.RCode = dnsmessage.RCodeNameError
+		}
+		if addr, ok := types[q.Type]; ok {
+			rh := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: ttl}
+			a := netip.MustParseAddr(addr)
+			switch q.Type {
+			case dnsmessage.TypeA:
+				m.Answers = append(m.Answers, dnsmessage.Resource{Header: rh, Body: &dnsmessage.AResource{A: a.As4()}})
+			case dnsmessage.TypeAAAA:
+				m.Answers = append(m.Answers, dnsmessage.Resource{Header: rh, Body: &dnsmessage.AAAAResource{AAAA: a.As16()}})
+			}
+		}
+		resp, err := m.AppendPack(make([]byte, 2))
+		if err != nil {
+			return
+		}
+		binary.BigEndian.PutUint16(resp, uint16(len(resp)-2))
+		if _, err = conn.Write(resp); err != nil {
+			return
+		}
+	}
+}
+
+func TestResolveOverMix(t *testing.T) {
+	require := require.New(t)
+
+	records := map[string]map[dnsmessage.Type]string{
+		"example.com.": {dnsmessage.TypeA: "192.0.2.1", dnsmessage.TypeAAAA: "2001:db8::1"},
+		"v6.example.":  {dnsmessage.TypeAAAA: "2001:db8::2"},
+	}
+	var ttl uint32 = 60
+	dials := new(atomic.Int32)
+	c := &Client{dnsDial: func(ctx context.Context, isolation string) (net.Conn, error) {
+		dials.Add(1)
+		local, remote := net.Pipe()
+		go serveDNS(remote, records, ttl)
+		return local, nil
+	}}
+
+	addrs, err := c.resolveOverMix(context.Background(), "", "example.com")
+	require.NoError(err)
+	require.Equal([]netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")}, addrs)
+
+	// answers are cached for their TTL, regardless of case
+	addrs, err = c.resolveOverMix(context.Background(), "", "Example.COM.")
+	require.NoError(err)
+	require.Len(addrs, 2)
+	require.Equal(int32(1), dials.Load())
+
+	// and are queried again once it has passed
+	ttl = 0
+	_, err = c.resolveOverMix(context.Background(), "", "v6.example")
+	require.NoError(err)
+	_, err = c.resolveOverMix(context.Background(), "", "v6.example")
+	require.NoError(err)
+	require.Equal(int32(3), dials.Load())
+
+	_, err = c.resolveOverMix(context.Background(), "", "missing.example")
+	var dnsErr *net.DNSError
+	require.ErrorAs(err, &dnsErr)
+	require.True(dnsErr.IsNotFound)
+
+	// targets are rewritten to the first address
+	tgt, err := url.Parse("tcp://example.com:443")
+	require.NoError(err)
+	require.NoError(c.resolveTarget(context.Background(), tgt, ""))
+	require.Equal("192.0.2.1:443", tgt.Host)
+	tgt, err = url.Parse("tcp://v6.example:80")
+	require.NoError(err)
+	require.NoError(c.resolveTarget(context.Background(), tgt, ""))
+	require.Equal("[2001:db8::2]:80", tgt.Host)
+	dials.Store(0)
+	tgt, err = url.Parse("tcp://127.0.0.1:80")
+	require.NoError(err)
+	require.NoError(c.resolveTarget(context.Background(), tgt, ""))
+	require.Equal("127.0.0.1:80", tgt.Host)
+	require.Equal(int32(0), dials.Load())
+}
+
+func TestResolveOverMixIsolation(t *testing.T) {
+	require := require.New(t)
+
+	records := map[string]map[dnsmessage.Type]string{
+		"example.com.": {dnsmessage.TypeA: "192.0.2.1"},
+	}
+	desc := &utils.ServiceDescriptor{Provider: "gateway", Parameters: map[string]interface{}{CapabilitiesParameter: "tcp,mux"}}
+	var lock sync.Mutex
+	var isolations []string
+	queries := new(atomic.Int32)
+	c := &Client{
+		descs: []*utils.ServiceDescriptor{desc},
+		log:   logging.MustGetLogger("dns_test"),
+		buildCircuit: func(desc *utils.ServiceDescriptor, tgt *url.URL, isolation string) (*circuit, error) {
+			lock.Lock()
+			isolations = append(isolations, isolation)
+			lock.Unlock()
+			return testCircuit(t, desc, func(conn net.Conn) {
+				queries.Add(1)
+				serveDNS(conn, records, 60)
+			})
+		},
+	}
+
+	// the lookups of each isolation key are carried by its own circuit,
+	// and not answered from the cache of another key
+	for _, isolation := range []string{"alice", "bob", "alice"} {
+		addrs, err := c.resolveOverMix(context.Background(), isolation, "example.com")
+		require.NoError(err)
+		require.Equal([]netip.Addr{netip.MustParseAddr("192.0.2.1")}, addrs)
+	}
+	require.Equal([]string{"alice", "bob"}, isolations)
+	require.Equal(int32(2), queries.Load())
+}
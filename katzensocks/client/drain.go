@@ -0,0 +1,106 @@
+// drain.go - katzensocks client graceful shutdown
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+const (
+	// DefaultDrainTimeout is how long Drain is given to let the
+	// connections in flight finish on shutdown.
+	DefaultDrainTimeout = 30 * time.Second
+
+	drainPollInterval = 100 * time.Millisecond
+)
+
+// serving registers ln as accepting connections for Serve, so that Drain
+// closes it.  It returns false if the Client is already draining.
+func (c *Client) serving(ln net.Listener) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.draining {
+		return false
+	}
+	if c.listeners == nil {
+		c.listeners = make(map[net.Listener]struct{})
+	}
+	c.listeners[ln] = struct{}{}
+	return true
+}
+
+// startRequest registers a forwarded HTTP request in flight, for Drain to
+// wait on.  It returns false if the Client is already draining.
+func (c *Client) startRequest() bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.draining {
+		return false
+	}
+	c.requests++
+	return true
+}
+
+// endRequest unregisters a forwarded HTTP request.
+func (c *Client) endRequest() {
+	c.Lock()
+	defer c.Unlock()
+	c.requests--
+}
+
+// Drain stops Serve from accepting connections and waits until the SOCKS
+// connections, HTTP CONNECT tunnels and forwarded HTTP requests in flight
+// have finished.  If ctx is done first, the remaining connections are
+// reset and ctx.Err() is returned.
+func (c *Client) Drain(ctx context.Context) error {
+	c.Lock()
+	c.draining = true
+	listeners := c.listeners
+	c.listeners = nil
+	c.Unlock()
+	for ln := range listeners {
+		ln.Close()
+	}
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		c.Lock()
+		remaining := c.conns + len(c.active) + c.requests
+		c.Unlock()
+		if remaining == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			c.Lock()
+			active := make([]net.Conn, 0, len(c.active))
+			for conn := range c.active {
+				active = append(active, conn)
+			}
+			c.Unlock()
+			c.log.Warningf("Resetting %d connections still in flight after draining", len(active))
+			for _, conn := range active {
+				resetConn(conn)
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// drain_test.go - katzensocks client graceful shutdown tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/katzenpost/client/utils"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/op/go-logging.v1"
+)
+
+func TestDrain(t *testing.T) {
+	require := require.New(t)
+
+	c := &Client{log: logging.MustGetLogger("drain_test")}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	served := make(chan error, 1)
+	go func() { served <- c.Serve(ln) }()
+
+	// a connection in flight holds up draining until the deadline
+	local, remote := net.Pipe()
+	require.True(c.trackConn(remote))
+	ctx, cancelFn := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancelFn()
+	require.ErrorIs(c.Drain(ctx), context.DeadlineExceeded)
+	require.NoError(<-served)
+	_, err = local.Read(make([]byte, 1))
+	require.ErrorIs(err, io.EOF)
+
+	// the listener is closed, and no longer served
+	_, err = net.Dial("tcp", ln.Addr().String())
+	require.Error(err)
+	require.NoError(c.Serve(ln))
+
+	// once it finishes, draining completes
+	c.untrackConn(remote)
+	require.NoError(c.Drain(context.Background()))
+}
+
+func TestDrainForwardedRequests(t *testing.T) {
+	require := require.New(t)
+
+	// the gateway answers once released
+	desc := &utils.ServiceDescriptor{Provider: "gateway", Parameters: map[string]interface{}{CapabilitiesParameter: "tcp,dns,mux"}}
+	release := make(chan struct{})
+	c := &Client{
+		Multiplex: true,
+		descs:     []*utils.ServiceDescriptor{desc},
+		log:       logging.MustGetLogger("drain_test"),
+		buildCircuit: func(desc *utils.ServiceDescriptor, tgt *url.URL, isolation string) (*circuit, error) {
+			return testCircuit(t, desc, func(s net.Conn) {
+				if _, err := http.ReadRequest(bufio.NewReader(s)); err != nil {
+					return
+				}
+				<-release
+				io.WriteString(s, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+			})
+		},
+	}
+	srv := httptest.NewServer(c.HTTPConnectHandler())
+	defer srv.Close()
+	proxyURL, err := url.Parse(srv.URL)
+	require.NoError(err)
+	hc := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableKeepAlives: true}}
+
+	// a forwarded request in flight holds up draining until it finishes
+	status := make(chan int, 1)
+	go func() {
+		resp, err := hc.Get("http://example.com/")
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	require.Eventually(func() bool {
+		c.Lock()
+		defer c.Unlock()
+		return c.requests == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	drained := make(chan error, 1)
+	go func() { drained <- c.Drain(context.Background()) }()
+	select {
+	case <-drained:
+		t.Fatal("drained with a request in flight")
+	case <-time.After(3 * drainPollInterval):
+	}
+
+	// while new ones are refused
+	resp, err := hc.Get("http://example.com/")
+	require.NoError(err)
+	resp.Body.Close()
+	require.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+
+	close(release)
+	require.Equal(http.StatusOK, <-status)
+	require.NoError(<-drained)
+}
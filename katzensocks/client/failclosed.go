@@ -0,0 +1,82 @@
+// failclosed.go - katzensocks client kill switch
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import "net"
+
+// trackConn registers conn as carried by the mixnet, so that it is reset
+// if the connection to the mixnet is lost.  It returns false without
+// registering conn if FailClosed is set and the mixnet is unreachable.
+func (c *Client) trackConn(conn net.Conn) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.FailClosed && c.offline {
+		c.stats.RejectedFailClosed++
+		return false
+	}
+	if c.active == nil {
+		c.active = make(map[net.Conn]struct{})
+	}
+	c.active[conn] = struct{}{}
+	return true
+}
+
+// untrackConn unregisters conn.
+func (c *Client) untrackConn(conn net.Conn) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.active, conn)
+}
+
+// connectionStatus records whether the mixnet is reachable.  When it is
+// lost and FailClosed is set, every tracked connection is reset and the
+// circuits are closed, rather than left to stall or to be retried.
+func (c *Client) connectionStatus(connected bool) {
+	c.Lock()
+	wasOffline := c.offline
+	c.offline = !connected
+	if connected || !c.FailClosed || wasOffline {
+		c.Unlock()
+		return
+	}
+	active := make([]net.Conn, 0, len(c.active))
+	for conn := range c.active {
+		active = append(active, conn)
+	}
+	c.active = nil
+	c.Unlock()
+
+	c.log.Warningf("Lost the mixnet, resetting %d connections until it is reachable", len(active))
+	for _, conn := range active {
+		resetConn(conn)
+	}
+	c.circuitLock.Lock()
+	for _, ci := range c.circuits {
+		ci.mux.Close()
+	}
+	c.circuits = nil
+	c.circuitLock.Unlock()
+}
+
+// resetConn closes conn, aborting TCP connections with a reset so that
+// the application sees the failure rather than the end of the stream.
+func resetConn(conn net.Conn) {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	conn.Close()
+}
@@ -0,0 +1,102 @@
+// failclosed_test.go - katzensocks client kill switch tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/katzenpost/client"
+	"github.com/katzenpost/katzenpost/client/utils"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/op/go-logging.v1"
+)
+
+func TestFailClosed(t *testing.T) {
+	require := require.New(t)
+
+	desc := &utils.ServiceDescriptor{Provider: "gateway", Parameters: map[string]interface{}{CapabilitiesParameter: "tcp,mux"}}
+	builds := new(atomic.Int32)
+	c := &Client{
+		Multiplex:  true,
+		FailClosed: true,
+		descs:      []*utils.ServiceDescriptor{desc},
+		log:        logging.MustGetLogger("failclosed_test"),
+		buildCircuit: func(desc *utils.ServiceDescriptor, tgt *url.URL, isolation string) (*circuit, error) {
+			builds.Add(1)
+			return echoCircuit(t, desc)
+		},
+	}
+	serve := func() net.Conn {
+		local, remote := net.Pipe()
+		go c.SocksHandler(remote)
+		t.Cleanup(func() { local.Close() })
+		return local
+	}
+
+	// an established connection is reset when the mixnet is lost
+	conn := serve()
+	require.NoError(socksEcho(conn, "", "hello"))
+	c.connectionStatus(false)
+	_, err := conn.Read(make([]byte, 1))
+	require.Error(err)
+	require.Empty(c.circuits)
+
+	// new connections are refused until it is restored
+	require.EqualError(socksEcho(serve(), "", "hello"), "reply 1")
+	require.Equal(uint64(1), c.Stats().RejectedFailClosed)
+
+	c.connectionStatus(true)
+	require.NoError(socksEcho(serve(), "", "hello again"))
+	require.Equal(int32(2), builds.Load())
+}
+
+func TestFailClosedIdle(t *testing.T) {
+	require := require.New(t)
+
+	desc := &utils.ServiceDescriptor{Provider: "gateway", Parameters: map[string]interface{}{CapabilitiesParameter: "tcp,mux"}}
+	c := &Client{
+		Multiplex:  true,
+		FailClosed: true,
+		descs:      []*utils.ServiceDescriptor{desc},
+		log:        logging.MustGetLogger("failclosed_test"),
+		buildCircuit: func(desc *utils.ServiceDescriptor, tgt *url.URL, isolation string) (*circuit, error) {
+			return echoCircuit(t, desc)
+		},
+	}
+	events := make(chan client.Event)
+	c.Go(func() { c.eventWorker(events) })
+	defer c.Halt()
+
+	// the connectivity is followed while no tunnel is open
+	events <- &client.ConnectionStatusEvent{IsConnected: false}
+	require.Eventually(func() bool { return !c.Online() }, time.Second, 10*time.Millisecond)
+	local, remote := net.Pipe()
+	defer local.Close()
+	go c.SocksHandler(remote)
+	require.EqualError(socksEcho(local, "", "hello"), "reply 1")
+
+	events <- &client.ConnectionStatusEvent{IsConnected: true}
+	require.Eventually(c.Online, time.Second, 10*time.Millisecond)
+	local, remote = net.Pipe()
+	defer local.Close()
+	go c.SocksHandler(remote)
+	require.NoError(socksEcho(local, "", "hello again"))
+}
@@ -0,0 +1,74 @@
+// health.go - katzensocks client gateway health
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"time"
+
+	"github.com/katzenpost/katzenpost/client/utils"
+)
+
+// DefaultGatewayCooldown is how long a gateway that exhausted its retries
+// is passed over, if GatewayCooldown is zero.
+const DefaultGatewayCooldown = 5 * time.Minute
+
+// markUnhealthy passes over the gateway desc for the cooldown period, so
+// that new sessions are set up with the other gateways.
+func (c *Client) markUnhealthy(desc *utils.ServiceDescriptor) {
+	cooldown := c.GatewayCooldown
+	if cooldown == 0 {
+		cooldown = DefaultGatewayCooldown
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.unhealthy == nil {
+		c.unhealthy = make(map[string]time.Time)
+	}
+	c.unhealthy[desc.Provider] = time.Now().Add(cooldown)
+	c.log.Warningf("Gateway %s is unresponsive, avoiding it for %v", desc.Provider, cooldown)
+}
+
+// healthy returns true iff desc is not cooling down.  The caller must
+// hold the Client lock.
+func (c *Client) healthy(desc *utils.ServiceDescriptor) bool {
+	until, ok := c.unhealthy[desc.Provider]
+	if !ok {
+		return true
+	}
+	if time.Now().After(until) {
+		delete(c.unhealthy, desc.Provider)
+		return true
+	}
+	return false
+}
+
+// candidates returns the gateways and preferred gateway to select a new
+// session from, leaving out those that are cooling down.  The caller must
+// hold the Client lock.
+func (c *Client) candidates() ([]*utils.ServiceDescriptor, *utils.ServiceDescriptor) {
+	descs := make([]*utils.ServiceDescriptor, 0, len(c.descs))
+	for _, desc := range c.descs {
+		if c.healthy(desc) {
+			descs = append(descs, desc)
+		}
+	}
+	preferred := c.desc
+	if preferred != nil && !c.healthy(preferred) {
+		preferred = nil
+	}
+	return descs, preferred
+}
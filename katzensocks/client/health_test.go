@@ -0,0 +1,60 @@
+// health_test.go - katzensocks client gateway health tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/katzenpost/katzenpost/client/utils"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/op/go-logging.v1"
+)
+
+func TestGatewayCooldown(t *testing.T) {
+	require := require.New(t)
+
+	descs := testGateways("a", "b")
+	c := &Client{
+		descs:           descs,
+		desc:            descs[0],
+		GatewayCooldown: time.Hour,
+		sessionToDesc:   make(map[string]*utils.ServiceDescriptor),
+		log:             logging.MustGetLogger("health_test"),
+	}
+
+	// the pinned gateway is passed over while it cools down
+	c.markUnhealthy(descs[0])
+	for i := 0; i < 5; i++ {
+		id, err := c.NewSession()
+		require.NoError(err)
+		require.Equal("b", c.sessionToDesc[string(id)].Provider)
+	}
+
+	// no session is set up once every gateway is unresponsive
+	c.markUnhealthy(descs[1])
+	_, err := c.NewSession()
+	require.ErrorIs(err, errNoGatewayDescriptor)
+
+	// and gateways are used again after the cooldown
+	c.Lock()
+	c.unhealthy["a"] = time.Now().Add(-time.Second)
+	c.Unlock()
+	id, err := c.NewSession()
+	require.NoError(err)
+	require.Equal("a", c.sessionToDesc[string(id)].Provider)
+}
@@ -0,0 +1,312 @@
+// httpconnect.go - katzensocks client HTTP CONNECT proxy
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/katzenpost/client"
+	"github.com/katzenpost/katzenpost/katzensocks/common"
+	"github.com/quic-go/quic-go/http3"
+)
+
+var errNotAllowed = errors.New("destination not allowed by policy")
+
+// DialContext connects to the TCP address addr through the mixnet, over a
+// shared circuit if Multiplex is set and a gateway offers it, or else over
+// a session of its own.  The connection is set up within ConnectTimeout,
+// or errConnectTimeout is returned, as it is if ctx is done first.
+func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+	tgt := &url.URL{Scheme: "tcp", Host: addr}
+	if !c.allows(tgt.Hostname()) {
+		return nil, errNotAllowed
+	}
+	if c.DNSOverMix {
+		if err := c.resolveTarget(ctx, tgt, ""); err != nil {
+			return nil, err
+		}
+		if !c.allows(tgt.Hostname()) {
+			return nil, errNotAllowed
+		}
+	}
+
+	// bound the round trips to set up the connection
+	connectCtx, cancelConnect := c.connectContext(ctx)
+	defer cancelConnect()
+
+	if c.Multiplex {
+		ci, err := c.circuitWithin(connectCtx, tgt, "", "")
+		switch err {
+		case nil:
+			stream, err := ci.mux.OpenStream(connectCtx, tgt)
+			if err != nil && connectCtx.Err() != nil {
+				return nil, errConnectTimeout
+			}
+			if err != nil {
+				return nil, err
+			}
+			if ci.compress {
+				stream = common.NewCompressedConn(stream)
+			}
+			return stream, nil
+		case errNoCircuit:
+		default:
+			return nil, err
+		}
+	}
+
+	// set up a session, moving on to the next gateway while the selected
+	// one is unresponsive
+	var id []byte
+	var err error
+	for {
+		if id, err = c.NewSession(TargetCapabilities(tgt)...); err != nil {
+			return nil, err
+		}
+		if err = awaitConnect(connectCtx, c.Topup(id)); err != client.ErrReplyTimeout {
+			break
+		}
+	}
+	if err == errConnectTimeout {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("topup: %w", err)
+	}
+	if err = awaitConnect(connectCtx, c.Dial(id, tgt)); err != nil {
+		return nil, err
+	}
+
+	// the session relays one end of a pipe, the caller has the other
+	local, remote := net.Pipe()
+	counted := &countingConn{Conn: remote, session: c.countSession(id)}
+	qconn, errCh := c.Proxy(id, counted)
+	go func() {
+		defer c.uncountSession(id)
+		for err := range errCh {
+			if err != nil {
+				c.log.Errorf("Proxy returned error: %v", err)
+				qconn.Close()
+			}
+		}
+	}()
+	return local, nil
+}
+
+// HTTPConnectHandler serves an HTTP proxy that carries the tunnels of
+// CONNECT requests through the mixnet.  Other requests must have an
+// absolute URL, and are forwarded through the mixnet as well.
+func (c *Client) HTTPConnectHandler() http.Handler {
+	forward := &httputil.ReverseProxy{
+		Director:  func(r *http.Request) {},
+		Transport: &http.Transport{DialContext: c.DialContext},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			c.log.Errorf("Failed to forward %s %v: %v", r.Method, r.URL, err)
+			switch {
+			case errors.Is(err, errNotAllowed):
+				w.WriteHeader(http.StatusForbidden)
+			case errors.Is(err, errConnectTimeout):
+				w.WriteHeader(http.StatusGatewayTimeout)
+			default:
+				w.WriteHeader(http.StatusBadGateway)
+			}
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			if !r.URL.IsAbs() {
+				http.Error(w, "not a proxy request", http.StatusBadRequest)
+				return
+			}
+			// as with tunnels, new requests are refused while draining
+			if !c.startRequest() {
+				http.Error(w, "shutting down", http.StatusServiceUnavailable)
+				return
+			}
+			defer c.endRequest()
+			forward.ServeHTTP(w, r)
+			return
+		}
+		c.connect(w, r)
+	})
+}
+
+// connect answers a CONNECT request with a tunnel to its target.  An
+// HTTP/1 connection is hijacked, while over HTTP/3 the tunnel is carried
+// by the request stream.  The tunnels are limited and audited as SOCKS
+// connections are.
+func (c *Client) connect(w http.ResponseWriter, r *http.Request) {
+	hj, isHijacker := w.(http.Hijacker)
+	streamer, isStreamer := r.Body.(http3.HTTPStreamer)
+	if !isHijacker && !isStreamer {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	c.Lock()
+	offline := c.FailClosed && c.offline
+	draining := c.draining
+	c.Unlock()
+	if offline {
+		http.Error(w, "the mixnet is unreachable", http.StatusServiceUnavailable)
+		return
+	}
+	// an HTTP/3 server can not stop accepting requests without aborting
+	// them, so its new tunnels are refused here while draining
+	if draining {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	source := requestSource(r)
+	if !c.acquireSource(source) {
+		c.log.Warningf("Rejecting tunnel from %s: more than %d connections", source, c.MaxConnsPerIP)
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return
+	}
+	defer c.releaseSource(source)
+
+	rec := &AuditRecord{Time: time.Now(), Target: "tcp://" + r.Host}
+	defer c.audit(rec)
+
+	stream, err := c.DialContext(r.Context(), "tcp", r.Host)
+	if err != nil {
+		c.log.Errorf("Failed to connect to %s: %v", r.Host, err)
+		rec.Outcome = OutcomeDialFailed
+		status := http.StatusBadGateway
+		switch err {
+		case errNotAllowed:
+			rec.Outcome = OutcomeRejected
+			status = http.StatusForbidden
+		case errConnectTimeout:
+			rec.Outcome = OutcomeTimeout
+			status = http.StatusGatewayTimeout
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	defer stream.Close()
+
+	// the tunnel is refused with a status rather than dropped if the
+	// mixnet was lost while it was set up
+	var conn net.Conn
+	var src io.Reader
+	if isStreamer {
+		conn = newHTTP3Conn(w, r, streamer.HTTPStream())
+		defer conn.Close()
+		if !c.trackConn(conn) {
+			rec.Outcome = OutcomeRejected
+			http.Error(w, "the mixnet is unreachable", http.StatusServiceUnavailable)
+			w.(http.Flusher).Flush()
+			return
+		}
+		defer c.untrackConn(conn)
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		src = conn
+	} else {
+		var rw *bufio.ReadWriter
+		conn, rw, err = hj.Hijack()
+		if err != nil {
+			c.log.Errorf("Failed to hijack connection: %v", err)
+			return
+		}
+		defer conn.Close()
+		if !c.trackConn(conn) {
+			rec.Outcome = OutcomeRejected
+			io.WriteString(conn, "HTTP/1.1 503 Service Unavailable\r\n\r\n")
+			return
+		}
+		defer c.untrackConn(conn)
+		if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+			return
+		}
+		// the client may have sent data behind its request already
+		src = io.MultiReader(io.LimitReader(rw, int64(rw.Reader.Buffered())), conn)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		n, _ := io.Copy(conn, stream)
+		rec.BytesReceived = n
+		conn.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		n, _ := io.Copy(stream, src)
+		rec.BytesSent = n
+		stream.Close()
+	}()
+	wg.Wait()
+	rec.Outcome = OutcomeSucceeded
+	c.log.Infof("Tunnel to %s finished", r.Host)
+}
+
+// requestSource returns the IP address of the client of r.
+func requestSource(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// http3Conn is the net.Conn of a CONNECT tunnel carried by an HTTP/3
+// request stream.
+type http3Conn struct {
+	http3.Stream
+	local, remote net.Addr
+}
+
+func newHTTP3Conn(w http.ResponseWriter, r *http.Request, str http3.Stream) *http3Conn {
+	conn := &http3Conn{Stream: str}
+	if hj, ok := w.(http3.Hijacker); ok {
+		sc := hj.StreamCreator()
+		conn.local, conn.remote = sc.LocalAddr(), sc.RemoteAddr()
+	}
+	return conn
+}
+
+func (c *http3Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *http3Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Close closes both directions of the stream, as a net.Conn would.
+func (c *http3Conn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
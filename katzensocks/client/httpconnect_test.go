@@ -0,0 +1,280 @@
+// httpconnect_test.go - katzensocks client HTTP CONNECT proxy tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/katzenpost/client/utils"
+	kquic "github.com/katzenpost/katzenpost/quic"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/op/go-logging.v1"
+)
+
+func TestHTTPConnect(t *testing.T) {
+	require := require.New(t)
+
+	desc := &utils.ServiceDescriptor{Provider: "gateway", Parameters: map[string]interface{}{CapabilitiesParameter: "tcp,mux"}}
+	c := &Client{
+		Multiplex: true,
+		descs:     []*utils.ServiceDescriptor{desc},
+		log:       logging.MustGetLogger("httpconnect_test"),
+		buildCircuit: func(desc *utils.ServiceDescriptor, tgt *url.URL, isolation string) (*circuit, error) {
+			return echoCircuit(t, desc)
+		},
+	}
+	srv := httptest.NewServer(c.HTTPConnectHandler())
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	require.NoError(err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "CONNECT 127.0.0.1:80 HTTP/1.1\r\nHost: 127.0.0.1:80\r\n\r\n")
+	require.NoError(err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(err)
+	require.Equal(http.StatusOK, resp.StatusCode)
+	require.Equal("200 Connection Established", resp.Status)
+
+	_, err = io.WriteString(conn, "hello")
+	require.NoError(err)
+	echoed := make([]byte, 5)
+	_, err = io.ReadFull(br, echoed)
+	require.NoError(err)
+	require.Equal("hello", string(echoed))
+}
+
+// httpConnect sends a CONNECT request for target on a new connection to
+// the proxy at addr, and returns the connection and the response.
+func httpConnect(t *testing.T, addr, target string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	_, err = io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	return conn, br, resp
+}
+
+func TestHTTPConnectLimits(t *testing.T) {
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := NewAuditLog(path)
+	require.NoError(err)
+	defer audit.Close()
+	desc := &utils.ServiceDescriptor{Provider: "gateway", Parameters: map[string]interface{}{CapabilitiesParameter: "tcp,mux"}}
+	var lose atomic.Bool
+	c := &Client{
+		Multiplex:     true,
+		FailClosed:    true,
+		MaxConnsPerIP: 1,
+		Audit:         audit,
+		descs:         []*utils.ServiceDescriptor{desc},
+		log:           logging.MustGetLogger("httpconnect_test"),
+	}
+	c.buildCircuit = func(desc *utils.ServiceDescriptor, tgt *url.URL, isolation string) (*circuit, error) {
+		if lose.Load() {
+			// the mixnet is lost while the tunnel is set up
+			c.Lock()
+			c.offline = true
+			c.Unlock()
+		}
+		return echoCircuit(t, desc)
+	}
+	srv := httptest.NewServer(c.HTTPConnectHandler())
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	// a tunnel is audited as a SOCKS connection is
+	conn, br, resp := httpConnect(t, addr, "127.0.0.1:80")
+	require.Equal(http.StatusOK, resp.StatusCode)
+	_, err = io.WriteString(conn, "hello")
+	require.NoError(err)
+	_, err = io.ReadFull(br, make([]byte, 5))
+	require.NoError(err)
+
+	// and counted against the connections of its source
+	_, _, resp = httpConnect(t, addr, "127.0.0.1:80")
+	require.Equal(http.StatusTooManyRequests, resp.StatusCode)
+
+	conn.Close()
+	require.Eventually(func() bool {
+		return len(readAuditRecords(t, path)) == 1
+	}, time.Second, 10*time.Millisecond)
+	rec := readAuditRecords(t, path)[0]
+	require.Equal("tcp://127.0.0.1:80", rec.Target)
+	require.Equal(OutcomeSucceeded, rec.Outcome)
+	require.Equal(int64(5), rec.BytesSent)
+	require.Equal(int64(5), rec.BytesReceived)
+
+	// a tunnel refused once its connection is hijacked is answered with a
+	// status line rather than dropped
+	require.Eventually(func() bool {
+		return c.Stats().ActiveConnections == 0
+	}, time.Second, 10*time.Millisecond)
+	c.circuitLock.Lock()
+	c.circuits = nil
+	c.circuitLock.Unlock()
+	lose.Store(true)
+	_, _, resp = httpConnect(t, addr, "127.0.0.1:80")
+	require.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	require.Eventually(func() bool {
+		recs := readAuditRecords(t, path)
+		return len(recs) == 2 && recs[1].Outcome == OutcomeRejected
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestHTTP3Connect(t *testing.T) {
+	require := require.New(t)
+
+	desc := &utils.ServiceDescriptor{Provider: "gateway", Parameters: map[string]interface{}{CapabilitiesParameter: "tcp,mux"}}
+	c := &Client{
+		Multiplex: true,
+		descs:     []*utils.ServiceDescriptor{desc},
+		log:       logging.MustGetLogger("httpconnect_test"),
+		buildCircuit: func(desc *utils.ServiceDescriptor, tgt *url.URL, isolation string) (*circuit, error) {
+			return echoCircuit(t, desc)
+		},
+	}
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(err)
+	srv := &http3.Server{Handler: c.HTTPConnectHandler(), TLSConfig: kquic.GenerateTLSConfig()}
+	go srv.Serve(udp)
+	defer srv.Close()
+
+	rt := &http3.RoundTripper{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, NextProtos: []string{http3.NextProtoH3}}}
+	defer rt.Close()
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "https", Host: udp.LocalAddr().String()},
+		Host:   "127.0.0.1:80",
+		Header: make(http.Header),
+		Body:   pr,
+	}
+	resp, err := rt.RoundTripOpt(req, http3.RoundTripOpt{DontCloseRequestStream: true})
+	require.NoError(err)
+	defer resp.Body.Close()
+	require.Equal(http.StatusOK, resp.StatusCode)
+
+	_, err = io.WriteString(pw, "hello")
+	require.NoError(err)
+	echoed := make([]byte, 5)
+	_, err = io.ReadFull(resp.Body, echoed)
+	require.NoError(err)
+	require.Equal("hello", string(echoed))
+}
+
+func TestHTTPForward(t *testing.T) {
+	require := require.New(t)
+
+	// the gateway answers every request on the stream itself
+	desc := &utils.ServiceDescriptor{Provider: "gateway", Parameters: map[string]interface{}{CapabilitiesParameter: "tcp,dns,mux"}}
+	c := &Client{
+		Multiplex: true,
+		descs:     []*utils.ServiceDescriptor{desc},
+		log:       logging.MustGetLogger("httpconnect_test"),
+		buildCircuit: func(desc *utils.ServiceDescriptor, tgt *url.URL, isolation string) (*circuit, error) {
+			return testCircuit(t, desc, func(s net.Conn) {
+				req, err := http.ReadRequest(bufio.NewReader(s))
+				if err != nil {
+					return
+				}
+				io.WriteString(s, "HTTP/1.1 200 OK\r\nContent-Length: "+
+					"14\r\nConnection: close\r\n\r\nhello from "+req.URL.Path[1:])
+			})
+		},
+	}
+	srv := httptest.NewServer(c.HTTPConnectHandler())
+	defer srv.Close()
+
+	proxyURL, err := url.Parse(srv.URL)
+	require.NoError(err)
+	hc := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := hc.Get("http://example.com/abc")
+	require.NoError(err)
+	defer resp.Body.Close()
+	require.Equal(http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(err)
+	require.Equal("hello from abc", string(body))
+
+	// requests that are not meant for a proxy are refused
+	resp, err = http.Get(srv.URL + "/abc")
+	require.NoError(err)
+	resp.Body.Close()
+	require.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestHTTPConnectTimeout(t *testing.T) {
+	require := require.New(t)
+
+	// the gateway never replies
+	desc := &utils.ServiceDescriptor{Provider: "gateway", Parameters: map[string]interface{}{CapabilitiesParameter: "tcp,mux"}}
+	slow := make(chan struct{})
+	defer close(slow)
+	c := &Client{
+		Multiplex:      true,
+		ConnectTimeout: 100 * time.Millisecond,
+		descs:          []*utils.ServiceDescriptor{desc},
+		log:            logging.MustGetLogger("httpconnect_test"),
+		buildCircuit: func(desc *utils.ServiceDescriptor, tgt *url.URL, isolation string) (*circuit, error) {
+			<-slow
+			return echoCircuit(t, desc)
+		},
+	}
+	srv := httptest.NewServer(c.HTTPConnectHandler())
+	defer srv.Close()
+
+	// tunnels and forwarded requests are answered with a gateway timeout
+	// rather than left waiting
+	start := time.Now()
+	_, _, resp := httpConnect(t, srv.Listener.Addr().String(), "127.0.0.1:80")
+	require.Equal(http.StatusGatewayTimeout, resp.StatusCode)
+	proxyURL, err := url.Parse(srv.URL)
+	require.NoError(err)
+	hc := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err = hc.Get("http://example.com/abc")
+	require.NoError(err)
+	resp.Body.Close()
+	require.Equal(http.StatusGatewayTimeout, resp.StatusCode)
+	require.Less(time.Since(start), 5*time.Second)
+
+	// and the dial gives up once its context is done
+	c.ConnectTimeout = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = c.DialContext(ctx, "tcp", "127.0.0.1:80")
+	require.Equal(errConnectTimeout, err)
+}
@@ -0,0 +1,80 @@
+//go:build !noprometheus
+// +build !noprometheus
+
+package instrument
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	sessions = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "katzensocks_sessions_total",
+			Help: "Number of sessions created",
+		},
+	)
+	streamBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "katzensocks_stream_bytes_total",
+			Help: "Number of bytes relayed, sent to or received from the targets",
+		},
+		[]string{"direction"},
+	)
+	reconnects = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "katzensocks_reconnects_total",
+			Help: "Number of failed attempts to connect to the mixnet",
+		},
+	)
+	socksNegotiation = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "katzensocks_socks_negotiation_seconds",
+			Help:    "Duration of SOCKS handshakes in seconds",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(sessions)
+	prometheus.MustRegister(streamBytes)
+	prometheus.MustRegister(reconnects)
+	prometheus.MustRegister(socksNegotiation)
+}
+
+// StartPrometheusListener serves the metrics at http://<addr>/metrics
+func StartPrometheusListener(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go http.ListenAndServe(addr, mux)
+}
+
+// SessionCreated increments the counter for sessions
+func SessionCreated() {
+	sessions.Inc()
+}
+
+// BytesSent increments the counter for bytes sent to the targets
+func BytesSent(n int) {
+	streamBytes.With(prometheus.Labels{"direction": "sent"}).Add(float64(n))
+}
+
+// BytesReceived increments the counter for bytes received from the targets
+func BytesReceived(n int) {
+	streamBytes.With(prometheus.Labels{"direction": "received"}).Add(float64(n))
+}
+
+// Reconnect increments the counter for failed attempts to connect
+func Reconnect() {
+	reconnects.Inc()
+}
+
+// SocksNegotiation observes the duration of a SOCKS handshake
+func SocksNegotiation(d time.Duration) {
+	socksNegotiation.Observe(d.Seconds())
+}
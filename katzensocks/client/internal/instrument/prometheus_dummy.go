@@ -0,0 +1,26 @@
+//go:build noprometheus
+// +build noprometheus
+
+package instrument
+
+import (
+	"time"
+)
+
+// StartPrometheusListener does nothing
+func StartPrometheusListener(addr string) {}
+
+// SessionCreated increments the counter for sessions
+func SessionCreated() {}
+
+// BytesSent increments the counter for bytes sent to the targets
+func BytesSent(n int) {}
+
+// BytesReceived increments the counter for bytes received from the targets
+func BytesReceived(n int) {}
+
+// Reconnect increments the counter for failed attempts to connect
+func Reconnect() {}
+
+// SocksNegotiation observes the duration of a SOCKS handshake
+func SocksNegotiation(d time.Duration) {}
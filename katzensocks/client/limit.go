@@ -0,0 +1,128 @@
+// limit.go - katzensocks client per source connection limit
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/katzenpost/katzenpost/katzensocks/socks5"
+)
+
+const (
+	// maxRefusing bounds the connections over MaxConns that are answered
+	// with a SOCKS failure at once.  Beyond it they are closed outright,
+	// so that a flood of connections does not pile up refusals.
+	maxRefusing = 16
+
+	// refuseTimeout bounds the SOCKS handshake of a refused connection.
+	refuseTimeout = time.Second
+)
+
+// sourceIP returns the IP address of the source of a connection.
+func sourceIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// acquireSource counts a new connection from source, and returns false
+// without counting it if source already has MaxConnsPerIP connections.
+func (c *Client) acquireSource(source string) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.connsPerIP == nil {
+		c.connsPerIP = make(map[string]int)
+	}
+	if c.MaxConnsPerIP > 0 && c.connsPerIP[source] >= c.MaxConnsPerIP {
+		c.stats.RejectedPerIP++
+		return false
+	}
+	c.connsPerIP[source]++
+	return true
+}
+
+// releaseSource uncounts a connection from source.
+func (c *Client) releaseSource(source string) {
+	c.Lock()
+	defer c.Unlock()
+	if c.connsPerIP[source]--; c.connsPerIP[source] <= 0 {
+		delete(c.connsPerIP, source)
+	}
+}
+
+// acquireConn counts a new connection, and returns false without counting
+// it if MaxConns connections are already being served.
+func (c *Client) acquireConn() bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.MaxConns > 0 && c.conns >= c.MaxConns {
+		c.stats.RejectedMaxConns++
+		return false
+	}
+	c.conns++
+	return true
+}
+
+// releaseConn uncounts a connection.
+func (c *Client) releaseConn() {
+	c.Lock()
+	defer c.Unlock()
+	c.conns--
+}
+
+// acquireRefusal counts a refusal in progress, and returns false without
+// counting it if maxRefusing are in progress already.
+func (c *Client) acquireRefusal() bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.refusing >= maxRefusing {
+		return false
+	}
+	c.refusing++
+	return true
+}
+
+// releaseRefusal uncounts a refusal.
+func (c *Client) releaseRefusal() {
+	c.Lock()
+	defer c.Unlock()
+	c.refusing--
+}
+
+// refuse answers the SOCKS request on conn with a general failure, without
+// serving it, and closes conn.  The client is given at most refuseTimeout
+// to send its request, so refused connections do not linger.
+func (c *Client) refuse(conn net.Conn) {
+	defer conn.Close()
+	req := socks5.NewRequest(conn)
+	negotiate := c.NegotiationTimeout
+	if negotiate == 0 || negotiate > refuseTimeout {
+		negotiate = refuseTimeout
+	}
+	req.SetDeadlines(negotiate, 0)
+	if err := req.Handshake(context.Background()); err != nil {
+		return
+	}
+	req.Reply(socks5.ReplyGeneralFailure)
+}
@@ -0,0 +1,172 @@
+// limit_test.go - katzensocks client per source connection limit tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/katzenpost/katzensocks/socks5"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/op/go-logging.v1"
+)
+
+// sourceConn is a net.Conn from a chosen source address.
+type sourceConn struct {
+	net.Conn
+	source net.Addr
+}
+
+func (c *sourceConn) RemoteAddr() net.Addr {
+	return c.source
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	require := require.New(t)
+
+	c := &Client{MaxConnsPerIP: 2, log: logging.MustGetLogger("limit_test")}
+	busy := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	other := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1234}
+
+	// fill the cap of busy with long lived connections
+	require.True(c.acquireSource(sourceIP(busy)))
+	require.True(c.acquireSource(sourceIP(busy)))
+
+	// the excess connection is refused with a SOCKS failure
+	local, remote := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		c.SocksHandler(&sourceConn{Conn: remote, source: busy})
+		close(done)
+	}()
+	// VER = 05, NMETHODS = 01, METHODS = [00], then
+	// VER = 05, CMD = 01, RSV = 00, ATYPE = 01, DST = 127.0.0.1:80
+	_, err := local.Write([]byte{0x05, 0x01, 0x00})
+	require.NoError(err)
+	resp := make([]byte, 2)
+	_, err = io.ReadFull(local, resp)
+	require.NoError(err)
+	require.Equal([]byte{0x05, 0x00}, resp)
+	_, err = local.Write([]byte{0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0, 80})
+	require.NoError(err)
+	resp = make([]byte, 10)
+	_, err = io.ReadFull(local, resp)
+	require.NoError(err)
+	require.Equal(byte(socks5.ReplyConnectionNotAllowed), resp[1])
+	<-done
+
+	stats := c.Stats()
+	require.Equal(uint64(1), stats.RejectedPerIP)
+	require.Equal(2, stats.ActiveConnections)
+
+	// another source is unaffected
+	require.True(c.acquireSource(sourceIP(other)))
+	require.True(c.acquireSource(sourceIP(&net.TCPAddr{IP: other.IP, Port: 4321})))
+
+	// closing a connection makes room for a new one
+	c.releaseSource(sourceIP(busy))
+	require.True(c.acquireSource(sourceIP(busy)))
+	require.False(c.acquireSource(sourceIP(busy)))
+	require.Equal(uint64(2), c.Stats().RejectedPerIP)
+}
+
+func TestMaxConns(t *testing.T) {
+	require := require.New(t)
+
+	c := &Client{MaxConns: 1, log: logging.MustGetLogger("limit_test")}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	serveErr := make(chan error)
+	go func() {
+		serveErr <- c.Serve(ln)
+	}()
+
+	// fill the limit with a long lived connection
+	require.True(c.acquireConn())
+
+	// the excess connection is refused with a SOCKS failure
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(err)
+	defer conn.Close()
+	// VER = 05, NMETHODS = 01, METHODS = [00], then
+	// VER = 05, CMD = 01, RSV = 00, ATYPE = 01, DST = 127.0.0.1:80
+	_, err = conn.Write([]byte{0x05, 0x01, 0x00})
+	require.NoError(err)
+	resp := make([]byte, 2)
+	_, err = io.ReadFull(conn, resp)
+	require.NoError(err)
+	require.Equal([]byte{0x05, 0x00}, resp)
+	_, err = conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0, 80})
+	require.NoError(err)
+	resp = make([]byte, 10)
+	_, err = io.ReadFull(conn, resp)
+	require.NoError(err)
+	require.Equal(byte(socks5.ReplyGeneralFailure), resp[1])
+	_, err = conn.Read(resp)
+	require.Equal(io.EOF, err)
+	require.Equal(uint64(1), c.Stats().RejectedMaxConns)
+
+	// closing a connection makes room for a new one
+	c.releaseConn()
+	require.True(c.acquireConn())
+	require.False(c.acquireConn())
+
+	ln.Close()
+	require.Error(<-serveErr)
+}
+
+func TestMaxConnsFlood(t *testing.T) {
+	require := require.New(t)
+
+	c := &Client{MaxConns: 1, NegotiationTimeout: time.Minute, log: logging.MustGetLogger("limit_test")}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer ln.Close()
+	go c.Serve(ln)
+	require.True(c.acquireConn())
+
+	// silent connections over the limit are refused a few at a time, and
+	// the others are closed at once
+	var conns []net.Conn
+	for i := 0; i < 2*maxRefusing; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(err)
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	require.Eventually(func() bool {
+		return c.Stats().RejectedMaxConns == 2*maxRefusing
+	}, time.Second, 10*time.Millisecond)
+	c.Lock()
+	require.Equal(maxRefusing, c.refusing)
+	c.Unlock()
+
+	// and the refusals give up on them within refuseTimeout rather than
+	// the negotiation timeout
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(refuseTimeout + time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		require.Equal(io.EOF, err)
+	}
+	require.Eventually(func() bool {
+		c.Lock()
+		defer c.Unlock()
+		return c.refusing == 0
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,167 @@
+// listen.go - katzensocks client SOCKS listeners
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// unixScheme prefixes the path of a Unix domain socket to listen on.
+const unixScheme = "unix://"
+
+// DefaultBindAddress is the address the SOCKS listener binds to, unless
+// another is given, so that it is not reachable from other hosts.
+const DefaultBindAddress = "127.0.0.1"
+
+// BindAddress returns the address for ListenSOCKS to listen on, from bind,
+// which is an IP address, possibly bracketed IPv6, with or without a
+// port, or a unix:// path.  The port is used if bind has none.  Anything
+// but an IP address or localhost is rejected, rather than risking
+// listening on all interfaces.
+func BindAddress(bind string, port int) (string, error) {
+	if strings.HasPrefix(bind, unixScheme) {
+		return bind, nil
+	}
+	if bind == "" {
+		bind = DefaultBindAddress
+	}
+	host, p, err := net.SplitHostPort(bind)
+	if err != nil {
+		host, p = bind, strconv.Itoa(port)
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+		}
+	}
+	if host != "localhost" {
+		if _, err := netip.ParseAddr(host); err != nil {
+			return "", fmt.Errorf("invalid bind address %q: %w", bind, err)
+		}
+	}
+	if n, err := strconv.ParseUint(p, 10, 16); err != nil || n == 0 {
+		return "", fmt.Errorf("invalid port in bind address %q", bind)
+	}
+	return net.JoinHostPort(host, p), nil
+}
+
+// ListenSOCKS listens for SOCKS connections on addr, which is a TCP
+// host:port, or unix:// followed by the path of a Unix domain socket.  A
+// Unix domain socket is only accessible to its owner, and a stale one left
+// by an earlier run is removed.
+func ListenSOCKS(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixScheme) {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, unixScheme)
+	if path == "" {
+		return nil, fmt.Errorf("no path in %q", addr)
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// ListenTLS wraps the connections accepted by ln in TLS, with the
+// certificate and key in the PEM files certFile and keyFile, for SOCKS
+// clients that reach the listener over an untrusted network.
+func ListenTLS(ln net.Listener, certFile, keyFile string) (net.Listener, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("TLS requires both a certificate and a key")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}), nil
+}
+
+// removeStaleSocket removes the Unix domain socket at path unless it is in
+// use.  Files that are not sockets are left alone.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use", path)
+	}
+	return os.Remove(path)
+}
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation.
+const listenFDsStart = 3
+
+// SystemdFiles returns the sockets passed by systemd socket activation,
+// starting with file descriptor 3, or none if the process was not socket
+// activated.  The LISTEN_ environment variables are cleared, so that they
+// are not inherited by child processes.
+func SystemdFiles() ([]*os.File, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	return listenFDs(pid, fds, listenFDsStart)
+}
+
+// listenFDs returns the files of the sockets numbered from start, if the
+// LISTEN_PID pid is this process.
+func listenFDs(pid, fds string, start int) ([]*os.File, error) {
+	if pid == "" || fds == "" {
+		return nil, nil
+	}
+	p, err := strconv.Atoi(pid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_PID %q: %w", pid, err)
+	}
+	if p != os.Getpid() {
+		// the sockets were meant for another process
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+	files := make([]*os.File, 0, n)
+	for fd := start; fd < start+n; fd++ {
+		syscall.CloseOnExec(fd)
+		files = append(files, os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%d", fd)))
+	}
+	return files, nil
+}
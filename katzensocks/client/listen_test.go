@@ -0,0 +1,197 @@
+// listen_test.go - katzensocks client SOCKS listener tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/katzenpost/client/utils"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/op/go-logging.v1"
+)
+
+func TestListenSOCKSUnix(t *testing.T) {
+	require := require.New(t)
+	path := filepath.Join(t.TempDir(), "socks.sock")
+
+	// a stale socket is replaced
+	stale, err := net.Listen("unix", path)
+	require.NoError(err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := ListenSOCKS("unix://" + path)
+	require.NoError(err)
+	fi, err := os.Stat(path)
+	require.NoError(err)
+	require.Equal(os.FileMode(0600), fi.Mode().Perm())
+
+	// a socket in use is not
+	_, err = ListenSOCKS("unix://" + path)
+	require.Error(err)
+
+	desc := &utils.ServiceDescriptor{Provider: "gateway", Parameters: map[string]interface{}{CapabilitiesParameter: "tcp,mux"}}
+	c := &Client{
+		Multiplex: true,
+		descs:     []*utils.ServiceDescriptor{desc},
+		log:       logging.MustGetLogger("listen_test"),
+		buildCircuit: func(desc *utils.ServiceDescriptor, tgt *url.URL, isolation string) (*circuit, error) {
+			return echoCircuit(t, desc)
+		},
+	}
+	serveErr := make(chan error)
+	go func() {
+		serveErr <- c.Serve(ln)
+	}()
+
+	// SOCKS is served over the socket
+	conn, err := net.Dial("unix", path)
+	require.NoError(err)
+	require.NoError(socksEcho(conn, "", "hello over unix"))
+	conn.Close()
+
+	ln.Close()
+	require.Error(<-serveErr)
+}
+
+// writeTestCert writes a self signed certificate and its key to PEM files
+// in dir.
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	require := require.New(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(err)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func TestListenTLS(t *testing.T) {
+	require := require.New(t)
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer ln.Close()
+	_, err = ListenTLS(ln, certFile, "")
+	require.Error(err)
+	tlsLn, err := ListenTLS(ln, certFile, keyFile)
+	require.NoError(err)
+
+	desc := &utils.ServiceDescriptor{Provider: "gateway", Parameters: map[string]interface{}{CapabilitiesParameter: "tcp,mux"}}
+	c := &Client{
+		Multiplex: true,
+		descs:     []*utils.ServiceDescriptor{desc},
+		log:       logging.MustGetLogger("listen_test"),
+		buildCircuit: func(desc *utils.ServiceDescriptor, tgt *url.URL, isolation string) (*circuit, error) {
+			return echoCircuit(t, desc)
+		},
+	}
+	go c.Serve(tlsLn)
+
+	// SOCKS is served over TLS
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	require.NoError(err)
+	require.NoError(socksEcho(conn, "", "hello over tls"))
+	conn.Close()
+}
+
+func TestListenSOCKSNotASocket(t *testing.T) {
+	require := require.New(t)
+	path := filepath.Join(t.TempDir(), "socks.sock")
+	require.NoError(os.WriteFile(path, []byte("keep"), 0600))
+
+	_, err := ListenSOCKS("unix://" + path)
+	require.Error(err)
+	_, err = os.Stat(path)
+	require.NoError(err)
+}
+
+func TestListenFDs(t *testing.T) {
+	require := require.New(t)
+
+	// not socket activated, or activated for another process
+	files, err := listenFDs("", "", listenFDsStart)
+	require.NoError(err)
+	require.Empty(files)
+	files, err = listenFDs(strconv.Itoa(os.Getpid()+1), "1", listenFDsStart)
+	require.NoError(err)
+	require.Empty(files)
+	_, err = listenFDs(strconv.Itoa(os.Getpid()), "x", listenFDsStart)
+	require.Error(err)
+
+	// pass a listener as systemd would
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	require.NoError(err)
+	defer f.Close()
+	fd, err := syscall.Dup(int(f.Fd()))
+	require.NoError(err)
+
+	files, err = listenFDs(strconv.Itoa(os.Getpid()), "1", fd)
+	require.NoError(err)
+	require.Len(files, 1)
+	inherited, err := net.FileListener(files[0])
+	require.NoError(err)
+	files[0].Close()
+	defer inherited.Close()
+	require.Equal(ln.Addr().String(), inherited.Addr().String())
+}
+
+func TestBindAddress(t *testing.T) {
+	require := require.New(t)
+	for bind, want := range map[string]string{
+		"":                   "127.0.0.1:4242",
+		"127.0.0.1":          "127.0.0.1:4242",
+		"0.0.0.0:1080":       "0.0.0.0:1080",
+		"::1":                "[::1]:4242",
+		"[::1]":              "[::1]:4242",
+		"[::1]:1080":         "[::1]:1080",
+		"[fe80::1%lo]:1080":  "[fe80::1%lo]:1080",
+		"localhost":          "localhost:4242",
+		"unix:///run/s.sock": "unix:///run/s.sock",
+	} {
+		addr, err := BindAddress(bind, 4242)
+		require.NoError(err, bind)
+		require.Equal(want, addr, bind)
+	}
+	for _, bind := range []string{"example.com", "[::1", "::1]:80", "127.0.0.1:0", "127.0.0.1:65536", "[::1]:x"} {
+		_, err := BindAddress(bind, 4242)
+		require.Error(err, bind)
+	}
+}
@@ -0,0 +1,186 @@
+// mux.go - katzensocks client circuit multiplexing
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+
+	"github.com/katzenpost/katzenpost/client/utils"
+	"github.com/katzenpost/katzenpost/katzensocks/common"
+	"github.com/katzenpost/katzenpost/katzensocks/socks5"
+)
+
+// CapabilityMux is the ability to carry many streams over one circuit.
+const CapabilityMux Capability = "mux"
+
+var (
+	errMuxRefused = errors.New("Gateway refused to multiplex the session")
+	errNoCircuit  = errors.New("No Gateway offers multiplexing")
+)
+
+// circuit is a session with a gateway that carries many connections, each
+// as a stream of its Mux.
+type circuit struct {
+	id       []byte
+	desc     *utils.ServiceDescriptor
+	mux      *common.Mux
+	compress bool
+
+	// isolation is the key of the connections that may share the circuit.
+	isolation string
+}
+
+func (ci *circuit) closed() bool {
+	select {
+	case <-ci.mux.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// circuitFor returns an open circuit to a gateway able to reach tgt,
+// building one if there is none.  Only connections of the same isolation
+// key share a circuit.  If gateway is set, the circuit is with that
+// gateway where it is able.  Circuits are built one at a time, so that
+// concurrent connections share the first circuit rather than each
+// building their own.
+func (c *Client) circuitFor(tgt *url.URL, isolation, gateway string) (*circuit, error) {
+	required := append(TargetCapabilities(tgt), CapabilityMux)
+	required = append(required, c.RequiredCapabilities...)
+
+	c.circuitLock.Lock()
+	defer c.circuitLock.Unlock()
+	open := c.circuits[:0]
+	for _, ci := range c.circuits {
+		if !ci.closed() {
+			open = append(open, ci)
+		}
+	}
+	c.circuits = open
+	for _, ci := range c.circuits {
+		if ci.isolation == isolation && hasCapabilities(ci.desc, required) && (gateway == "" || ci.desc.Provider == gateway) {
+			return ci, nil
+		}
+	}
+
+	c.Lock()
+	descs, preferred := c.candidatesFor(gateway)
+	desc, err := selectGateway(descs, preferred, required, c.GatewaySelector)
+	c.Unlock()
+	if err != nil {
+		return nil, errNoCircuit
+	}
+	build := c.buildCircuit
+	if build == nil {
+		build = c.dialCircuit
+	}
+	ci, err := build(desc, tgt, isolation)
+	if err != nil {
+		return nil, err
+	}
+	ci.isolation = isolation
+	c.circuits = append(c.circuits, ci)
+	return ci, nil
+}
+
+// dialCircuit sets up a multiplexed session with the gateway desc.
+func (c *Client) dialCircuit(desc *utils.ServiceDescriptor, tgt *url.URL, isolation string) (*circuit, error) {
+	id := c.newSessionTo(desc, isolation)
+	if err := <-c.Topup(id); err != nil {
+		return nil, fmt.Errorf("topup: %w", err)
+	}
+	if err := <-c.dial(id, tgt, true); err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+	c.Lock()
+	compress := c.compressed[string(id)]
+	c.Unlock()
+
+	qconn := c.newQUICProxyConn(id)
+	errCh := make(chan error, 2)
+	c.transport(id, desc, qconn, errCh)
+	mux, err := qconn.DialMux(context.Background(), common.UniqAddr(id))
+	if err != nil {
+		qconn.Close()
+		return nil, err
+	}
+	c.Go(func() {
+		select {
+		case err := <-errCh:
+			c.log.Errorf("Circuit %x failed: %v", id, err)
+		case <-mux.Done():
+		case <-c.HaltCh():
+		}
+		mux.Close()
+		qconn.Close()
+	})
+	c.log.Debugf("Built circuit %x to %s", id, desc.Provider)
+	return &circuit{id: id, desc: desc, mux: mux, compress: compress}, nil
+}
+
+// proxyStream proxies conn to tgt over a stream of ci, which must be
+// opened before ctx is done.
+func (c *Client) proxyStream(ctx context.Context, ci *circuit, req *socks5.Request, conn net.Conn, tgt *url.URL, rec *AuditRecord) {
+	rec.Session = fmt.Sprintf("%x", ci.id)
+	stream, err := ci.mux.OpenStream(ctx, tgt)
+	if err != nil && ctx.Err() != nil {
+		c.log.Errorf("Timed out opening stream to %v", tgt)
+		rec.Outcome = OutcomeTimeout
+		req.Reply(socks5.ReplyTTLExpired)
+		return
+	}
+	if err != nil {
+		c.log.Errorf("Failed to open stream to %v: %v", tgt, err)
+		rec.Outcome = OutcomeDialFailed
+		req.Reply(socks5.ReplyHostUnreachable)
+		return
+	}
+	if ci.compress {
+		stream = common.NewCompressedConn(stream)
+	}
+	if err := req.Reply(socks5.ReplySucceeded); err != nil {
+		c.log.Errorf("Failed to encode response: %v", err)
+		stream.Close()
+		return
+	}
+
+	counted := &countingConn{Conn: conn, session: c.countSession(ci.id)}
+	defer c.uncountSession(ci.id)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(counted, stream)
+		counted.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(stream, counted)
+		stream.Close()
+	}()
+	wg.Wait()
+	rec.Outcome = OutcomeSucceeded
+	rec.BytesSent, rec.BytesReceived = counted.read.Load(), counted.written.Load()
+	c.log.Infof("Stream of circuit %x to %v finished, tags: %v", ci.id, tgt, req.Args)
+}
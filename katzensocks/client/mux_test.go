@@ -0,0 +1,219 @@
+// mux_test.go - katzensocks client circuit multiplexing tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/katzenpost/katzenpost/client/utils"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/katzensocks/common"
+	"github.com/katzenpost/katzenpost/katzensocks/socks5"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/op/go-logging.v1"
+)
+
+// relayPackets carries the packets written by from to to, as the mixnet
+// would, until either is halted.
+func relayPackets(from, to *common.QUICProxyConn) {
+	for {
+		pkt := make([]byte, 1452)
+		n, _, err := from.ReadPacket(context.Background(), pkt)
+		if err != nil {
+			return
+		}
+		if _, err = to.WritePacket(context.Background(), pkt[:n], from.LocalAddr()); err != nil {
+			return
+		}
+	}
+}
+
+// echoCircuit builds a circuit to an in memory gateway that echoes every
+// stream.
+func echoCircuit(t *testing.T, desc *utils.ServiceDescriptor) (*circuit, error) {
+	return testCircuit(t, desc, func(s net.Conn) { io.Copy(s, s) })
+}
+
+// testCircuit builds a circuit to an in memory gateway that accepts every
+// stream and passes it to serve.
+func testCircuit(t *testing.T, desc *utils.ServiceDescriptor, serve func(net.Conn)) (*circuit, error) {
+	// quic-go multiplexes connections by local address, so use fresh ones
+	id := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return nil, err
+	}
+	client := common.NewQUICProxyConn(append(id, []byte("client")...))
+	gateway := common.NewQUICProxyConn(id)
+	go relayPackets(client, gateway)
+	go relayPackets(gateway, client)
+	t.Cleanup(func() {
+		client.Halt()
+		gateway.Halt()
+	})
+
+	go func() {
+		m, err := gateway.AcceptMux(context.Background())
+		if err != nil {
+			return
+		}
+		for {
+			s, err := m.AcceptStream(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				defer s.Close()
+				if s.Accept() == nil {
+					serve(s)
+				}
+			}()
+		}
+	}()
+
+	m, err := client.DialMux(context.Background(), gateway.LocalAddr())
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { m.Close() })
+	return &circuit{id: id, desc: desc, mux: m}, nil
+}
+
+// socksEcho requests a connection to 127.0.0.1:80 on conn, authenticating
+// as user if it is not empty, and checks that msg is echoed.
+func socksEcho(conn net.Conn, user string, msg string) error {
+	// VER = 05, NMETHODS = 01, METHODS = [00] or [02]
+	method := socks5.AuthNoneRequired
+	if user != "" {
+		method = socks5.AuthUsernamePassword
+	}
+	conn.Write([]byte{0x05, 0x01, method})
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if user != "" {
+		// VER = 01, ULEN, UNAME = user, PLEN = 01, PASSWD = "x"
+		auth := append([]byte{0x01, byte(len(user))}, user...)
+		conn.Write(append(auth, 0x01, 'x'))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return err
+		}
+	}
+	// VER = 05, CMD = 01, RSV = 00, ATYPE = 01, DST = 127.0.0.1:80
+	conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0, 80})
+	resp = make([]byte, 10)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[1] != byte(socks5.ReplySucceeded) {
+		return fmt.Errorf("reply %d", resp[1])
+	}
+	conn.Write([]byte(msg))
+	echoed := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, echoed); err != nil {
+		return err
+	}
+	if string(echoed) != msg {
+		return fmt.Errorf("echoed %q", echoed)
+	}
+	return nil
+}
+
+func TestMultiplexSharesCircuit(t *testing.T) {
+	require := require.New(t)
+
+	desc := &utils.ServiceDescriptor{Provider: "gateway", Parameters: map[string]interface{}{CapabilitiesParameter: "tcp,mux"}}
+	builds := new(atomic.Int32)
+	c := &Client{
+		Multiplex: true,
+		descs:     []*utils.ServiceDescriptor{desc},
+		log:       logging.MustGetLogger("mux_test"),
+		buildCircuit: func(desc *utils.ServiceDescriptor, tgt *url.URL, isolation string) (*circuit, error) {
+			builds.Add(1)
+			return echoCircuit(t, desc)
+		},
+	}
+
+	const conns = 5
+	var wg sync.WaitGroup
+	errCh := make(chan error, conns)
+	for i := 0; i < conns; i++ {
+		local, remote := net.Pipe()
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			c.SocksHandler(remote)
+		}()
+		go func(i int) {
+			defer wg.Done()
+			defer local.Close()
+			if err := socksEcho(local, "", fmt.Sprintf("hello from connection %d", i)); err != nil {
+				errCh <- fmt.Errorf("connection %d: %w", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		require.NoError(err)
+	}
+	require.Equal(int32(1), builds.Load())
+	require.Len(c.circuits, 1)
+}
+
+func TestIsolateSOCKSAuth(t *testing.T) {
+	require := require.New(t)
+
+	desc := &utils.ServiceDescriptor{Provider: "gateway", Parameters: map[string]interface{}{CapabilitiesParameter: "tcp,mux"}}
+	builds := new(atomic.Int32)
+	c := &Client{
+		Multiplex:        true,
+		IsolateSOCKSAuth: true,
+		descs:            []*utils.ServiceDescriptor{desc},
+		log:              logging.MustGetLogger("mux_test"),
+		buildCircuit: func(desc *utils.ServiceDescriptor, tgt *url.URL, isolation string) (*circuit, error) {
+			builds.Add(1)
+			return echoCircuit(t, desc)
+		},
+	}
+
+	// connections of the same user share a circuit, others do not
+	for _, user := range []string{"alice", "bob", "alice", "bob", ""} {
+		local, remote := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			c.SocksHandler(remote)
+			close(done)
+		}()
+		require.NoError(socksEcho(local, user, "hello from "+user))
+		local.Close()
+		<-done
+	}
+	require.Equal(int32(3), builds.Load())
+	isolation := []string{}
+	for _, ci := range c.circuits {
+		isolation = append(isolation, ci.isolation)
+	}
+	require.ElementsMatch([]string{"alice", "bob", ""}, isolation)
+}
@@ -0,0 +1,108 @@
+// pac.go - katzensocks client proxy auto-config endpoint
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// PAC returns a proxy auto-config file sending browsers to the SOCKS
+// listener at socksAddr and the HTTP CONNECT proxy at httpAddr, either of
+// which may be empty.  The destinations that policy, if set, does not
+// allow are connected to DIRECT, bypassing the mixnet.
+//
+// PAC files can not match IPv6 addresses against prefixes, so with an
+// allow policy every IPv6 address is sent to the proxies, and with a block
+// policy none is connected to DIRECT.  The Client enforces the policy in
+// either case.
+func PAC(socksAddr, httpAddr string, policy *Policy) string {
+	var proxies []string
+	if socksAddr != "" {
+		proxies = append(proxies, "SOCKS5 "+socksAddr, "SOCKS "+socksAddr)
+	}
+	if httpAddr != "" {
+		proxies = append(proxies, "PROXY "+httpAddr)
+	}
+	proxy := fmt.Sprintf("%q", strings.Join(proxies, "; "))
+
+	b := new(strings.Builder)
+	fmt.Fprintf(b, "function FindProxyForURL(url, host) {\n")
+	if policy == nil {
+		fmt.Fprintf(b, "\treturn %s;\n}\n", proxy)
+		return b.String()
+	}
+	fmt.Fprintf(b, "\tvar ipv4 = /^[0-9]+\\.[0-9]+\\.[0-9]+\\.[0-9]+$/.test(host);\n")
+	fmt.Fprintf(b, "\tvar ipv6 = host.indexOf(\":\") >= 0;\n")
+	fmt.Fprintf(b, "\tvar listed = false;\n")
+	ipv6 := false
+	for _, prefix := range policy.Prefixes() {
+		if !prefix.Addr().Is4() {
+			ipv6 = true
+			continue
+		}
+		mask := net.IP(net.CIDRMask(prefix.Bits(), 32))
+		fmt.Fprintf(b, "\tlisted = listed || (ipv4 && isInNet(host, %q, %q));\n", prefix.Addr(), mask)
+	}
+	if ipv6 && policy.Mode == PolicyAllow {
+		fmt.Fprintf(b, "\tlisted = listed || ipv6;\n")
+	}
+	for _, glob := range policy.Globs() {
+		fmt.Fprintf(b, "\tlisted = listed || (!ipv4 && !ipv6 && shExpMatch(host.toLowerCase(), %q));\n", glob)
+	}
+	if policy.Mode == PolicyAllow {
+		fmt.Fprintf(b, "\treturn listed ? %s : \"DIRECT\";\n}\n", proxy)
+	} else {
+		fmt.Fprintf(b, "\treturn listed ? \"DIRECT\" : %s;\n}\n", proxy)
+	}
+	return b.String()
+}
+
+// PACHandler serves the PAC of the SOCKS listener at socksAddr and the
+// HTTP CONNECT proxy at httpAddr, and the current destination policy, at
+// /proxy.pac.  Listeners bound to an unspecified address are given as the
+// address the PAC was requested on, so that other hosts on the network
+// are sent to an address they can reach.
+func (c *Client) PACHandler(socksAddr, httpAddr string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/proxy.pac", func(w http.ResponseWriter, r *http.Request) {
+		local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		c.Lock()
+		policy := c.policy
+		c.Unlock()
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		fmt.Fprint(w, PAC(pacAddress(socksAddr, local), pacAddress(httpAddr, local), policy))
+	})
+	return mux
+}
+
+// pacAddress returns addr, with its host replaced by the IP address of
+// local if it is unspecified.
+func pacAddress(addr string, local net.Addr) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	ip := net.ParseIP(host)
+	tcpAddr, ok := local.(*net.TCPAddr)
+	if ip == nil || !ip.IsUnspecified() || !ok {
+		return addr
+	}
+	return net.JoinHostPort(tcpAddr.IP.String(), port)
+}
@@ -0,0 +1,67 @@
+// pac_test.go - katzensocks client proxy auto-config tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPAC(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal("function FindProxyForURL(url, host) {\n\treturn \"SOCKS5 10.0.0.1:4242; SOCKS 10.0.0.1:4242\";\n}\n",
+		PAC("10.0.0.1:4242", "", nil))
+
+	file := filepath.Join(t.TempDir(), "policy")
+	require.NoError(os.WriteFile(file, []byte("10.0.0.0/8\n2001:db8::/32\n*.example.com\n"), 0600))
+	allow, err := LoadPolicy(file, PolicyAllow)
+	require.NoError(err)
+	pac := PAC("", "10.0.0.1:8080", allow)
+	require.Contains(pac, `isInNet(host, "10.0.0.0", "255.0.0.0")`)
+	require.Contains(pac, `shExpMatch(host.toLowerCase(), "*.example.com")`)
+	require.Contains(pac, "listed = listed || ipv6;")
+	require.Contains(pac, `return listed ? "PROXY 10.0.0.1:8080" : "DIRECT";`)
+
+	block, err := LoadPolicy(file, PolicyBlock)
+	require.NoError(err)
+	pac = PAC("", "10.0.0.1:8080", block)
+	require.NotContains(pac, "listed = listed || ipv6;")
+	require.Contains(pac, `return listed ? "DIRECT" : "PROXY 10.0.0.1:8080";`)
+}
+
+func TestPACHandler(t *testing.T) {
+	require := require.New(t)
+
+	c := &Client{}
+	srv := httptest.NewServer(c.PACHandler("0.0.0.0:4242", "[::1]:8080"))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/proxy.pac")
+	require.NoError(err)
+	defer resp.Body.Close()
+	require.Equal("application/x-ns-proxy-autoconfig", resp.Header.Get("Content-Type"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(err)
+	require.Contains(string(body), `"SOCKS5 127.0.0.1:4242; SOCKS 127.0.0.1:4242; PROXY [::1]:8080"`)
+}
@@ -0,0 +1,143 @@
+// payment.go - katzensocks client session payment
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/katzenpost/katzenpost/katzensocks/cashu"
+)
+
+const (
+	// SessionValidity is how long a gateway serves a session after each
+	// topup.
+	SessionValidity = 60 * time.Minute
+
+	// DefaultTopupThreshold is how long before a session runs out it is
+	// topped up again, if it is relaying connections.
+	DefaultTopupThreshold = 5 * time.Minute
+
+	// satoshisPerTopup is the payment sent with each topup.
+	satoshisPerTopup = 1
+)
+
+// PaymentProvider pays the gateways for sessions.
+type PaymentProvider interface {
+	// Topup makes sure that funds are available to pay for a session,
+	// depositing more if needed.
+	Topup(ctx context.Context) error
+
+	// Token returns a payment of amount satoshis to send to a gateway.
+	Token(ctx context.Context, amount int64) ([]byte, error)
+}
+
+// CashuPayment pays with the tokens of a cashu wallet.
+type CashuPayment struct {
+	wallet *cashu.CashuApiClient
+}
+
+// NewCashuPayment returns a CashuPayment drawing on wallet.
+func NewCashuPayment(wallet *cashu.CashuApiClient) *CashuPayment {
+	return &CashuPayment{wallet: wallet}
+}
+
+// Topup implements PaymentProvider.  The wallet can not yet be refilled
+// from here, so a low balance is reported as an error.
+func (p *CashuPayment) Topup(ctx context.Context) error {
+	balance, err := p.wallet.GetBalance()
+	if err != nil {
+		return err
+	}
+	if balance.Balance < satoshisPerTopup {
+		// this should prompt the user to create a lightning invoice
+		// after creating the invoice with cashu.CreateInvoice and displaying to user
+		// it should call cashu.CheckInvoice repeatedly until the invoice is paid
+		return fmt.Errorf("wallet balance of %d sats is too low", balance.Balance)
+	}
+	return nil
+}
+
+// Token implements PaymentProvider.
+func (p *CashuPayment) Token(ctx context.Context, amount int64) ([]byte, error) {
+	resp, err := p.wallet.SendToken(cashu.SendRequest{Amount: amount})
+	if err != nil {
+		return nil, err
+	}
+	return []byte(resp.Token), nil
+}
+
+// paid records that the session id was topped up at t.
+func (c *Client) paid(id []byte, t time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	if c.paidUntil == nil {
+		c.paidUntil = make(map[string]time.Time)
+	}
+	c.paidUntil[string(id)] = t.Add(SessionValidity)
+}
+
+// renewSessions tops up the sessions relaying connections before they run
+// out, checking twice per TopupThreshold, until the Client is halted.
+func (c *Client) renewSessions() {
+	interval := c.TopupThreshold / 2
+	if interval < minReapInterval {
+		interval = minReapInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.HaltCh():
+			return
+		case now := <-ticker.C:
+			for _, id := range c.dueSessions(now) {
+				id := id
+				c.Go(func() {
+					if err := <-c.Topup(id); err != nil {
+						c.log.Errorf("Failed to renew session %x: %v", id, err)
+					}
+					c.Lock()
+					delete(c.renewing, string(id))
+					c.Unlock()
+				})
+			}
+		}
+	}
+}
+
+// dueSessions returns the sessions relaying connections that run out
+// within TopupThreshold of now, and are not being renewed already.
+func (c *Client) dueSessions(now time.Time) [][]byte {
+	c.Lock()
+	defer c.Unlock()
+	if c.renewing == nil {
+		c.renewing = make(map[string]bool)
+	}
+	due := [][]byte{}
+	for id, until := range c.paidUntil {
+		if _, busy := c.sessionCounters[id]; !busy || c.renewing[id] {
+			continue
+		}
+		if until.Sub(now) < c.TopupThreshold {
+			c.renewing[id] = true
+			due = append(due, []byte(id))
+		}
+	}
+	return due
+}
@@ -0,0 +1,82 @@
+// payment_test.go - katzensocks client session payment tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/katzenpost/katzensocks/cashu"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCashuPayment(t *testing.T) {
+	require := require.New(t)
+
+	balance := 10
+	wallet := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/balance":
+			fmt.Fprintf(w, `{"balance": %d}`, balance)
+		case "/send":
+			fmt.Fprintf(w, `{"balance": %d, "token": "cashuA%s"}`, balance, r.URL.Query().Get("amount"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer wallet.Close()
+
+	p := NewCashuPayment(cashu.NewCashuApiClient(nil, wallet.URL))
+	require.NoError(p.Topup(context.Background()))
+	token, err := p.Token(context.Background(), satoshisPerTopup)
+	require.NoError(err)
+	require.Equal("cashuA1", string(token))
+
+	balance = 0
+	require.Error(p.Topup(context.Background()))
+}
+
+func TestDueSessions(t *testing.T) {
+	require := require.New(t)
+
+	c := &Client{TopupThreshold: 5 * time.Minute}
+	now := time.Now()
+	for id, paid := range map[string]time.Time{
+		"expiring": now.Add(time.Minute - SessionValidity),
+		"paid":     now,
+		"idle":     now.Add(time.Minute - SessionValidity),
+	} {
+		c.paid([]byte(id), paid)
+	}
+	c.countSession([]byte("expiring"))
+	c.countSession([]byte("paid"))
+
+	require.Equal([][]byte{[]byte("expiring")}, c.dueSessions(now))
+	// a session is renewed once at a time
+	require.Empty(c.dueSessions(now))
+	// and a renewed session is due once it runs out again
+	c.Lock()
+	delete(c.renewing, "expiring")
+	c.Unlock()
+	c.paid([]byte("expiring"), now)
+	require.Empty(c.dueSessions(now))
+	require.Len(c.dueSessions(now.Add(SessionValidity)), 2)
+}
@@ -0,0 +1,125 @@
+// pkicache.go - katzensocks client PKI document cache
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/katzenpost/katzenpost/client/config"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/epochtime"
+	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/wire"
+)
+
+// PKICacheFile is the name of the PKI document cache in a data directory.
+const PKICacheFile = "pki.cbor"
+
+// pkiRefreshTimeout limits the background fetch of a cached document.
+const pkiRefreshTimeout = 2 * time.Minute
+
+// GetPKIWithCache is like GetPKI, but returns the document cached in
+// cacheFile if it is for the current epoch, while a fresh one is fetched
+// in the background.  Fetched documents are cached for the next start.
+func GetPKIWithCache(ctx context.Context, cfgFile, cacheFile string) (pki.Client, *pki.Document, error) {
+	cfg, err := config.LoadFile(cfgFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return GetPKIFromConfigWithCache(ctx, cfg, cacheFile)
+}
+
+// GetPKIFromConfigWithCache is like GetPKIWithCache, but uses an already
+// parsed config.
+func GetPKIFromConfigWithCache(ctx context.Context, cfg *config.Config, cacheFile string) (pki.Client, *pki.Document, error) {
+	cc, err := GetClientFromConfig(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	linkKey, _ := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+	pkiClient, err := cfg.NewPKIClient(cc.GetBackendLog(), cfg.UpstreamProxyConfig(), linkKey, cfg.Debug.PreferedTransports)
+	if err != nil {
+		return nil, nil, err
+	}
+	epoch, _, _ := epochtime.Now()
+	doc, err := cachedPKI(ctx, pkiClient, cacheFile, epoch)
+	return pkiClient, doc, err
+}
+
+// cachedPKI returns the document of epoch from cacheFile, refreshing the
+// cache in the background, or else fetches and caches it.  A cached
+// document is verified as a fetched one is, and never used past its
+// epoch.
+func cachedPKI(ctx context.Context, pkiClient pki.Client, cacheFile string, epoch uint64) (*pki.Document, error) {
+	if doc, err := loadPKICache(pkiClient, cacheFile, epoch); err == nil {
+		go func() {
+			ctx, cancelFn := context.WithTimeout(context.Background(), pkiRefreshTimeout)
+			defer cancelFn()
+			fetchPKI(ctx, pkiClient, cacheFile, epoch)
+		}()
+		return doc, nil
+	}
+	return fetchPKI(ctx, pkiClient, cacheFile, epoch)
+}
+
+// fetchPKI fetches the document of epoch and writes it to cacheFile.  A
+// failure to cache the document is not an error.
+func fetchPKI(ctx context.Context, pkiClient pki.Client, cacheFile string, epoch uint64) (*pki.Document, error) {
+	doc, raw, err := pkiClient.Get(ctx, epoch)
+	if err != nil {
+		return nil, err
+	}
+	savePKICache(cacheFile, raw)
+	return doc, nil
+}
+
+func loadPKICache(pkiClient pki.Client, cacheFile string, epoch uint64) (*pki.Document, error) {
+	raw, err := os.ReadFile(cacheFile)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := pkiClient.Deserialize(raw)
+	if err != nil {
+		return nil, err
+	}
+	if doc.Epoch != epoch {
+		return nil, fmt.Errorf("cached document is for epoch %d, not %d", doc.Epoch, epoch)
+	}
+	return doc, nil
+}
+
+// savePKICache replaces cacheFile with raw, so that a reader never sees a
+// partly written document.
+func savePKICache(cacheFile string, raw []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(cacheFile), filepath.Base(cacheFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), cacheFile)
+}
@@ -0,0 +1,84 @@
+// pkicache_test.go - katzensocks client PKI document cache tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePKI serves documents that serialize to their epoch.
+type fakePKI struct {
+	pki.Client
+	gets atomic.Int32
+	down bool
+}
+
+func (f *fakePKI) Get(ctx context.Context, epoch uint64) (*pki.Document, []byte, error) {
+	f.gets.Add(1)
+	if f.down {
+		return nil, nil, errors.New("authority unreachable")
+	}
+	return &pki.Document{Epoch: epoch}, []byte(strconv.FormatUint(epoch, 10)), nil
+}
+
+func (f *fakePKI) Deserialize(raw []byte) (*pki.Document, error) {
+	epoch, err := strconv.ParseUint(string(raw), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &pki.Document{Epoch: epoch}, nil
+}
+
+func TestPKICache(t *testing.T) {
+	require := require.New(t)
+	cacheFile := filepath.Join(t.TempDir(), PKICacheFile)
+
+	// the first start fetches and caches the document
+	f := &fakePKI{}
+	doc, err := cachedPKI(context.Background(), f, cacheFile, 42)
+	require.NoError(err)
+	require.Equal(uint64(42), doc.Epoch)
+	raw, err := os.ReadFile(cacheFile)
+	require.NoError(err)
+	require.Equal("42", string(raw))
+
+	// later starts use the cache, even while the authority is down
+	f = &fakePKI{down: true}
+	doc, err = cachedPKI(context.Background(), f, cacheFile, 42)
+	require.NoError(err)
+	require.Equal(uint64(42), doc.Epoch)
+	require.Eventually(func() bool { return f.gets.Load() == 1 }, time.Second, 10*time.Millisecond)
+
+	// but not past the epoch of the cached document
+	_, err = cachedPKI(context.Background(), f, cacheFile, 43)
+	require.Error(err)
+
+	// nor if it can not be verified
+	require.NoError(os.WriteFile(cacheFile, []byte("forged"), 0600))
+	_, err = cachedPKI(context.Background(), f, cacheFile, 42)
+	require.Error(err)
+}
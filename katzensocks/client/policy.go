@@ -0,0 +1,59 @@
+// policy.go - katzensocks client destination policy
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import "github.com/katzenpost/katzenpost/katzensocks/common"
+
+// PolicyMode is whether a Policy lists the allowed or the blocked
+// destinations.
+type PolicyMode = common.PolicyMode
+
+const (
+	// PolicyAllow allows only the listed destinations.
+	PolicyAllow = common.PolicyAllow
+	// PolicyBlock allows all but the listed destinations.
+	PolicyBlock = common.PolicyBlock
+)
+
+// Policy restricts the destinations that can be reached through the
+// Client, see common.Policy.
+type Policy = common.Policy
+
+// LoadPolicy reads a Policy in mode from file, see common.LoadPolicy.
+func LoadPolicy(file string, mode PolicyMode) (*Policy, error) {
+	return common.LoadPolicy(file, mode)
+}
+
+// SetPolicy replaces the destination policy of the Client, or removes it
+// if p is nil.
+func (c *Client) SetPolicy(p *Policy) {
+	c.Lock()
+	defer c.Unlock()
+	c.policy = p
+}
+
+// allows returns true iff the destination policy allows host, and counts
+// it as rejected otherwise.
+func (c *Client) allows(host string) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.policy == nil || c.policy.Allows(host) {
+		return true
+	}
+	c.stats.RejectedPolicy++
+	return false
+}
@@ -0,0 +1,61 @@
+// policy_test.go - katzensocks client destination policy tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/katzenpost/katzenpost/client/utils"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/op/go-logging.v1"
+)
+
+func TestPolicyRejects(t *testing.T) {
+	require := require.New(t)
+
+	file := filepath.Join(t.TempDir(), "policy")
+	require.NoError(os.WriteFile(file, []byte("127.0.0.0/8\n"), 0600))
+	policy, err := LoadPolicy(file, PolicyBlock)
+	require.NoError(err)
+
+	desc := &utils.ServiceDescriptor{Provider: "gateway", Parameters: map[string]interface{}{CapabilitiesParameter: "tcp,mux"}}
+	c := &Client{
+		Multiplex: true,
+		descs:     []*utils.ServiceDescriptor{desc},
+		log:       logging.MustGetLogger("policy_test"),
+		buildCircuit: func(desc *utils.ServiceDescriptor, tgt *url.URL, isolation string) (*circuit, error) {
+			return echoCircuit(t, desc)
+		},
+	}
+	c.SetPolicy(policy)
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	go c.SocksHandler(remote)
+	require.EqualError(socksEcho(local, "", "hello"), "reply 2")
+	require.Equal(uint64(1), c.Stats().RejectedPolicy)
+
+	c.SetPolicy(nil)
+	local, remote = net.Pipe()
+	defer local.Close()
+	go c.SocksHandler(remote)
+	require.NoError(socksEcho(local, "", "hello"))
+}
@@ -0,0 +1,160 @@
+// probe.go - katzensocks client reachability probes
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/katzenpost/client/utils"
+	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/quic-go/quic-go"
+)
+
+// DefaultUDPProbeTimeout is how long a UDP probe waits for a reply.
+const DefaultUDPProbeTimeout = 3 * time.Second
+
+// ErrUDPBlocked is returned when no reply to a UDP probe is received.
+var ErrUDPBlocked = errors.New("outbound UDP appears to be blocked")
+
+// ProbeUDP tests whether outbound UDP to addr works by starting a QUIC
+// handshake.  Any reply from the peer, even one refusing the handshake,
+// shows that UDP is passed, so only silence is reported as ErrUDPBlocked.
+func ProbeUDP(ctx context.Context, addr string, timeout time.Duration) error {
+	ctx, cancelFn := context.WithTimeout(ctx, timeout)
+	defer cancelFn()
+	tlsConf := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"katzenpost-probe"}}
+	conn, err := quic.DialAddr(ctx, addr, tlsConf, &quic.Config{HandshakeIdleTimeout: timeout})
+	if err == nil {
+		conn.CloseWithError(0, "")
+		return nil
+	}
+
+	var (
+		transportErr *quic.TransportError
+		appErr       *quic.ApplicationError
+		versionErr   *quic.VersionNegotiationError
+		resetErr     *quic.StatelessResetError
+	)
+	switch {
+	case errors.As(err, &transportErr), errors.As(err, &appErr),
+		errors.As(err, &versionErr), errors.As(err, &resetErr):
+		return nil
+	}
+	return fmt.Errorf("%w: %s: %v", ErrUDPBlocked, addr, err)
+}
+
+// QUICAddresses returns the host:port addresses of the QUIC transports
+// of the providers in doc, which are the entries to the mixnet.
+func QUICAddresses(doc *pki.Document) []string {
+	addrs := []string{}
+	for _, desc := range doc.Providers {
+		for _, a := range desc.Addresses[pki.TransportQUIC] {
+			u, err := url.Parse(a)
+			if err != nil {
+				continue
+			}
+			addrs = append(addrs, u.Host)
+		}
+	}
+	return addrs
+}
+
+// CheckUDP probes the QUIC entry addresses and returns true iff any of
+// them can be reached over UDP.  Otherwise it logs a warning that QUIC
+// and HTTP3 features are unavailable; SOCKS is unaffected as it is
+// carried over whichever link transport works.
+func (c *Client) CheckUDP(ctx context.Context, addrs []string, timeout time.Duration) bool {
+	if len(addrs) == 0 {
+		c.log.Debugf("No QUIC entry addresses to probe")
+		return false
+	}
+	var err error
+	for _, addr := range addrs {
+		if err = ProbeUDP(ctx, addr, timeout); err == nil {
+			c.log.Debugf("UDP to %s is reachable", addr)
+			return true
+		}
+	}
+	c.log.Warningf("QUIC and HTTP3 features are unavailable, continuing with SOCKS only: %v", err)
+	return false
+}
+
+// GatewayProbe is the outcome of probing a gateway.
+type GatewayProbe struct {
+	Provider string
+	RTT      time.Duration
+	Err      error
+}
+
+// ProbeGateway measures the round trip time through the mixnet to the
+// gateway desc, by setting up a session with it that is then forgotten.
+// Only the mixnet round trip is measured, not the payment for it.
+func (c *Client) ProbeGateway(desc *utils.ServiceDescriptor) (time.Duration, error) {
+	id := c.newSessionTo(desc, "")
+	defer func() {
+		c.Lock()
+		c.forgetSession(string(id))
+		c.Unlock()
+	}()
+	stats := c.pathStatsFor(id)
+	if err := <-c.Topup(id); err != nil && stats.RTT() == 0 {
+		return 0, err
+	}
+	if stats.RTT() == 0 {
+		return 0, errors.New("no round trip completed")
+	}
+	return stats.RTT(), nil
+}
+
+// ProbeGateways probes every gateway concurrently, and returns the
+// results from the fastest to the unreachable gateways.
+func (c *Client) ProbeGateways() []GatewayProbe {
+	c.Lock()
+	descs := append([]*utils.ServiceDescriptor{}, c.descs...)
+	c.Unlock()
+
+	probes := make([]GatewayProbe, len(descs))
+	var wg sync.WaitGroup
+	for i, desc := range descs {
+		wg.Add(1)
+		go func(i int, desc *utils.ServiceDescriptor) {
+			defer wg.Done()
+			rtt, err := c.ProbeGateway(desc)
+			probes[i] = GatewayProbe{Provider: desc.Provider, RTT: rtt, Err: err}
+		}(i, desc)
+	}
+	wg.Wait()
+	sortProbes(probes)
+	return probes
+}
+
+// sortProbes orders probes from the fastest to the unreachable gateways.
+func sortProbes(probes []GatewayProbe) {
+	sort.SliceStable(probes, func(i, j int) bool {
+		if (probes[i].Err == nil) != (probes[j].Err == nil) {
+			return probes[i].Err == nil
+		}
+		return probes[i].RTT < probes[j].RTT
+	})
+}
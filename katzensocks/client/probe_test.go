@@ -0,0 +1,120 @@
+// probe_test.go - katzensocks client UDP reachability probe tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	kquic "github.com/katzenpost/katzenpost/quic"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const testProbeTimeout = 500 * time.Millisecond
+
+// blackhole returns the address of a UDP socket that never replies.
+func blackhole(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			if _, _, err := conn.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestProbeUDP(t *testing.T) {
+	require := require.New(t)
+
+	err := ProbeUDP(context.Background(), blackhole(t), testProbeTimeout)
+	require.ErrorIs(err, ErrUDPBlocked)
+
+	// a QUIC server that refuses the probe's ALPN still proves UDP works
+	ln, err := quic.ListenAddr("127.0.0.1:0", kquic.GenerateTLSConfig(), nil)
+	require.NoError(err)
+	defer ln.Close()
+	go func() {
+		for {
+			if _, err := ln.Accept(context.Background()); err != nil {
+				return
+			}
+		}
+	}()
+	require.NoError(ProbeUDP(context.Background(), ln.Addr().String(), testProbeTimeout))
+}
+
+func TestSOCKSWithUDPBlocked(t *testing.T) {
+	require := require.New(t)
+
+	logBuf := new(bytes.Buffer)
+	log := logging.MustGetLogger("probe_test")
+	log.SetBackend(logging.AddModuleLevel(logging.NewLogBackend(logBuf, "", 0)))
+	c := &Client{log: log}
+
+	require.False(c.CheckUDP(context.Background(), []string{blackhole(t)}, testProbeTimeout))
+	require.Contains(logBuf.String(), "QUIC and HTTP3 features are unavailable")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	served := make(chan error, 1)
+	go func() {
+		served <- c.Serve(ln)
+	}()
+
+	// VER = 05, NMETHODS = 01, METHODS = [00]
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(err)
+	defer conn.Close()
+	_, err = conn.Write([]byte{0x05, 0x01, 0x00})
+	require.NoError(err)
+	resp := make([]byte, 2)
+	require.NoError(conn.SetReadDeadline(time.Now().Add(5 * time.Second)))
+	_, err = io.ReadFull(conn, resp)
+	require.NoError(err)
+	require.Equal([]byte{0x05, 0x00}, resp)
+
+	ln.Close()
+	require.Error(<-served)
+}
+
+func TestSortProbes(t *testing.T) {
+	require := require.New(t)
+
+	probes := []GatewayProbe{
+		{Provider: "down", Err: errors.New("timeout")},
+		{Provider: "slow", RTT: 3 * time.Second},
+		{Provider: "fast", RTT: time.Second},
+	}
+	sortProbes(probes)
+	providers := []string{}
+	for _, p := range probes {
+		providers = append(providers, p.Provider)
+	}
+	require.Equal([]string{"fast", "slow", "down"}, providers)
+}
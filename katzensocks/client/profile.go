@@ -0,0 +1,101 @@
+// profile.go - katzensocks client config profiles
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/katzenpost/katzenpost/client/config"
+)
+
+// Profile overrides the listener, gateway and retry settings of the
+// client when selected by name from the [profiles.NAME] tables of a
+// config file.  Zero values leave the settings unchanged.
+type Profile struct {
+	// Bind and Port are the SOCKS listener address and port.
+	Bind string
+	Port int
+
+	// Gateway is the provider name of the gateway to use.
+	Gateway string
+
+	// Retry limits the reconnection attempts, or is unlimited if
+	// negative.  Delay is the wait in seconds before the first one.
+	Retry *int
+	Delay *int
+}
+
+// LoadProfile loads the config file cfgFile and the profile name from
+// it, which is nil if name is empty.
+func LoadProfile(cfgFile, name string) (*config.Config, *Profile, error) {
+	b, err := os.ReadFile(cfgFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg, err := config.Load(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if name == "" {
+		return cfg, nil, nil
+	}
+	profiles := struct {
+		Profiles map[string]*Profile `toml:"profiles"`
+	}{}
+	if err := toml.Unmarshal(b, &profiles); err != nil {
+		return nil, nil, err
+	}
+	p, ok := profiles.Profiles[name]
+	if !ok {
+		return nil, nil, fmt.Errorf("%s has no profile %q", cfgFile, name)
+	}
+	return cfg, p, nil
+}
+
+// SetLogging overrides the logging of cfg with level and file, where set.
+// Logs go to stderr unless a file is given here or in cfg, as stdout is
+// where the client prints its listings.
+func SetLogging(cfg *config.Config, level, file string) error {
+	l := config.Logging{Level: "NOTICE"}
+	if cfg.Logging != nil {
+		l = *cfg.Logging
+	}
+	if level != "" {
+		switch level = strings.ToUpper(level); level {
+		case "ERROR", "WARNING", "NOTICE", "INFO", "DEBUG":
+		default:
+			return fmt.Errorf("invalid log level %q", level)
+		}
+		l.Level = level
+	}
+	if file != "" {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+		l.File = abs
+	}
+	if l.File == "" {
+		l.File = os.Stderr.Name()
+	}
+	cfg.Logging = &l
+	return nil
+}
@@ -0,0 +1,104 @@
+// profile_test.go - katzensocks client config profile tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	vServerConfig "github.com/katzenpost/katzenpost/authority/voting/server/config"
+	"github.com/katzenpost/katzenpost/client/config"
+	"github.com/katzenpost/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/katzenpost/core/crypto/nike/ecdh"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/sphinx/geo"
+	"github.com/katzenpost/katzenpost/core/wire"
+	"github.com/stretchr/testify/require"
+)
+
+const testProfiles = `
+[profiles.public]
+  Port = 4343
+  Gateway = "provider1"
+
+[profiles.private]
+  Bind = "[::1]"
+  Retry = -1
+  Delay = 0
+`
+
+func TestLoadProfile(t *testing.T) {
+	require := require.New(t)
+
+	_, idKey := cert.Scheme.NewKeypair()
+	_, linkKey := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+	cfg := &config.Config{
+		SphinxGeometry: geo.GeometryFromUserForwardPayloadLength(ecdh.NewEcdhNike(rand.Reader), 2000, true, 5),
+		Logging:        &config.Logging{Level: "ERROR"},
+		UpstreamProxy:  &config.UpstreamProxy{Type: "none"},
+		VotingAuthority: &config.VotingAuthority{
+			Peers: []*vServerConfig.Authority{{
+				Identifier:        "authority",
+				IdentityPublicKey: idKey,
+				LinkPublicKey:     linkKey,
+				Addresses:         []string{"127.0.0.1:30000"},
+			}},
+		},
+	}
+	buf := new(bytes.Buffer)
+	require.NoError(toml.NewEncoder(buf).Encode(cfg))
+	buf.WriteString(testProfiles)
+	cfgFile := filepath.Join(t.TempDir(), "katzensocks.toml")
+	require.NoError(os.WriteFile(cfgFile, buf.Bytes(), 0600))
+
+	loaded, p, err := LoadProfile(cfgFile, "")
+	require.NoError(err)
+	require.Nil(p)
+	require.Len(loaded.VotingAuthority.Peers, 1)
+
+	_, p, err = LoadProfile(cfgFile, "public")
+	require.NoError(err)
+	require.Equal(&Profile{Port: 4343, Gateway: "provider1"}, p)
+
+	_, p, err = LoadProfile(cfgFile, "private")
+	require.NoError(err)
+	require.Equal("[::1]", p.Bind)
+	require.Equal(-1, *p.Retry)
+	require.Equal(0, *p.Delay)
+
+	_, _, err = LoadProfile(cfgFile, "missing")
+	require.ErrorContains(err, `no profile "missing"`)
+}
+
+func TestSetLogging(t *testing.T) {
+	require := require.New(t)
+
+	cfg := &config.Config{Logging: &config.Logging{Level: "INFO"}}
+	require.NoError(SetLogging(cfg, "", ""))
+	require.Equal(config.Logging{Level: "INFO", File: os.Stderr.Name()}, *cfg.Logging)
+
+	cfg = &config.Config{Logging: &config.Logging{Level: "INFO", File: "/var/log/katzensocks.log"}}
+	require.NoError(SetLogging(cfg, "debug", "client.log"))
+	wd, err := os.Getwd()
+	require.NoError(err)
+	require.Equal(config.Logging{Level: "DEBUG", File: filepath.Join(wd, "client.log")}, *cfg.Logging)
+
+	require.Error(SetLogging(cfg, "verbose", ""))
+}
@@ -0,0 +1,69 @@
+// ratelimit.go - katzensocks client session rate limits
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket of bytes, refilled at rate bytes per
+// second up to a burst of one second's worth.
+type rateLimiter struct {
+	sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter of rate bytes per second, or nil for
+// no limit if rate is not positive.
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate)}
+}
+
+// reserve takes n bytes from the bucket at now, and returns how long to
+// wait until they are available.
+func (l *rateLimiter) reserve(n int, now time.Time) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// wait blocks until n bytes may pass.  A nil limiter never blocks.
+func (l *rateLimiter) wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	if d := l.reserve(n, time.Now()); d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,58 @@
+// ratelimit_test.go - katzensocks client session rate limit tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	require := require.New(t)
+
+	require.Nil(newRateLimiter(0))
+	l := newRateLimiter(1000)
+	now := time.Now()
+
+	// a second's worth passes at once, then the bucket is empty
+	require.Zero(l.reserve(1000, now))
+	require.Equal(500*time.Millisecond, l.reserve(500, now))
+
+	// it refills at the rate, repaying the debt first
+	require.Zero(l.reserve(500, now.Add(time.Second)))
+	require.Equal(100*time.Millisecond, l.reserve(100, now.Add(time.Second)))
+
+	// and up to a burst of a second's worth
+	now = now.Add(time.Minute)
+	require.Zero(l.reserve(1000, now))
+	require.Equal(time.Second, l.reserve(1000, now))
+}
+
+func TestSessionRateLimit(t *testing.T) {
+	require := require.New(t)
+
+	c := &Client{RateDown: 1000}
+	sc := c.countSession([]byte("session"))
+	require.Nil(sc.up)
+	require.NotNil(sc.down)
+
+	// connections of the session share its budget
+	require.Same(sc, c.countSession([]byte("session")))
+	require.NotSame(sc.down, c.countSession([]byte("other")).down)
+}
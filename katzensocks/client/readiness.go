@@ -0,0 +1,89 @@
+// readiness.go - katzensocks client readiness endpoint
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// Readiness states reported by the Readiness endpoint.
+const (
+	StateConnecting   = "connecting"
+	StateConnected    = "connected"
+	StateReconnecting = "reconnecting"
+)
+
+// Online returns true unless the connection to the mixnet has been lost.
+func (c *Client) Online() bool {
+	c.Lock()
+	defer c.Unlock()
+	return !c.offline
+}
+
+// Readiness serves the state of the connection to the mixnet for
+// container health probes.  It is created before the session is set up,
+// and reports ready only once SetClient is given the Client of a live
+// session, and for as long as that session is connected.  The connection
+// status events are handled by the Client whether or not a tunnel is open.
+type Readiness struct {
+	sync.Mutex
+	c *Client
+}
+
+// SetClient marks the session of c as set up.
+func (r *Readiness) SetClient(c *Client) {
+	r.Lock()
+	defer r.Unlock()
+	r.c = c
+}
+
+// State returns the state of the connection to the mixnet.
+func (r *Readiness) State() string {
+	r.Lock()
+	c := r.c
+	r.Unlock()
+	switch {
+	case c == nil:
+		return StateConnecting
+	case c.Online():
+		return StateConnected
+	default:
+		return StateReconnecting
+	}
+}
+
+// Handler serves /ready, which answers 200 while connected to the mixnet
+// and 503 otherwise, and /live, which answers 200 while the process runs.
+func (r *Readiness) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/live", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, req *http.Request) {
+		state := r.State()
+		w.Header().Set("Content-Type", "application/json")
+		if state != StateConnected {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(struct {
+			State string `json:"state"`
+		}{state})
+	})
+	return mux
+}
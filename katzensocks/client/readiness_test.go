@@ -0,0 +1,65 @@
+// readiness_test.go - katzensocks client readiness endpoint tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/katzenpost/client"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/op/go-logging.v1"
+)
+
+func TestReadiness(t *testing.T) {
+	require := require.New(t)
+
+	r := new(Readiness)
+	probe := func(path string) (int, string) {
+		w := httptest.NewRecorder()
+		r.Handler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code, w.Body.String()
+	}
+
+	// alive but not ready until the session is set up
+	code, _ := probe("/live")
+	require.Equal(http.StatusOK, code)
+	code, body := probe("/ready")
+	require.Equal(http.StatusServiceUnavailable, code)
+	require.JSONEq(`{"state": "connecting"}`, body)
+
+	c := &Client{FailClosed: true, log: logging.MustGetLogger("readiness_test")}
+	events := make(chan client.Event)
+	c.Go(func() { c.eventWorker(events) })
+	defer c.Halt()
+	r.SetClient(c)
+	code, body = probe("/ready")
+	require.Equal(http.StatusOK, code)
+	require.JSONEq(`{"state": "connected"}`, body)
+
+	// not ready while the mixnet connection is lost, even with no tunnel
+	// open, and ready again once it is restored
+	events <- &client.ConnectionStatusEvent{IsConnected: false}
+	require.Eventually(func() bool { return r.State() == StateReconnecting }, time.Second, 10*time.Millisecond)
+	code, body = probe("/ready")
+	require.Equal(http.StatusServiceUnavailable, code)
+	require.JSONEq(`{"state": "reconnecting"}`, body)
+	events <- &client.ConnectionStatusEvent{IsConnected: true}
+	require.Eventually(func() bool { return r.State() == StateConnected }, time.Second, 10*time.Millisecond)
+}
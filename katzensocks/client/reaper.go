@@ -0,0 +1,100 @@
+// reaper.go - katzensocks client idle session eviction
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import "time"
+
+// minReapInterval is the shortest interval between idle session sweeps.
+const minReapInterval = time.Second
+
+// touchSession records activity of the session id.  The caller must hold
+// the Client lock.
+func (c *Client) touchSession(id string) {
+	if c.lastActive == nil {
+		c.lastActive = make(map[string]time.Time)
+	}
+	c.lastActive[id] = time.Now()
+}
+
+// reapSessions evicts the sessions idle for longer than SessionTTL,
+// checking twice per SessionTTL, until the Client is halted.
+func (c *Client) reapSessions() {
+	interval := c.SessionTTL / 2
+	if interval < minReapInterval {
+		interval = minReapInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.HaltCh():
+			return
+		case now := <-ticker.C:
+			c.evictIdleSessions(now)
+		}
+	}
+}
+
+// evictIdleSessions forgets the sessions that have relayed no connection
+// since SessionTTL before now, closing their circuits, and returns the
+// number evicted.  Sessions with connections in progress are never idle.
+func (c *Client) evictIdleSessions(now time.Time) int {
+	c.Lock()
+	evicted := make(map[string]bool)
+	for id := range c.sessionToDesc {
+		if _, busy := c.sessionCounters[id]; busy {
+			continue
+		}
+		if last, ok := c.lastActive[id]; ok && now.Sub(last) <= c.SessionTTL {
+			continue
+		}
+		c.forgetSession(id)
+		evicted[id] = true
+		c.stats.SessionsEvicted++
+		c.log.Infof("Evicted session %x, idle for longer than %v", id, c.SessionTTL)
+	}
+	c.Unlock()
+	if len(evicted) == 0 {
+		return 0
+	}
+
+	c.circuitLock.Lock()
+	open := c.circuits[:0]
+	for _, ci := range c.circuits {
+		if evicted[string(ci.id)] {
+			ci.mux.Close()
+			continue
+		}
+		open = append(open, ci)
+	}
+	c.circuits = open
+	c.circuitLock.Unlock()
+	return len(evicted)
+}
+
+// forgetSession removes the state of the session id.  The caller must
+// hold the Client lock.
+func (c *Client) forgetSession(id string) {
+	delete(c.sessionToDesc, id)
+	delete(c.sessionTags, id)
+	delete(c.compressed, id)
+	delete(c.pathStats, id)
+	delete(c.lastActive, id)
+	delete(c.paidUntil, id)
+	delete(c.sessionTotals, id)
+	delete(c.sessionCreated, id)
+}
@@ -0,0 +1,62 @@
+// reaper_test.go - katzensocks client idle session eviction tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/katzenpost/katzenpost/client/utils"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/op/go-logging.v1"
+)
+
+func TestEvictIdleSessions(t *testing.T) {
+	require := require.New(t)
+
+	desc := &utils.ServiceDescriptor{Provider: "gateway"}
+	c := &Client{
+		SessionTTL:    time.Minute,
+		sessionToDesc: make(map[string]*utils.ServiceDescriptor),
+		log:           logging.MustGetLogger("reaper_test"),
+	}
+	idle := c.newSessionTo(desc, "")
+	busy := c.newSessionTo(desc, "")
+	recent := c.newSessionTo(desc, "")
+	ci, err := echoCircuit(t, desc)
+	require.NoError(err)
+	ci.id = idle
+	c.circuits = append(c.circuits, ci)
+
+	c.countSession(busy)
+	later := time.Now().Add(2 * time.Minute)
+	c.Lock()
+	c.lastActive[string(recent)] = later
+	c.Unlock()
+
+	require.Equal(1, c.evictIdleSessions(later))
+	require.Len(c.Sessions(), 2)
+	require.Empty(c.circuits)
+	<-ci.mux.Done()
+	require.Equal(uint64(1), c.Stats().SessionsEvicted)
+
+	// a session is idle again once its last connection is done
+	c.uncountSession(busy)
+	require.Zero(c.evictIdleSessions(time.Now()))
+	require.Equal(1, c.evictIdleSessions(later))
+	require.Len(c.Sessions(), 1)
+}
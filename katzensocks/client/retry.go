@@ -0,0 +1,107 @@
+// retry.go - katzensocks client retry policy
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"time"
+
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+)
+
+// DefaultRetryPolicy retries twice, after 1 and 2 seconds.
+var DefaultRetryPolicy = RetryPolicy{MaxRetries: 2, Delay: time.Second, Multiplier: 2}
+
+// RetryPolicy describes how failed attempts are retried.
+type RetryPolicy struct {
+	// MaxRetries is the number of retries after the first attempt, or
+	// unlimited if negative.
+	MaxRetries int
+
+	// Delay is the wait before the first retry.
+	Delay time.Duration
+
+	// Multiplier scales the wait after each retry.  Values below 1 keep
+	// the wait constant.
+	Multiplier float64
+
+	// MaxDelay caps the wait between attempts, if non zero.
+	MaxDelay time.Duration
+
+	// Jitter, if set, waits a random time of up to the backoff, so that
+	// clients that failed together do not retry in lockstep.
+	Jitter bool
+}
+
+// Backoff returns the wait before retry number attempt, counting from 0.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	d := p.Delay
+	for i := 0; i < attempt && p.Multiplier > 1; i++ {
+		d = time.Duration(float64(d) * p.Multiplier)
+		if p.MaxDelay != 0 && d >= p.MaxDelay {
+			break
+		}
+	}
+	if p.MaxDelay != 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+// Wait returns the time to wait before retry number attempt, which is the
+// Backoff, or with Jitter a random time of up to the Backoff.
+func (p RetryPolicy) Wait(attempt int) time.Duration {
+	d := p.Backoff(attempt)
+	if !p.Jitter || d <= 0 {
+		return d
+	}
+	return time.Duration(rand.NewMath().Int63n(int64(d) + 1))
+}
+
+// SetRetryPolicy replaces the retry policy of the Client.  Retries that
+// are in progress use the new policy from their next attempt on.
+func (c *Client) SetRetryPolicy(policy RetryPolicy) {
+	c.Lock()
+	defer c.Unlock()
+	c.retryPolicy = &policy
+}
+
+// RetryPolicy returns the current retry policy of the Client.
+func (c *Client) RetryPolicy() RetryPolicy {
+	c.Lock()
+	defer c.Unlock()
+	if c.retryPolicy == nil {
+		return DefaultRetryPolicy
+	}
+	return *c.retryPolicy
+}
+
+// retry calls fn until it returns false or the retries of the current
+// policy are exhausted, waiting between attempts as the policy at that
+// time prescribes.
+func (c *Client) retry(fn func() (retry bool)) {
+	sleep := c.sleep
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+	for attempt := 0; fn(); attempt++ {
+		policy := c.RetryPolicy()
+		if policy.MaxRetries >= 0 && attempt >= policy.MaxRetries {
+			return
+		}
+		sleep(policy.Wait(attempt))
+	}
+}
@@ -0,0 +1,81 @@
+// retry_test.go - katzensocks client retry policy tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	require := require.New(t)
+	p := RetryPolicy{Delay: time.Second, Multiplier: 2, MaxDelay: 5 * time.Second}
+	require.Equal(time.Second, p.Backoff(0))
+	require.Equal(2*time.Second, p.Backoff(1))
+	require.Equal(4*time.Second, p.Backoff(2))
+	require.Equal(5*time.Second, p.Backoff(3))
+	require.Equal(5*time.Second, p.Backoff(100))
+
+	p = RetryPolicy{Delay: time.Second}
+	require.Equal(time.Second, p.Backoff(10))
+}
+
+func TestSetRetryPolicy(t *testing.T) {
+	require := require.New(t)
+
+	var waits []time.Duration
+	c := &Client{}
+	c.sleep = func(d time.Duration) {
+		waits = append(waits, d)
+	}
+	c.SetRetryPolicy(RetryPolicy{MaxRetries: -1, Delay: 10 * time.Millisecond})
+
+	attempts := 0
+	c.retry(func() bool {
+		attempts++
+		if attempts == 3 {
+			// back off while the retries are in progress
+			c.SetRetryPolicy(RetryPolicy{MaxRetries: 4, Delay: time.Second, Multiplier: 2})
+		}
+		return true
+	})
+
+	require.Equal(5, attempts)
+	require.Equal([]time.Duration{
+		10 * time.Millisecond,
+		10 * time.Millisecond,
+		4 * time.Second,
+		8 * time.Second,
+	}, waits)
+}
+
+func TestRetryPolicyJitter(t *testing.T) {
+	require := require.New(t)
+	p := RetryPolicy{Delay: time.Second, Multiplier: 2, MaxDelay: 5 * time.Second}
+	require.Equal(p.Backoff(2), p.Wait(2))
+
+	p.Jitter = true
+	for attempt := 0; attempt < 10; attempt++ {
+		for i := 0; i < 100; i++ {
+			wait := p.Wait(attempt)
+			require.True(wait >= 0 && wait <= p.Backoff(attempt), "wait %v", wait)
+		}
+	}
+	require.Equal(time.Duration(0), RetryPolicy{Jitter: true}.Wait(0))
+}
@@ -0,0 +1,159 @@
+// selector.go - katzensocks client gateway selection policies
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/katzenpost/client/utils"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+)
+
+// GatewaySelector chooses the gateway for each new session.
+type GatewaySelector interface {
+	// Select returns one of the gateways in capable, which is never
+	// empty.
+	Select(capable []*utils.ServiceDescriptor) *utils.ServiceDescriptor
+}
+
+// latencyObserver is a GatewaySelector that learns from the round trips
+// to the gateways.
+type latencyObserver interface {
+	Observe(desc *utils.ServiceDescriptor, rtt time.Duration)
+}
+
+// Random selects a gateway uniformly at random.
+type Random struct{}
+
+// Select implements GatewaySelector.
+func (Random) Select(capable []*utils.ServiceDescriptor) *utils.ServiceDescriptor {
+	return capable[rand.NewMath().Intn(len(capable))]
+}
+
+// RoundRobin selects the gateways in turn, spreading sessions evenly.
+type RoundRobin struct {
+	sync.Mutex
+	next int
+}
+
+// Select implements GatewaySelector.
+func (r *RoundRobin) Select(capable []*utils.ServiceDescriptor) *utils.ServiceDescriptor {
+	r.Lock()
+	defer r.Unlock()
+	desc := capable[r.next%len(capable)]
+	r.next++
+	return desc
+}
+
+// LowestLatency selects the gateway with the lowest smoothed round trip
+// time.  Gateways without a measurement are selected first, so that every
+// gateway is measured.
+type LowestLatency struct {
+	sync.Mutex
+	srtt map[string]time.Duration
+}
+
+// NewLowestLatency returns a LowestLatency without measurements.
+func NewLowestLatency() *LowestLatency {
+	return &LowestLatency{srtt: make(map[string]time.Duration)}
+}
+
+// Select implements GatewaySelector.
+func (l *LowestLatency) Select(capable []*utils.ServiceDescriptor) *utils.ServiceDescriptor {
+	l.Lock()
+	defer l.Unlock()
+	var best *utils.ServiceDescriptor
+	var bestRTT time.Duration
+	for _, desc := range capable {
+		rtt, ok := l.srtt[desc.Provider]
+		if !ok {
+			return desc
+		}
+		if best == nil || rtt < bestRTT {
+			best, bestRTT = desc, rtt
+		}
+	}
+	return best
+}
+
+// Observe records a round trip to the gateway desc, smoothed as TCP does
+// with a gain of 1/8.
+func (l *LowestLatency) Observe(desc *utils.ServiceDescriptor, rtt time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	srtt, ok := l.srtt[desc.Provider]
+	if !ok {
+		l.srtt[desc.Provider] = rtt
+		return
+	}
+	l.srtt[desc.Provider] = srtt + (rtt-srtt)/8
+}
+
+// GatewayHintArg is the SOCKS argument, passed in the username as
+// gw=provider, that selects the gateway of a connection.
+const GatewayHintArg = "gw"
+
+// gatewayHint returns the gateway selected by the SOCKS arguments args, or
+// "" if none is, or if it is not a published gateway.
+func (c *Client) gatewayHint(args map[string]string) string {
+	gateway := args[GatewayHintArg]
+	if gateway == "" {
+		return ""
+	}
+	c.Lock()
+	defer c.Unlock()
+	for _, desc := range c.descs {
+		if desc.Provider == gateway {
+			return gateway
+		}
+	}
+	c.log.Warningf("Ignoring unknown gateway %s selected by SOCKS username", gateway)
+	return ""
+}
+
+// candidatesFor is candidates, preferring gateway, if set and not cooling
+// down, to the gateway set with SetGateway.  The caller must hold the
+// Client lock.
+func (c *Client) candidatesFor(gateway string) ([]*utils.ServiceDescriptor, *utils.ServiceDescriptor) {
+	descs, preferred := c.candidates()
+	if gateway == "" {
+		return descs, preferred
+	}
+	for _, desc := range descs {
+		if desc.Provider == gateway {
+			return descs, desc
+		}
+	}
+	return descs, preferred
+}
+
+// ParseGatewayPolicy returns the GatewaySelector named policy, which is
+// one of "random", "round_robin" or "lowest_latency".
+func ParseGatewayPolicy(policy string) (GatewaySelector, error) {
+	switch policy {
+	case "", "random":
+		return Random{}, nil
+	case "round_robin":
+		return new(RoundRobin), nil
+	case "lowest_latency":
+		return NewLowestLatency(), nil
+	default:
+		return nil, fmt.Errorf("unknown gateway policy %q", policy)
+	}
+}
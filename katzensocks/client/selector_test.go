@@ -0,0 +1,133 @@
+// selector_test.go - katzensocks client gateway selection tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/katzenpost/katzenpost/client/utils"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/op/go-logging.v1"
+)
+
+func testGateways(providers ...string) []*utils.ServiceDescriptor {
+	descs := []*utils.ServiceDescriptor{}
+	for _, p := range providers {
+		descs = append(descs, &utils.ServiceDescriptor{Name: "+katzensocks", Provider: p})
+	}
+	return descs
+}
+
+func TestRoundRobin(t *testing.T) {
+	require := require.New(t)
+	descs := testGateways("a", "b", "c")
+	r := new(RoundRobin)
+	for _, want := range []string{"a", "b", "c", "a", "b"} {
+		require.Equal(want, r.Select(descs).Provider)
+	}
+}
+
+func TestLowestLatency(t *testing.T) {
+	require := require.New(t)
+	descs := testGateways("a", "b", "c")
+	l := NewLowestLatency()
+
+	// unmeasured gateways are tried first
+	l.Observe(descs[0], 300*time.Millisecond)
+	require.Equal("b", l.Select(descs).Provider)
+	l.Observe(descs[1], 100*time.Millisecond)
+	l.Observe(descs[2], 200*time.Millisecond)
+	require.Equal("b", l.Select(descs).Provider)
+
+	// one slow round trip is smoothed rather than taken at face value
+	l.Observe(descs[1], 500*time.Millisecond)
+	require.Equal("b", l.Select(descs).Provider)
+	for i := 0; i < 10; i++ {
+		l.Observe(descs[1], 500*time.Millisecond)
+	}
+	require.Equal("c", l.Select(descs).Provider)
+}
+
+func TestParseGatewayPolicy(t *testing.T) {
+	require := require.New(t)
+	for policy, want := range map[string]GatewaySelector{
+		"":               Random{},
+		"random":         Random{},
+		"round_robin":    new(RoundRobin),
+		"lowest_latency": NewLowestLatency(),
+	} {
+		s, err := ParseGatewayPolicy(policy)
+		require.NoError(err)
+		require.IsType(want, s, policy)
+	}
+	_, err := ParseGatewayPolicy("fastest")
+	require.Error(err)
+}
+
+func TestNewSessionUsesSelector(t *testing.T) {
+	require := require.New(t)
+	c := &Client{
+		descs:           testGateways("a", "b"),
+		sessionToDesc:   make(map[string]*utils.ServiceDescriptor),
+		log:             logging.MustGetLogger("selector_test"),
+		GatewaySelector: new(RoundRobin),
+	}
+	selected := map[string]string{}
+	c.OnGatewaySelected = func(id []byte, gateway string) {
+		selected[string(id)] = gateway
+	}
+	for _, want := range []string{"a", "b", "a"} {
+		id, err := c.NewSession()
+		require.NoError(err)
+		require.Equal(want, c.sessionToDesc[string(id)].Provider)
+		require.Equal(want, selected[string(id)])
+	}
+	require.Len(selected, 3)
+}
+
+func TestGatewayHint(t *testing.T) {
+	require := require.New(t)
+	descs := testGateways("a", "b")
+	c := &Client{
+		descs:         descs,
+		desc:          descs[0],
+		sessionToDesc: make(map[string]*utils.ServiceDescriptor),
+		log:           logging.MustGetLogger("selector_test"),
+	}
+
+	// the hint overrides the gateway set with SetGateway
+	gateway := c.gatewayHint(map[string]string{GatewayHintArg: "b"})
+	require.Equal("b", gateway)
+	id, err := c.newSession("", gateway)
+	require.NoError(err)
+	require.Equal("b", c.sessionToDesc[string(id)].Provider)
+
+	// unknown gateways fall back to the default selection
+	gateway = c.gatewayHint(map[string]string{GatewayHintArg: "c"})
+	require.Equal("", gateway)
+	id, err = c.newSession("", gateway)
+	require.NoError(err)
+	require.Equal("a", c.sessionToDesc[string(id)].Provider)
+	require.Equal("", c.gatewayHint(map[string]string{"app": "mail"}))
+
+	// as do gateways that are cooling down
+	c.markUnhealthy(descs[1])
+	id, err = c.newSession("", "b")
+	require.NoError(err)
+	require.Equal("a", c.sessionToDesc[string(id)].Provider)
+}
@@ -0,0 +1,73 @@
+// serve.go - katzensocks client SOCKS server
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"net"
+)
+
+// Serve accepts SOCKS connections from ln until it fails.  Beyond
+// MaxConns concurrent connections, new connections are refused with a
+// SOCKS failure rather than queued, or closed outright while many are
+// being refused.  Idle sessions are evicted while it serves, if
+// SessionTTL is set, and busy ones renewed, if TopupThreshold is set.  It
+// returns nil once Drain closes ln.
+func (c *Client) Serve(ln net.Listener) error {
+	defer ln.Close()
+	if !c.serving(ln) {
+		return nil
+	}
+	c.workersOnce.Do(func() {
+		if c.SessionTTL > 0 {
+			c.Go(c.reapSessions)
+		}
+		if c.TopupThreshold > 0 {
+			c.Go(c.renewSessions)
+		}
+	})
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			c.Lock()
+			draining := c.draining
+			c.Unlock()
+			if draining {
+				return nil
+			}
+			if e, ok := err.(net.Error); ok && !e.Temporary() {
+				return err
+			}
+			continue
+		}
+		if !c.acquireConn() {
+			c.log.Warningf("Refusing connection from %s: serving %d connections", conn.RemoteAddr(), c.MaxConns)
+			if !c.acquireRefusal() {
+				conn.Close()
+				continue
+			}
+			go func() {
+				defer c.releaseRefusal()
+				c.refuse(conn)
+			}()
+			continue
+		}
+		go func() {
+			defer c.releaseConn()
+			c.SocksHandler(conn)
+		}()
+	}
+}
@@ -0,0 +1,129 @@
+// session_test.go - katzensocks client session tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/katzenpost/katzenpost/client/utils"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/op/go-logging.v1"
+)
+
+func TestSessionTags(t *testing.T) {
+	require := require.New(t)
+
+	desc := &utils.ServiceDescriptor{Name: "+katzensocks", Provider: "gateway"}
+	c := &Client{
+		descs:         []*utils.ServiceDescriptor{desc},
+		sessionToDesc: make(map[string]*utils.ServiceDescriptor),
+		log:           logging.MustGetLogger("session_test"),
+	}
+
+	id, err := c.NewSession()
+	require.NoError(err)
+	tags := map[string]string{"app": "mail", "user": "bob"}
+	c.TagSession(id, tags)
+
+	sessions := c.Sessions()
+	require.Len(sessions, 1)
+	require.Equal(id, sessions[0].ID)
+	require.Equal("gateway", sessions[0].Provider)
+	require.Equal(tags, sessions[0].Tags)
+}
+
+func TestStableSessionIDs(t *testing.T) {
+	require := require.New(t)
+
+	descs := testGateways("a", "b")
+	secret, err := LoadSessionIDSecret(filepath.Join(t.TempDir(), SessionIDSecretFile))
+	require.NoError(err)
+	newClient := func() *Client {
+		return &Client{
+			descs:            descs[:1],
+			StableSessionIDs: true,
+			SessionIDSecret:  secret,
+			sessionToDesc:    make(map[string]*utils.ServiceDescriptor),
+			log:              logging.MustGetLogger("session_test"),
+		}
+	}
+
+	// the sessions of a gateway and isolation key share a prefix, and
+	// are numbered
+	c := newClient()
+	first, err := c.newSession("alice", "")
+	require.NoError(err)
+	second, err := c.newSession("alice", "")
+	require.NoError(err)
+	require.Len(first, sessionIDLen)
+	require.Equal(first[:stableSessionIDPrefixLen], second[:stableSessionIDPrefixLen])
+	require.NotEqual(first, second)
+	other := c.newSessionTo(descs[0], "bob")
+	require.NotEqual(first[:stableSessionIDPrefixLen], other[:stableSessionIDPrefixLen])
+	other = c.newSessionTo(descs[1], "alice")
+	require.NotEqual(first[:stableSessionIDPrefixLen], other[:stableSessionIDPrefixLen])
+
+	// and are reproduced by a restarted client keeping its secret
+	id, err := newClient().newSession("alice", "")
+	require.NoError(err)
+	require.Equal(first, id)
+
+	// but not by other clients, whose ids can not be guessed
+	otherSecret, err := LoadSessionIDSecret(filepath.Join(t.TempDir(), SessionIDSecretFile))
+	require.NoError(err)
+	c = newClient()
+	c.SessionIDSecret = otherSecret
+	id, err = c.newSession("alice", "")
+	require.NoError(err)
+	require.NotEqual(first[:stableSessionIDPrefixLen], id[:stableSessionIDPrefixLen])
+	c = newClient()
+	c.SessionIDSecret = nil
+	other, err = c.newSession("alice", "")
+	require.NoError(err)
+	require.NotEqual(first[:stableSessionIDPrefixLen], other[:stableSessionIDPrefixLen])
+	require.NotEqual(id[:stableSessionIDPrefixLen], other[:stableSessionIDPrefixLen])
+
+	// ids are random by default
+	c = newClient()
+	c.StableSessionIDs = false
+	id, err = c.newSession("alice", "")
+	require.NoError(err)
+	require.NotEqual(first, id)
+}
+
+func TestLoadSessionIDSecret(t *testing.T) {
+	require := require.New(t)
+
+	// the secret is created once and kept
+	file := filepath.Join(t.TempDir(), SessionIDSecretFile)
+	secret, err := LoadSessionIDSecret(file)
+	require.NoError(err)
+	require.Len(secret, sessionIDSecretLen)
+	fi, err := os.Stat(file)
+	require.NoError(err)
+	require.Equal(os.FileMode(0600), fi.Mode().Perm())
+	loaded, err := LoadSessionIDSecret(file)
+	require.NoError(err)
+	require.Equal(secret, loaded)
+
+	// a damaged one is refused rather than replaced
+	require.NoError(os.WriteFile(file, secret[:8], 0600))
+	_, err = LoadSessionIDSecret(file)
+	require.Error(err)
+}
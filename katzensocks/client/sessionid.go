@@ -0,0 +1,128 @@
+// sessionid.go - katzensocks client session ids
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/katzenpost/katzenpost/client/utils"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/epochtime"
+)
+
+const (
+	sessionIDLen = 32
+
+	// stableSessionIDPrefixLen is the length of the part of a stable
+	// session id derived from its gateway, isolation key and epoch, which
+	// is followed by a sequence number.
+	stableSessionIDPrefixLen = 24
+
+	sessionIDSecretLen = 32
+)
+
+// SessionIDSecretFile is the name of the file of the stable session id
+// secret in a data directory.
+const SessionIDSecretFile = "session-id.key"
+
+// LoadSessionIDSecret returns the stable session id secret of file,
+// creating it if it does not exist yet.
+func LoadSessionIDSecret(file string) ([]byte, error) {
+	secret, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		secret = make([]byte, sessionIDSecretLen)
+		if _, err = io.ReadFull(rand.Reader, secret); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(err, os.ErrExist) {
+			// created meanwhile by another client
+			return LoadSessionIDSecret(file)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, err = f.Write(secret); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return secret, f.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) != sessionIDSecretLen {
+		return nil, fmt.Errorf("session id secret %s is %d bytes rather than %d", file, len(secret), sessionIDSecretLen)
+	}
+	return secret, nil
+}
+
+// StableSessionIDPrefix returns the prefix shared by the stable session
+// ids of the sessions with gateway, of the isolation key, in epoch.  It is
+// keyed with secret, so that the ids of other clients can not be guessed.
+func StableSessionIDPrefix(secret []byte, gateway, isolation string, epoch uint64) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte("katzensocks stable session id"))
+	for _, s := range []string{gateway, isolation} {
+		binary.Write(h, binary.BigEndian, uint32(len(s)))
+		h.Write([]byte(s))
+	}
+	binary.Write(h, binary.BigEndian, epoch)
+	return h.Sum(nil)[:stableSessionIDPrefixLen]
+}
+
+// sessionID returns the id of a new session with the gateway desc, for
+// connections of the isolation key.  It is random unless StableSessionIDs
+// is set, in which case it is keyed with SessionIDSecret, or with a
+// random secret of this Client if it is not set.  The caller must hold
+// the Client lock.
+func (c *Client) sessionID(desc *utils.ServiceDescriptor, isolation string) []byte {
+	if !c.StableSessionIDs {
+		id := make([]byte, sessionIDLen)
+		if _, err := io.ReadFull(rand.Reader, id); err != nil {
+			panic(err)
+		}
+		return id
+	}
+	if c.SessionIDSecret == nil {
+		c.SessionIDSecret = make([]byte, sessionIDSecretLen)
+		if _, err := io.ReadFull(rand.Reader, c.SessionIDSecret); err != nil {
+			panic(err)
+		}
+	}
+	epoch, _, _ := epochtime.Now()
+	prefix := StableSessionIDPrefix(c.SessionIDSecret, desc.Provider, isolation, epoch)
+	if c.sessionSeqs == nil {
+		c.sessionSeqs = make(map[string]uint64)
+	}
+	for {
+		seq := c.sessionSeqs[string(prefix)]
+		c.sessionSeqs[string(prefix)] = seq + 1
+		id := make([]byte, stableSessionIDPrefixLen, sessionIDLen)
+		copy(id, prefix)
+		id = binary.BigEndian.AppendUint64(id, seq)
+		if _, ok := c.sessionToDesc[string(id)]; !ok {
+			return id
+		}
+	}
+}
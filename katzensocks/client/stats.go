@@ -0,0 +1,160 @@
+// stats.go - katzensocks client statistics
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// reconnects counts the failed attempts to connect to the mixnet in
+// GetSession, which happen before there is a Client.
+var reconnects atomic.Uint64
+
+// Stats are counters of the SOCKS connections and sessions of a Client.
+type Stats struct {
+	// ActiveConnections is the number of SOCKS connections and HTTP
+	// CONNECT tunnels being served.
+	ActiveConnections int `json:"active_connections"`
+
+	// RejectedPerIP is the number of SOCKS connections rejected because
+	// their source exceeded MaxConnsPerIP.
+	RejectedPerIP uint64 `json:"rejected_per_ip"`
+
+	// RejectedMaxConns is the number of SOCKS connections rejected
+	// because MaxConns were already being served.
+	RejectedMaxConns uint64 `json:"rejected_max_conns"`
+
+	// RejectedFailClosed is the number of SOCKS connections rejected
+	// because the mixnet was unreachable and FailClosed is set.
+	RejectedFailClosed uint64 `json:"rejected_fail_closed"`
+
+	// RejectedPolicy is the number of SOCKS connections rejected because
+	// the destination policy does not allow their target.
+	RejectedPolicy uint64 `json:"rejected_policy"`
+
+	// SessionsCreated is the number of sessions created.
+	SessionsCreated uint64 `json:"sessions_created"`
+
+	// SessionsEvicted is the number of sessions evicted after being idle
+	// for longer than SessionTTL.
+	SessionsEvicted uint64 `json:"sessions_evicted"`
+
+	// ActiveSessions is the number of sessions relaying connections.
+	ActiveSessions int `json:"active_sessions"`
+
+	// Sessions are the byte counts of the active sessions, by hex id.
+	Sessions map[string]SessionStats `json:"sessions"`
+
+	// BytesSent and BytesReceived are the bytes relayed by all sessions,
+	// to and from the targets.
+	BytesSent     int64 `json:"bytes_sent"`
+	BytesReceived int64 `json:"bytes_received"`
+
+	// Reconnects is the number of failed attempts to connect to the
+	// mixnet, which are retried.
+	Reconnects uint64 `json:"reconnects"`
+}
+
+// SessionStats are the byte counts of a session.
+type SessionStats struct {
+	BytesSent     int64 `json:"bytes_sent"`
+	BytesReceived int64 `json:"bytes_received"`
+}
+
+// sessionCounter counts the bytes relayed by the connections of a
+// session, and limits their rate if RateUp or RateDown are set.
+type sessionCounter struct {
+	conns          int
+	sent, received atomic.Int64
+	up, down       *rateLimiter
+}
+
+// Stats returns a snapshot of the counters.
+func (c *Client) Stats() Stats {
+	c.Lock()
+	defer c.Unlock()
+	stats := c.stats
+	for _, n := range c.connsPerIP {
+		stats.ActiveConnections += n
+	}
+	stats.Sessions = make(map[string]SessionStats, len(c.sessionCounters))
+	for id, sc := range c.sessionCounters {
+		s := SessionStats{BytesSent: sc.sent.Load(), BytesReceived: sc.received.Load()}
+		stats.Sessions[fmt.Sprintf("%x", id)] = s
+		stats.BytesSent += s.BytesSent
+		stats.BytesReceived += s.BytesReceived
+	}
+	stats.ActiveSessions = len(c.sessionCounters)
+	stats.Reconnects = reconnects.Load()
+	return stats
+}
+
+// countSession returns the counter of the session id for a connection
+// starting to relay, which must call uncountSession when done.
+func (c *Client) countSession(id []byte) *sessionCounter {
+	c.Lock()
+	defer c.Unlock()
+	if c.sessionCounters == nil {
+		c.sessionCounters = make(map[string]*sessionCounter)
+	}
+	sc, ok := c.sessionCounters[string(id)]
+	if !ok {
+		sc = &sessionCounter{up: newRateLimiter(c.RateUp), down: newRateLimiter(c.RateDown)}
+		c.sessionCounters[string(id)] = sc
+	}
+	sc.conns++
+	return sc
+}
+
+// uncountSession is called when a connection of the session id stops
+// relaying.  The bytes of a session are added to the totals once its last
+// connection is done.
+func (c *Client) uncountSession(id []byte) {
+	c.Lock()
+	defer c.Unlock()
+	sc, ok := c.sessionCounters[string(id)]
+	if !ok {
+		return
+	}
+	if sc.conns--; sc.conns > 0 {
+		return
+	}
+	c.stats.BytesSent += sc.sent.Load()
+	c.stats.BytesReceived += sc.received.Load()
+	if c.sessionTotals == nil {
+		c.sessionTotals = make(map[string]SessionStats)
+	}
+	total := c.sessionTotals[string(id)]
+	total.BytesSent += sc.sent.Load()
+	total.BytesReceived += sc.received.Load()
+	c.sessionTotals[string(id)] = total
+	delete(c.sessionCounters, string(id))
+	c.touchSession(string(id))
+}
+
+// StatsHandler serves the Stats of the Client as JSON.
+func (c *Client) StatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(c.Stats()); err != nil {
+			c.log.Errorf("Failed to encode stats: %v", err)
+		}
+	})
+}
@@ -0,0 +1,83 @@
+// stats_test.go - katzensocks client statistics tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/katzenpost/katzenpost/client/utils"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/op/go-logging.v1"
+)
+
+func TestSessionStats(t *testing.T) {
+	require := require.New(t)
+
+	desc := &utils.ServiceDescriptor{Provider: "gateway", Parameters: map[string]interface{}{CapabilitiesParameter: "tcp,mux"}}
+	c := &Client{
+		Multiplex:     true,
+		descs:         []*utils.ServiceDescriptor{desc},
+		sessionToDesc: make(map[string]*utils.ServiceDescriptor),
+		log:           logging.MustGetLogger("stats_test"),
+		buildCircuit: func(desc *utils.ServiceDescriptor, tgt *url.URL, isolation string) (*circuit, error) {
+			return echoCircuit(t, desc)
+		},
+	}
+	_, err := c.NewSession()
+	require.NoError(err)
+	require.Equal(uint64(1), c.Stats().SessionsCreated)
+
+	// a session is counted while it relays a connection
+	sc := c.countSession([]byte("session"))
+	sc.sent.Add(3)
+	stats := c.Stats()
+	require.Equal(1, stats.ActiveSessions)
+	require.Equal(SessionStats{BytesSent: 3}, stats.Sessions["73657373696f6e"])
+	c.uncountSession([]byte("session"))
+	stats = c.Stats()
+	require.Equal(0, stats.ActiveSessions)
+	require.Equal(int64(3), stats.BytesSent)
+
+	// the bytes relayed over a circuit are added to the totals
+	msg := "hello, statistics"
+	local, remote := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		c.SocksHandler(remote)
+		close(done)
+	}()
+	require.NoError(socksEcho(local, "", msg))
+	local.Close()
+	<-done
+	stats = c.Stats()
+	require.Equal(0, stats.ActiveSessions)
+	require.Equal(int64(3+len(msg)), stats.BytesSent)
+	require.Equal(int64(len(msg)), stats.BytesReceived)
+
+	// and served as JSON
+	w := httptest.NewRecorder()
+	c.StatsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/stats", nil))
+	require.Equal("application/json", w.Header().Get("Content-Type"))
+	served := Stats{}
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &served))
+	require.Equal(stats.BytesSent, served.BytesSent)
+	require.Equal(stats.SessionsCreated, served.SessionsCreated)
+}
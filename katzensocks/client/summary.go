@@ -0,0 +1,87 @@
+// summary.go - katzensocks client PKI summary
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"encoding/hex"
+	"sort"
+
+	"github.com/katzenpost/katzenpost/client/utils"
+	"github.com/katzenpost/katzenpost/core/pki"
+)
+
+// PKISummary is the part of a PKI document relevant to choosing a
+// katzensocks gateway, in a form suitable for encoding as JSON.
+type PKISummary struct {
+	Epoch             uint64           `json:"epoch"`
+	SendRatePerMinute uint64           `json:"send_rate_per_minute"`
+	Layers            int              `json:"layers"`
+	Mixes             int              `json:"mixes"`
+	Providers         []string         `json:"providers"`
+	Gateways          []GatewaySummary `json:"gateways"`
+}
+
+// GatewaySummary describes a provider offering the katzensocks service.
+type GatewaySummary struct {
+	// Name is the endpoint of the service at Provider.
+	Name     string `json:"name"`
+	Provider string `json:"provider"`
+
+	// Addresses are the addresses of the provider, by transport.
+	Addresses map[string][]string `json:"addresses"`
+
+	// LinkKey is the hex encoded wire protocol public key of the
+	// provider.
+	LinkKey string `json:"link_key"`
+
+	Capabilities []string `json:"capabilities"`
+}
+
+// SummarizePKI returns the PKISummary of doc.
+func SummarizePKI(doc *pki.Document) *PKISummary {
+	s := &PKISummary{
+		Epoch:             doc.Epoch,
+		SendRatePerMinute: doc.SendRatePerMinute,
+		Layers:            len(doc.Topology),
+		Providers:         []string{},
+		Gateways:          []GatewaySummary{},
+	}
+	for _, layer := range doc.Topology {
+		s.Mixes += len(layer)
+	}
+	for _, p := range doc.Providers {
+		s.Providers = append(s.Providers, p.Name)
+	}
+	for _, desc := range utils.FindServices("katzensocks", doc) {
+		gw := GatewaySummary{Name: desc.Name, Provider: desc.Provider, Addresses: map[string][]string{}, Capabilities: []string{}}
+		if p, err := doc.GetProvider(desc.Provider); err == nil {
+			for t, addrs := range p.Addresses {
+				gw.Addresses[string(t)] = addrs
+			}
+			if p.LinkKey != nil {
+				gw.LinkKey = hex.EncodeToString(p.LinkKey.Bytes())
+			}
+		}
+		desc := desc
+		for c := range GatewayCapabilities(&desc) {
+			gw.Capabilities = append(gw.Capabilities, string(c))
+		}
+		sort.Strings(gw.Capabilities)
+		s.Gateways = append(s.Gateways, gw)
+	}
+	return s
+}
@@ -0,0 +1,65 @@
+// summary_test.go - katzensocks client PKI summary tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/wire"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSummarizePKI(t *testing.T) {
+	require := require.New(t)
+
+	_, linkKey := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+	doc := &pki.Document{
+		Epoch:    42,
+		Topology: [][]*pki.MixDescriptor{{{Name: "mix1"}, {Name: "mix2"}}, {{Name: "mix3"}}},
+		Providers: []*pki.MixDescriptor{
+			{
+				Name:      "provider1",
+				LinkKey:   linkKey,
+				Addresses: map[pki.Transport][]string{pki.TransportQUIC: {"quic://127.0.0.1:30001"}},
+				Kaetzchen: map[string]map[string]interface{}{"katzensocks": {"endpoint": "+socks", CapabilitiesParameter: "tcp,mux"}},
+			},
+			{Name: "provider2"},
+		},
+	}
+	s := SummarizePKI(doc)
+	require.Equal(uint64(42), s.Epoch)
+	require.Equal(2, s.Layers)
+	require.Equal(3, s.Mixes)
+	require.Equal([]string{"provider1", "provider2"}, s.Providers)
+	require.Equal([]GatewaySummary{{
+		Name:         "+socks",
+		Provider:     "provider1",
+		Addresses:    map[string][]string{"quic": {"quic://127.0.0.1:30001"}},
+		LinkKey:      hex.EncodeToString(linkKey.Bytes()),
+		Capabilities: []string{"mux", "tcp"},
+	}}, s.Gateways)
+
+	b, err := json.Marshal(s)
+	require.NoError(err)
+	decoded := new(PKISummary)
+	require.NoError(json.Unmarshal(b, decoded))
+	require.Equal(s, decoded)
+}
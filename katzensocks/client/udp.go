@@ -0,0 +1,170 @@
+// udp.go - katzensocks client UDP ASSOCIATE relay
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/katzenpost/katzensocks/common"
+	"github.com/katzenpost/katzenpost/katzensocks/socks5"
+	"gopkg.in/op/go-logging.v1"
+)
+
+// udpRelay is a net.Conn that carries the datagrams of a UDP ASSOCIATE
+// relay socket as a datagram stream, see common.WriteDatagram, so that
+// they can be proxied over a session to the gateway.  Datagrams from the
+// SOCKS client have their SOCKS5 header stripped, and the header is
+// applied again to the datagrams returned by the gateway.
+type udpRelay struct {
+	pc  net.PacketConn
+	log *logging.Logger
+
+	// allows reports whether datagrams may be sent to a host
+	allows func(host string) bool
+
+	// frames read from pc, and frames written for pc
+	outR, inR *io.PipeReader
+	outW, inW *io.PipeWriter
+
+	sync.Mutex
+	client net.Addr
+
+	closeOnce sync.Once
+}
+
+// newUDPRelay starts relaying the datagrams of pc.  Datagrams to a host
+// that allows rejects are dropped.
+func newUDPRelay(pc net.PacketConn, log *logging.Logger, allows func(host string) bool) *udpRelay {
+	r := &udpRelay{pc: pc, log: log, allows: allows}
+	r.outR, r.outW = io.Pipe()
+	r.inR, r.inW = io.Pipe()
+	go r.readClient()
+	go r.writeClient()
+	return r
+}
+
+// readClient frames the datagrams from the SOCKS client that are allowed
+// by policy.
+func (r *udpRelay) readClient() {
+	defer r.Close()
+	buf := make([]byte, 65535)
+	for {
+		n, src, err := r.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		target, _, payload, err := socks5.ParseUDPHeader(buf[:n])
+		if err != nil {
+			// fragments and malformed datagrams are dropped
+			r.log.Debugf("Dropping datagram from %v: %v", src, err)
+			continue
+		}
+		host, _, err := net.SplitHostPort(target)
+		if err != nil || !r.allows(host) {
+			r.log.Warningf("Dropping datagram to %s: not allowed by policy", target)
+			continue
+		}
+		r.Lock()
+		r.client = src
+		r.Unlock()
+		if err = common.WriteDatagram(r.outW, target, payload); err != nil {
+			return
+		}
+	}
+}
+
+// writeClient returns the framed datagrams from the gateway to the SOCKS
+// client, with their source in the SOCKS5 header.
+func (r *udpRelay) writeClient() {
+	defer r.Close()
+	for {
+		src, payload, err := common.ReadDatagram(r.inR)
+		switch {
+		case errors.Is(err, socks5.ErrUDPFragmented):
+			continue
+		case err != nil:
+			return
+		}
+		r.Lock()
+		client := r.client
+		r.Unlock()
+		if client == nil {
+			// nothing was sent, so nothing can be answered
+			continue
+		}
+		d, err := socks5.EncodeUDPHeader(src, payload)
+		if err != nil {
+			continue
+		}
+		if _, err = r.pc.WriteTo(d, client); err != nil {
+			r.log.Debugf("Failed to return datagram to %v: %v", client, err)
+		}
+	}
+}
+
+// Read implements net.Conn
+func (r *udpRelay) Read(b []byte) (int, error) {
+	return r.outR.Read(b)
+}
+
+// Write implements net.Conn
+func (r *udpRelay) Write(b []byte) (int, error) {
+	return r.inW.Write(b)
+}
+
+// Close implements net.Conn
+func (r *udpRelay) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		r.outW.Close()
+		r.inR.Close()
+		err = r.pc.Close()
+	})
+	return err
+}
+
+// LocalAddr implements net.Conn
+func (r *udpRelay) LocalAddr() net.Addr {
+	return r.pc.LocalAddr()
+}
+
+// RemoteAddr implements net.Conn, and is the address of the SOCKS client
+// once it has sent a datagram.
+func (r *udpRelay) RemoteAddr() net.Addr {
+	r.Lock()
+	defer r.Unlock()
+	return r.client
+}
+
+// SetDeadline implements net.Conn
+func (r *udpRelay) SetDeadline(t time.Time) error {
+	return r.pc.SetDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn
+func (r *udpRelay) SetReadDeadline(t time.Time) error {
+	return r.pc.SetReadDeadline(t)
+}
+
+// SetWriteDeadline implements net.Conn
+func (r *udpRelay) SetWriteDeadline(t time.Time) error {
+	return r.pc.SetWriteDeadline(t)
+}
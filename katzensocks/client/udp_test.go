@@ -0,0 +1,110 @@
+// udp_test.go - katzensocks client UDP ASSOCIATE relay tests
+// Copyright (C) 2023  Masala
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/katzenpost/katzensocks/common"
+	"github.com/katzenpost/katzenpost/katzensocks/socks5"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/op/go-logging.v1"
+)
+
+func TestUDPRelay(t *testing.T) {
+	require := require.New(t)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(err)
+	relay := newUDPRelay(pc, logging.MustGetLogger("udp_test"), func(string) bool { return true })
+	defer relay.Close()
+
+	app, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(err)
+	defer app.Close()
+	app.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// fragments are dropped, datagrams are framed without the SOCKS header
+	frag, err := socks5.EncodeUDPHeader("192.0.2.1:53", []byte("fragment"))
+	require.NoError(err)
+	frag[2] = 0x01
+	_, err = app.WriteTo(frag, pc.LocalAddr())
+	require.NoError(err)
+	d, err := socks5.EncodeUDPHeader("192.0.2.1:53", []byte("query"))
+	require.NoError(err)
+	_, err = app.WriteTo(d, pc.LocalAddr())
+	require.NoError(err)
+	target, payload, err := common.ReadDatagram(relay)
+	require.NoError(err)
+	require.Equal("192.0.2.1:53", target)
+	require.Equal([]byte("query"), payload)
+	require.Equal(app.LocalAddr().String(), relay.RemoteAddr().String())
+
+	// replies are returned to the client with the header applied
+	require.NoError(common.WriteDatagram(relay, "192.0.2.1:53", []byte("answer")))
+	buf := make([]byte, 1500)
+	n, _, err := app.ReadFrom(buf)
+	require.NoError(err)
+	src, _, payload, err := socks5.ParseUDPHeader(buf[:n])
+	require.NoError(err)
+	require.Equal("192.0.2.1:53", src)
+	require.Equal([]byte("answer"), payload)
+
+	// closing the relay ends the stream
+	relay.Close()
+	_, err = relay.Read(buf)
+	require.Equal(io.EOF, err)
+}
+
+func TestUDPRelayPolicy(t *testing.T) {
+	require := require.New(t)
+
+	file := filepath.Join(t.TempDir(), "policy")
+	require.NoError(os.WriteFile(file, []byte("192.0.2.1/32\n"), 0600))
+	policy, err := LoadPolicy(file, PolicyBlock)
+	require.NoError(err)
+	c := &Client{log: logging.MustGetLogger("udp_test")}
+	c.SetPolicy(policy)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(err)
+	relay := newUDPRelay(pc, c.log, c.allows)
+	defer relay.Close()
+
+	app, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(err)
+	defer app.Close()
+	app.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// the datagram to the blocked destination is dropped, the next is relayed
+	for _, target := range []string{"192.0.2.1:53", "192.0.2.2:53"} {
+		d, err := socks5.EncodeUDPHeader(target, []byte("query"))
+		require.NoError(err)
+		_, err = app.WriteTo(d, pc.LocalAddr())
+		require.NoError(err)
+	}
+	target, payload, err := common.ReadDatagram(relay)
+	require.NoError(err)
+	require.Equal("192.0.2.2:53", target)
+	require.Equal([]byte("query"), payload)
+	require.Equal(uint64(1), c.Stats().RejectedPolicy)
+}
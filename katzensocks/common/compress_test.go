@@ -0,0 +1,119 @@
+package common
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// countingConn counts the bytes written to the underlying conn.
+type countingConn struct {
+	net.Conn
+	written int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// transfer sends payload from one end of a pipe to the other, optionally
+// compressed, and returns the received bytes and the bytes on the wire.
+func transfer(t *testing.T, payload []byte, compress bool) ([]byte, int64) {
+	a, b := net.Pipe()
+	wire := &countingConn{Conn: a}
+	var w net.Conn = wire
+	var r net.Conn = b
+	if compress {
+		w = NewCompressedConn(wire)
+		r = NewCompressedConn(b)
+	}
+
+	go func() {
+		// write in uneven chunks, as a proxied stream would
+		for p := payload; len(p) > 0; {
+			n := 1000
+			if n > len(p) {
+				n = len(p)
+			}
+			_, err := w.Write(p[:n])
+			require.NoError(t, err)
+			p = p[n:]
+		}
+		w.Close()
+	}()
+	received, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return received, atomic.LoadInt64(&wire.written)
+}
+
+func TestCompressedConn(t *testing.T) {
+	require := require.New(t)
+
+	text := []byte(strings.Repeat("GET /index.html HTTP/1.1\r\nHost: example.com\r\nAccept: text/html\r\n\r\n", 2000))
+	plain, plainWire := transfer(t, text, false)
+	require.Equal(text, plain)
+	compressed, compressedWire := transfer(t, text, true)
+	require.Equal(text, compressed)
+	require.Less(compressedWire, plainWire/2)
+
+	// incompressible data is sent as is, plus the frame headers
+	random := make([]byte, 200<<10)
+	_, err := rand.Read(random)
+	require.NoError(err)
+	received, randomWire := transfer(t, random, true)
+	require.Equal(random, received)
+	require.LessOrEqual(randomWire, int64(len(random)+frameHeaderLen*(len(random)/1000+1)))
+
+	// writes larger than a frame are split
+	large := bytes.Repeat([]byte("katzensocks "), 3*MaxFrameLen/12)
+	a, b := net.Pipe()
+	go func() {
+		w := NewCompressedConn(a)
+		_, err := w.Write(large)
+		require.NoError(err)
+		w.Close()
+	}()
+	received, err = io.ReadAll(NewCompressedConn(b))
+	require.NoError(err)
+	require.Equal(large, received)
+}
+
+func BenchmarkCompressedConn(b *testing.B) {
+	text := []byte(strings.Repeat("GET /index.html HTTP/1.1\r\nHost: example.com\r\nAccept: text/html\r\n\r\n", 500))
+	random := make([]byte, len(text))
+	rand.Read(random)
+
+	for _, bc := range []struct {
+		name    string
+		payload []byte
+	}{{"text", text}, {"random", random}} {
+		b.Run(bc.name, func(b *testing.B) {
+			wire := &countingConn{Conn: nopConn{}}
+			w := NewCompressedConn(wire)
+			b.SetBytes(int64(len(bc.payload)))
+			for i := 0; i < b.N; i++ {
+				if _, err := w.Write(bc.payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(wire.written)/float64(b.N*len(bc.payload)), "wire/byte")
+		})
+	}
+}
+
+// nopConn discards writes.
+type nopConn struct {
+	net.Conn
+}
+
+func (nopConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
@@ -28,6 +28,8 @@ type Transport interface {
 	Dial(context.Context, net.Addr) (net.Conn, error)
 	WritePacket(context.Context, []byte, net.Addr) (int, error)
 	ReadPacket(context.Context, []byte) (int, net.Addr, error)
+	AcceptMux(context.Context) (*Mux, error)
+	DialMux(context.Context, net.Addr) (*Mux, error)
 	Close() error
 }
 
@@ -93,6 +95,21 @@ func (w *wc) Close() error {
 	return nil
 }
 
+// defaultKeepAlivePeriod is long enough that an idle tunnel sends no
+// keepalives before it times out.
+const defaultKeepAlivePeriod = 42 * time.Minute
+
+// The QUIC defaults are raised from those of quic-go for the round trips
+// of the mixnet, which are seconds rather than milliseconds: a tunnel
+// must outlive many round trips without traffic, and a stream must be
+// able to send for a whole round trip without waiting for a window
+// update.
+const (
+	DefaultMaxIdleTimeout             = 42 * time.Minute
+	DefaultInitialStreamReceiveWindow = 2 << 20
+	DefaultMaxIncomingStreams         = 256
+)
+
 // NewQUICProxyConn returns a
 func NewQUICProxyConn(id []byte) *QUICProxyConn {
 	return &QUICProxyConn{
@@ -101,9 +118,11 @@ func NewQUICProxyConn(id []byte) *QUICProxyConn {
 		outgoing:  make(chan *pkt, 1000),
 		tlsConf:   kquic.GenerateTLSConfig(),
 		qcfg: &quic.Config{
-			KeepAlivePeriod: 42 * time.Minute,
-			HandshakeIdleTimeout: 42 * time.Minute,
-			MaxIdleTimeout:  42 * time.Minute,
+			KeepAlivePeriod:            defaultKeepAlivePeriod,
+			HandshakeIdleTimeout:       42 * time.Minute,
+			MaxIdleTimeout:             DefaultMaxIdleTimeout,
+			InitialStreamReceiveWindow: DefaultInitialStreamReceiveWindow,
+			MaxIncomingStreams:         DefaultMaxIncomingStreams,
 			Tracer: func(ctx context.Context, p qlogging.Perspective, connID quic.ConnectionID) *qlogging.ConnectionTracer {
 				return qlog.NewConnectionTracer(&wc{}, p, connID)
 			},
@@ -115,6 +134,17 @@ func (k *QUICProxyConn) Config() *quic.Config {
 	return k.qcfg
 }
 
+// SetKeepAlive makes the QUIC connection send a PING frame after every
+// period without traffic, which keeps an idle tunnel from being torn down
+// along the path. The peer acknowledges it without passing anything to the
+// application. A zero period restores the default.
+func (k *QUICProxyConn) SetKeepAlive(period time.Duration) {
+	if period <= 0 {
+		period = defaultKeepAlivePeriod
+	}
+	k.qcfg.KeepAlivePeriod = period
+}
+
 func (k *QUICProxyConn) TLSConfig() *tls.Config {
 	if k.tlsConf == nil {
 		k.tlsConf = kquic.GenerateTLSConfig()
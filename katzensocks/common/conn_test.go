@@ -6,7 +6,9 @@ import (
 	"errors"
 	"io"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
 	"github.com/stretchr/testify/require"
@@ -166,3 +168,64 @@ func TestQUICProxyConn(t *testing.T) {
 		require.NoError(err)
 	}
 }
+
+func TestQUICProxyConnKeepAlive(t *testing.T) {
+	require := require.New(t)
+	// quic-go multiplexes connections by local address, so use fresh ones
+	id := make([]byte, 8)
+	_, err := io.ReadFull(rand.Reader, id)
+	require.NoError(err)
+	sender := NewQUICProxyConn(append([]byte("sender"), id...))
+	receiver := NewQUICProxyConn(append([]byte("receiver"), id...))
+	interval := 100 * time.Millisecond
+	sender.SetKeepAlive(interval)
+
+	// relay packets between the peers, counting those sent by sender
+	sent := new(atomic.Int64)
+	relay := func(from, to *QUICProxyConn, count *atomic.Int64) {
+		for {
+			pkt := make([]byte, payloadSize)
+			n, _, err := from.ReadPacket(context.Background(), pkt)
+			if err != nil {
+				return
+			}
+			if count != nil {
+				count.Add(1)
+			}
+			if _, err = to.WritePacket(context.Background(), pkt[:n], from.LocalAddr()); err != nil {
+				return
+			}
+		}
+	}
+	go relay(sender, receiver, sent)
+	go relay(receiver, sender, nil)
+	defer sender.Halt()
+	defer receiver.Halt()
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	accepted := make(chan error, 1)
+	go func() {
+		rConn, err := receiver.Accept(ctx)
+		if err == nil {
+			_, err = io.ReadFull(rConn, make([]byte, 1))
+		}
+		accepted <- err
+	}()
+	sConn, err := sender.Dial(ctx, receiver.LocalAddr())
+	require.NoError(err)
+	defer sConn.Close()
+	_, err = sConn.Write([]byte{0})
+	require.NoError(err)
+	require.NoError(<-accepted)
+
+	// leave the tunnel idle and count the keepalives
+	time.Sleep(interval)
+	before := sent.Load()
+	idle := 10 * interval
+	time.Sleep(idle)
+	keepalives := sent.Load() - before
+	expected := int64(idle / interval)
+	require.GreaterOrEqual(keepalives, expected/2)
+	require.LessOrEqual(keepalives, expected*2)
+}
@@ -0,0 +1,48 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/katzenpost/katzenpost/katzensocks/socks5"
+)
+
+// datagramHeaderLen is the length prefix of a datagram frame.
+const datagramHeaderLen = 2
+
+var errDatagramTooLong = errors.New("datagram too long")
+
+// WriteDatagram writes payload to w as a frame of a datagram stream, which
+// carries the datagrams of a UDP ASSOCIATE session between the client and
+// the gateway.  Each frame is the length of the rest of the frame, then
+// the SOCKS5 UDP header naming addr, the target or source of the datagram,
+// and then the payload.
+func WriteDatagram(w io.Writer, addr string, payload []byte) error {
+	d, err := socks5.EncodeUDPHeader(addr, payload)
+	if err != nil {
+		return err
+	}
+	if len(d) > 0xffff {
+		return errDatagramTooLong
+	}
+	frame := make([]byte, datagramHeaderLen, datagramHeaderLen+len(d))
+	binary.BigEndian.PutUint16(frame, uint16(len(d)))
+	_, err = w.Write(append(frame, d...))
+	return err
+}
+
+// ReadDatagram reads a frame written by WriteDatagram from r, and returns
+// its address and payload.
+func ReadDatagram(r io.Reader) (addr string, payload []byte, err error) {
+	hdr := make([]byte, datagramHeaderLen)
+	if _, err = io.ReadFull(r, hdr); err != nil {
+		return "", nil, err
+	}
+	d := make([]byte, binary.BigEndian.Uint16(hdr))
+	if _, err = io.ReadFull(r, d); err != nil {
+		return "", nil, err
+	}
+	addr, _, payload, err = socks5.ParseUDPHeader(d)
+	return addr, payload, err
+}
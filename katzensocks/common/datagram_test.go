@@ -0,0 +1,42 @@
+package common
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatagramFrames(t *testing.T) {
+	require := require.New(t)
+
+	buf := new(bytes.Buffer)
+	require.NoError(WriteDatagram(buf, "192.0.2.1:53", []byte("query")))
+	require.NoError(WriteDatagram(buf, "[2001:db8::1]:443", []byte{}))
+	require.NoError(WriteDatagram(buf, "example.com:123", []byte("ntp")))
+	require.Error(WriteDatagram(buf, "example.com", []byte("no port")))
+	require.Error(WriteDatagram(buf, "192.0.2.1:53", make([]byte, 0xffff)))
+
+	for _, want := range []struct {
+		addr    string
+		payload []byte
+	}{
+		{"192.0.2.1:53", []byte("query")},
+		{"[2001:db8::1]:443", []byte{}},
+		{"example.com:123", []byte("ntp")},
+	} {
+		addr, payload, err := ReadDatagram(buf)
+		require.NoError(err)
+		require.Equal(want.addr, addr)
+		require.Equal(want.payload, payload)
+	}
+	_, _, err := ReadDatagram(buf)
+	require.Equal(io.EOF, err)
+
+	// a truncated frame is an error
+	require.NoError(WriteDatagram(buf, "192.0.2.1:53", []byte("query")))
+	buf.Truncate(buf.Len() - 1)
+	_, _, err = ReadDatagram(buf)
+	require.Equal(io.ErrUnexpectedEOF, err)
+}
@@ -0,0 +1,190 @@
+package common
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"os"
+
+	kquic "github.com/katzenpost/katzenpost/quic"
+	quic "github.com/quic-go/quic-go"
+)
+
+const (
+	streamAccepted byte = 0
+	streamRefused  byte = 1
+
+	streamHeaderLen = 2
+
+	// MaxStreamTargetLen is the longest target URL that can be sent when
+	// opening a stream of a Mux.
+	MaxStreamTargetLen = 1024
+)
+
+var (
+	// ErrStreamRefused is returned by OpenStream when the peer could not
+	// connect the stream to its target.
+	ErrStreamRefused = errors.New("stream refused")
+
+	errTargetTooLong = errors.New("stream target too long")
+)
+
+// Mux carries many streams over a single QUIC connection through the
+// mixnet, so that connections to different targets share the cost of one
+// circuit.  Each stream starts with the target to connect it to, which
+// the accepting side answers with a status byte before any data is
+// exchanged.
+type Mux struct {
+	conn quic.Connection
+}
+
+// DialMux is like Dial, but returns a Mux for opening many streams.
+func (k *QUICProxyConn) DialMux(ctx context.Context, addr net.Addr) (*Mux, error) {
+	if addr == nil {
+		return nil, errors.New("DialMux() called with nil net.Addr")
+	}
+	k.remoteAddr = addr
+	for {
+		select {
+		case <-k.HaltCh():
+			return nil, errHalted
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		c, err := quic.Dial(ctx, k, addr, k.tlsConf, k.Config())
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &Mux{conn: c}, nil
+	}
+}
+
+// AcceptMux is like Accept, but returns a Mux for accepting many streams.
+func (k *QUICProxyConn) AcceptMux(ctx context.Context) (*Mux, error) {
+	l, err := quic.Listen(k, k.tlsConf, k.Config())
+	if err != nil {
+		return nil, err
+	}
+	for {
+		select {
+		case <-k.HaltCh():
+			return nil, errHalted
+		case <-ctx.Done():
+			return nil, os.ErrDeadlineExceeded
+		default:
+		}
+		c, err := l.Accept(ctx)
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		k.remoteAddr = c.RemoteAddr()
+		return &Mux{conn: c}, nil
+	}
+}
+
+// OpenStream opens a new stream to target and waits until the peer has
+// connected it.
+func (m *Mux) OpenStream(ctx context.Context, target *url.URL) (net.Conn, error) {
+	tgt := target.String()
+	if len(tgt) > MaxStreamTargetLen {
+		return nil, errTargetTooLong
+	}
+	s, err := m.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, streamHeaderLen, streamHeaderLen+len(tgt))
+	binary.BigEndian.PutUint16(hdr, uint16(len(tgt)))
+	if _, err = s.Write(append(hdr, tgt...)); err != nil {
+		s.CancelRead(0)
+		s.CancelWrite(0)
+		return nil, err
+	}
+	status := make([]byte, 1)
+	if _, err = io.ReadFull(s, status); err != nil {
+		s.CancelWrite(0)
+		return nil, err
+	}
+	if status[0] != streamAccepted {
+		s.Close()
+		return nil, ErrStreamRefused
+	}
+	return &kquic.QuicConn{Stream: s, Conn: m.conn}, nil
+}
+
+// MuxStream is a stream accepted from a Mux, which must be answered with
+// Accept or Refuse.
+type MuxStream struct {
+	net.Conn
+
+	// Target is the target the stream is to be connected to.
+	Target *url.URL
+}
+
+// AcceptStream waits for the peer to open a stream.  Malformed streams
+// are reset and skipped.
+func (m *Mux) AcceptStream(ctx context.Context) (*MuxStream, error) {
+	for {
+		s, err := m.conn.AcceptStream(ctx)
+		if err != nil {
+			return nil, err
+		}
+		target, err := readStreamTarget(s)
+		if err != nil {
+			s.CancelRead(0)
+			s.CancelWrite(0)
+			continue
+		}
+		return &MuxStream{Conn: &kquic.QuicConn{Stream: s, Conn: m.conn}, Target: target}, nil
+	}
+}
+
+func readStreamTarget(r io.Reader) (*url.URL, error) {
+	hdr := make([]byte, streamHeaderLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint16(hdr)
+	if n > MaxStreamTargetLen {
+		return nil, errTargetTooLong
+	}
+	tgt := make([]byte, n)
+	if _, err := io.ReadFull(r, tgt); err != nil {
+		return nil, err
+	}
+	return url.Parse(string(tgt))
+}
+
+// Accept tells the peer that the stream is connected to its target.
+func (s *MuxStream) Accept() error {
+	_, err := s.Write([]byte{streamAccepted})
+	return err
+}
+
+// Refuse tells the peer that the stream could not be connected to its
+// target, and closes it.
+func (s *MuxStream) Refuse() error {
+	_, err := s.Write([]byte{streamRefused})
+	s.Close()
+	return err
+}
+
+// Done returns a channel that is closed when the Mux is closed.
+func (m *Mux) Done() <-chan struct{} {
+	return m.conn.Context().Done()
+}
+
+// Close closes the Mux and all its streams.
+func (m *Mux) Close() error {
+	return m.conn.CloseWithError(0, "")
+}
@@ -0,0 +1,89 @@
+package common
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/require"
+)
+
+// relayPackets carries the packets written by from to to, as the mixnet
+// would, until either is halted.
+func relayPackets(from, to *QUICProxyConn) {
+	for {
+		pkt := make([]byte, payloadSize)
+		n, _, err := from.ReadPacket(context.Background(), pkt)
+		if err != nil {
+			return
+		}
+		if _, err = to.WritePacket(context.Background(), pkt[:n], from.LocalAddr()); err != nil {
+			return
+		}
+	}
+}
+
+func TestMux(t *testing.T) {
+	require := require.New(t)
+	// quic-go multiplexes connections by local address, so use fresh ones
+	id := make([]byte, 8)
+	_, err := io.ReadFull(rand.Reader, id)
+	require.NoError(err)
+	client := NewQUICProxyConn(append([]byte("muxclient"), id...))
+	server := NewQUICProxyConn(append([]byte("muxserver"), id...))
+	go relayPackets(client, server)
+	go relayPackets(server, client)
+	defer client.Halt()
+	defer server.Halt()
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+
+	// the server echoes the target of each stream, refusing udp targets
+	go func() {
+		m, err := server.AcceptMux(ctx)
+		if err != nil {
+			return
+		}
+		defer m.Close()
+		for {
+			s, err := m.AcceptStream(ctx)
+			if err != nil {
+				return
+			}
+			if s.Target.Scheme != "tcp" {
+				s.Refuse()
+				continue
+			}
+			go func() {
+				defer s.Close()
+				if s.Accept() == nil {
+					s.Write([]byte(s.Target.Host))
+				}
+			}()
+		}
+	}()
+
+	m, err := client.DialMux(ctx, server.LocalAddr())
+	require.NoError(err)
+	defer m.Close()
+
+	for _, host := range []string{"example.com:443", "127.0.0.1:80", "[::1]:22"} {
+		conn, err := m.OpenStream(ctx, &url.URL{Scheme: "tcp", Host: host})
+		require.NoError(err)
+		echoed, err := io.ReadAll(conn)
+		require.NoError(err)
+		require.Equal(host, string(echoed))
+		conn.Close()
+	}
+
+	_, err = m.OpenStream(ctx, &url.URL{Scheme: "udp", Host: "127.0.0.1:53"})
+	require.ErrorIs(err, ErrStreamRefused)
+
+	long := &url.URL{Scheme: "tcp", Host: string(make([]byte, MaxStreamTargetLen))}
+	_, err = m.OpenStream(ctx, long)
+	require.ErrorIs(err, errTargetTooLong)
+}
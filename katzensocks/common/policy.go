@@ -0,0 +1,118 @@
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"path"
+	"strings"
+)
+
+// PolicyMode is whether a Policy lists the allowed or the blocked
+// destinations.
+type PolicyMode string
+
+const (
+	// PolicyAllow allows only the listed destinations.
+	PolicyAllow PolicyMode = "allow"
+	// PolicyBlock allows all but the listed destinations.
+	PolicyBlock PolicyMode = "block"
+)
+
+// Policy restricts the destinations that can be reached through a proxy,
+// or selects the destinations a proxy treats differently.  Its entries are
+// CIDR prefixes, which match IP address targets, and host name globs such
+// as *.example.com, which match host name targets.
+type Policy struct {
+	Mode     PolicyMode
+	prefixes []netip.Prefix
+	globs    []string
+}
+
+// LoadPolicy reads a Policy in mode from file, which has an entry per
+// line.  Blank lines and lines starting with # are ignored.
+func LoadPolicy(file string, mode PolicyMode) (*Policy, error) {
+	switch mode {
+	case PolicyAllow, PolicyBlock:
+	default:
+		return nil, fmt.Errorf("invalid policy mode %q", mode)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &Policy{Mode: mode}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		if err := p.add(entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Policy) add(entry string) error {
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return err
+		}
+		p.prefixes = append(p.prefixes, prefix.Masked())
+		return nil
+	}
+	if addr, err := netip.ParseAddr(entry); err == nil {
+		p.prefixes = append(p.prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		return nil
+	}
+	glob := strings.ToLower(strings.TrimSuffix(entry, "."))
+	if _, err := path.Match(glob, ""); err != nil {
+		return fmt.Errorf("invalid host name glob %q", entry)
+	}
+	p.globs = append(p.globs, glob)
+	return nil
+}
+
+// Prefixes returns the CIDR prefixes of the Policy.
+func (p *Policy) Prefixes() []netip.Prefix {
+	return p.prefixes
+}
+
+// Globs returns the host name globs of the Policy, in lower case.
+func (p *Policy) Globs() []string {
+	return p.globs
+}
+
+// Allows returns true iff host, an IP address or host name, may be
+// reached.
+func (p *Policy) Allows(host string) bool {
+	return p.matches(host) == (p.Mode == PolicyAllow)
+}
+
+func (p *Policy) matches(host string) bool {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.Unmap()
+		for _, prefix := range p.prefixes {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, glob := range p.globs {
+		if ok, _ := path.Match(glob, host); ok {
+			return true
+		}
+	}
+	return false
+}
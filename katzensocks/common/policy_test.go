@@ -0,0 +1,53 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testPolicy = `# kiosk destinations
+10.0.0.0/8
+192.0.2.1
+2001:db8::/32
+
+*.Example.com
+example.com.
+`
+
+func TestPolicy(t *testing.T) {
+	require := require.New(t)
+
+	file := filepath.Join(t.TempDir(), "policy")
+	require.NoError(os.WriteFile(file, []byte(testPolicy), 0600))
+
+	allow, err := LoadPolicy(file, PolicyAllow)
+	require.NoError(err)
+	block, err := LoadPolicy(file, PolicyBlock)
+	require.NoError(err)
+	for host, listed := range map[string]bool{
+		"10.1.2.3":         true,
+		"::ffff:10.1.2.3":  true,
+		"11.1.2.3":         false,
+		"192.0.2.1":        true,
+		"192.0.2.2":        false,
+		"2001:db8::1":      true,
+		"2001:db9::1":      false,
+		"example.com":      true,
+		"www.example.com":  true,
+		"WWW.EXAMPLE.COM.": true,
+		"example.org":      false,
+		"evilexample.com":  false,
+	} {
+		require.Equal(listed, allow.Allows(host), host)
+		require.Equal(!listed, block.Allows(host), host)
+	}
+
+	_, err = LoadPolicy(file, "deny")
+	require.Error(err)
+	require.NoError(os.WriteFile(file, []byte("10.0.0.0/33\n"), 0600))
+	_, err = LoadPolicy(file, PolicyBlock)
+	require.ErrorContains(err, ":1:")
+}
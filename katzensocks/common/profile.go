@@ -0,0 +1,151 @@
+package common
+
+import (
+	"sync"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+var (
+	// HighLatencyRTT is the round trip time above which a path is
+	// considered high latency.
+	HighLatencyRTT = 2 * time.Second
+
+	// LossyThreshold is the fraction of lost round trips above which
+	// a path is considered lossy.
+	LossyThreshold = 0.05
+
+	// DefaultProfile leaves the QUIC configuration unchanged.
+	DefaultProfile = &QUICProfile{Name: "default"}
+
+	// HighLatencyProfile is for high RTT, low loss paths and uses
+	// large initial windows so that a flow is not stalled waiting
+	// for window updates to cross the mixnet.
+	HighLatencyProfile = &QUICProfile{
+		Name:                           "high-latency",
+		InitialStreamReceiveWindow:     2 << 20,
+		MaxStreamReceiveWindow:         8 << 20,
+		InitialConnectionReceiveWindow: 3 << 20,
+		MaxConnectionReceiveWindow:     12 << 20,
+	}
+
+	// LossyProfile is for paths that drop a significant fraction of
+	// packets and keeps the windows small to limit the size of bursts
+	// that must be retransmitted.
+	LossyProfile = &QUICProfile{
+		Name:                           "lossy",
+		InitialStreamReceiveWindow:     256 << 10,
+		MaxStreamReceiveWindow:         1 << 20,
+		InitialConnectionReceiveWindow: 384 << 10,
+		MaxConnectionReceiveWindow:     2 << 20,
+		KeepAlivePeriod:                time.Minute,
+	}
+)
+
+// QUICProfile is a set of QUIC tuning parameters selected for a path.
+// Zero valued fields leave the corresponding quic.Config field unchanged.
+type QUICProfile struct {
+	Name string
+
+	InitialStreamReceiveWindow     uint64
+	MaxStreamReceiveWindow         uint64
+	InitialConnectionReceiveWindow uint64
+	MaxConnectionReceiveWindow     uint64
+	KeepAlivePeriod                time.Duration
+	MaxIdleTimeout                 time.Duration
+	MaxIncomingStreams             int64
+}
+
+// Apply sets the profile parameters on cfg.
+func (p *QUICProfile) Apply(cfg *quic.Config) {
+	if p.InitialStreamReceiveWindow != 0 {
+		cfg.InitialStreamReceiveWindow = p.InitialStreamReceiveWindow
+	}
+	if p.MaxStreamReceiveWindow != 0 {
+		cfg.MaxStreamReceiveWindow = p.MaxStreamReceiveWindow
+	}
+	if p.InitialConnectionReceiveWindow != 0 {
+		cfg.InitialConnectionReceiveWindow = p.InitialConnectionReceiveWindow
+	}
+	if p.MaxConnectionReceiveWindow != 0 {
+		cfg.MaxConnectionReceiveWindow = p.MaxConnectionReceiveWindow
+	}
+	if p.KeepAlivePeriod != 0 {
+		cfg.KeepAlivePeriod = p.KeepAlivePeriod
+	}
+	if p.MaxIdleTimeout != 0 {
+		cfg.MaxIdleTimeout = p.MaxIdleTimeout
+	}
+	if p.MaxIncomingStreams != 0 {
+		cfg.MaxIncomingStreams = p.MaxIncomingStreams
+	}
+}
+
+// SelectQUICProfile returns the profile matching the measured path.
+func SelectQUICProfile(stats *PathStats) *QUICProfile {
+	if stats == nil || stats.Samples() == 0 {
+		return DefaultProfile
+	}
+	switch {
+	case stats.Loss() >= LossyThreshold:
+		return LossyProfile
+	case stats.RTT() >= HighLatencyRTT:
+		return HighLatencyProfile
+	default:
+		return DefaultProfile
+	}
+}
+
+// PathStats accumulates round trip measurements of a mixnet path.
+type PathStats struct {
+	sync.Mutex
+
+	total time.Duration
+	ok    int
+	lost  int
+}
+
+// NewPathStats returns an empty PathStats.
+func NewPathStats() *PathStats {
+	return &PathStats{}
+}
+
+// AddSample records a round trip that took rtt, or that was lost.
+func (p *PathStats) AddSample(rtt time.Duration, lost bool) {
+	p.Lock()
+	defer p.Unlock()
+	if lost {
+		p.lost++
+		return
+	}
+	p.ok++
+	p.total += rtt
+}
+
+// Samples returns the number of recorded round trips.
+func (p *PathStats) Samples() int {
+	p.Lock()
+	defer p.Unlock()
+	return p.ok + p.lost
+}
+
+// RTT returns the mean round trip time of the successful round trips.
+func (p *PathStats) RTT() time.Duration {
+	p.Lock()
+	defer p.Unlock()
+	if p.ok == 0 {
+		return 0
+	}
+	return p.total / time.Duration(p.ok)
+}
+
+// Loss returns the fraction of lost round trips.
+func (p *PathStats) Loss() float64 {
+	p.Lock()
+	defer p.Unlock()
+	if p.ok+p.lost == 0 {
+		return 0
+	}
+	return float64(p.lost) / float64(p.ok+p.lost)
+}
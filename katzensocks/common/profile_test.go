@@ -0,0 +1,55 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectQUICProfile(t *testing.T) {
+	require := require.New(t)
+
+	// no measurements
+	require.Equal(DefaultProfile, SelectQUICProfile(nil))
+	require.Equal(DefaultProfile, SelectQUICProfile(NewPathStats()))
+
+	// low latency, no loss
+	stats := NewPathStats()
+	for i := 0; i < 10; i++ {
+		stats.AddSample(500*time.Millisecond, false)
+	}
+	require.Equal(DefaultProfile, SelectQUICProfile(stats))
+
+	// high latency, no loss
+	stats = NewPathStats()
+	for i := 0; i < 10; i++ {
+		stats.AddSample(4*time.Second, false)
+	}
+	require.Equal(4*time.Second, stats.RTT())
+	require.Equal(HighLatencyProfile, SelectQUICProfile(stats))
+
+	// high latency, 3 of 13 round trips lost
+	for i := 0; i < 3; i++ {
+		stats.AddSample(0, true)
+	}
+	require.Equal(4*time.Second, stats.RTT())
+	require.InDelta(3.0/13.0, stats.Loss(), 0.0001)
+	require.Equal(LossyProfile, SelectQUICProfile(stats))
+}
+
+func TestQUICProfileApply(t *testing.T) {
+	require := require.New(t)
+	cfg := &quic.Config{KeepAlivePeriod: time.Hour}
+	HighLatencyProfile.Apply(cfg)
+	require.Equal(HighLatencyProfile.InitialStreamReceiveWindow, cfg.InitialStreamReceiveWindow)
+	require.Equal(HighLatencyProfile.MaxConnectionReceiveWindow, cfg.MaxConnectionReceiveWindow)
+	require.Equal(time.Hour, cfg.KeepAlivePeriod)
+
+	tuning := &QUICProfile{Name: "tuned", MaxIdleTimeout: time.Minute, MaxIncomingStreams: 16}
+	tuning.Apply(cfg)
+	require.Equal(time.Minute, cfg.MaxIdleTimeout)
+	require.Equal(int64(16), cfg.MaxIncomingStreams)
+	require.Equal(HighLatencyProfile.InitialStreamReceiveWindow, cfg.InitialStreamReceiveWindow)
+}
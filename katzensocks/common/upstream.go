@@ -0,0 +1,159 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// UpstreamProxy chains the connections a gateway makes to its targets
+// through a SOCKS5 or HTTP CONNECT proxy, for gateways that cannot reach
+// the Internet directly.
+//
+// The proxy sees every target it carries, and the traffic to it unless the
+// client uses TLS end to end, so it must be trusted as much as the gateway
+// itself.  It cannot tell which client a connection belongs to, as the
+// mixnet hides that from the gateway too, but a proxy that also observes
+// the clients' side of the network gains a vantage point the gateway alone
+// does not have.
+type UpstreamProxy struct {
+	// URL is the proxy, as socks5://[user:password@]host:port or
+	// http://[user:password@]host:port.
+	URL *url.URL
+
+	// Policy, if set, selects the targets that are chained: the targets
+	// it allows are dialed through the proxy and the others directly.
+	// Otherwise every target is chained.
+	Policy *Policy
+
+	// Timeout limits connecting to the proxy and the proxy handshake.
+	Timeout time.Duration
+}
+
+// DefaultUpstreamTimeout is the UpstreamProxy.Timeout set by
+// ParseUpstreamProxy.
+var DefaultUpstreamTimeout = 30 * time.Second
+
+var errUpstreamScheme = errors.New("upstream proxy must be socks5:// or http://")
+
+// ParseUpstreamProxy returns an UpstreamProxy chaining the targets allowed
+// by policy, or all targets if policy is nil, through the proxy at rawURL.
+func ParseUpstreamProxy(rawURL string, policy *Policy) (*UpstreamProxy, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5", "http":
+	default:
+		return nil, errUpstreamScheme
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("upstream proxy %s has no port", u.Redacted())
+	}
+	return &UpstreamProxy{URL: u, Policy: policy, Timeout: DefaultUpstreamTimeout}, nil
+}
+
+// Chains returns true iff addr, a host:port, is dialed through the proxy.
+func (u *UpstreamProxy) Chains(addr string) bool {
+	if u.Policy == nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return u.Policy.Allows(host)
+}
+
+// DialContext connects to the TCP address addr, through the proxy if
+// Chains(addr).
+func (u *UpstreamProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &net.Dialer{}
+	if !u.Chains(addr) {
+		return d.DialContext(ctx, network, addr)
+	}
+	if u.Timeout != 0 {
+		var cancelFn context.CancelFunc
+		ctx, cancelFn = context.WithTimeout(ctx, u.Timeout)
+		defer cancelFn()
+	}
+	switch u.URL.Scheme {
+	case "socks5":
+		var auth *proxy.Auth
+		if u.URL.User != nil {
+			password, _ := u.URL.User.Password()
+			auth = &proxy.Auth{User: u.URL.User.Username(), Password: password}
+		}
+		dialer, err := proxy.SOCKS5("tcp", u.URL.Host, auth, d)
+		if err != nil {
+			return nil, err
+		}
+		return dialer.(proxy.ContextDialer).DialContext(ctx, network, addr)
+	case "http":
+		return u.dialConnect(ctx, d, addr)
+	default:
+		return nil, errUpstreamScheme
+	}
+}
+
+// dialConnect opens a tunnel to addr with an HTTP CONNECT request.
+func (u *UpstreamProxy) dialConnect(ctx context.Context, d *net.Dialer, addr string) (net.Conn, error) {
+	conn, err := d.DialContext(ctx, "tcp", u.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u.URL.User != nil {
+		password, _ := u.URL.User.Password()
+		creds := u.URL.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(creds)))
+	}
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy: CONNECT %s: %s", addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() != 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn whose reads start with data already read
+// into r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
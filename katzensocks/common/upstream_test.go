@@ -0,0 +1,113 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// echoListener accepts a connection on l and echoes it.
+func echoListener(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+// connectProxy is an HTTP CONNECT proxy that records the requested
+// targets.
+func connectProxy(t *testing.T, targets chan<- string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				targets <- req.Host
+				if req.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\n\r\n")
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	require := require.New(t)
+
+	echo := echoListener(t)
+	targets := make(chan string, 1)
+	proxy := connectProxy(t, targets)
+
+	file := filepath.Join(t.TempDir(), "policy")
+	require.NoError(os.WriteFile(file, []byte("127.0.0.0/8\n"), 0600))
+	policy, err := LoadPolicy(file, PolicyAllow)
+	require.NoError(err)
+
+	u, err := ParseUpstreamProxy("http://user:pass@"+proxy.Addr().String(), policy)
+	require.NoError(err)
+	require.True(u.Chains(echo.Addr().String()))
+	require.False(u.Chains("example.com:443"))
+
+	conn, err := u.DialContext(context.Background(), "tcp", echo.Addr().String())
+	require.NoError(err)
+	defer conn.Close()
+	require.Equal(echo.Addr().String(), <-targets)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(err)
+	require.Equal("hello", string(buf))
+
+	// the proxy refuses bad credentials
+	u, err = ParseUpstreamProxy("http://user:wrong@"+proxy.Addr().String(), nil)
+	require.NoError(err)
+	_, err = u.DialContext(context.Background(), "tcp", echo.Addr().String())
+	require.ErrorContains(err, "407")
+	<-targets
+
+	_, err = ParseUpstreamProxy("ftp://"+proxy.Addr().String(), nil)
+	require.Error(err)
+	_, err = ParseUpstreamProxy("socks5://127.0.0.1", nil)
+	require.Error(err)
+}
@@ -26,8 +26,10 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"time"
 
 	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/katzensocks/common"
 	"github.com/katzenpost/katzenpost/katzensocks/server"
 	"github.com/katzenpost/katzenpost/server/cborplugin"
 )
@@ -37,10 +39,24 @@ func main() {
 	var maxRequests int
 	var logDir string
 	var clientCfg string
+	var quicIdleTimeout time.Duration
+	var quicStreamWindow uint64
+	var quicMaxStreams int64
+	var upstreamProxy string
+	var upstreamPolicy string
+	var upstreamPolicyMode string
 	flag.StringVar(&clientCfg, "cfg", "", "client configuration")
 	flag.StringVar(&logDir, "log_dir", "", "logging directory")
 	flag.IntVar(&maxRequests, "max_requests", 420, "number of concurrent workers")
 	flag.StringVar(&logLevel, "log_level", "DEBUG", "logging level could be set to: DEBUG, INFO, NOTICE, WARNING, ERROR, CRITICAL")
+	// the QUIC defaults are raised from those of quic-go (30s, 512KiB and
+	// 100) for the round trips of the mixnet, see common.DefaultMaxIdleTimeout
+	flag.DurationVar(&quicIdleTimeout, "quic_max_idle_timeout", common.DefaultMaxIdleTimeout, "close QUIC tunnels idle for this long")
+	flag.Uint64Var(&quicStreamWindow, "quic_stream_window", common.DefaultInitialStreamReceiveWindow, "initial QUIC stream receive window in bytes")
+	flag.Int64Var(&quicMaxStreams, "quic_max_streams", common.DefaultMaxIncomingStreams, "limit concurrent incoming QUIC streams")
+	flag.StringVar(&upstreamProxy, "upstream_proxy", "", "chain connections to targets through this socks5:// or http:// proxy")
+	flag.StringVar(&upstreamPolicy, "upstream_policy", "", "file of destination CIDRs and host name globs selecting the targets chained through -upstream_proxy, default all")
+	flag.StringVar(&upstreamPolicyMode, "upstream_policy_mode", string(common.PolicyAllow), "whether the upstream policy file lists the chained (allow) or directly dialed (block) destinations")
 	flag.Parse()
 
 	// Ensure that the log directory exists.
@@ -85,6 +101,25 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	katzensocksServer.QUICTuning = &common.QUICProfile{
+		Name:                       "flags",
+		MaxIdleTimeout:             quicIdleTimeout,
+		InitialStreamReceiveWindow: quicStreamWindow,
+		MaxIncomingStreams:         quicMaxStreams,
+	}
+	if upstreamProxy != "" {
+		var policy *common.Policy
+		if upstreamPolicy != "" {
+			policy, err = common.LoadPolicy(upstreamPolicy, common.PolicyMode(upstreamPolicyMode))
+			if err != nil {
+				panic(err)
+			}
+		}
+		katzensocksServer.Upstream, err = common.ParseUpstreamProxy(upstreamProxy, policy)
+		if err != nil {
+			panic(err)
+		}
+	}
 	cmdBuilder := new(cborplugin.RequestFactory)
 	server := cborplugin.NewServer(serverLog, socketFile, cmdBuilder, katzensocksServer)
 	// XXX: MUST PRINT THIS LINE FOR KATZENPOST SERVER TO CONNECT !!!
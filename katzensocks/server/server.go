@@ -34,6 +34,7 @@ import (
 	"github.com/katzenpost/katzenpost/core/worker"
 	"github.com/katzenpost/katzenpost/katzensocks/cashu"
 	"github.com/katzenpost/katzenpost/katzensocks/common"
+	"github.com/katzenpost/katzenpost/katzensocks/socks5"
 	"github.com/katzenpost/katzenpost/server/cborplugin"
 )
 
@@ -74,8 +75,16 @@ type Server struct {
 	logBackend  *log.Backend
 	payloadLen  int
 	cashuClient *cashu.CashuApiClient
+	redeemer    *cashu.IdempotentReceiver
 	sessions    *sync.Map
 	write       func(cborplugin.Command)
+
+	// QUICTuning, if set, overrides the QUIC parameters of every session.
+	QUICTuning *common.QUICProfile
+
+	// Upstream, if set, chains the connections to the targets it selects
+	// through an upstream proxy.
+	Upstream *common.UpstreamProxy
 }
 
 // NewServer instantiates the Katzensocks Kaetzchen responder
@@ -86,7 +95,8 @@ func NewServer(cfgFile string, logBackend *log.Backend) (*Server, error) {
 		return nil, err
 	}
 	cashuClient := cashu.NewCashuApiClient(nil, cashuWalletUrl)
-	s := &Server{cfg: cfg, log: log, sessions: new(sync.Map), payloadLen: cfg.SphinxGeometry.UserForwardPayloadLength, cashuClient: cashuClient}
+	redeemer := cashu.NewIdempotentReceiver(cashuClient, cashu.DefaultRedemptionTTL)
+	s := &Server{cfg: cfg, log: log, sessions: new(sync.Map), payloadLen: cfg.SphinxGeometry.UserForwardPayloadLength, cashuClient: cashuClient, redeemer: redeemer}
 	return s, nil
 }
 
@@ -110,6 +120,14 @@ type DialCommand struct {
 	ID      []byte
 	Target  *url.URL // supports tcp:// or udp://
 	Payload []byte   // may send initial data frame
+
+	// Compress requests that the proxied stream is compressed, see
+	// common.CompressedConn.
+	Compress bool
+
+	// Mux requests that the session carries many streams, each to its own
+	// target, see common.Mux.  Target is then not dialed.
+	Mux bool
 }
 
 // Marshal implements cborplugin.Command
@@ -134,6 +152,15 @@ const (
 type DialResponse struct {
 	Status  DialStatus
 	Payload []byte
+
+	// Compress is set iff the server will compress the proxied stream.
+	Compress bool
+
+	// Mux is set iff the server will accept a common.Mux for the session.
+	Mux bool
+
+	// Reply is the SOCKS5 reply code describing a DialFailure.
+	Reply uint8
 }
 
 // Marshal implements cborplugin.Command
@@ -191,6 +218,11 @@ func (p *ProxyResponse) Unmarshal(b []byte) error {
 type TopupCommand struct {
 	ID   []byte
 	Nuts []byte
+
+	// RequestID makes the topup idempotent: a retried TopupCommand for
+	// the same ID with the same RequestID and Nuts does not redeem Nuts a
+	// second time.
+	RequestID []byte
 }
 
 // Marshal implements cborplugin.Command
@@ -286,6 +318,12 @@ type Session struct {
 	// Mode
 	Mode Mode
 
+	// Compress is set iff the stream to the client is compressed
+	Compress bool
+
+	// Mux is set iff the client multiplexes streams over the Transport
+	Mux bool
+
 	// Errors ?
 	Errors     chan error
 	acceptOnce *sync.Once
@@ -366,6 +404,26 @@ func (s *Server) writeResponse(req *cborplugin.Request, cmd cborplugin.Command)
 	s.write(&cborplugin.Response{SURB: req.SURB, ID: req.ID, Payload: p})
 }
 
+// newQUICProxyConn returns the gateway end of the QUIC transport of the
+// session id, tuned as configured.
+func (s *Server) newQUICProxyConn(id []byte) *common.QUICProxyConn {
+	qconn := common.NewQUICProxyConn(id)
+	if s.QUICTuning != nil {
+		s.QUICTuning.Apply(qconn.Config())
+	}
+	return qconn
+}
+
+// dialTarget connects to the TCP target addr, through the Upstream proxy
+// if it chains addr.
+func (s *Server) dialTarget(ctx context.Context, addr string) (net.Conn, error) {
+	if s.Upstream != nil {
+		return s.Upstream.DialContext(ctx, "tcp", addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
 func (s *Server) dial(cmd *DialCommand) (cborplugin.Command, error) {
 	reply := &DialResponse{}
 
@@ -382,33 +440,54 @@ func (s *Server) dial(cmd *DialCommand) (cborplugin.Command, error) {
 		return nil, err
 	}
 
+	ss.Lock()
+	ss.Compress = cmd.Compress
+	ss.Unlock()
+	reply.Compress = cmd.Compress
+
+	// a multiplexed session dials the target of each stream it carries
+	if cmd.Mux {
+		s.log.Debugf("Multiplexing session %x", cmd.ID)
+		ss.Lock()
+		ss.Mux = true
+		ss.Transport = s.newQUICProxyConn(cmd.ID)
+		ss.Unlock()
+		reply.Mux = true
+		return reply, nil
+	}
+
 	// Get a net.Conn for the target
 	switch cmd.Target.Scheme {
 	case "tcp":
 		s.log.Debugf("got tcp target %s", cmd.Target.Host)
 		// start quic transport for tcp, listening on Addr given by client
-		ss.Transport = common.NewQUICProxyConn(cmd.ID)
+		ss.Transport = s.newQUICProxyConn(cmd.ID)
 
 		// this could happen asynchronously from responding to Dial
 		s.log.Debugf("dialing Target")
-		conn, err := net.Dial("tcp", cmd.Target.Host)
+		conn, err := s.dialTarget(context.Background(), cmd.Target.Host)
 		if err == nil {
 			s.log.Debugf("Dialed target")
 			ss.Target = conn
 		} else {
-			s.log.Debugf("Failed to Dial target")
+			s.log.Debugf("Failed to Dial target: %v", err)
 			reply.Status = DialFailure
+			reply.Reply = socks5.ReplyCodeForError(err)
 		}
 	case "udp":
-		// XXX: Add proxy support
+		// the datagrams of a UDP ASSOCIATE session each name their own
+		// target, so the session relays from an unconnected socket
 		s.log.Debugf("got udp target %s", cmd.Target.Host)
-		conn, err := net.Dial("udp", cmd.Target.Host)
+		ss.Transport = s.newQUICProxyConn(cmd.ID)
+		conn, err := net.ListenUDP("udp", nil)
 		if err == nil {
-			s.log.Debugf("Dialed target")
+			s.log.Debugf("Listening for datagrams on %v", conn.LocalAddr())
 			ss.Target = conn
+			ss.Mode = UDP
 		} else {
-			s.log.Debugf("Failed to Dial target")
+			s.log.Debugf("Failed to Dial target: %v", err)
 			reply.Status = DialFailure
+			reply.Reply = socks5.ReplyCodeForError(err)
 		}
 	default:
 		s.log.Errorf("Received DialCommand with unsupported protocol field")
@@ -431,13 +510,37 @@ func (s *Session) AcceptOnce(transport common.Transport, target net.Conn) {
 				case <-ctx.Done():
 				}
 			}()
+			s.Lock()
+			mux := s.Mux
+			s.Unlock()
+			if mux {
+				m, err := transport.AcceptMux(ctx)
+				if err != nil {
+					s.s.log.Error("Failure Accepting: %v", err)
+					return
+				}
+				s.s.serveMux(ctx, s, m)
+				s.reset()
+				return
+			}
 			conn, err := transport.Accept(ctx)
 			if err != nil {
 				s.s.log.Error("Failure Accepting: %v", err)
 				return
 			}
 			s.s.log.Debugf("Accepted %v", conn.RemoteAddr())
-			errCh := s.s.proxyWorker(conn, target)
+			s.Lock()
+			if s.Compress {
+				conn = common.NewCompressedConn(conn)
+			}
+			mode := s.Mode
+			s.Unlock()
+			var errCh chan error
+			if pc, ok := target.(net.PacketConn); ok && mode == UDP {
+				errCh = s.s.datagramWorker(conn, pc)
+			} else {
+				errCh = s.s.proxyWorker(conn, target)
+			}
 			select {
 			case <-s.s.HaltCh():
 			case err := <-errCh:
@@ -457,8 +560,9 @@ func (s *Session) SendRecv(payload []byte) ([]byte, error) {
 	// write packet to transport
 	transport := s.Transport
 	target := s.Target
+	mux := s.Mux
 	s.Unlock()
-	if transport == nil || target == nil { // wtf
+	if transport == nil || (target == nil && !mux) { // wtf
 		s.s.log.Error("SendRecv() called before Transport or Target exists")
 		return nil, errors.New("No Transport")
 	}
@@ -514,14 +618,27 @@ func (s *Server) findSession(id []byte) (*Session, error) {
 }
 
 func (s *Server) topup(cmd *TopupCommand) (cborplugin.Command, error) {
-	s.log.Debugf("Received TopupCommand(%x, %x)", cmd.ID, cmd.Nuts[:16])
+	s.log.Debugf("Received TopupCommand(%x)", cmd.ID)
 	// validate topup
 	cashuTokenStr := string(cmd.Nuts)
+	if tokens, err := cashu.DecodeTokens(cashuTokenStr); err == nil {
+		s.log.Debugf("TopupCommand(%x): %s", cmd.ID, tokens.Summary())
+		if _, err := cashu.DefaultPricer.Requests(tokens); err != nil {
+			s.log.Warningf("TopupCommand(%x): %v", cmd.ID, err)
+		}
+	}
 	permissive := true // topups always succeed
-	_, err := s.cashuClient.Receive(cashu.ReceiveParameters{Token: &cashuTokenStr})
+	params := cashu.ReceiveParameters{Token: &cashuTokenStr}
+	var err error
+	if len(cmd.RequestID) != 0 {
+		_, err = s.redeemer.Receive(cmd.ID, cmd.RequestID, params)
+	} else {
+		_, err = s.cashuClient.Receive(params)
+	}
 	if err != nil {
 		s.log.Error("topup cashu: %v", err)
-		if !permissive {
+		// a replayed request is never a redemption, permissive or not
+		if !permissive || errors.Is(err, cashu.ErrRequestReplayed) {
 			return &TopupResponse{Status: TopupFailure}, nil
 		}
 	}
@@ -589,6 +706,99 @@ func (s *Server) proxyWorker(a, b net.Conn) chan error {
 	return errCh
 }
 
+// datagramWorker relays the datagrams framed on conn by the client to the
+// targets they name through pc, and the datagrams received on pc back to
+// the client, framed with their source, until either fails.
+func (s *Server) datagramWorker(conn net.Conn, pc net.PacketConn) chan error {
+	errCh := make(chan error, 2)
+	s.Go(func() {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			defer pc.Close()
+			for {
+				target, payload, err := common.ReadDatagram(conn)
+				switch {
+				case err == io.EOF:
+					return
+				case errors.Is(err, socks5.ErrUDPFragmented):
+					continue
+				case err != nil:
+					errCh <- err
+					return
+				}
+				addr, err := net.ResolveUDPAddr("udp", target)
+				if err != nil {
+					s.log.Debugf("Dropping datagram to %s: %v", target, err)
+					continue
+				}
+				if _, err = pc.WriteTo(payload, addr); err != nil {
+					s.log.Debugf("Dropping datagram to %s: %v", target, err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			buf := make([]byte, 65535)
+			for {
+				n, src, err := pc.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				if err = common.WriteDatagram(conn, src.String(), buf[:n]); err != nil {
+					errCh <- err
+					return
+				}
+			}
+		}()
+		wg.Wait()
+		close(errCh)
+	})
+	return errCh
+}
+
+// serveMux connects each stream of m to its target until m is closed.
+func (s *Server) serveMux(ctx context.Context, ss *Session, m *common.Mux) {
+	defer m.Close()
+	ss.Lock()
+	compress := ss.Compress
+	ss.Unlock()
+	for {
+		stream, err := m.AcceptStream(ctx)
+		if err != nil {
+			s.log.Debugf("Mux of session %x closed: %v", ss.ID, err)
+			return
+		}
+		s.Go(func() {
+			if stream.Target.Scheme != "tcp" {
+				s.log.Errorf("Refusing stream with unsupported protocol %s", stream.Target.Scheme)
+				stream.Refuse()
+				return
+			}
+			target, err := s.dialTarget(ctx, stream.Target.Host)
+			if err != nil {
+				s.log.Debugf("Failed to Dial stream target: %v", err)
+				stream.Refuse()
+				return
+			}
+			if err := stream.Accept(); err != nil {
+				target.Close()
+				stream.Close()
+				return
+			}
+			var conn net.Conn = stream
+			if compress {
+				conn = common.NewCompressedConn(conn)
+			}
+			for err := range s.proxyWorker(conn, target) {
+				s.log.Debugf("proxyWorker: %v: %v", stream.Target, err)
+			}
+		})
+	}
+}
+
 func (s *Server) proxy(cmd *ProxyCommand) (cborplugin.Command, error) {
 	// deserialize cmd as a ProxyResponse
 	reply := &ProxyResponse{}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2015, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package socks5
+
+import (
+	"fmt"
+	"net"
+)
+
+// EventType is the kind of a SocksEvent.
+type EventType int
+
+const (
+	// EventAuth is emitted when the authentication method is chosen.
+	EventAuth EventType = iota
+	// EventCommand is emitted when the command is received.
+	EventCommand
+	// EventTarget is emitted when the target of the command is parsed.
+	EventTarget
+	// EventReply is emitted when a reply is sent.
+	EventReply
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventAuth:
+		return "auth"
+	case EventCommand:
+		return "command"
+	case EventTarget:
+		return "target"
+	case EventReply:
+		return "reply"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+// SocksEvent describes a step of handling a request, for logging.
+type SocksEvent struct {
+	Type EventType
+
+	// RemoteAddr is the address of the client, if known.
+	RemoteAddr net.Addr
+
+	// Method is the chosen authentication method, once chosen.
+	Method byte
+
+	// Command and Target are the request, once received.
+	Command byte
+	Target  string
+
+	// Reply is the reply code sent, for EventReply.
+	Reply ReplyCode
+}
+
+func (ev SocksEvent) String() string {
+	s := fmt.Sprintf("%s remote=%v method=0x%02x", ev.Type, ev.RemoteAddr, ev.Method)
+	switch ev.Type {
+	case EventCommand:
+		s += fmt.Sprintf(" command=0x%02x", ev.Command)
+	case EventTarget:
+		s += fmt.Sprintf(" command=0x%02x target=%s", ev.Command, ev.Target)
+	case EventReply:
+		s += fmt.Sprintf(" command=0x%02x target=%s reply=0x%02x", ev.Command, ev.Target, byte(ev.Reply))
+	}
+	return s
+}
+
+// emit passes an event of type t to OnEvent, if set.
+func (req *Request) emit(t EventType, reply ReplyCode) {
+	if req.OnEvent == nil {
+		return
+	}
+	ev := SocksEvent{
+		Type:    t,
+		Method:  req.method,
+		Command: req.Command,
+		Target:  req.Target,
+		Reply:   reply,
+	}
+	if req.conn != nil {
+		ev.RemoteAddr = req.conn.RemoteAddr()
+	}
+	req.OnEvent(ev)
+}
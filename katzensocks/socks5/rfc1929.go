@@ -27,14 +27,54 @@
 
 package socks5
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+	"time"
+)
 
 const (
 	authRFC1929Ver     = 0x01
 	authRFC1929Success = 0x00
 	authRFC1929Fail    = 0x01
+
+	// authRFC1929MaxLen is the longest USERNAME or PASSWORD RFC1929 allows.
+	authRFC1929MaxLen = 255
+
+	// credentialFieldTimeout is the time a client has to send a USERNAME
+	// or PASSWORD once it announced its length, so that a client stalling
+	// mid-field fails well before the negotiation timeout.
+	credentialFieldTimeout = 2 * time.Second
 )
 
+// maxCredentialLen returns the longest USERNAME or PASSWORD accepted.
+func (req *Request) maxCredentialLen() int {
+	if req.MaxCredentialLen > 0 && req.MaxCredentialLen < authRFC1929MaxLen {
+		return req.MaxCredentialLen
+	}
+	return authRFC1929MaxLen
+}
+
+// readCredential reads a USERNAME or PASSWORD field of n bytes, which must
+// arrive within credentialFieldTimeout.
+func (req *Request) readCredential(n int) ([]byte, error) {
+	if req.conn == nil || req.rw.Reader.Buffered() >= n {
+		return req.readBytes(n)
+	}
+	deadline := time.Now().Add(credentialFieldTimeout)
+	if !req.deadline.IsZero() && req.deadline.Before(deadline) {
+		deadline = req.deadline
+	}
+	if err := req.conn.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+	b, err := req.readBytes(n)
+	if rerr := req.conn.SetReadDeadline(req.deadline); err == nil {
+		err = rerr
+	}
+	return b, err
+}
+
 func (req *Request) authRFC1929() (err error) {
 	sendErrResp := func() {
 		// Swallow write/flush errors, the auth failure is the relevant error.
@@ -63,9 +103,12 @@ func (req *Request) authRFC1929() (err error) {
 	} else if ulen < 1 {
 		sendErrResp()
 		return fmt.Errorf("username with 0 length")
+	} else if int(ulen) > req.maxCredentialLen() {
+		sendErrResp()
+		return fmt.Errorf("username of %d bytes exceeds %d", ulen, req.maxCredentialLen())
 	}
 	var uname []byte
-	if uname, err = req.readBytes(int(ulen)); err != nil {
+	if uname, err = req.readCredential(int(ulen)); err != nil {
 		sendErrResp()
 		return
 	}
@@ -78,9 +121,12 @@ func (req *Request) authRFC1929() (err error) {
 	} else if plen < 1 {
 		sendErrResp()
 		return fmt.Errorf("password with 0 length")
+	} else if int(plen) > req.maxCredentialLen() {
+		sendErrResp()
+		return fmt.Errorf("password of %d bytes exceeds %d", plen, req.maxCredentialLen())
 	}
 	var passwd []byte
-	if passwd, err = req.readBytes(int(plen)); err != nil {
+	if passwd, err = req.readCredential(int(plen)); err != nil {
 		sendErrResp()
 		return
 	}
@@ -94,7 +140,34 @@ func (req *Request) authRFC1929() (err error) {
 		// actual argument data.
 		argStr += string(passwd)
 	}
+	req.Username = string(uname)
+	if req.CredentialVerifier != nil {
+		var ok bool
+		if ok, err = req.CredentialVerifier(string(uname), string(passwd)); err != nil {
+			sendErrResp()
+			return
+		} else if !ok {
+			sendErrResp()
+			return fmt.Errorf("invalid credentials for user '%s'", uname)
+		}
+	}
+	req.Args = parseArgs(argStr)
 	resp := []byte{authRFC1929Ver, authRFC1929Success}
 	_, err = req.rw.Write(resp[:])
 	return
 }
+
+// parseArgs parses the "key=value" pairs separated by ';' of the combined
+// username/password fields.  Pairs without a '=' are ignored, so plain
+// usernames are accepted but yield no arguments.
+func parseArgs(argStr string) map[string]string {
+	args := make(map[string]string)
+	for _, kv := range strings.Split(argStr, ";") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" {
+			continue
+		}
+		args[k] = v
+	}
+	return args
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2015, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package socks5
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+const (
+	socks4Version = 0x04
+
+	socks4ReplyVersion = 0x00
+	socks4Granted      = 0x5a
+	socks4Rejected     = 0x5b
+	socks4MaxFieldLen  = 255
+	socks4ReplyLen     = 8
+	socks4ConnectCmd   = 0x01
+	socks4DstLen       = 2 + 4
+)
+
+// readSocks4Command reads a SOCKS4 or SOCKS4a CONNECT request, whose
+// version byte has been peeked by Handshake.  The USERID is treated as the
+// RFC1929 username of SOCKS5.
+func (req *Request) readSocks4Command() error {
+	req.socks4 = true
+	if code, err := req.parseSocks4Command(); err != nil {
+		_ = req.Reply(code)
+		return err
+	}
+	return req.flushBuffers()
+}
+
+func (req *Request) parseSocks4Command() (ReplyCode, error) {
+	// The client sends the request.
+	//  uint8_t vn (0x04)
+	//  uint8_t cd
+	//  uint16_t dstport
+	//  uint8_t dstip[4]
+	//  uint8_t userid[] (NUL terminated)
+	//  uint8_t hostname[] (NUL terminated, SOCKS4a only)
+
+	var err error
+	if err = req.readByteVerify("version", socks4Version); err != nil {
+		return ReplyGeneralFailure, err
+	}
+	if err = req.readByteVerify("command", socks4ConnectCmd); err != nil {
+		return ReplyCommandNotSupported, err
+	}
+	req.Command = ConnectCmd
+	req.emit(EventCommand, 0)
+
+	var hdr []byte
+	if hdr, err = req.readBytes(socks4DstLen); err != nil {
+		return ReplyGeneralFailure, err
+	}
+	port := int(hdr[0])<<8 | int(hdr[1])
+	ip := hdr[2:6]
+
+	var userID []byte
+	if userID, err = req.readNullTerminated("userid"); err != nil {
+		return ReplyGeneralFailure, err
+	}
+	req.Username = string(userID)
+	req.Args = parseArgs(req.Username)
+
+	// SOCKS4 has no password, so verified credentials can not be given.
+	if req.CredentialVerifier != nil {
+		return ReplyConnectionNotAllowed, fmt.Errorf("SOCKS4 can not authenticate")
+	}
+
+	// SOCKS4a marks a hostname following the USERID with a DSTIP of
+	// 0.0.0.x, where x is non zero.
+	host := net.IPv4(ip[0], ip[1], ip[2], ip[3]).String()
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		var hostname []byte
+		if hostname, err = req.readNullTerminated("hostname"); err != nil {
+			return ReplyGeneralFailure, err
+		}
+		if len(hostname) == 0 {
+			return ReplyGeneralFailure, fmt.Errorf("hostname with 0 length")
+		}
+		if err = validateDomainName(hostname); err != nil {
+			return ReplyGeneralFailure, err
+		}
+		host = string(hostname)
+	}
+	req.Target = fmt.Sprintf("%s:%d", host, port)
+	req.emit(EventTarget, 0)
+	return ReplySucceeded, nil
+}
+
+// readNullTerminated reads a NUL terminated field of at most
+// socks4MaxFieldLen bytes, and returns it without the NUL.
+func (req *Request) readNullTerminated(descr string) ([]byte, error) {
+	var field bytes.Buffer
+	for {
+		b, err := req.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == 0x00 {
+			return field.Bytes(), nil
+		}
+		if field.Len() == socks4MaxFieldLen {
+			return nil, fmt.Errorf("message field '%s' is too long", descr)
+		}
+		field.WriteByte(b)
+	}
+}
+
+// replySocks4 sends a SOCKS4 reply, which grants the request iff code is
+// ReplySucceeded.  The DSTPORT and DSTIP fields are ignored by CONNECT
+// clients, and are set to zero.
+func (req *Request) replySocks4(code ReplyCode) error {
+	// The server sends a reply message.
+	//  uint8_t vn (0x00)
+	//  uint8_t cd
+	//  uint16_t dstport
+	//  uint8_t dstip[4]
+
+	var resp [socks4ReplyLen]byte
+	resp[0] = socks4ReplyVersion
+	resp[1] = socks4Rejected
+	if code == ReplySucceeded {
+		resp[1] = socks4Granted
+	}
+	if _, err := req.rw.Write(resp[:]); err != nil {
+		return err
+	}
+	return req.flushBuffers()
+}
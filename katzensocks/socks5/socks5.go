@@ -27,24 +27,28 @@
 
 // Package socks5 implements a SOCKS 5 server and the required pluggable
 // transport specific extensions.  For more information see RFC 1928 and RFC
-// 1929.
+// 1929.  SOCKS 4 and 4a CONNECT requests are accepted as well.
 //
 // Notes:
 //   - GSSAPI authentication, is NOT supported.
-//   - Only the CONNECT command is supported.
-//   - The authentication provided by the client is always accepted as it is
-//     used as a channel to pass information rather than for authentication for
-//     pluggable transports.
+//   - The CONNECT, BIND and UDP ASSOCIATE commands are supported.
+//   - RFC1929 username/password authentication is accepted as provided
+//     unless a CredentialVerifier is set, in which case credentials it
+//     rejects fail authentication.  The username is kept in
+//     Request.Username.
 package socks5 // import "gitlab.com/yawning/obfs4.git/common/socks5"
 
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/netip"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -54,8 +58,14 @@ const (
 	rsv     = 0x00
 
 	ConnectCmd      = 0x01
+	BindCmd         = 0x02
 	UDPAssociateCmd = 0x03
 
+	// ResolveCmd and ResolvePtrCmd are the Tor extensions for resolving a
+	// name or an address without opening a stream.
+	ResolveCmd    = 0xf0
+	ResolvePtrCmd = 0xf1
+
 	atypIPv4       = 0x01
 	atypDomainName = 0x03
 	atypIPv6       = 0x04
@@ -67,6 +77,15 @@ const (
 	requestTimeout = 5 * time.Second
 )
 
+// The authentication methods that may be listed in PreferredMethods.
+const (
+	AuthNoneRequired     byte = authNoneRequired
+	AuthUsernamePassword byte = authUsernamePassword
+)
+
+// defaultPreferredMethods prioritizes authenticating over not.
+var defaultPreferredMethods = []byte{authUsernamePassword, authNoneRequired}
+
 // ReplyCode is a SOCKS 5 reply code.
 type ReplyCode byte
 
@@ -88,17 +107,50 @@ func Version() string {
 	return "socks5"
 }
 
-// ErrorToReplyCode converts an error to the "best" reply code.
-func ErrorToReplyCode(err error) ReplyCode {
-	opErr, ok := err.(*net.OpError)
-	if !ok {
-		return ReplyGeneralFailure
+// maxLabelLen is the longest label of a domain name, per RFC 1035.
+const maxLabelLen = 63
+
+// validateDomainName checks that name is a plausible domain name, with no
+// NUL bytes and labels of 1 to maxLabelLen bytes, so that junk is not
+// passed on to be resolved.  A trailing root label is permitted.
+func validateDomainName(name []byte) error {
+	if bytes.IndexByte(name, 0x00) != -1 {
+		return fmt.Errorf("domain name with NUL byte")
+	}
+	name = bytes.TrimSuffix(name, []byte("."))
+	for _, label := range bytes.Split(name, []byte(".")) {
+		if len(label) == 0 {
+			return fmt.Errorf("domain name with empty label")
+		}
+		if len(label) > maxLabelLen {
+			return fmt.Errorf("domain name with label of %d bytes", len(label))
+		}
 	}
+	return nil
+}
 
-	errno, ok := opErr.Err.(syscall.Errno)
-	if !ok {
+// ErrorToReplyCode converts an error to the "best" reply code, so that
+// clients can tell why a connection failed.  Wrapped errors are examined,
+// and errors that can not be classified are a general failure.
+func ErrorToReplyCode(err error) ReplyCode {
+	var (
+		dnsErr *net.DNSError
+		netErr net.Error
+		errno  syscall.Errno
+	)
+	switch {
+	case err == nil:
+		return ReplyGeneralFailure
+	case errors.As(err, &dnsErr):
+		// The target name could not be resolved.
+		return ReplyHostUnreachable
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return ReplyTTLExpired
+	case !errors.As(err, &errno):
 		return ReplyGeneralFailure
 	}
+
 	switch errno {
 	case syscall.EADDRNOTAVAIL:
 		return ReplyAddressNotSupported
@@ -110,57 +162,214 @@ func ErrorToReplyCode(err error) ReplyCode {
 		return ReplyHostUnreachable
 	case syscall.ECONNREFUSED, syscall.ECONNRESET:
 		return ReplyConnectionRefused
+	case syscall.EACCES, syscall.EPERM:
+		return ReplyConnectionNotAllowed
 	default:
 		return ReplyGeneralFailure
 	}
 }
 
+// ReplyCodeForError returns the REP byte of ErrorToReplyCode(err), for
+// callers that build their own replies.
+func ReplyCodeForError(err error) byte {
+	return byte(ErrorToReplyCode(err))
+}
+
+// DefaultNegotiationTimeout is the time a client has to complete the
+// handshake, unless changed with SetDeadlines.
+const DefaultNegotiationTimeout = requestTimeout
+
+// ErrNegotiationTimeout is returned when a client does not complete the
+// handshake in time.
+var ErrNegotiationTimeout = errors.New("socks5: negotiation timed out")
+
+// CredentialVerifier checks the RFC1929 username and password of a client,
+// returning false to reject them.
+type CredentialVerifier func(user, pass string) (bool, error)
+
 // Request describes a SOCKS 5 request.
 type Request struct {
 	Target  string
 	Command byte
 	Conn    net.Conn
 	rw      *bufio.ReadWriter
+
+	// Listener is the listener of a BIND request, announced in the first
+	// reply.  The connection accepted from it is the Conn announced in the
+	// second reply.
+	Listener    net.Listener
+	bindReplied bool
+
+	// Username is the USERNAME sent in RFC1929 authentication, if any.
+	Username string
+
+	// OnEvent, if set, is called as the request is handled, with the
+	// authentication method, command, target and reply code.
+	OnEvent func(SocksEvent)
+
+	// method is the chosen authentication method.
+	method byte
+
+	// PreferredMethods is the order in which the authentication methods
+	// offered by the client are selected, by default AuthUsernamePassword
+	// then AuthNoneRequired.  Methods not listed are never selected.
+	PreferredMethods []byte
+
+	// CredentialVerifier, if set, must accept the RFC1929 credentials of
+	// the client, which is then required to authenticate.
+	CredentialVerifier CredentialVerifier
+
+	// MaxCredentialLen, if non zero, is the longest RFC1929 USERNAME or
+	// PASSWORD accepted, below the RFC1929 limit of 255 bytes.  Longer
+	// fields fail authentication before they are read.
+	MaxCredentialLen int
+
+	// Args are the per-connection arguments passed as "key=value" pairs
+	// separated by ';' in the USERNAME/PASSWORD authentication fields.
+	Args map[string]string
+
+	// CoerceIPv4 forces the BND.ADDR of replies to be an IPv4 address, for
+	// clients that mishandle IPv6 bound addresses.  When the bound address
+	// has no IPv4 form, 0.0.0.0 is sent.
+	CoerceIPv4 bool
+
+	// udpPeer is the client address declared in a UDP ASSOCIATE request.
+	udpPeer netip.AddrPort
+
+	// conn is the connection the request is read from, if any.
+	conn net.Conn
+
+	negotiateTimeout time.Duration
+	idleTimeout      time.Duration
+
+	// deadline is the end of the negotiation, or zero if it is unlimited.
+	deadline time.Time
+
+	// socks4 is set iff the request was made with SOCKS4 or SOCKS4a.
+	socks4 bool
 }
 
 // Handshake attempts to handle a incoming client handshake over the provided
 // connection and receive the SOCKS5 request.  The routine handles sending
 // appropriate errors if applicable, but will not close the connection.
 func Handshake(conn net.Conn) (*Request, error) {
-	// Arm the handshake timeout.
-	var err error
-	if err = conn.SetDeadline(time.Now().Add(requestTimeout)); err != nil {
+	return HandshakeWithVerifier(conn, nil)
+}
+
+// HandshakeWithVerifier is like Handshake, but requires the client to
+// authenticate with credentials accepted by verify, if it is not nil.
+func HandshakeWithVerifier(conn net.Conn, verify CredentialVerifier) (*Request, error) {
+	return HandshakeContext(context.Background(), conn, verify)
+}
+
+// HandshakeContext is like HandshakeWithVerifier, but stops waiting for the
+// client command when ctx is done.
+func HandshakeContext(ctx context.Context, conn net.Conn, verify CredentialVerifier) (*Request, error) {
+	req := NewRequest(conn)
+	req.CredentialVerifier = verify
+	if err := req.Handshake(ctx); err != nil {
 		return nil, err
 	}
-	defer func() {
-		// Disarm the handshake timeout, only propagate the error if
-		// the handshake was successful.
-		nerr := conn.SetDeadline(time.Time{})
-		if err == nil {
-			err = nerr
-		}
-	}()
+	return req, nil
+}
 
-	req := new(Request)
+// NewRequest returns a Request to be read from conn with Handshake, which
+// may be configured first.
+func NewRequest(conn net.Conn) *Request {
+	req := &Request{conn: conn, negotiateTimeout: requestTimeout}
 	req.rw = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	return req
+}
+
+// SetDeadlines limits the time the whole handshake may take to negotiate,
+// and the time the connection returned by RelayConn may be idle.  A zero
+// duration removes the limit.  By default the handshake is limited to
+// DefaultNegotiationTimeout and relaying is not.
+func (req *Request) SetDeadlines(negotiate, idle time.Duration) {
+	req.negotiateTimeout = negotiate
+	req.idleTimeout = idle
+}
+
+// Handshake handles the client handshake and receives the request,
+// returning an error wrapping ErrNegotiationTimeout if it takes too long.
+// The routine handles sending appropriate errors if applicable, but will not
+// close the connection.
+func (req *Request) Handshake(ctx context.Context) error {
+	// Arm the handshake timeout.
+	if req.negotiateTimeout > 0 {
+		req.deadline = time.Now().Add(req.negotiateTimeout)
+		if err := req.conn.SetDeadline(req.deadline); err != nil {
+			return err
+		}
+	}
+	err := req.handshake(ctx)
+	req.deadline = time.Time{}
+
+	// Disarm the handshake timeout, only propagate the error if the
+	// handshake was successful.
+	if nerr := req.conn.SetDeadline(time.Time{}); err == nil {
+		err = nerr
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() && ctx.Err() == nil {
+		return fmt.Errorf("%w: %v", ErrNegotiationTimeout, err)
+	}
+	return err
+}
+
+func (req *Request) handshake(ctx context.Context) error {
+	// SOCKS4 clients send their request without negotiating.
+	ver, err := req.rw.Peek(1)
+	if err != nil {
+		return err
+	}
+	if ver[0] == socks4Version {
+		return req.readSocks4Command()
+	}
 
 	// Negotiate the protocol version and authentication method.
 	var method byte
 	if method, err = req.negotiateAuth(); err != nil {
-		return nil, err
+		return err
 	}
 
 	// Authenticate if neccecary.
 	if err = req.authenticate(method); err != nil {
-		return nil, err
+		return err
 	}
 
 	// Read the client command.
-	if err = req.readCommand(); err != nil {
-		return nil, err
+	return req.readCommandContext(ctx)
+}
+
+// RelayConn returns the connection of the request for relaying data, which
+// is closed for reading and writing after being idle for the idle time set
+// with SetDeadlines.
+func (req *Request) RelayConn() net.Conn {
+	if req.idleTimeout <= 0 {
+		return req.conn
 	}
+	return &idleConn{Conn: req.conn, idle: req.idleTimeout}
+}
 
-	return req, err
+// idleConn is a net.Conn that extends its deadline on every read and write.
+type idleConn struct {
+	net.Conn
+	idle time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetDeadline(time.Now().Add(c.idle)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetDeadline(time.Now().Add(c.idle)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
 }
 
 func ListenUDP() net.Conn {
@@ -172,8 +381,88 @@ func ListenUDP() net.Conn {
 	return conn
 }
 
+// BindUDP starts a local UDP listener for a UDP ASSOCIATE request that only
+// accepts datagrams sent from the address and port the client declared in
+// the request.  An all-zeros address or port in the request matches any
+// source address or port, respectively.
+func (req *Request) BindUDP() net.Conn {
+	return &udpAssociateConn{UDPConn: ListenUDP().(*net.UDPConn), peer: req.udpPeer}
+}
+
+// BindTCP starts a TCP listener for a BIND request on an ephemeral port of
+// the local address the client connected to, rather than on every interface
+// of the host.  A client connection that is not TCP binds to loopback.
+func (req *Request) BindTCP() (net.Listener, error) {
+	laddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	if req.conn != nil {
+		if addr, ok := req.conn.LocalAddr().(*net.TCPAddr); ok {
+			laddr.IP = addr.IP
+		}
+	}
+	ln, err := net.ListenTCP("tcp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	req.Listener = ln
+	return ln, nil
+}
+
+// AcceptBind waits for the peer of a BIND request to connect to the
+// Listener, which is then closed, and sets Conn to the connection.  The
+// caller then sends the second reply.
+func (req *Request) AcceptBind() (net.Conn, error) {
+	if req.Listener == nil {
+		return nil, fmt.Errorf("BIND listener not started")
+	}
+	defer req.Listener.Close()
+	conn, err := req.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	req.Conn = conn
+	return conn, nil
+}
+
+// udpAssociateConn is a UDP relay socket that drops datagrams from sources
+// other than the associated client.
+type udpAssociateConn struct {
+	*net.UDPConn
+	peer netip.AddrPort
+}
+
+func (c *udpAssociateConn) permits(src netip.AddrPort) bool {
+	if c.peer.Addr().IsValid() && !c.peer.Addr().IsUnspecified() && c.peer.Addr().Unmap() != src.Addr().Unmap() {
+		return false
+	}
+	if c.peer.Port() != 0 && c.peer.Port() != src.Port() {
+		return false
+	}
+	return true
+}
+
+// Read implements net.Conn
+func (c *udpAssociateConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+// ReadFrom implements net.PacketConn
+func (c *udpAssociateConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, src, err := c.UDPConn.ReadFromUDPAddrPort(b)
+		if err != nil {
+			return n, nil, err
+		}
+		if c.permits(src) {
+			return n, net.UDPAddrFromAddrPort(src), nil
+		}
+	}
+}
+
 // Reply sends a SOCKS5 reply to the corresponding request.  The BND.ADDR and
-// BND.PORT fields are always set to an address/port corresponding to
+// BND.PORT fields are set to the address of the UDP relay for UDP ASSOCIATE,
+// and for BIND to the address of the listener in the first reply and to the
+// address of the connecting peer in the second.  Otherwise they are set to
 // "0.0.0.0:0".
 func (req *Request) Reply(code ReplyCode) error {
 	// The server sends a reply message.
@@ -184,8 +473,12 @@ func (req *Request) Reply(code ReplyCode) error {
 	//  uint8_t bnd_addr[]
 	//  uint16_t bnd_port
 
+	req.emit(EventReply, code)
+	if req.socks4 {
+		return req.replySocks4(code)
+	}
+
 	var err error
-	var err_in_outer_scope error
 	var resp [4 + 16 + 2]byte
 	resp[0] = version
 	resp[1] = byte(code)
@@ -204,55 +497,124 @@ func (req *Request) Reply(code ReplyCode) error {
 
 	// Handle responses for each command type
 	switch req.Command {
-	case ConnectCmd:
-		resp[3] = atypIPv4
-		// addr resp[4:8] zero
-		// port resp[8:10] zero
-		_, err = req.rw.Write(resp[:10]) // truncate response
 	case UDPAssociateCmd:
 		if req.Conn == nil {
 			// should have started a listener!
 			panic("No UDP Listener")
 		}
-		ap, err := netip.ParseAddrPort(req.Conn.LocalAddr().String())
-		if err != nil {
-			_, err = req.rw.Write(resp[:])
-			return err
-		}
-		if !ap.Addr().IsValid() {
-			return req.flushBuffers()
-			return fmt.Errorf("Invalid UDP LocalAddr!")
-		}
-		if ap.Addr().Is4() {
-			resp[3] = atypIPv4
-			ip4 := ap.Addr().As4()
-			copy(resp[4:8], ip4[:])
-			binary.BigEndian.PutUint16(resp[8:10], ap.Port())
-			_, err_in_outer_scope = req.rw.Write(resp[:10])
-		} else if ap.Addr().Is6() {
-			resp[3] = atypIPv6
-			ip6 := ap.Addr().As16()
-			copy(resp[4:20], ip6[:])
-			binary.BigEndian.PutUint16(resp[20:22], ap.Port())
-			_, err_in_outer_scope = req.rw.Write(resp[:])
+		err = req.writeBoundAddr(resp, req.Conn.LocalAddr())
+	case BindCmd:
+		if !req.bindReplied {
+			if req.Listener == nil {
+				// should have started a listener!
+				panic("No BIND Listener")
+			}
+			req.bindReplied = true
+			err = req.writeBoundAddr(resp, req.Listener.Addr())
+		} else {
+			if req.Conn == nil {
+				panic("No BIND peer connection")
+			}
+			err = req.writeBoundAddr(resp, req.Conn.RemoteAddr())
 		}
 	default:
 		// nil response
 		resp[3] = atypIPv4
 		_, err = req.rw.Write(resp[:10]) // truncate response
 	}
-
 	if err != nil {
 		return err
 	}
+	return req.flushBuffers()
+}
 
-	if err_in_outer_scope != nil {
+// ReplyResolved sends the successful reply to a RESOLVE request, with the
+// resolved addr as BND.ADDR.
+func (req *Request) ReplyResolved(addr netip.Addr) error {
+	req.emit(EventReply, ReplySucceeded)
+	if req.Command != ResolveCmd {
+		return fmt.Errorf("reply to command 0x%02x is not a resolution", req.Command)
+	}
+	var resp [4 + 16 + 2]byte
+	resp[0] = version
+	resp[1] = byte(ReplySucceeded)
+	resp[2] = rsv
+	if err := req.writeBoundAddr(resp, net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, 0))); err != nil {
 		return err
 	}
+	return req.flushBuffers()
+}
 
+// ReplyResolvedName sends the successful reply to a RESOLVE_PTR request,
+// with the resolved name as BND.ADDR.
+func (req *Request) ReplyResolvedName(name string) error {
+	req.emit(EventReply, ReplySucceeded)
+	if req.Command != ResolvePtrCmd {
+		return fmt.Errorf("reply to command 0x%02x is not a resolution", req.Command)
+	}
+	if len(name) == 0 || len(name) > 255 {
+		return fmt.Errorf("invalid domain name length %d", len(name))
+	}
+	resp := []byte{version, byte(ReplySucceeded), rsv, atypDomainName, byte(len(name))}
+	resp = append(append(resp, name...), 0, 0)
+	if _, err := req.rw.Write(resp); err != nil {
+		return err
+	}
 	return req.flushBuffers()
 }
 
+// boundAddrPort returns the address and port of addr.  A socket bound to
+// all interfaces without an address family is returned as 0.0.0.0.
+func boundAddrPort(addr net.Addr) (netip.AddrPort, error) {
+	var ap netip.AddrPort
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ap = a.AddrPort()
+	case *net.TCPAddr:
+		ap = a.AddrPort()
+	default:
+		var err error
+		if ap, err = netip.ParseAddrPort(addr.String()); err != nil {
+			return ap, err
+		}
+	}
+	if !ap.Addr().IsValid() {
+		ap = netip.AddrPortFrom(netip.IPv4Unspecified(), ap.Port())
+	}
+	return ap, nil
+}
+
+// writeBoundAddr writes the reply resp with addr as BND.ADDR and BND.PORT,
+// using the address type of addr unless CoerceIPv4 is set.  IPv4-mapped
+// addresses of dual stack sockets are sent as IPv4.
+func (req *Request) writeBoundAddr(resp [4 + 16 + 2]byte, addr net.Addr) error {
+	ap, err := boundAddrPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid bound address %v", addr)
+	}
+	var n int
+	if req.CoerceIPv4 && !ap.Addr().Unmap().Is4() {
+		// no IPv4 form, send 0.0.0.0
+		resp[3] = atypIPv4
+		binary.BigEndian.PutUint16(resp[8:10], ap.Port())
+		n = 10
+	} else if ap.Addr().Unmap().Is4() {
+		resp[3] = atypIPv4
+		ip4 := ap.Addr().Unmap().As4()
+		copy(resp[4:8], ip4[:])
+		binary.BigEndian.PutUint16(resp[8:10], ap.Port())
+		n = 10
+	} else {
+		resp[3] = atypIPv6
+		ip6 := ap.Addr().As16()
+		copy(resp[4:20], ip6[:])
+		binary.BigEndian.PutUint16(resp[20:22], ap.Port())
+		n = len(resp)
+	}
+	_, err = req.rw.Write(resp[:n])
+	return err
+}
+
 func (req *Request) negotiateAuth() (byte, error) {
 	// The client sends a version identifier/selection message.
 	//	uint8_t ver (0x05)
@@ -275,12 +637,24 @@ func (req *Request) negotiateAuth() (byte, error) {
 		return 0, err
 	}
 
-	// Pick the best authentication method, prioritizing authenticating
-	// over not if both options are present.
-	if bytes.IndexByte(methods, authUsernamePassword) != -1 {
-		method = authUsernamePassword
-	} else if bytes.IndexByte(methods, authNoneRequired) != -1 {
-		method = authNoneRequired
+	// Pick the most preferred authentication method offered, by default
+	// prioritizing authenticating over not if both options are present.
+	// Authenticating is required when credentials are verified.
+	preferred := req.PreferredMethods
+	if preferred == nil {
+		preferred = defaultPreferredMethods
+	}
+	for _, m := range preferred {
+		if m == authNoneRequired && req.CredentialVerifier != nil {
+			continue
+		}
+		if m != authNoneRequired && m != authUsernamePassword {
+			continue
+		}
+		if bytes.IndexByte(methods, m) != -1 {
+			method = m
+			break
+		}
 	}
 
 	// The server sends a method selection message.
@@ -291,6 +665,8 @@ func (req *Request) negotiateAuth() (byte, error) {
 		return 0, err
 	}
 
+	req.method = method
+	req.emit(EventAuth, 0)
 	return method, req.flushBuffers()
 }
 
@@ -313,7 +689,56 @@ func (req *Request) authenticate(method byte) error {
 	return req.flushBuffers()
 }
 
+// ParseRequest parses the request details sent by a SOCKS5 client after
+// authentication from r.  Nothing is written in reply, so it may be used on
+// untrusted input outside of a connection, such as by a fuzzer.
+func ParseRequest(r io.Reader) (*Request, error) {
+	req := new(Request)
+	req.rw = bufio.NewReadWriter(bufio.NewReader(r), bufio.NewWriter(io.Discard))
+	if _, err := req.parseCommand(); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
 func (req *Request) readCommand() error {
+	return req.readCommandContext(context.Background())
+}
+
+// readCommandContext is like readCommand, but gives up when ctx is done by
+// expiring the read deadline of the connection, and returns ctx.Err().
+func (req *Request) readCommandContext(ctx context.Context) error {
+	if req.conn != nil && ctx.Done() != nil {
+		stopCh := make(chan struct{})
+		doneCh := make(chan struct{})
+		go func() {
+			defer close(doneCh)
+			select {
+			case <-ctx.Done():
+				_ = req.conn.SetReadDeadline(time.Unix(1, 0))
+			case <-stopCh:
+			}
+		}()
+		defer func() {
+			close(stopCh)
+			<-doneCh
+		}()
+	}
+
+	code, err := req.parseCommand()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if err != nil {
+		_ = req.Reply(code)
+		return err
+	}
+	return req.flushBuffers()
+}
+
+// parseCommand reads the request details, returning the reply code
+// describing the failure on error.
+func (req *Request) parseCommand() (ReplyCode, error) {
 	// The client sends the request details.
 	//  uint8_t ver (0x05)
 	//  uint8_t cmd
@@ -324,83 +749,93 @@ func (req *Request) readCommand() error {
 
 	var err error
 	if err = req.readByteVerify("version", version); err != nil {
-		_ = req.Reply(ReplyGeneralFailure)
-		return err
+		return ReplyGeneralFailure, err
 	}
 	command, err := req.readByte()
 	if err != nil {
-		_ = req.Reply(ReplyGeneralFailure)
-		return err
+		return ReplyGeneralFailure, err
 	}
+	req.Command = command
+	req.emit(EventCommand, 0)
 
 	switch command {
-	// we support Connect and UDPAssociate
-	case ConnectCmd, UDPAssociateCmd:
+	// we support Connect, Bind, UDPAssociate and the Tor resolve extensions
+	case ConnectCmd, BindCmd, UDPAssociateCmd, ResolveCmd, ResolvePtrCmd:
 	default:
-		_ = req.Reply(ReplyCommandNotSupported)
-		return fmt.Errorf("command not supported")
+		return ReplyCommandNotSupported, fmt.Errorf("command not supported")
 	}
-	req.Command = command
 
 	// read reserved byte
 	if err = req.readByteVerify("reserved", rsv); err != nil {
-		_ = req.Reply(ReplyGeneralFailure)
-		return err
+		return ReplyGeneralFailure, err
 	}
 
 	// Read the destination address/port.
 	var atyp byte
 	var host string
 	if atyp, err = req.readByte(); err != nil {
-		_ = req.Reply(ReplyGeneralFailure)
-		return err
+		return ReplyGeneralFailure, err
 	}
 	switch atyp {
 	case atypIPv4:
 		var addr []byte
 		if addr, err = req.readBytes(net.IPv4len); err != nil {
-			_ = req.Reply(ReplyGeneralFailure)
-			return err
+			return ReplyGeneralFailure, err
 		}
 
 		host = net.IPv4(addr[0], addr[1], addr[2], addr[3]).String()
 	case atypDomainName:
 		var alen byte
 		if alen, err = req.readByte(); err != nil {
-			_ = req.Reply(ReplyGeneralFailure)
-			return err
+			return ReplyGeneralFailure, err
 		}
 		if alen == 0 {
-			_ = req.Reply(ReplyGeneralFailure)
-			return fmt.Errorf("domain name with 0 length")
+			return ReplyAddressNotSupported, fmt.Errorf("domain name with 0 length")
 		}
 		var addr []byte
 		if addr, err = req.readBytes(int(alen)); err != nil {
-			_ = req.Reply(ReplyGeneralFailure)
-			return err
+			return ReplyGeneralFailure, err
+		}
+		if err = validateDomainName(addr); err != nil {
+			return ReplyAddressNotSupported, err
 		}
 		host = string(addr)
 	case atypIPv6:
 		var rawAddr []byte
 		if rawAddr, err = req.readBytes(net.IPv6len); err != nil {
-			_ = req.Reply(ReplyGeneralFailure)
-			return err
+			return ReplyGeneralFailure, err
 		}
 		addr := make(net.IP, net.IPv6len)
 		copy(addr[:], rawAddr[:])
 		host = fmt.Sprintf("[%s]", addr.String())
 	default:
-		_ = req.Reply(ReplyAddressNotSupported)
-		return fmt.Errorf("unsupported address type 0x%02x", atyp)
+		return ReplyAddressNotSupported, fmt.Errorf("unsupported address type 0x%02x", atyp)
 	}
 	var rawPort []byte
 	if rawPort, err = req.readBytes(2); err != nil {
-		_ = req.Reply(ReplyGeneralFailure)
-		return err
+		return ReplyGeneralFailure, err
 	}
 	port := int(rawPort[0])<<8 | int(rawPort[1])
 	req.Target = fmt.Sprintf("%s:%d", host, port)
-	return req.flushBuffers()
+	switch req.Command {
+	case ResolveCmd:
+		// The name to resolve, without the ignored port.
+		req.Target = strings.Trim(host, "[]")
+	case ResolvePtrCmd:
+		// The address to resolve, which must not be a name.
+		if atyp == atypDomainName {
+			return ReplyAddressNotSupported, fmt.Errorf("RESOLVE_PTR of a domain name")
+		}
+		req.Target = strings.Trim(host, "[]")
+	}
+	req.emit(EventTarget, 0)
+	if req.Command == UDPAssociateCmd {
+		// A domain name leaves the peer unrestricted.
+		if addr, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+			req.udpPeer = netip.AddrPortFrom(addr, uint16(port))
+		}
+	}
+	return ReplySucceeded, nil
 }
 
 func (req *Request) flushBuffers() error {
@@ -30,13 +30,18 @@ package socks5
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/netip"
+	"os"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -227,6 +232,37 @@ func TestAuthUnsupported2(t *testing.T) {
 	}
 }
 
+// TestAuthPreferredMethods tests selecting methods in the preferred order.
+func TestAuthPreferredMethods(t *testing.T) {
+	c := new(testReadWriter)
+	req := c.toRequest()
+	req.PreferredMethods = []byte{AuthNoneRequired, AuthUsernamePassword}
+
+	// VER = 05, NMETHODS = 02, METHODS = [02, 00]
+	c.writeHex("05020200")
+	if method, err := req.negotiateAuth(); err != nil {
+		t.Error("negotiateAuth(Both) failed:", err)
+	} else if method != authNoneRequired {
+		t.Error("negotiateAuth(Both) unexpected method:", method)
+	}
+	if msg := c.readHex(); msg != "0500" {
+		t.Error("negotiateAuth(Both) invalid response:", msg)
+	}
+
+	// a method that is not preferred is not selected
+	c.reset(req)
+	req.PreferredMethods = []byte{AuthUsernamePassword}
+	c.writeHex("050100")
+	if method, err := req.negotiateAuth(); err != nil {
+		t.Error("negotiateAuth(None) failed:", err)
+	} else if method != authNoAcceptableMethods {
+		t.Error("negotiateAuth(None) unexpected method:", method)
+	}
+	if msg := c.readHex(); msg != "05ff" {
+		t.Error("negotiateAuth(None) invalid response:", msg)
+	}
+}
+
 // TestRFC1929InvalidVersion tests RFC1929 auth with an invalid version.
 func TestRFC1929InvalidVersion(t *testing.T) {
 	c := new(testReadWriter)
@@ -272,6 +308,150 @@ func TestRFC1929InvalidPlen(t *testing.T) {
 	}
 }
 
+// TestRFC1929MaxCredentialLen tests that fields longer than
+// MaxCredentialLen are rejected.
+func TestRFC1929MaxCredentialLen(t *testing.T) {
+	c := new(testReadWriter)
+	req := c.toRequest()
+	req.MaxCredentialLen = 4
+
+	// VER = 01, ULEN = 5, UNAME = "ABCDE", PLEN = 1, PASSWD = NUL
+	c.writeHex("010541424344450100")
+	if err := req.authenticate(authUsernamePassword); err == nil {
+		t.Error("authenticate(MaxCredentialLen) succeded")
+	}
+	if msg := c.readHex(); msg != "0101" {
+		t.Error("authenticate(MaxCredentialLen) invalid response:", msg)
+	}
+}
+
+// TestRFC1929Stall tests that a client stalling mid-field fails before
+// the negotiation times out.
+func TestRFC1929Stall(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	req := NewRequest(remote)
+	req.SetDeadlines(time.Minute, 0)
+	resp := make(chan string, 1)
+	go func() {
+		// VER = 05, NMETHODS = 01, METHODS = [02], then
+		// VER = 01, ULEN = 255, UNAME = "AB" and nothing more
+		local.Write([]byte{0x05, 0x01, 0x02})
+		io.ReadFull(local, make([]byte, 2))
+		local.Write([]byte{0x01, 0xff, 'A', 'B'})
+		b := make([]byte, 2)
+		io.ReadFull(local, b)
+		resp <- hex.EncodeToString(b)
+	}()
+	start := time.Now()
+	if err := req.Handshake(context.Background()); err == nil {
+		t.Error("Handshake(Stall) succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > credentialFieldTimeout+time.Second {
+		t.Error("Handshake(Stall) took", elapsed)
+	}
+	if msg := <-resp; msg != "0101" {
+		t.Error("Handshake(Stall) invalid response:", msg)
+	}
+}
+
+// TestRFC1929Args tests that the USERNAME/PASSWORD fields are parsed into
+// per-connection arguments.
+func TestRFC1929Args(t *testing.T) {
+	c := new(testReadWriter)
+	req := c.toRequest()
+
+	// VER = 01, ULEN = 17, UNAME = "app=mail;user=bob", PLEN = 1, PASSWD = NUL
+	c.writeHex("01116170703d6d61696c3b757365723d626f620100")
+	if err := req.authenticate(authUsernamePassword); err != nil {
+		t.Error("authenticate(Args) failed:", err)
+	}
+	if msg := c.readHex(); msg != "0100" {
+		t.Error("authenticate(Args) invalid response:", msg)
+	}
+	if req.Args["app"] != "mail" || req.Args["user"] != "bob" || len(req.Args) != 2 {
+		t.Error("authenticate(Args) invalid args:", req.Args)
+	}
+	if req.Username != "app=mail;user=bob" {
+		t.Error("authenticate(Args) invalid username:", req.Username)
+	}
+}
+
+// TestRFC1929Verifier tests that credentials are checked by the
+// CredentialVerifier.
+func TestRFC1929Verifier(t *testing.T) {
+	c := new(testReadWriter)
+	req := c.toRequest()
+	req.CredentialVerifier = func(user, pass string) (bool, error) {
+		return user == "alice" && pass == "secret", nil
+	}
+
+	// VER = 01, ULEN = 5, UNAME = "alice", PLEN = 6, PASSWD = "secret"
+	c.writeHex("0105616c69636506736563726574")
+	if err := req.authenticate(authUsernamePassword); err != nil {
+		t.Error("authenticate(Valid) failed:", err)
+	}
+	if msg := c.readHex(); msg != "0100" {
+		t.Error("authenticate(Valid) invalid response:", msg)
+	}
+	if req.Username != "alice" {
+		t.Error("authenticate(Valid) invalid username:", req.Username)
+	}
+
+	// VER = 01, ULEN = 5, UNAME = "alice", PLEN = 5, PASSWD = "wrong"
+	c.reset(req)
+	c.writeHex("0105616c6963650577726f6e67")
+	if err := req.authenticate(authUsernamePassword); err == nil {
+		t.Error("authenticate(Invalid) succeeded")
+	}
+	if msg := c.readHex(); msg != "0101" {
+		t.Error("authenticate(Invalid) invalid response:", msg)
+	}
+
+	// verification errors reject the credentials
+	c.reset(req)
+	req.CredentialVerifier = func(user, pass string) (bool, error) {
+		return false, fmt.Errorf("tenant database unavailable")
+	}
+	c.writeHex("0105616c69636506736563726574")
+	if err := req.authenticate(authUsernamePassword); err == nil {
+		t.Error("authenticate(Error) succeeded")
+	}
+	if msg := c.readHex(); msg != "0101" {
+		t.Error("authenticate(Error) invalid response:", msg)
+	}
+}
+
+// TestAuthVerifierRequired tests that no authentication is refused when
+// credentials are verified.
+func TestAuthVerifierRequired(t *testing.T) {
+	c := new(testReadWriter)
+	req := c.toRequest()
+	req.CredentialVerifier = func(user, pass string) (bool, error) {
+		return true, nil
+	}
+
+	// VER = 05, NMETHODS = 01, METHODS = [00]
+	c.writeHex("050100")
+	if _, err := req.negotiateAuth(); err != nil {
+		t.Error("negotiateAuth(None) failed:", err)
+	}
+	if msg := c.readHex(); msg != "05ff" {
+		t.Error("negotiateAuth(None) invalid response:", msg)
+	}
+
+	// SOCKS4 can not authenticate
+	c.reset(req)
+	c.writeHex("04010050" + "7f000001" + "00")
+	if err := req.readSocks4Command(); err == nil {
+		t.Error("readSocks4Command(Verified) succeeded")
+	}
+	if msg := c.readHex(); msg != "005b000000000000" {
+		t.Error("readSocks4Command(Verified) invalid response:", msg)
+	}
+}
+
 // TestRequestInvalidHdr tests SOCKS5 requests with invalid VER/CMD/RSV/ATYPE
 func TestRequestInvalidHdr(t *testing.T) {
 	c := new(testReadWriter)
@@ -371,6 +551,43 @@ func TestRequestFQDN(t *testing.T) {
 	}
 }
 
+// TestRequestFQDNInvalid tests that malformed domain names are rejected.
+func TestRequestFQDNInvalid(t *testing.T) {
+	c := new(testReadWriter)
+	req := c.toRequest()
+
+	long := strings.Repeat("61", maxLabelLen+1)
+	for name, addr := range map[string]string{
+		"Empty":       "00",
+		"NUL":         "0561620000" + "63",
+		"AllNUL":      "ff" + strings.Repeat("00", 255),
+		"EmptyLabel":  "04612e2e62",
+		"LongLabel":   fmt.Sprintf("%02x", maxLabelLen+1) + long,
+		"LongLabel2":  fmt.Sprintf("%02x", maxLabelLen+3) + "612e" + long,
+		"OnlyTheRoot": "012e",
+	} {
+		c.reset(req)
+		// VER = 05, CMD = 01, RSV = 00, ATYPE = 03, DST.ADDR = addr, DST.PORT = 9050
+		c.writeHex("05010003" + addr + "235a")
+		if err := req.readCommand(); err == nil {
+			t.Errorf("readCommand(%s) succeeded", name)
+		}
+		if msg := c.readHex(); msg != "05080001000000000000" {
+			t.Errorf("readCommand(%s) invalid response: %s", name, msg)
+		}
+	}
+
+	// a trailing root label is permitted
+	c.reset(req)
+	c.writeHex("050100030c6578616d706c652e636f6d2e235a")
+	if err := req.readCommand(); err != nil {
+		t.Error("readCommand(FQDNRoot) failed:", err)
+	}
+	if req.Target != "example.com.:9050" {
+		t.Error("Unexpected target:", req.Target)
+	}
+}
+
 // TestResponseNil tests nil address SOCKS5 responses.
 func TestResponseNil(t *testing.T) {
 	c := new(testReadWriter)
@@ -384,6 +601,46 @@ func TestResponseNil(t *testing.T) {
 	}
 }
 
+// TestRequestEvents tests the events reported while handling a request.
+func TestRequestEvents(t *testing.T) {
+	c := new(testReadWriter)
+	req := c.toRequest()
+	var events []SocksEvent
+	req.OnEvent = func(ev SocksEvent) {
+		events = append(events, ev)
+	}
+
+	// VER = 05, NMETHODS = 01, METHODS = [00]
+	c.writeHex("050100")
+	if _, err := req.negotiateAuth(); err != nil {
+		t.Error("negotiateAuth(None) failed:", err)
+	}
+	c.readHex()
+	// VER = 05, CMD = 01, RSV = 00, ATYPE = 04, DST.ADDR = example.com, DST.PORT = 9050
+	c.writeHex("050100030b6578616d706c652e636f6d235a")
+	if err := req.readCommand(); err != nil {
+		t.Error("readCommand(FQDN) failed:", err)
+	}
+	if err := req.Reply(ReplyHostUnreachable); err != nil {
+		t.Error("Reply(ReplyHostUnreachable) failed:", err)
+	}
+
+	want := []SocksEvent{
+		{Type: EventAuth, Method: AuthNoneRequired},
+		{Type: EventCommand, Method: AuthNoneRequired, Command: ConnectCmd},
+		{Type: EventTarget, Method: AuthNoneRequired, Command: ConnectCmd, Target: "example.com:9050"},
+		{Type: EventReply, Method: AuthNoneRequired, Command: ConnectCmd, Target: "example.com:9050", Reply: ReplyHostUnreachable},
+	}
+	if len(events) != len(want) {
+		t.Fatal("Unexpected events:", events)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("Unexpected event %d: %v", i, events[i])
+		}
+	}
+}
+
 func TestRequestUDPAssociate(t *testing.T) {
 	c := new(testReadWriter)
 	req := c.toRequest()
@@ -484,4 +741,653 @@ func TestRequestUDPAssociate(t *testing.T) {
 	}
 }
 
+// TestUDPAssociateRestrictsPeer tests that the UDP relay drops datagrams from
+// sources other than the one declared in the UDP ASSOCIATE request.
+func TestUDPAssociateRestrictsPeer(t *testing.T) {
+	c := new(testReadWriter)
+	req := c.toRequest()
+
+	// the client declares the address it will send datagrams from
+	allowed, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer allowed.Close()
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	ap := allowed.LocalAddr().(*net.UDPAddr).AddrPort()
+	var cmd [4 + 4 + 2]byte
+	cmd[0] = version
+	cmd[1] = UDPAssociateCmd
+	cmd[3] = atypIPv4
+	ip4 := ap.Addr().As4()
+	copy(cmd[4:8], ip4[:])
+	binary.BigEndian.PutUint16(cmd[8:10], ap.Port())
+	if _, err := c.readBuf.Write(cmd[:]); err != nil {
+		t.Fatal("readBuf.Write failed:", err)
+	}
+	if err := req.readCommand(); err != nil {
+		t.Fatal("readCommand(UDPAssociate) failed:", err)
+	}
+
+	req.Conn = req.BindUDP()
+	defer req.Conn.Close()
+	relayAddr := req.Conn.LocalAddr()
+
+	// the unauthorized datagram is sent first and must be dropped
+	if _, err := other.WriteTo([]byte("injected"), relayAddr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := allowed.WriteTo([]byte("allowed"), relayAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := req.Conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, err := req.Conn.Read(buf)
+	if err != nil {
+		t.Fatal("Read failed:", err)
+	}
+	if string(buf[:n]) != "allowed" {
+		t.Errorf("Received datagram from unauthorized source: %q", buf[:n])
+	}
+
+	// nothing else is pending
+	if err := req.Conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := req.Conn.Read(buf); err == nil {
+		t.Errorf("Unexpected datagram: %q", buf[:n])
+	}
+}
+
+// v6LocalConn is a net.Conn that reports an IPv6 local address.
+type v6LocalConn struct {
+	net.Conn
+	addr *net.UDPAddr
+}
+
+func (c *v6LocalConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// TestReplyCoerceIPv4 tests that the UDP ASSOCIATE reply carries an IPv4
+// bound address iff CoerceIPv4 is set.
+func TestReplyCoerceIPv4(t *testing.T) {
+	c := new(testReadWriter)
+	req := c.toRequest()
+	req.Command = UDPAssociateCmd
+	req.Conn = &v6LocalConn{addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 4242}}
+
+	if err := req.Reply(ReplySucceeded); err != nil {
+		t.Error("Reply(ReplySucceeded) failed:", err)
+	}
+	if msg := c.readHex(); msg != "0500000420010db80000000000000000000000011092" {
+		t.Error("Reply(ReplySucceeded) invalid response:", msg)
+	}
+
+	c.reset(req)
+	req.Command = UDPAssociateCmd
+	req.CoerceIPv4 = true
+	if err := req.Reply(ReplySucceeded); err != nil {
+		t.Error("Reply(ReplySucceeded) failed:", err)
+	}
+	if msg := c.readHex(); msg != "05000001000000001092" {
+		t.Error("Reply(ReplySucceeded) not coerced to IPv4:", msg)
+	}
+
+	c.reset(req)
+	req.Command = UDPAssociateCmd
+	req.CoerceIPv4 = true
+	req.Conn = &v6LocalConn{addr: &net.UDPAddr{IP: net.ParseIP("::ffff:127.0.0.1"), Port: 4242}}
+	if err := req.Reply(ReplySucceeded); err != nil {
+		t.Error("Reply(ReplySucceeded) failed:", err)
+	}
+	if msg := c.readHex(); msg != "050000017f0000011092" {
+		t.Error("Reply(ReplySucceeded) mapped address not unmapped:", msg)
+	}
+}
+
+// v6Listener is a net.Listener that reports an IPv6 address.
+type v6Listener struct {
+	net.Listener
+	addr *net.TCPAddr
+}
+
+func (l *v6Listener) Addr() net.Addr {
+	return l.addr
+}
+
+// TestRequestBind tests the two replies to a BIND request.
+func TestRequestBind(t *testing.T) {
+	c := new(testReadWriter)
+	req := c.toRequest()
+
+	// VER = 05, CMD = 02, RSV = 00, ATYPE = 01, DST.ADDR = 127.0.0.1, DST.PORT = 21
+	c.writeHex("05020001" + "7f000001" + "0015")
+	if err := req.readCommand(); err != nil {
+		t.Error("readCommand(Bind) failed:", err)
+	}
+	if req.Command != BindCmd || req.Target != "127.0.0.1:21" {
+		t.Error("readCommand(Bind) invalid request:", req.Command, req.Target)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Listener = ln
+	lnPort := ln.Addr().(*net.TCPAddr).Port
+
+	// the first reply carries the address of the listener
+	if err := req.Reply(ReplySucceeded); err != nil {
+		t.Error("Reply(ReplySucceeded) failed:", err)
+	}
+	if msg := c.readHex(); msg != fmt.Sprintf("050000017f000001%04x", lnPort) {
+		t.Error("Reply(ReplySucceeded) invalid first response:", msg)
+	}
+
+	// the second reply carries the address of the connecting peer
+	peer, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	conn, err := req.AcceptBind()
+	if err != nil {
+		t.Fatal("AcceptBind failed:", err)
+	}
+	defer conn.Close()
+	c.reset(req)
+	if err := req.Reply(ReplySucceeded); err != nil {
+		t.Error("Reply(ReplySucceeded) failed:", err)
+	}
+	peerPort := peer.LocalAddr().(*net.TCPAddr).Port
+	if msg := c.readHex(); msg != fmt.Sprintf("050000017f000001%04x", peerPort) {
+		t.Error("Reply(ReplySucceeded) invalid second response:", msg)
+	}
+	if _, err := ln.Accept(); err == nil {
+		t.Error("AcceptBind did not close the listener")
+	}
+
+	// an IPv6 listener is announced with an IPv6 address
+	c.reset(req)
+	req = c.toRequest()
+	req.Command = BindCmd
+	req.Listener = &v6Listener{addr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 4242}}
+	if err := req.Reply(ReplySucceeded); err != nil {
+		t.Error("Reply(ReplySucceeded) failed:", err)
+	}
+	if msg := c.readHex(); msg != "0500000420010db80000000000000000000000011092" {
+		t.Error("Reply(ReplySucceeded) invalid IPv6 response:", msg)
+	}
+}
+
+// TestBindTCPLocalAddr tests that a BIND listener is started on the local
+// address of the client connection.
+func TestBindTCPLocalAddr(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := NewRequest(conn)
+	bindLn, err := req.BindTCP()
+	if err != nil {
+		t.Fatal("BindTCP failed:", err)
+	}
+	defer bindLn.Close()
+	addr := bindLn.Addr().(*net.TCPAddr)
+	if !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) || addr.Port == 0 {
+		t.Error("BindTCP listening on unexpected address:", addr)
+	}
+	if req.Listener != bindLn {
+		t.Error("BindTCP did not set Listener")
+	}
+}
+
+// TestSocks4Connect tests a SOCKS4 CONNECT request and its replies.
+func TestSocks4Connect(t *testing.T) {
+	c := new(testReadWriter)
+	req := c.toRequest()
+
+	// VN = 04, CD = 01, DSTPORT = 80, DSTIP = 127.0.0.1, USERID = "bob"
+	c.writeHex("04010050" + "7f000001" + "626f6200")
+	if err := req.readSocks4Command(); err != nil {
+		t.Error("readSocks4Command(IPv4) failed:", err)
+	}
+	if req.Target != "127.0.0.1:80" || req.Command != ConnectCmd || req.Username != "bob" {
+		t.Error("readSocks4Command(IPv4) invalid request:", req.Target, req.Command, req.Username)
+	}
+	if err := req.Reply(ReplySucceeded); err != nil {
+		t.Error("Reply(ReplySucceeded) failed:", err)
+	}
+	if msg := c.readHex(); msg != "005a000000000000" {
+		t.Error("Reply(ReplySucceeded) invalid response:", msg)
+	}
+
+	c.reset(req)
+	if err := req.Reply(ReplyConnectionRefused); err != nil {
+		t.Error("Reply(ReplyConnectionRefused) failed:", err)
+	}
+	if msg := c.readHex(); msg != "005b000000000000" {
+		t.Error("Reply(ReplyConnectionRefused) invalid response:", msg)
+	}
+}
+
+// TestSocks4a tests a SOCKS4a CONNECT request carrying a hostname.
+func TestSocks4a(t *testing.T) {
+	c := new(testReadWriter)
+	req := c.toRequest()
+
+	// VN = 04, CD = 01, DSTPORT = 443, DSTIP = 0.0.0.1, USERID = "", HOSTNAME = "example.com"
+	c.writeHex("040101bb" + "00000001" + "00" + "6578616d706c652e636f6d00")
+	if err := req.readSocks4Command(); err != nil {
+		t.Error("readSocks4Command(Hostname) failed:", err)
+	}
+	if req.Target != "example.com:443" {
+		t.Error("readSocks4Command(Hostname) invalid target:", req.Target)
+	}
+}
+
+// TestSocks4Invalid tests SOCKS4 requests that are rejected.
+func TestSocks4Invalid(t *testing.T) {
+	c := new(testReadWriter)
+	req := c.toRequest()
+
+	// VN = 04, CD = 02 (BIND)
+	c.writeHex("04020050" + "7f000001" + "00")
+	if err := req.readSocks4Command(); err == nil {
+		t.Error("readSocks4Command(Bind) succeeded")
+	}
+	if msg := c.readHex(); msg != "005b000000000000" {
+		t.Error("readSocks4Command(Bind) invalid response:", msg)
+	}
+
+	// SOCKS4a with an empty hostname
+	c.reset(req)
+	c.writeHex("04010050" + "00000001" + "00" + "00")
+	if err := req.readSocks4Command(); err == nil {
+		t.Error("readSocks4Command(EmptyHostname) succeeded")
+	}
+
+	// SOCKS4a with a hostname label that is too long
+	c.reset(req)
+	c.writeHex("04010050" + "00000001" + "00" + strings.Repeat("61", maxLabelLen+1) + "00")
+	if err := req.readSocks4Command(); err == nil {
+		t.Error("readSocks4Command(LongLabel) succeeded")
+	}
+
+	// USERID without a terminating NUL within the length limit
+	c.reset(req)
+	c.writeHex("04010050" + "7f000001" + strings.Repeat("41", socks4MaxFieldLen+1) + "00")
+	if err := req.readSocks4Command(); err == nil {
+		t.Error("readSocks4Command(LongUserID) succeeded")
+	}
+}
+
+// TestHandshakeSocks4 tests that Handshake dispatches on the version byte.
+func TestHandshakeSocks4(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	go func() {
+		local.Write([]byte{0x04, 0x01, 0x00, 0x50, 127, 0, 0, 1, 0x00})
+	}()
+	req, err := Handshake(remote)
+	if err != nil {
+		t.Fatal("Handshake(SOCKS4) failed:", err)
+	}
+	if req.Target != "127.0.0.1:80" {
+		t.Error("Handshake(SOCKS4) invalid target:", req.Target)
+	}
+}
+
+// TestReplyUDPAssociateIPv6 tests that the UDP ASSOCIATE reply carries the
+// address type of the UDP relay socket.
+func TestReplyUDPAssociateIPv6(t *testing.T) {
+	relay, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skip("IPv6 is unavailable:", err)
+	}
+	defer relay.Close()
+
+	c := new(testReadWriter)
+	req := c.toRequest()
+	req.Command = UDPAssociateCmd
+	req.Conn = relay
+	if err := req.Reply(ReplySucceeded); err != nil {
+		t.Error("Reply(ReplySucceeded) failed:", err)
+	}
+	port := relay.LocalAddr().(*net.UDPAddr).Port
+	if msg := c.readHex(); msg != fmt.Sprintf("0500000400000000000000000000000000000001%04x", port) {
+		t.Error("Reply(ReplySucceeded) invalid IPv6 response:", msg)
+	}
+}
+
+// TestReplyBoundAddrForms tests the replies for bound addresses without
+// an address family and for IPv4-mapped addresses.
+func TestReplyBoundAddrForms(t *testing.T) {
+	c := new(testReadWriter)
+	req := c.toRequest()
+	req.Command = UDPAssociateCmd
+	req.Conn = &v6LocalConn{addr: &net.UDPAddr{Port: 4242}}
+	if err := req.Reply(ReplySucceeded); err != nil {
+		t.Error("Reply(ReplySucceeded) failed:", err)
+	}
+	if msg := c.readHex(); msg != "05000001000000001092" {
+		t.Error("Reply(ReplySucceeded) invalid unspecified response:", msg)
+	}
+
+	c.reset(req)
+	req.Conn = &v6LocalConn{addr: &net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 4242}}
+	if err := req.Reply(ReplySucceeded); err != nil {
+		t.Error("Reply(ReplySucceeded) failed:", err)
+	}
+	if msg := c.readHex(); msg != "05000001c00002011092" {
+		t.Error("Reply(ReplySucceeded) invalid mapped response:", msg)
+	}
+}
+
+// TestUDPHeader tests encoding and parsing SOCKS5 datagram headers.
+func TestUDPHeader(t *testing.T) {
+	payload := []byte("hello")
+	for target, hdr := range map[string]string{
+		"127.0.0.1:53":          "000000017f0000010035",
+		"[2001:db8::1]:53":      "0000000420010db80000000000000000000000010035",
+		"example.com:443":       "000000030b6578616d706c652e636f6d01bb",
+		"[::ffff:192.0.2.1]:53": "00000001c00002010035",
+	} {
+		b, err := EncodeUDPHeader(target, payload)
+		if err != nil {
+			t.Error("EncodeUDPHeader failed:", target, err)
+			continue
+		}
+		if msg := hex.EncodeToString(b); msg != hdr+hex.EncodeToString(payload) {
+			t.Error("EncodeUDPHeader invalid header:", target, msg)
+		}
+		tgt, frag, p, err := ParseUDPHeader(b)
+		if err != nil {
+			t.Error("ParseUDPHeader failed:", target, err)
+		}
+		if frag != 0 || !bytes.Equal(p, payload) {
+			t.Error("ParseUDPHeader invalid datagram:", target, frag, p)
+		}
+		if target != "[::ffff:192.0.2.1]:53" && tgt != target {
+			t.Error("ParseUDPHeader invalid target:", target, tgt)
+		}
+	}
+
+	// FRAG = 01
+	b, _ := hex.DecodeString("000001017f000001003568656c6c6f")
+	if _, frag, _, err := ParseUDPHeader(b); err != ErrUDPFragmented || frag != 1 {
+		t.Error("ParseUDPHeader(Fragment) did not fail with ErrUDPFragmented:", frag, err)
+	}
+
+	// truncated headers
+	full, _ := hex.DecodeString("000000030b6578616d706c652e636f6d01bb")
+	for i := 0; i < len(full); i++ {
+		if _, _, _, err := ParseUDPHeader(full[:i]); err == nil {
+			t.Error("ParseUDPHeader(Truncated) succeeded:", i)
+		}
+	}
+
+	// RSV != 0, ATYP invalid
+	for _, raw := range []string{"010000017f0000010035", "00000005"} {
+		b, _ := hex.DecodeString(raw)
+		if _, _, _, err := ParseUDPHeader(b); err == nil {
+			t.Error("ParseUDPHeader(Invalid) succeeded:", raw)
+		}
+	}
+
+	if _, err := EncodeUDPHeader("example.com", payload); err == nil {
+		t.Error("EncodeUDPHeader(NoPort) succeeded")
+	}
+	if _, err := EncodeUDPHeader(strings.Repeat("a", 256)+":53", payload); err == nil {
+		t.Error("EncodeUDPHeader(LongDomain) succeeded")
+	}
+}
+
+// TestReadCommandContext tests that waiting for the client command stops
+// when the context is done.
+func TestReadCommandContext(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	req := &Request{conn: remote, rw: bufio.NewReadWriter(bufio.NewReader(remote), bufio.NewWriter(remote))}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelFn()
+	start := time.Now()
+	if err := req.readCommandContext(ctx); err != context.DeadlineExceeded {
+		t.Error("readCommandContext(Deadline) did not time out:", err)
+	}
+	if elapsed := time.Since(start); elapsed > requestTimeout {
+		t.Error("readCommandContext(Deadline) took", elapsed)
+	}
+
+	// a cancelled context stops a partially read command
+	remote.SetReadDeadline(time.Time{})
+	ctx, cancelFn = context.WithCancel(context.Background())
+	go func() {
+		local.Write([]byte{version, ConnectCmd})
+		cancelFn()
+	}()
+	if err := req.readCommandContext(ctx); err != context.Canceled {
+		t.Error("readCommandContext(Cancel) was not cancelled:", err)
+	}
+}
+
+// TestSetDeadlines tests the negotiation and idle deadlines.
+func TestSetDeadlines(t *testing.T) {
+	// a client that sends nothing times out the negotiation
+	local, remote := net.Pipe()
+	defer local.Close()
+	req := NewRequest(remote)
+	req.SetDeadlines(50*time.Millisecond, 0)
+	if err := req.Handshake(context.Background()); !errors.Is(err, ErrNegotiationTimeout) {
+		t.Error("Handshake(Silent) did not time out:", err)
+	}
+	remote.Close()
+
+	// a client that completes the handshake is relayed until idle
+	local, remote = net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	req = NewRequest(remote)
+	req.SetDeadlines(time.Second, 50*time.Millisecond)
+	go func() {
+		// VER = 05, NMETHODS = 01, METHODS = [00], then a CONNECT to 127.0.0.1:80
+		local.Write([]byte{0x05, 0x01, 0x00})
+		io.ReadFull(local, make([]byte, 2))
+		local.Write([]byte{0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0, 80})
+		local.Write([]byte("data"))
+	}()
+	if err := req.Handshake(context.Background()); err != nil {
+		t.Fatal("Handshake failed:", err)
+	}
+	conn := req.RelayConn()
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Error("RelayConn read failed:", err)
+	}
+	start := time.Now()
+	_, err := conn.Read(buf)
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Error("RelayConn did not time out when idle:", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("RelayConn idle timeout took", elapsed)
+	}
+}
+
+// TestRequestResolve tests the Tor RESOLVE and RESOLVE_PTR extensions.
+func TestRequestResolve(t *testing.T) {
+	c := new(testReadWriter)
+	req := c.toRequest()
+
+	// VER = 05, CMD = F0, RSV = 00, ATYPE = 03, DST.ADDR = "example.com", DST.PORT = 0
+	c.writeHex("05f000030b6578616d706c652e636f6d0000")
+	if err := req.readCommand(); err != nil {
+		t.Error("readCommand(Resolve) failed:", err)
+	}
+	if req.Command != ResolveCmd || req.Target != "example.com" {
+		t.Error("readCommand(Resolve) invalid request:", req.Command, req.Target)
+	}
+	if err := req.ReplyResolved(netip.MustParseAddr("192.0.2.1")); err != nil {
+		t.Error("ReplyResolved failed:", err)
+	}
+	if msg := c.readHex(); msg != "05000001c00002010000" {
+		t.Error("ReplyResolved invalid response:", msg)
+	}
+	c.reset(req)
+	if err := req.ReplyResolved(netip.MustParseAddr("2001:db8::1")); err != nil {
+		t.Error("ReplyResolved failed:", err)
+	}
+	if msg := c.readHex(); msg != "0500000420010db80000000000000000000000010000" {
+		t.Error("ReplyResolved invalid IPv6 response:", msg)
+	}
+
+	// VER = 05, CMD = F1, RSV = 00, ATYPE = 04, DST.ADDR = 2001:db8::1, DST.PORT = 0
+	c.reset(req)
+	req = c.toRequest()
+	c.writeHex("05f1000420010db80000000000000000000000010000")
+	if err := req.readCommand(); err != nil {
+		t.Error("readCommand(ResolvePtr) failed:", err)
+	}
+	if req.Command != ResolvePtrCmd || req.Target != "2001:db8::1" {
+		t.Error("readCommand(ResolvePtr) invalid request:", req.Command, req.Target)
+	}
+	if err := req.ReplyResolvedName("example.com"); err != nil {
+		t.Error("ReplyResolvedName failed:", err)
+	}
+	if msg := c.readHex(); msg != "050000030b6578616d706c652e636f6d0000" {
+		t.Error("ReplyResolvedName invalid response:", msg)
+	}
+	if err := req.ReplyResolved(netip.MustParseAddr("192.0.2.1")); err == nil {
+		t.Error("ReplyResolved to RESOLVE_PTR succeeded")
+	}
+
+	// RESOLVE_PTR of a domain name
+	c.reset(req)
+	req = c.toRequest()
+	c.writeHex("05f100030b6578616d706c652e636f6d0000")
+	if err := req.readCommand(); err == nil {
+		t.Error("readCommand(ResolvePtrDomain) succeeded")
+	}
+	if msg := c.readHex(); msg != "05080001000000000000" {
+		t.Error("readCommand(ResolvePtrDomain) invalid response:", msg)
+	}
+}
+
+// TestErrorToReplyCode tests the reply codes chosen for dial errors.
+func TestErrorToReplyCode(t *testing.T) {
+	opErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+	for _, tc := range []struct {
+		err  error
+		code ReplyCode
+	}{
+		{nil, ReplyGeneralFailure},
+		{errors.New("Dial Failed"), ReplyGeneralFailure},
+		{context.DeadlineExceeded, ReplyTTLExpired},
+		{fmt.Errorf("dial: %w", os.ErrDeadlineExceeded), ReplyTTLExpired},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}}, ReplyHostUnreachable},
+		{opErr(syscall.ECONNREFUSED), ReplyConnectionRefused},
+		{opErr(syscall.ENETUNREACH), ReplyNetworkUnreachable},
+		{opErr(syscall.EHOSTUNREACH), ReplyHostUnreachable},
+		{opErr(syscall.ETIMEDOUT), ReplyTTLExpired},
+		{fmt.Errorf("dial: %w", opErr(syscall.EACCES)), ReplyConnectionNotAllowed},
+	} {
+		if code := ErrorToReplyCode(tc.err); code != tc.code {
+			t.Errorf("ErrorToReplyCode(%v) = 0x%02x, expected 0x%02x", tc.err, byte(code), byte(tc.code))
+		}
+		if code := ReplyCodeForError(tc.err); code != byte(tc.code) {
+			t.Errorf("ReplyCodeForError(%v) = 0x%02x, expected 0x%02x", tc.err, code, byte(tc.code))
+		}
+	}
+}
+
+// TestParseRequest tests parsing request details without a connection.
+func TestParseRequest(t *testing.T) {
+	// VER = 05, CMD = 01, RSV = 00, ATYPE = 03, DST.ADDR = "example.com", DST.PORT = 443
+	raw, _ := hex.DecodeString("050100030b6578616d706c652e636f6d01bb")
+	req, err := ParseRequest(bytes.NewReader(raw))
+	if err != nil {
+		t.Error("ParseRequest(Domain) failed:", err)
+	} else if req.Target != "example.com:443" || req.Command != ConnectCmd {
+		t.Error("ParseRequest(Domain) invalid request:", req.Target, req.Command)
+	}
+
+	// Truncated DST.ADDR
+	if _, err = ParseRequest(bytes.NewReader(raw[:8])); err == nil {
+		t.Error("ParseRequest(Truncated) succeeded")
+	}
+}
+
+// maxParseAllocs bounds the allocations of parsing a single request,
+// whatever the input.
+const maxParseAllocs = 16
+
+// maxTargetLen is the length of the longest target, a 255 byte domain
+// name and a port.
+const maxTargetLen = 255 + len(":65535")
+
+// FuzzReadCommand feeds arbitrary bytes to the request parser.
+func FuzzReadCommand(f *testing.F) {
+	for _, seed := range []string{
+		"050100017f000001235a",
+		"050300010a00000100350",
+		"050100030b6578616d706c652e636f6d01bb",
+		"05010003056361736875000000000001bb",
+		"0501000420010db8000000000000000000000001235a",
+		"050100030000",
+		"0501000500",
+		"0302000100",
+	} {
+		raw, err := hex.DecodeString(seed)
+		if err != nil {
+			raw = []byte(seed)
+		}
+		f.Add(raw)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		req, err := ParseRequest(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if len(req.Target) > maxTargetLen {
+			t.Errorf("ParseRequest target of %d bytes", len(req.Target))
+		}
+		switch req.Command {
+		case ConnectCmd, BindCmd, UDPAssociateCmd, ResolveCmd, ResolvePtrCmd:
+		default:
+			t.Errorf("ParseRequest accepted command 0x%02x", req.Command)
+		}
+		allocs := testing.AllocsPerRun(1, func() {
+			_, _ = ParseRequest(bytes.NewReader(data))
+		})
+		if allocs > maxParseAllocs {
+			t.Errorf("ParseRequest made %v allocations", allocs)
+		}
+	})
+}
+
 var _ io.ReadWriter = (*testReadWriter)(nil)
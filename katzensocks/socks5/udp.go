@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2015, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+const udpHeaderMinLen = 2 + 1 + 1
+
+var (
+	// ErrUDPFragmented is returned by ParseUDPHeader for datagrams with a
+	// non zero FRAG field, as fragment reassembly is not supported.
+	ErrUDPFragmented = errors.New("fragmented UDP datagram")
+
+	errUDPTruncated = errors.New("truncated UDP datagram header")
+)
+
+// ParseUDPHeader parses the SOCKS5 header of a datagram relayed by UDP
+// ASSOCIATE, returning the target as a host:port string, the FRAG field and
+// the payload following the header.  Fragments are returned with
+// ErrUDPFragmented, so that callers can drop them deliberately.
+func ParseUDPHeader(b []byte) (target string, frag byte, payload []byte, err error) {
+	// Each datagram is prefixed with a header.
+	//  uint16_t rsv (0x0000)
+	//  uint8_t frag
+	//  uint8_t atyp
+	//  uint8_t dst_addr[]
+	//  uint16_t dst_port
+
+	if len(b) < udpHeaderMinLen {
+		return "", 0, nil, errUDPTruncated
+	}
+	if b[0] != rsv || b[1] != rsv {
+		return "", 0, nil, fmt.Errorf("message field 'reserved' was 0x%02x%02x (expected 0x0000)", b[0], b[1])
+	}
+	frag = b[2]
+	atyp := b[3]
+	b = b[udpHeaderMinLen:]
+
+	var host string
+	switch atyp {
+	case atypIPv4:
+		if len(b) < net.IPv4len {
+			return "", frag, nil, errUDPTruncated
+		}
+		host = net.IPv4(b[0], b[1], b[2], b[3]).String()
+		b = b[net.IPv4len:]
+	case atypDomainName:
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return "", frag, nil, errUDPTruncated
+		}
+		if b[0] == 0 {
+			return "", frag, nil, fmt.Errorf("domain name with 0 length")
+		}
+		host = string(b[1 : 1+b[0]])
+		b = b[1+b[0]:]
+	case atypIPv6:
+		if len(b) < net.IPv6len {
+			return "", frag, nil, errUDPTruncated
+		}
+		addr := make(net.IP, net.IPv6len)
+		copy(addr, b[:net.IPv6len])
+		host = fmt.Sprintf("[%s]", addr.String())
+		b = b[net.IPv6len:]
+	default:
+		return "", frag, nil, fmt.Errorf("unsupported address type 0x%02x", atyp)
+	}
+	if len(b) < 2 {
+		return "", frag, nil, errUDPTruncated
+	}
+	target = fmt.Sprintf("%s:%d", host, binary.BigEndian.Uint16(b))
+	payload = b[2:]
+	if frag != 0 {
+		return target, frag, payload, ErrUDPFragmented
+	}
+	return target, frag, payload, nil
+}
+
+// EncodeUDPHeader returns payload prefixed with an unfragmented SOCKS5
+// datagram header for target, a host:port string.
+func EncodeUDPHeader(target string, payload []byte) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port '%s'", portStr)
+	}
+
+	b := make([]byte, 0, udpHeaderMinLen+1+len(host)+2+len(payload))
+	b = append(b, rsv, rsv, 0x00)
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if addr.Is4() || addr.Is4In6() {
+			ip4 := addr.Unmap().As4()
+			b = append(append(b, atypIPv4), ip4[:]...)
+		} else {
+			ip6 := addr.As16()
+			b = append(append(b, atypIPv6), ip6[:]...)
+		}
+	} else {
+		if len(host) == 0 || len(host) > 255 {
+			return nil, fmt.Errorf("invalid domain name length %d", len(host))
+		}
+		b = append(append(b, atypDomainName, byte(len(host))), host...)
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(port))
+	return append(b, payload...), nil
+}
@@ -19,8 +19,10 @@ import (
 	"context"
 	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"errors"
 	"math/big"
@@ -134,6 +136,59 @@ func GenerateTLSConfig() *tls.Config {
 	return &tls.Config{Certificates: []tls.Certificate{tlsCert}, NextProtos: []string{http3.NextProtoH3}, InsecureSkipVerify: true}
 }
 
+// LoadTLSConfig is like GenerateTLSConfig, but uses the persistent
+// certificate and key in the PEM files certFile and keyFile, so that
+// clients may pin it with the pin returned by SPKIPin.
+func LoadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	tlsCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{tlsCert}, NextProtos: []string{http3.NextProtoH3}}, nil
+}
+
+// SPKIPin returns the pin of the public key of the leaf certificate of
+// conf, in the "sha256//<base64>" form used by curl --pinnedpubkey.
+func SPKIPin(conf *tls.Config) (string, error) {
+	if len(conf.Certificates) == 0 || len(conf.Certificates[0].Certificate) == 0 {
+		return "", errors.New("no certificate")
+	}
+	cert, err := x509.ParseCertificate(conf.Certificates[0].Certificate[0])
+	if err != nil {
+		return "", err
+	}
+	return spkiPin(cert), nil
+}
+
+func spkiPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256//" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// PinnedTLSConfig returns a client TLS config that accepts only a peer
+// whose certificate has the public key pinned by pin, as returned by
+// SPKIPin, whether or not the certificate is signed by a known CA.
+func PinnedTLSConfig(pin string) *tls.Config {
+	return &tls.Config{
+		// the chain is not verified, the pin is
+		InsecureSkipVerify: true,
+		NextProtos:         []string{http3.NextProtoH3},
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("no peer certificate")
+			}
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			if spkiPin(cert) != pin {
+				return errors.New("peer certificate does not match the pin")
+			}
+			return nil
+		},
+	}
+}
+
 func DialURL(u *url.URL, ctx context.Context, dialFn func(ctx context.Context, network, address string) (net.Conn, error)) (net.Conn, error) {
 	switch u.Scheme {
 	case "tcp", "tcp4", "tcp6":
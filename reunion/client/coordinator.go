@@ -0,0 +1,161 @@
+// coordinator.go - Reunion client exchange coordinator.
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/katzenpost/katzenpost/reunion/server"
+	"gopkg.in/op/go-logging.v1"
+)
+
+var (
+	// ErrExchangeExists is the error returned when starting an exchange
+	// for a contact that already has one running.
+	ErrExchangeExists = errors.New("reunion: contact already has an exchange")
+
+	// ErrNoSuchExchange is the error returned when cancelling an exchange
+	// for a contact that has none running.
+	ErrNoSuchExchange = errors.New("reunion: contact has no exchange")
+)
+
+// Coordinator runs the Reunion exchanges of many contacts against one
+// shared ReunionDatabase, reporting all their updates on one channel.
+// Each exchange has its own shutdown channel so that it can be cancelled
+// without affecting the others.
+type Coordinator struct {
+	sync.Mutex
+
+	log        *logging.Logger
+	db         server.ReunionDatabase
+	updateChan chan ReunionUpdate
+
+	exchanges map[uint64]*coordinatedExchange
+	wg        sync.WaitGroup
+}
+
+type coordinatedExchange struct {
+	exchange     *Exchange
+	shutdownChan chan struct{}
+}
+
+// NewCoordinator creates a new Coordinator.  The caller MUST keep reading
+// updateChan for as long as exchanges are running.
+func NewCoordinator(log *logging.Logger, db server.ReunionDatabase, updateChan chan ReunionUpdate) *Coordinator {
+	return &Coordinator{
+		log:        log,
+		db:         db,
+		updateChan: updateChan,
+		exchanges:  make(map[uint64]*coordinatedExchange),
+	}
+}
+
+// Start creates and runs a new Exchange for contactID.  The Exchange is
+// created, which takes a while for the passphrase derivation, without
+// holding the lock.
+func (c *Coordinator) Start(payload []byte, contactID uint64, passphrase []byte, sharedRandomValue []byte, epoch uint64) (*Exchange, error) {
+	c.Lock()
+	_, ok := c.exchanges[contactID]
+	c.Unlock()
+	if ok {
+		return nil, ErrExchangeExists
+	}
+	shutdownChan := make(chan struct{})
+	ex, err := NewExchange(payload, c.log, c.db, contactID, passphrase, sharedRandomValue, epoch, c.updateChan, shutdownChan)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.run(contactID, ex, shutdownChan); err != nil {
+		return nil, err
+	}
+	return ex, nil
+}
+
+// Resume runs an Exchange restored from a snapshot.
+func (c *Coordinator) Resume(serialized []byte) (*Exchange, error) {
+	shutdownChan := make(chan struct{})
+	ex, err := NewExchangeFromSnapshot(serialized, c.log, c.db, c.updateChan, shutdownChan)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.run(ex.contactID, ex, shutdownChan); err != nil {
+		return nil, err
+	}
+	return ex, nil
+}
+
+// run starts ex and forgets it once it returns, unless contactID has an
+// exchange running already, in which case ex is wiped.
+func (c *Coordinator) run(contactID uint64, ex *Exchange, shutdownChan chan struct{}) error {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.exchanges[contactID]; ok {
+		ex.Wipe()
+		return ErrExchangeExists
+	}
+	ce := &coordinatedExchange{exchange: ex, shutdownChan: shutdownChan}
+	c.exchanges[contactID] = ce
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ex.Run()
+		c.Lock()
+		if c.exchanges[contactID] == ce {
+			delete(c.exchanges, contactID)
+		}
+		c.Unlock()
+	}()
+	return nil
+}
+
+// Cancel stops the exchange of contactID, which reports that it was
+// halted on the update channel, and removes it.  The other exchanges and
+// the shared database are unaffected.
+func (c *Coordinator) Cancel(contactID uint64) error {
+	c.Lock()
+	defer c.Unlock()
+	ce, ok := c.exchanges[contactID]
+	if !ok {
+		return ErrNoSuchExchange
+	}
+	close(ce.shutdownChan)
+	delete(c.exchanges, contactID)
+	return nil
+}
+
+// Contacts returns the contact IDs with running exchanges.
+func (c *Coordinator) Contacts() []uint64 {
+	c.Lock()
+	defer c.Unlock()
+	ids := make([]uint64, 0, len(c.exchanges))
+	for id := range c.exchanges {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Shutdown cancels all exchanges and waits for them to return.
+func (c *Coordinator) Shutdown() {
+	c.Lock()
+	for id, ce := range c.exchanges {
+		close(ce.shutdownChan)
+		delete(c.exchanges, id)
+	}
+	c.Unlock()
+	c.wg.Wait()
+}
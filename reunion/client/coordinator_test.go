@@ -0,0 +1,132 @@
+// coordinator_test.go - Reunion client coordinator tests.
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/reunion/epochtime/katzenpost"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoordinatorCancel(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+
+	clock := new(katzenpost.Clock)
+	epoch, _, _ := clock.Now()
+	reunionDB, err := NewMockReunionDB(logBackend.GetLogger("Reunion_DB"), clock)
+	require.NoError(err)
+
+	srv := []byte{1, 2, 3}
+	passphrase := []byte("blah blah motorcycle pencil sharpening gas tank")
+	const alice, bob, carol = uint64(1), uint64(2), uint64(3)
+
+	updateCh := make(chan ReunionUpdate)
+	c := NewCoordinator(logBackend.GetLogger("coordinator"), reunionDB, updateCh)
+
+	// carol has no partner, so her exchange only ends when cancelled
+	_, err = c.Start([]byte("anyone there?"), carol, []byte("nobody knows this passphrase"), srv, epoch)
+	require.NoError(err)
+	_, err = c.Start([]byte("sup bobby"), alice, passphrase, srv, epoch)
+	require.NoError(err)
+	_, err = c.Start([]byte("yo alice"), bob, passphrase, srv, epoch)
+	require.NoError(err)
+	_, err = c.Start([]byte("again"), alice, passphrase, srv, epoch)
+	require.ErrorIs(err, ErrExchangeExists)
+	require.ElementsMatch([]uint64{alice, bob, carol}, c.Contacts())
+
+	results := make(map[uint64][]byte)
+	done := make(map[uint64]bool)
+	halted := false
+	timeout := time.After(time.Minute)
+	for !halted || !done[alice] || !done[bob] {
+		select {
+		case update := <-updateCh:
+			switch {
+			case len(update.Result) > 0:
+				results[update.ContactID] = update.Result
+			case update.Done:
+				done[update.ContactID] = true
+			case update.Error != nil:
+				require.Equal(carol, update.ContactID, update.Error)
+				halted = true
+			case update.ContactID == carol && !halted:
+				// carol's exchange is running, cancel it
+				if err := c.Cancel(carol); err != ErrNoSuchExchange {
+					require.NoError(err)
+				}
+			}
+		case <-timeout:
+			t.Fatalf("exchanges did not finish: done %v, carol halted %v", done, halted)
+		}
+	}
+	require.ErrorIs(c.Cancel(carol), ErrNoSuchExchange)
+	require.Equal([]byte("yo alice"), results[alice])
+	require.Equal([]byte("sup bobby"), results[bob])
+	require.False(done[carol])
+
+	c.Shutdown()
+	require.Empty(c.Contacts())
+}
+
+func TestCoordinatorStartUnlocked(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+
+	clock := new(katzenpost.Clock)
+	epoch, _, _ := clock.Now()
+	reunionDB, err := NewMockReunionDB(logBackend.GetLogger("Reunion_DB"), clock)
+	require.NoError(err)
+
+	srv := []byte{1, 2, 3}
+	updateCh := make(chan ReunionUpdate, 100)
+	c := NewCoordinator(logBackend.GetLogger("coordinator"), reunionDB, updateCh)
+	defer c.Shutdown()
+
+	// the contacts are listed while the exchanges are being derived, and
+	// only one exchange of a contact started concurrently is run
+	const starts = 2
+	errCh := make(chan error, starts)
+	for i := 0; i < starts; i++ {
+		go func() {
+			_, err := c.Start([]byte("anyone there?"), 1, []byte("nobody knows this passphrase"), srv, epoch)
+			errCh <- err
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	require.Empty(c.Contacts())
+	require.Empty(errCh)
+
+	failed := 0
+	for i := 0; i < starts; i++ {
+		if err := <-errCh; err != nil {
+			require.ErrorIs(err, ErrExchangeExists)
+			failed++
+		}
+	}
+	require.Equal(starts-1, failed)
+	require.Equal([]uint64{1}, c.Contacts())
+}
@@ -19,12 +19,17 @@ package client
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
-	"math/rand"
+	"hash"
+	"io"
+	"sync"
+	"time"
 
-	"github.com/katzenpost/katzenpost/client"
+	"github.com/awnumar/memguard"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/katzenpost/reunion/commands"
 	"github.com/katzenpost/katzenpost/reunion/crypto"
 	"github.com/katzenpost/katzenpost/reunion/server"
@@ -32,21 +37,74 @@ import (
 )
 
 var (
+	// ErrWrongResponseCommand is the error returned when the Reunion DB
+	// replies to a query with a command of the wrong type.
+	ErrWrongResponseCommand = errors.New("reunion: wrong response command received from Reunion DB")
+
+	// ErrInvalidMessage is the error returned when the state fetched from
+	// the Reunion DB holds a message with neither a T2 nor a T3 payload.
+	ErrInvalidMessage = errors.New("reunion: invalid message found")
+
+	// ErrServerStatus is matched by every *ServerStatusError.
+	ErrServerStatus = errors.New("reunion: error status code received from Reunion DB")
+
 	// InvalidResponseErr is an error used to indicate
 	// that an invalid response from the Reunion server was received.
-	InvalidResponseErr = errors.New("invalid response received from Reunion DB")
+	//
+	// Deprecated: use ErrWrongResponseCommand.
+	InvalidResponseErr = ErrWrongResponseCommand
 
 	// ErrShutdown is an error invoked during shutdown.
 	ErrShutdown = errors.New("reunion: shutdown requested")
+
+	// ErrStaleSnapshot is the error returned when restoring a snapshot of
+	// an Exchange whose epoch or shared random has expired.
+	ErrStaleSnapshot = errors.New("reunion: snapshot is stale")
+
+	// ErrMaxRounds is the error an Exchange halts with when it has not
+	// completed within its MaxRounds.
+	ErrMaxRounds = errors.New("reunion: exchange timed out after its maximum rounds")
 )
 
 const (
 	initialState       = 0
 	t1MessageSentState = 1
+
+	// maxStateChunks limits the chunks of a truncated state fetched by
+	// fetchState.
+	maxStateChunks = 1024
+
+	// StatusInitial is the status of an Exchange that has not sent its T1.
+	StatusInitial = initialState
+	// StatusT1Sent is the status of an Exchange that has sent its T1.
+	StatusT1Sent = t1MessageSentState
+
+	// t2Workers is the number of T2 messages sent concurrently by
+	// sendT2Messages.
+	t2Workers = 8
 )
 
+// ServerStatusError is the error returned when the Reunion DB replies to a
+// query with an error status code.  errors.Is(err, ErrServerStatus) is true
+// for every ServerStatusError.
+type ServerStatusError struct {
+	// Code is the ErrorCode of the response.
+	Code uint8
+}
+
+func (e *ServerStatusError) Error() string {
+	return fmt.Sprintf("received an error status code from the reunion db: %d", e.Code)
+}
+
+// Is returns true iff target is ErrServerStatus.
+func (e *ServerStatusError) Is(target error) bool {
+	return target == ErrServerStatus
+}
+
 // ExchangeHash is a 32 byte array which represents a hash of
-// one of our cryptographic messages, t1 hash, t2 hash etc.
+// one of our cryptographic messages, t1 hash, t2 hash etc.  It is the
+// size of the hashes carried by the Reunion DB commands, so the Hash of
+// an Exchange must make 32 byte digests.
 type ExchangeHash [32]byte
 
 // ReunionUpdate represents an update to the reunion client state or
@@ -62,6 +120,20 @@ type ReunionUpdate struct {
 	Serialized []byte
 	// Result is the received decrypted T1 message payload.
 	Result []byte
+	// Payloads are the labeled payloads of Result, which is a single
+	// payload without a label unless the peer sent several.
+	Payloads []Payload
+	// Done is set on the final update sent when the exchange completes.
+	// It is sent exactly once, after every Result, and carries no Result
+	// and Phase PhaseComplete, which no other update has.  Nothing is
+	// sent after it, so a caller may stop reading updates once it is
+	// received.  An exchange that halts sends an Error instead.
+	Done bool
+	// ResultCount is the number of results collected, set when Done.
+	ResultCount int
+	// Progress is how far along the exchange is.  An update with only
+	// Progress is sent whenever it changes.
+	Progress
 }
 
 // Exchange encapsulates all the client key material and
@@ -75,17 +147,59 @@ type ReunionUpdate struct {
 // For every t2 message sent in reply to their own t1,
 // they construct and transmit a t3 message.
 type Exchange struct {
-	log          *logging.Logger
+	// RetryPolicy is how the queries to the Reunion DB are retried.
+	RetryPolicy RetryPolicy
+
+	// PollInterval is about how long Run waits between rounds of
+	// fetching the state, give or take half of it at random, so that
+	// clients do not poll the Reunion DB in lockstep.  Zero means no
+	// wait.
+	PollInterval time.Duration
+
+	// Compress, if set, makes Marshal compress the snapshots with gzip.
+	// Snapshots are restored whether they are compressed or not.
+	Compress bool
+
+	// Hash makes the hashes of the T1 and T2 messages, which MUST agree
+	// with the hashes the Reunion DB and the other clients make.  It is
+	// recorded in snapshots and set at creation.
+	Hash func() hash.Hash
+
+	// MaxRounds, unless it is zero, limits the rounds of fetching the
+	// state and replying to it that Run makes waiting for the T3s of its
+	// peers, after which it halts with ErrMaxRounds.  RunContext with a
+	// deadline limits the time Run takes instead.
+	MaxRounds int
+
+	// Peers is the number of peers of a group reunion whose results Run
+	// waits for, unless it is zero.  Run always waits for the result of
+	// every peer it sent a T3 to, and for at least one result.
+	Peers int
+
+	log          *exchangeLogger
 	updateChan   chan ReunionUpdate
 	db           server.ReunionDatabase
 	shutdownChan chan struct{}
 
+	// phase and the Progress last reported are only used by Run, and
+	// by Unmarshal before it runs, so they are not guarded by mu.
+	phase    Phase
+	reported Progress
+
+	// mu guards the state of the Exchange from status to
+	// processedT3s.  Run, the only writer, takes it to write and may read
+	// without it, and other goroutines, as Marshal and Status, take it
+	// to read.
+	mu         sync.RWMutex
 	status     int
 	contactID  uint64
 	ExchangeID uint64
 	session    *crypto.Session
 
-	payload []byte
+	// payload is the plaintext of our T1, a single payload or the
+	// payloads encoded by encodePayloads.
+	payload     []byte
+	resultCount int
 
 	sentT1 []byte
 
@@ -111,6 +225,9 @@ type Exchange struct {
 
 	// t1 hash -> beta
 	decryptedT1Betas map[ExchangeHash]*crypto.PublicKey
+
+	// src t1 hash -> whether its t3 gave a result
+	processedT3s map[ExchangeHash]bool
 }
 
 // NewExchangeFromSnapshot creates a new Exchange given a snapshot blob.
@@ -120,13 +237,31 @@ func NewExchangeFromSnapshot(
 	db server.ReunionDatabase,
 	updateChan chan ReunionUpdate,
 	shutdownChan chan struct{}) (*Exchange, error) {
+	return NewExchangeFromSnapshotWithHash(serialized, log, db, updateChan, shutdownChan, DefaultHash)
+}
+
+// NewExchangeFromSnapshotWithHash creates a new Exchange given a snapshot
+// blob taken by an Exchange with the Hash h.
+func NewExchangeFromSnapshotWithHash(
+	serialized []byte,
+	log *logging.Logger,
+	db server.ReunionDatabase,
+	updateChan chan ReunionUpdate,
+	shutdownChan chan struct{},
+	h func() hash.Hash) (*Exchange, error) {
 
+	if err := checkHash(h); err != nil {
+		return nil, err
+	}
 	ex := &Exchange{
-		log:          log,
+		RetryPolicy:  DefaultRetryPolicy,
+		PollInterval: DefaultPollInterval,
+		Hash:         h,
 		updateChan:   updateChan,
 		db:           db,
 		shutdownChan: shutdownChan,
 	}
+	ex.log = newExchangeLogger(log, ex)
 	err := ex.Unmarshal(serialized)
 	if err != nil {
 		return ex, err
@@ -141,30 +276,40 @@ func NewExchangeFromSnapshot(
 	if err != nil {
 		return ex, err
 	}
+	return ex, ex.Validate(epochs, srvs)
+}
+
+// Validate returns an error wrapping ErrStaleSnapshot unless the session
+// of the Exchange is of one of the current epochs and shared randoms, so
+// that it can still be run.
+func (e *Exchange) Validate(epochs []uint64, sharedRandoms [][]byte) error {
+	if e.session == nil {
+		return fmt.Errorf("%w: no session", ErrStaleSnapshot)
+	}
 
 	// Verify that the session epoch is still valid
 	current := false
 	for _, ep := range epochs {
-		if ex.session.Epoch() == ep {
+		if e.session.Epoch() == ep {
 			current = true
 		}
 	}
 	if !current {
-		return ex, errors.New("Epoch has expired, cannot resume exchange")
+		return fmt.Errorf("%w: epoch %d has expired", ErrStaleSnapshot, e.session.Epoch())
 	}
-	current = false
 
 	// Verify that the session shared random is still valid
-	ssrv := ex.session.SharedRandom()
-	for _, srv := range srvs {
+	current = false
+	ssrv := e.session.SharedRandom()
+	for _, srv := range sharedRandoms {
 		if bytes.Equal(srv, ssrv) {
 			current = true
 		}
 	}
 	if !current {
-		return ex, errors.New("SharedRandom has expired, cannot resume exchange")
+		return fmt.Errorf("%w: shared random has expired", ErrStaleSnapshot)
 	}
-	return ex, nil
+	return nil
 }
 
 // NewExchange creates a new Exchange struct type.
@@ -178,21 +323,82 @@ func NewExchange(
 	epoch uint64,
 	updateChan chan ReunionUpdate,
 	shutdownChan chan struct{}) (*Exchange, error) {
+	return NewExchangeWithHash(payload, log, db, contactID, passphrase, sharedRandomValue, epoch, updateChan, shutdownChan, DefaultHash)
+}
+
+// NewExchangeWithPayloads creates a new Exchange sending several labeled
+// payloads to each peer, which must together fit in a T1 message.
+func NewExchangeWithPayloads(
+	payloads []Payload,
+	log *logging.Logger,
+	db server.ReunionDatabase,
+	contactID uint64,
+	passphrase []byte,
+	sharedRandomValue []byte,
+	epoch uint64,
+	updateChan chan ReunionUpdate,
+	shutdownChan chan struct{}) (*Exchange, error) {
+	payload, err := encodePayloads(payloads)
+	if err != nil {
+		return nil, err
+	}
+	return NewExchangeWithHash(payload, log, db, contactID, passphrase, sharedRandomValue, epoch, updateChan, shutdownChan, DefaultHash)
+}
+
+// NewExchangeWithHash creates a new Exchange hashing its messages with h.
+func NewExchangeWithHash(
+	payload []byte,
+	log *logging.Logger,
+	db server.ReunionDatabase,
+	contactID uint64,
+	passphrase []byte,
+	sharedRandomValue []byte,
+	epoch uint64,
+	updateChan chan ReunionUpdate,
+	shutdownChan chan struct{},
+	h func() hash.Hash) (*Exchange, error) {
+	return NewExchangeWithRand(payload, log, db, contactID, passphrase, sharedRandomValue, epoch, updateChan, shutdownChan, h, rand.Reader)
+}
+
+// NewExchangeWithRand creates a new Exchange hashing its messages with h,
+// whose session keys and ExchangeID are read from rng.  Tests pass a
+// deterministic rng to make exchanges reproducible.
+func NewExchangeWithRand(
+	payload []byte,
+	log *logging.Logger,
+	db server.ReunionDatabase,
+	contactID uint64,
+	passphrase []byte,
+	sharedRandomValue []byte,
+	epoch uint64,
+	updateChan chan ReunionUpdate,
+	shutdownChan chan struct{},
+	h func() hash.Hash,
+	rng io.Reader) (*Exchange, error) {
 
-	session, err := crypto.NewSession(passphrase, sharedRandomValue, epoch)
+	if err := checkHash(h); err != nil {
+		return nil, err
+	}
+	session, err := crypto.NewSessionWithReader(rng, passphrase, sharedRandomValue, epoch)
 	if err != nil {
 		return nil, err
 	}
-	return &Exchange{
-		log:          log,
+	var exchangeID [8]byte
+	if _, err = io.ReadFull(rng, exchangeID[:]); err != nil {
+		return nil, err
+	}
+	ex := &Exchange{
+		RetryPolicy:  DefaultRetryPolicy,
+		PollInterval: DefaultPollInterval,
+		Hash:         h,
 		updateChan:   updateChan,
 		db:           db,
 		shutdownChan: shutdownChan,
 		status:       initialState,
 		contactID:    contactID,
-		ExchangeID:   rand.Uint64(),
+		ExchangeID:   binary.BigEndian.Uint64(exchangeID[:]),
 		session:      session,
-		payload:      payload,
+		payload:      append([]byte(nil), payload...),
 
 		sentT1:    nil,
 		sentT2Map: make(map[ExchangeHash][]byte),
@@ -206,20 +412,33 @@ func NewExchange(
 
 		receivedT1Alphas: make(map[ExchangeHash]*crypto.PublicKey),
 		decryptedT1Betas: make(map[ExchangeHash]*crypto.PublicKey),
-	}, nil
+		processedT3s:     make(map[ExchangeHash]bool),
+	}
+	ex.log = newExchangeLogger(log, ex)
+	return ex, nil
 }
 
 // Unmarshal returns an error if the given data fails to be deserialized.
 func (e *Exchange) Unmarshal(data []byte) error {
 	state := new(serializableExchange)
-	err := state.Unmarshal(data)
+	err := unmarshalSnapshot(state, data)
 	if err != nil {
 		return fmt.Errorf("wtf unmarshal failure: %s", err.Error())
 	}
+	if err = e.checkHashID(state.HashID); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	e.contactID = state.ContactID
 	e.ExchangeID = state.ExchangeID
 	e.status = state.Status
+	if e.status == t1MessageSentState {
+		e.phase = PhaseSentT1
+	}
 	e.session = state.Session
+	e.payload = state.Payload
+	e.resultCount = state.ResultCount
 	e.sentT1 = state.SentT1
 	e.sentT2Map = state.SentT2Map
 	e.receivedT1s = state.ReceivedT1s
@@ -229,16 +448,33 @@ func (e *Exchange) Unmarshal(data []byte) error {
 	e.repliedT2s = state.RepliedT2s
 	e.receivedT1Alphas = state.ReceivedT1Alphas
 	e.decryptedT1Betas = state.DecryptedT1Betas
+	e.processedT3s = state.ProcessedT3s
+	if e.processedT3s == nil {
+		e.processedT3s = make(map[ExchangeHash]bool)
+	}
 	return nil
 }
 
 // Marshal returns a serialization of the Exchange or an error.
-// XXX fix me; added many more fields since this was written...
 func (e *Exchange) Marshal() ([]byte, error) {
-	ex := serializableExchange{
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return marshalSnapshot(e.serializable(), e.Compress)
+}
+
+// serializable returns the serializableExchange of every field of the
+// Exchange state, which shares the maps of the Exchange.  The caller must
+// hold the lock of the Exchange until it is done with it, unless it is
+// Run.
+func (e *Exchange) serializable() *serializableExchange {
+	return &serializableExchange{
 		ContactID:        e.contactID,
+		ExchangeID:       e.ExchangeID,
+		HashID:           hashID(e.Hash),
 		Status:           e.status,
 		Session:          e.session,
+		Payload:          e.payload,
+		ResultCount:      e.resultCount,
 		SentT1:           e.sentT1,
 		SentT2Map:        e.sentT2Map,
 		ReceivedT1s:      e.receivedT1s,
@@ -248,14 +484,50 @@ func (e *Exchange) Marshal() ([]byte, error) {
 		RepliedT2s:       e.repliedT2s,
 		ReceivedT1Alphas: e.receivedT1Alphas,
 		DecryptedT1Betas: e.decryptedT1Betas,
+		ProcessedT3s:     e.processedT3s,
 	}
-	return ex.Marshal()
 }
 
-func (e *Exchange) shouldStop() bool {
+// Status returns the status of the Exchange, StatusInitial or
+// StatusT1Sent, and its contact ID.  It is safe to call while the Exchange
+// runs.
+func (e *Exchange) Status() (phase int, contactID uint64) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.status, e.contactID
+}
+
+func (e *Exchange) setStatus(status int) {
+	e.mu.Lock()
+	e.status = status
+	e.mu.Unlock()
+}
+
+// Wipe destroys the key material of the Exchange: its session, the betas
+// decrypted from the T1s of its peers and its payload.  It is called when
+// Run returns, after the final update with the state to resume from was
+// sent, and the Exchange can not be run again.
+func (e *Exchange) Wipe() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.session != nil {
+		e.session.Destroy()
+		e.session = nil
+	}
+	for t1Hash, beta := range e.decryptedT1Betas {
+		memguard.WipeBytes(beta[:])
+		delete(e.decryptedT1Betas, t1Hash)
+	}
+	memguard.WipeBytes(e.payload)
+	e.payload = nil
+}
+
+func (e *Exchange) shouldStop(ctx context.Context) bool {
 	select {
 	case <-e.shutdownChan:
 		return true
+	case <-ctx.Done():
+		return true
 	default:
 		return false
 	}
@@ -265,13 +537,10 @@ func (e *Exchange) shouldStop() bool {
 
 func (e *Exchange) sentUpdateOK() bool {
 	serialized, err := e.Marshal()
-	e.updateChan <- ReunionUpdate{
-		ContactID:  e.contactID,
-		ExchangeID: e.ExchangeID,
+	e.sendUpdate(ReunionUpdate{
 		Error:      err,
 		Serialized: serialized,
-		Result:     nil,
-	}
+	})
 	if err != nil {
 		return false
 	}
@@ -280,6 +549,8 @@ func (e *Exchange) sentUpdateOK() bool {
 }
 
 func (e *Exchange) processState(state *server.RequestedReunionState) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	hasNew := false
 	for t1hash, t1 := range state.T1Map {
 		if _, ok := e.receivedT1s[t1hash]; !ok {
@@ -299,129 +570,147 @@ func (e *Exchange) processState(state *server.RequestedReunionState) (bool, erro
 				hasNew = true
 			}
 		} else {
-			return false, errors.New("wtf, invalid message found")
+			return false, ErrInvalidMessage
 		}
 	}
 	return hasNew, nil
 }
 
-func (e *Exchange) fetchState() error {
-	h := sha256.New()
-	h.Write(e.sentT1)
-	t1Hash := h.Sum(nil)
-	t1HashAr := [sha256.Size]byte{}
-	copy(t1HashAr[:], t1Hash)
+func (e *Exchange) fetchState(ctx context.Context) error {
+	t1HashAr := e.hashOf(e.sentT1)
 
-	fetchStateCmd := new(commands.FetchState)
-	fetchStateCmd.Epoch = e.session.Epoch()
-	fetchStateCmd.T1Hash = t1HashAr
+	// a truncated state is fetched a chunk at a time, each merged into
+	// our state as it arrives
+	for chunk := uint32(0); chunk < maxStateChunks; chunk++ {
+		fetchStateCmd := new(commands.FetchState)
+		fetchStateCmd.Epoch = e.session.Epoch()
+		fetchStateCmd.T1Hash = t1HashAr
+		fetchStateCmd.Chunk = chunk
 
-	rawResponse, err := e.db.Query(fetchStateCmd)
-	if err != nil {
-		return err
-	}
-	response, ok := rawResponse.(*commands.StateResponse)
-	if !ok {
-		return errors.New("fetch state: wrong response command received")
-	}
-	if response.ErrorCode != commands.ResponseStatusOK {
-		return fmt.Errorf("fetch state: received an error status code from the reunion db: %d", response.ErrorCode)
-	}
-	state := new(server.RequestedReunionState)
-	err = state.Unmarshal(response.Payload)
-	if err != nil {
-		return err
-	}
-	if response.Truncated {
-		return errors.New("truncated Reunion DB state not yet supported")
+		e.log.Debugf("fetch state: T1 %s, chunk %d", redact(t1HashAr[:]), chunk)
+		rawResponse, err := e.query(ctx, fetchStateCmd)
+		if err != nil {
+			return err
+		}
+		response, ok := rawResponse.(*commands.StateResponse)
+		if !ok {
+			return fmt.Errorf("fetch state: %w", ErrWrongResponseCommand)
+		}
+		if response.ErrorCode != commands.ResponseStatusOK {
+			return fmt.Errorf("fetch state: %w", &ServerStatusError{Code: response.ErrorCode})
+		}
+		state := new(server.RequestedReunionState)
+		err = state.Unmarshal(response.Payload)
+		if err != nil {
+			return err
+		}
+		hasNew, err := e.processState(state)
+		if err != nil {
+			return err
+		}
+		e.log.Debugf("fetch state: %d T1s and %d messages, new: %v", len(state.T1Map), len(state.Messages), hasNew)
+		if !response.Truncated {
+			return nil
+		}
+		e.log.Debugf("fetch state: chunk %d truncated, %d chunks left", chunk, response.LeftOverChunksHint)
 	}
-	_, err = e.processState(state)
-	return err
+	return fmt.Errorf("fetch state: truncated beyond %d chunks", maxStateChunks)
 }
 
-func (e *Exchange) sendT1() error {
-	var err error
-	e.sentT1, err = e.session.GenerateType1Message(e.payload)
+func (e *Exchange) sendT1(ctx context.Context) error {
+	sentT1, err := e.session.GenerateType1Message(e.payload)
 	if err != nil {
 		return err
 	}
+	e.mu.Lock()
+	e.sentT1 = sentT1
+	e.mu.Unlock()
 	t1Cmd := commands.SendT1{
 		Epoch:   e.session.Epoch(),
 		Payload: e.sentT1,
 	}
-	rawResponse, err := e.db.Query(&t1Cmd)
+	rawResponse, err := e.query(ctx, &t1Cmd)
 	if err != nil {
 		return err
 	}
 	response, ok := rawResponse.(*commands.MessageResponse)
 	if !ok {
-		return InvalidResponseErr
+		return ErrWrongResponseCommand
 	}
 	if response.ErrorCode != commands.ResponseStatusOK {
-		return fmt.Errorf("received an error status code from the reunion db: %d", response.ErrorCode)
+		return &ServerStatusError{Code: response.ErrorCode}
 	}
+	t1Hash := e.hashOf(e.sentT1)
+	e.log.Debugf("sent T1 %s", redact(t1Hash[:]))
 	return nil
 }
 
-func (e *Exchange) sendT2Messages() error {
-	hasSent := false
-
-	h := sha256.New()
-	h.Write([]byte(e.sentT1))
-	myT1Hash := h.Sum(nil)
-	myT1HashAr := [sha256.Size]byte{}
-	copy(myT1HashAr[:], myT1Hash)
+func (e *Exchange) sendT2Messages(ctx context.Context) error {
+	myT1HashAr := e.hashOf(e.sentT1)
 
+	type t2Job struct {
+		t1Hash ExchangeHash
+		t1     []byte
+	}
+	jobs := []t2Job{}
 	for t1Hash, t1 := range e.receivedT1s {
-		if bytes.Equal(t1Hash[:], myT1Hash) {
+		if t1Hash == myT1HashAr {
 			continue
 		}
-
-		_, ok := e.repliedT1s[t1Hash]
-		if ok {
+		if _, ok := e.repliedT1s[t1Hash]; ok {
 			continue
 		}
-
-		// decrypt alpha pub key and store it in our state
-		alpha, _, _, err := crypto.DecodeT1Message(t1)
-		if err != nil {
-			return err
-		}
-		t2, alphaPubKey, err := e.session.ProcessType1MessageAlpha(alpha)
-		if err != nil {
-			return err
+		jobs = append(jobs, t2Job{t1Hash: t1Hash, t1: t1})
+	}
+
+	// the T2s are sent by a pool of workers, the first failure stopping
+	// the others from starting new ones
+	ctx, cancelFn := context.WithCancel(ctx)
+	defer cancelFn()
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+		hasSent  bool
+	)
+	workers := t2Workers
+	if len(jobs) < workers {
+		workers = len(jobs)
+	}
+	jobCh := make(chan t2Job)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobCh {
+				err := e.sendT2(ctx, myT1HashAr, job.t1Hash, job.t1)
+				mu.Lock()
+				if err == nil {
+					hasSent = true
+				} else if firstErr == nil {
+					firstErr = err
+					cancelFn()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, job := range jobs {
+		select {
+		case jobCh <- job:
+		case <-ctx.Done():
+			break feed
 		}
+	}
+	close(jobCh)
+	wg.Wait()
 
-		e.receivedT1Alphas[t1Hash] = alphaPubKey
-
-		h := sha256.New()
-		h.Write(t2)
-		t2Hash := h.Sum(nil)
-		t2HashAr := [sha256.Size]byte{}
-		copy(t2HashAr[:], t2Hash)
-
-		e.sentT2Map[t2HashAr] = t2
-
-		// reply with t2 and t1 hash
-		t2Cmd := commands.SendT2{
-			Epoch:     e.session.Epoch(),
-			SrcT1Hash: myT1HashAr,
-			DstT1Hash: t1Hash,
-			Payload:   t2,
-		}
-		rawResponse, err := e.db.Query(&t2Cmd)
-		if err != nil {
-			return err
-		}
-		response, ok := rawResponse.(*commands.MessageResponse)
-		if !ok {
-			return InvalidResponseErr
-		}
-		if response.ErrorCode != commands.ResponseStatusOK {
-			return fmt.Errorf("received an error status code from the reunion db: %d", response.ErrorCode)
-		}
-		e.repliedT1s[t1Hash] = t1
-		hasSent = true
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 	if hasSent {
 		return nil
@@ -429,25 +718,62 @@ func (e *Exchange) sendT2Messages() error {
 	return fmt.Errorf("Failed to send T2 Messages!")
 }
 
-func (e *Exchange) sendT3Messages() error {
+// sendT2 replies to t1 with a T2 message.  It is called by several
+// workers at once, which update the Exchange state under its lock.
+func (e *Exchange) sendT2(ctx context.Context, myT1Hash, t1Hash ExchangeHash, t1 []byte) error {
+	// decrypt alpha pub key and store it in our state
+	alpha, _, _, err := crypto.DecodeT1Message(t1)
+	if err != nil {
+		return err
+	}
+	t2, alphaPubKey, err := e.session.ProcessType1MessageAlpha(alpha)
+	if err != nil {
+		return err
+	}
+
+	t2HashAr := e.hashOf(t2)
+
+	e.mu.Lock()
+	e.receivedT1Alphas[t1Hash] = alphaPubKey
+	e.sentT2Map[t2HashAr] = t2
+	e.mu.Unlock()
+
+	// reply with t2 and t1 hash
+	t2Cmd := commands.SendT2{
+		Epoch:     e.session.Epoch(),
+		SrcT1Hash: myT1Hash,
+		DstT1Hash: t1Hash,
+		Payload:   t2,
+	}
+	rawResponse, err := e.query(ctx, &t2Cmd)
+	if err != nil {
+		return err
+	}
+	response, ok := rawResponse.(*commands.MessageResponse)
+	if !ok {
+		return ErrWrongResponseCommand
+	}
+	if response.ErrorCode != commands.ResponseStatusOK {
+		return &ServerStatusError{Code: response.ErrorCode}
+	}
+	e.log.Debugf("sent T2 to T1 %s", redact(t1Hash[:]))
+	e.mu.Lock()
+	e.repliedT1s[t1Hash] = t1
+	e.mu.Unlock()
+	return nil
+}
+
+func (e *Exchange) sendT3Messages(ctx context.Context) error {
 	hasSentT3 := false
 
-	h := sha256.New()
-	h.Write([]byte(e.sentT1))
-	myT1Hash := h.Sum(nil)
-	myT1HashAr := [sha256.Size]byte{}
-	copy(myT1HashAr[:], myT1Hash)
+	myT1HashAr := e.hashOf(e.sentT1)
 
 	for srcT1Hash, t2 := range e.receivedT2s {
 		t1, ok := e.receivedT1s[srcT1Hash]
 		if !ok {
 			return fmt.Errorf("error, t1 hash %x missing from map", srcT1Hash[:])
 		}
-		h := sha256.New()
-		h.Write(t2)
-		t2Hash := h.Sum(nil)
-		t2HashAr := [sha256.Size]byte{}
-		copy(t2HashAr[:], t2Hash)
+		t2HashAr := e.hashOf(t2)
 
 		if _, ok := e.repliedT2s[t2HashAr]; ok {
 			continue
@@ -479,21 +805,23 @@ func (e *Exchange) sendT3Messages() error {
 			DstT1Hash: srcT1Hash,
 			Payload:   t3,
 		}
-		rawResponse, err := e.db.Query(&sendT3Cmd)
+		rawResponse, err := e.query(ctx, &sendT3Cmd)
 		if err != nil {
 			return err
 		}
 		response, ok := rawResponse.(*commands.MessageResponse)
 		if !ok {
-			return InvalidResponseErr
+			return ErrWrongResponseCommand
 		}
 		if response.ErrorCode != commands.ResponseStatusOK {
-			return fmt.Errorf("received an error status code from the reunion db: %d", response.ErrorCode)
+			return &ServerStatusError{Code: response.ErrorCode}
 		}
 
+		e.log.Debugf("sent T3 to T1 %s", redact(srcT1Hash[:]))
+		e.mu.Lock()
 		e.decryptedT1Betas[srcT1Hash] = beta
-
 		e.repliedT2s[t2HashAr] = t2
+		e.mu.Unlock()
 		hasSentT3 = true
 	}
 	if hasSentT3 {
@@ -502,9 +830,14 @@ func (e *Exchange) sendT3Messages() error {
 	return fmt.Errorf("Failed to send T3 Messages!")
 }
 
+// processT3Messages sends a Result update for each peer whose T3 is newly
+// decrypted, and returns true once there is a result from every peer we
+// sent a T3 to, and from at least Peers peers.
 func (e *Exchange) processT3Messages() bool {
-	processed := false
 	for srcT1Hash, t3 := range e.receivedT3s {
+		if e.processedT3s[srcT1Hash] {
+			continue
+		}
 		beta, ok := e.decryptedT1Betas[srcT1Hash]
 		if !ok {
 			continue
@@ -512,29 +845,37 @@ func (e *Exchange) processT3Messages() bool {
 		t1, ok := e.receivedT1s[srcT1Hash]
 		if !ok {
 			e.log.Error("error, t1 missing from map")
-			return false
+			continue
 		}
 		_, _, gamma, err := crypto.DecodeT1Message(t1)
 		if err != nil {
 			e.log.Debug("decode t1 message failure")
 			e.log.Error(err.Error())
-			return false
+			continue
 		}
 		plaintext, err := e.session.ProcessType3Message(t3, gamma, beta)
 		if err != nil {
 			e.log.Errorf("ProcessType3Message failure: %s", err.Error())
-			return false
+			continue
 		}
-		e.updateChan <- ReunionUpdate{
-			ExchangeID: e.ExchangeID,
-			ContactID:  e.contactID,
-			Error:      nil,
-			Serialized: nil,
-			Result:     plaintext,
+		e.mu.Lock()
+		e.processedT3s[srcT1Hash] = true
+		e.resultCount++
+		e.mu.Unlock()
+		e.sendUpdate(ReunionUpdate{
+			Result:   plaintext,
+			Payloads: decodePayloads(plaintext),
+		})
+	}
+	if e.resultCount == 0 || e.resultCount < e.Peers {
+		return false
+	}
+	for srcT1Hash := range e.decryptedT1Betas {
+		if !e.processedT3s[srcT1Hash] {
+			return false
 		}
-		processed = true
 	}
-	return processed
+	return true
 }
 
 // Run performs the Reunion exchange and expresses a simple
@@ -542,98 +883,135 @@ func (e *Exchange) processT3Messages() bool {
 // state transition. This method is meant to run in it's own
 // goroutine.
 func (e *Exchange) Run() {
+	e.RunContext(context.Background())
+}
+
+// RunContext is Run, cancelled when ctx is done as well as on shutdown.
+// A cancelled exchange sends a final update with ctx.Err() and returns
+// without waiting for the query in flight.
+func (e *Exchange) RunContext(ctx context.Context) {
+	defer e.Wipe()
 	defer e.log.Debug("Run was halted.")
-	haltedfn := func() {
-		e.updateChan <- ReunionUpdate{
-			ExchangeID: e.ExchangeID,
-			ContactID:  e.contactID,
-			Error:      errors.New("Run was halted."),
-		}
+	parent := ctx
+	ctx, cancelFn := context.WithCancel(ctx)
+	defer cancelFn()
+	go func() {
+		select {
+		case <-e.shutdownChan:
+			cancelFn()
+		case <-ctx.Done():
+		}
+	}()
+	haltedfn := func(cause error) {
+		select {
+		case <-e.shutdownChan:
+			cause = ErrShutdown
+		default:
+		}
+		err := errors.New("Run was halted.")
+		if parent.Err() != nil {
+			err = parent.Err()
+		} else if cause != nil {
+			err = fmt.Errorf("Run was halted: %w", cause)
+		}
+		e.sendUpdate(ReunionUpdate{
+			Error: err,
+		})
 	}
 
 	switch e.status {
 	case initialState:
 		// XXX not required -> 1:A <- DB: fetch current epoch and current set of data for epoch state
 		// 2:A -> DB: transmit א message
-		for {
-			err := e.sendT1()
-			if err == client.ErrReplyTimeout {
-				continue
-			} else if err != nil {
-				defer haltedfn()
-				return
-			}
-			break
+		if err := e.sendT1(ctx); err != nil {
+			e.log.Error(err.Error())
+			defer haltedfn(err)
+			return
 		}
-		e.status = t1MessageSentState
+		e.setStatus(t1MessageSentState)
+		e.phase = PhaseSentT1
 		if !e.sentUpdateOK() {
-			defer haltedfn()
+			defer haltedfn(nil)
 			return
 		}
-		if e.shouldStop() {
+		if e.shouldStop(ctx) {
 			e.log.Error(ErrShutdown.Error())
-			defer haltedfn()
+			defer haltedfn(nil)
 			return
 		}
 		fallthrough
 	case t1MessageSentState:
-		for {
-			// 3:A <- DB: fetch epoch state
-			err := e.fetchState()
-			// if failure due to timeout, retransmit
-			if err == client.ErrReplyTimeout {
-				continue
+		for round := 1; ; round++ {
+			if e.MaxRounds != 0 && round > e.MaxRounds {
+				e.log.Errorf("no result after %d rounds", e.MaxRounds)
+				defer haltedfn(ErrMaxRounds)
+				return
 			}
+
+			// 3:A <- DB: fetch epoch state
+			// transient failures are retried by query
+			err := e.fetchState(ctx)
 			if err != nil {
 				e.log.Error(err.Error())
-				defer haltedfn()
+				defer haltedfn(err)
 				return
 			}
+			e.reportProgress(PhaseSendingT2)
+
 			// 4:A -> DB: transmit one ב message for each א
-			if err := e.sendT2Messages(); err != nil {
+			if err := e.sendT2Messages(ctx); err != nil {
 				e.log.Error(err.Error())
 			} else {
 				e.log.Debug("Sent T2 Messages successfully")
 			}
 
 			if !e.sentUpdateOK() {
-				defer haltedfn()
+				defer haltedfn(nil)
 				return
 			}
-			if e.shouldStop() {
+			if e.shouldStop(ctx) {
 				e.log.Error(ErrShutdown.Error())
-				defer haltedfn()
+				defer haltedfn(nil)
 				return
 			}
 
 			// 5:A <- DB: fetch epoch state for replies to A’s א
 			// 6:A -> DB: transmit one ג message for each new ב
-			if err := e.sendT3Messages(); err != nil {
+			e.reportProgress(PhaseSendingT3)
+			if err := e.sendT3Messages(ctx); err != nil {
 				e.log.Error(err.Error())
 			} else {
 				e.log.Debug("Sent T3 Messages successfully")
 			}
 
 			if !e.sentUpdateOK() {
-				defer haltedfn()
+				defer haltedfn(nil)
 				return
 			}
-			if e.shouldStop() {
+			if e.shouldStop(ctx) {
 				e.log.Error(ErrShutdown.Error())
-				defer haltedfn()
+				defer haltedfn(nil)
 				return
 			}
 
 			if e.processT3Messages() {
 				break
 			}
+			if !e.poll(ctx) {
+				e.log.Error(ErrShutdown.Error())
+				defer haltedfn(nil)
+				return
+			}
 		} // end for loop
+		e.phase = PhaseComplete
+		e.sendUpdate(ReunionUpdate{
+			Done:        true,
+			ResultCount: e.resultCount,
+		})
 	default:
-		e.updateChan <- ReunionUpdate{
-			ExchangeID: e.ExchangeID,
-			ContactID:  e.contactID,
-			Error:      errors.New("unknown state error"),
-		}
+		e.sendUpdate(ReunionUpdate{
+			Error: errors.New("unknown state error"),
+		})
 		return
 	}
 
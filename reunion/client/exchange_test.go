@@ -18,13 +18,18 @@
 package client
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	mrand "math/rand"
 	"os"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/katzenpost/katzenpost/core/log"
 	"github.com/katzenpost/katzenpost/reunion/commands"
+	"github.com/katzenpost/katzenpost/reunion/crypto"
 	"github.com/katzenpost/katzenpost/reunion/epochtime"
 	"github.com/katzenpost/katzenpost/reunion/epochtime/katzenpost"
 	"github.com/katzenpost/katzenpost/reunion/server"
@@ -53,7 +58,7 @@ func NewMockReunionDB(mylog *logging.Logger, clock epochtime.EpochClock) (*MockR
 	}, err
 }
 
-func (m *MockReunionDB) Query(command commands.Command) (commands.Command, error) {
+func (m *MockReunionDB) Query(ctx context.Context, command commands.Command) (commands.Command, error) {
 	return m.server.ProcessQuery(command)
 }
 
@@ -137,34 +142,34 @@ func TestClientServerBasics1(t *testing.T) {
 	require.NoError(err)
 
 	// Run the reunion client exchanges manually instead of using the Exchange method.
-	hasAliceSent := aliceExchange.sendT1()
-	hasBobSent := bobExchange.sendT1()
+	hasAliceSent := aliceExchange.sendT1(context.Background())
+	hasBobSent := bobExchange.sendT1(context.Background())
 	require.NoError(hasAliceSent)
 	require.NoError(hasBobSent)
 
-	err = aliceExchange.fetchState()
+	err = aliceExchange.fetchState(context.Background())
 	require.NoError(err)
-	err = bobExchange.fetchState()
+	err = bobExchange.fetchState(context.Background())
 	require.NoError(err)
 
-	hasAliceSent = aliceExchange.sendT2Messages()
-	hasBobSent = bobExchange.sendT2Messages()
+	hasAliceSent = aliceExchange.sendT2Messages(context.Background())
+	hasBobSent = bobExchange.sendT2Messages(context.Background())
 	require.NoError(hasAliceSent)
 	require.NoError(hasBobSent)
 
-	err = aliceExchange.fetchState()
+	err = aliceExchange.fetchState(context.Background())
 	require.NoError(err)
-	err = bobExchange.fetchState()
+	err = bobExchange.fetchState(context.Background())
 	require.NoError(err)
 
-	hasAliceSent = aliceExchange.sendT3Messages()
-	hasBobSent = bobExchange.sendT3Messages()
+	hasAliceSent = aliceExchange.sendT3Messages(context.Background())
+	hasBobSent = bobExchange.sendT3Messages(context.Background())
 	require.NoError(hasAliceSent)
 	require.NoError(hasBobSent)
 
-	err = aliceExchange.fetchState()
+	err = aliceExchange.fetchState(context.Background())
 	require.NoError(err)
-	err = bobExchange.fetchState()
+	err = bobExchange.fetchState(context.Background())
 	require.NoError(err)
 
 	aliceExchange.processT3Messages()
@@ -608,8 +613,8 @@ func TestClientStateSavingAndRecovery(t *testing.T) {
 	require.NoError(err)
 
 	// Run the reunion client exchanges manually instead of using the Exchange method.
-	hasAliceSent := aliceExchange.sendT1()
-	hasBobSent := bobExchange.sendT1()
+	hasAliceSent := aliceExchange.sendT1(context.Background())
+	hasBobSent := bobExchange.sendT1(context.Background())
 	require.NoError(hasAliceSent)
 	require.NoError(hasBobSent)
 
@@ -623,19 +628,19 @@ func TestClientStateSavingAndRecovery(t *testing.T) {
 	bobExchange, err = NewExchangeFromSnapshot(bobSerialized, bobExchangelog, reunionDB, bobUpdateCh, shutdownChan)
 	require.NoError(err)
 
-	err = aliceExchange.fetchState()
+	err = aliceExchange.fetchState(context.Background())
 	require.NoError(err)
-	err = bobExchange.fetchState()
+	err = bobExchange.fetchState(context.Background())
 	require.NoError(err)
 
-	hasAliceSent = aliceExchange.sendT2Messages()
-	hasBobSent = bobExchange.sendT2Messages()
+	hasAliceSent = aliceExchange.sendT2Messages(context.Background())
+	hasBobSent = bobExchange.sendT2Messages(context.Background())
 	require.NoError(hasAliceSent)
 	require.NoError(hasBobSent)
 
-	err = aliceExchange.fetchState()
+	err = aliceExchange.fetchState(context.Background())
 	require.NoError(err)
-	err = bobExchange.fetchState()
+	err = bobExchange.fetchState(context.Background())
 	require.NoError(err)
 
 	aliceSerialized, err = aliceExchange.Marshal()
@@ -648,14 +653,14 @@ func TestClientStateSavingAndRecovery(t *testing.T) {
 	bobExchange, err = NewExchangeFromSnapshot(bobSerialized, bobExchangelog, reunionDB, bobUpdateCh, shutdownChan)
 	require.NoError(err)
 
-	hasAliceSent = aliceExchange.sendT3Messages()
-	hasBobSent = bobExchange.sendT3Messages()
+	hasAliceSent = aliceExchange.sendT3Messages(context.Background())
+	hasBobSent = bobExchange.sendT3Messages(context.Background())
 	require.NoError(hasAliceSent)
 	require.NoError(hasBobSent)
 
-	err = aliceExchange.fetchState()
+	err = aliceExchange.fetchState(context.Background())
 	require.NoError(err)
-	err = bobExchange.fetchState()
+	err = bobExchange.fetchState(context.Background())
 	require.NoError(err)
 
 	aliceSerialized, err = aliceExchange.Marshal()
@@ -676,3 +681,726 @@ func TestClientStateSavingAndRecovery(t *testing.T) {
 	require.Equal(aliceResult, bobPayload)
 	require.Equal(bobResult, alicePayload)
 }
+
+func TestClientDoneUpdate(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	shutdownChan := make(chan struct{})
+	defer close(shutdownChan)
+
+	clock := new(katzenpost.Clock)
+	epoch, _, _ := clock.Now()
+	reunionDB, err := NewMockReunionDB(logBackend.GetLogger("Reunion_DB"), clock)
+	require.NoError(err)
+
+	srv := []byte{1, 2, 3}
+	passphrase := []byte("blah blah motorcycle pencil sharpening gas tank")
+
+	// each caller reads updates until Done and no longer, so Run could
+	// not return if it sent anything after Done
+	run := func(ex *Exchange, updateCh chan ReunionUpdate, updates *[]ReunionUpdate, wg *sync.WaitGroup) {
+		runDone := make(chan struct{})
+		go func() {
+			ex.Run()
+			close(runDone)
+		}()
+		go func() {
+			defer wg.Done()
+			for update := range updateCh {
+				*updates = append(*updates, update)
+				if update.Done {
+					break
+				}
+			}
+			<-runDone
+		}()
+	}
+
+	aliceUpdateCh := make(chan ReunionUpdate)
+	aliceExchange, err := NewExchange([]byte("sup bobby"), logBackend.GetLogger("alice_exchange"), reunionDB, uint64(1), passphrase, srv, epoch, aliceUpdateCh, shutdownChan)
+	require.NoError(err)
+	bobUpdateCh := make(chan ReunionUpdate)
+	bobExchange, err := NewExchange([]byte("yo alice"), logBackend.GetLogger("bob_exchange"), reunionDB, uint64(2), passphrase, srv, epoch, bobUpdateCh, shutdownChan)
+	require.NoError(err)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	var alice, bob []ReunionUpdate
+	run(aliceExchange, aliceUpdateCh, &alice, &wg)
+	run(bobExchange, bobUpdateCh, &bob, &wg)
+	wg.Wait()
+
+	for _, updates := range [][]ReunionUpdate{alice, bob} {
+		require.NotEmpty(updates)
+		last := updates[len(updates)-1]
+		require.True(last.Done)
+		require.Nil(last.Result)
+		require.NoError(last.Error)
+		require.Equal(PhaseComplete, last.Phase)
+		results := 0
+		for _, update := range updates[:len(updates)-1] {
+			require.False(update.Done)
+			require.NotEqual(PhaseComplete, update.Phase)
+			if update.Result != nil {
+				results++
+			}
+		}
+		require.Equal(1, results)
+		require.Equal(results, last.ResultCount)
+	}
+}
+
+// TruncatingReunionDB is a MockReunionDB which truncates the state sent in
+// reply to FetchState to one message per chunk.
+type TruncatingReunionDB struct {
+	*MockReunionDB
+
+	sync.Mutex
+	chunksFetched int
+}
+
+func (m *TruncatingReunionDB) Query(ctx context.Context, command commands.Command) (commands.Command, error) {
+	fetch, ok := command.(*commands.FetchState)
+	if !ok {
+		return m.MockReunionDB.Query(ctx, command)
+	}
+	full := *fetch
+	full.Chunk = 0
+	rawResponse, err := m.MockReunionDB.Query(ctx, &full)
+	if err != nil {
+		return nil, err
+	}
+	response := rawResponse.(*commands.StateResponse)
+	state := new(server.RequestedReunionState)
+	if err := state.Unmarshal(response.Payload); err != nil {
+		return nil, err
+	}
+	chunk, leftOver := state.Chunk(fetch.Chunk, 1)
+	response.Payload, err = chunk.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	response.Truncated = leftOver != 0
+	response.LeftOverChunksHint = leftOver
+	m.Lock()
+	m.chunksFetched++
+	m.Unlock()
+	return response, nil
+}
+
+func TestClientTruncatedState(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	shutdownChan := make(chan struct{})
+	defer close(shutdownChan)
+
+	clock := new(katzenpost.Clock)
+	epoch, _, _ := clock.Now()
+	mockDB, err := NewMockReunionDB(logBackend.GetLogger("Reunion_DB"), clock)
+	require.NoError(err)
+	reunionDB := &TruncatingReunionDB{MockReunionDB: mockDB}
+
+	srv := []byte{1, 2, 3}
+	passphrase := []byte("blah blah motorcycle pencil sharpening gas tank")
+	alicePayload := []byte("sup bobby")
+	bobPayload := []byte("yo alice")
+
+	aliceUpdateCh := make(chan ReunionUpdate, 8)
+	aliceExchange, err := NewExchange(alicePayload, logBackend.GetLogger("alice_exchange"), reunionDB, uint64(1), passphrase, srv, epoch, aliceUpdateCh, shutdownChan)
+	require.NoError(err)
+	bobUpdateCh := make(chan ReunionUpdate, 8)
+	bobExchange, err := NewExchange(bobPayload, logBackend.GetLogger("bob_exchange"), reunionDB, uint64(1), passphrase, srv, epoch, bobUpdateCh, shutdownChan)
+	require.NoError(err)
+
+	require.NoError(aliceExchange.sendT1(context.Background()))
+	require.NoError(bobExchange.sendT1(context.Background()))
+	require.NoError(aliceExchange.fetchState(context.Background()))
+	require.NoError(bobExchange.fetchState(context.Background()))
+	require.Len(aliceExchange.receivedT1s, 2)
+	require.Len(bobExchange.receivedT1s, 2)
+
+	require.NoError(aliceExchange.sendT2Messages(context.Background()))
+	require.NoError(bobExchange.sendT2Messages(context.Background()))
+	require.NoError(aliceExchange.fetchState(context.Background()))
+	require.NoError(bobExchange.fetchState(context.Background()))
+	require.NoError(aliceExchange.sendT3Messages(context.Background()))
+	require.NoError(bobExchange.sendT3Messages(context.Background()))
+	require.NoError(aliceExchange.fetchState(context.Background()))
+	require.NoError(bobExchange.fetchState(context.Background()))
+
+	require.True(aliceExchange.processT3Messages())
+	require.True(bobExchange.processT3Messages())
+	require.Equal(bobPayload, (<-aliceUpdateCh).Result)
+	require.Equal(alicePayload, (<-bobUpdateCh).Result)
+
+	// each fetch of the two T1s and two replies took several chunks
+	require.Greater(reunionDB.chunksFetched, 6)
+}
+
+// BlockingReunionDB is a MockReunionDB whose queries block until their
+// context is done.
+type BlockingReunionDB struct {
+	*MockReunionDB
+}
+
+func (m *BlockingReunionDB) Query(ctx context.Context, command commands.Command) (commands.Command, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestClientRunContext(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	shutdownChan := make(chan struct{})
+	defer close(shutdownChan)
+
+	clock := new(katzenpost.Clock)
+	epoch, _, _ := clock.Now()
+	mockDB, err := NewMockReunionDB(logBackend.GetLogger("Reunion_DB"), clock)
+	require.NoError(err)
+	reunionDB := &BlockingReunionDB{MockReunionDB: mockDB}
+
+	srv := []byte{1, 2, 3}
+	passphrase := []byte("blah blah motorcycle pencil sharpening gas tank")
+	updateCh := make(chan ReunionUpdate, 1)
+	ex, err := NewExchange([]byte("sup bobby"), logBackend.GetLogger("alice_exchange"), reunionDB, uint64(1), passphrase, srv, epoch, updateCh, shutdownChan)
+	require.NoError(err)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFn()
+	runDone := make(chan struct{})
+	go func() {
+		ex.RunContext(ctx)
+		close(runDone)
+	}()
+	select {
+	case <-runDone:
+	case <-time.After(10 * time.Second):
+		t.Fatal("RunContext did not return after its deadline")
+	}
+	update := <-updateCh
+	require.ErrorIs(update.Error, context.DeadlineExceeded)
+}
+
+// RefusingReunionDB is a MockReunionDB which replies to every query with
+// response.
+type RefusingReunionDB struct {
+	*MockReunionDB
+
+	response commands.Command
+}
+
+func (m *RefusingReunionDB) Query(ctx context.Context, command commands.Command) (commands.Command, error) {
+	return m.response, nil
+}
+
+func TestClientTypedErrors(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	shutdownChan := make(chan struct{})
+	defer close(shutdownChan)
+
+	clock := new(katzenpost.Clock)
+	epoch, _, _ := clock.Now()
+	mockDB, err := NewMockReunionDB(logBackend.GetLogger("Reunion_DB"), clock)
+	require.NoError(err)
+
+	srv := []byte{1, 2, 3}
+	passphrase := []byte("blah blah motorcycle pencil sharpening gas tank")
+	run := func(response commands.Command) error {
+		reunionDB := &RefusingReunionDB{MockReunionDB: mockDB, response: response}
+		updateCh := make(chan ReunionUpdate, 1)
+		ex, err := NewExchange([]byte("sup bobby"), logBackend.GetLogger("alice_exchange"), reunionDB, uint64(1), passphrase, srv, epoch, updateCh, shutdownChan)
+		require.NoError(err)
+		ex.Run()
+		return (<-updateCh).Error
+	}
+
+	err = run(&commands.MessageResponse{ErrorCode: commands.ResponseInvalidCommand})
+	require.ErrorIs(err, ErrServerStatus)
+	var statusErr *ServerStatusError
+	require.ErrorAs(err, &statusErr)
+	require.Equal(uint8(commands.ResponseInvalidCommand), statusErr.Code)
+
+	err = run(&commands.StateResponse{})
+	require.ErrorIs(err, ErrWrongResponseCommand)
+	require.False(errors.As(err, &statusErr))
+}
+
+// SlowReunionDB is a MockReunionDB which delays the SendT2 queries,
+// recording how many are concurrent.
+type SlowReunionDB struct {
+	*MockReunionDB
+
+	sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (m *SlowReunionDB) Query(ctx context.Context, command commands.Command) (commands.Command, error) {
+	if _, ok := command.(*commands.SendT2); ok {
+		m.Lock()
+		m.inFlight++
+		if m.inFlight > m.maxInFlight {
+			m.maxInFlight = m.inFlight
+		}
+		m.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		m.Lock()
+		m.inFlight--
+		m.Unlock()
+	}
+	return m.MockReunionDB.Query(ctx, command)
+}
+
+func TestClientConcurrentT2(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	shutdownChan := make(chan struct{})
+	defer close(shutdownChan)
+
+	clock := new(katzenpost.Clock)
+	epoch, _, _ := clock.Now()
+	mockDB, err := NewMockReunionDB(logBackend.GetLogger("Reunion_DB"), clock)
+	require.NoError(err)
+	reunionDB := &SlowReunionDB{MockReunionDB: mockDB}
+
+	srv := []byte{1, 2, 3}
+	passphrase := []byte("blah blah motorcycle pencil sharpening gas tank")
+	ctx := context.Background()
+	alice, err := NewExchange([]byte("sup bobby"), logBackend.GetLogger("alice_exchange"), reunionDB, uint64(1), passphrase, srv, epoch, make(chan ReunionUpdate, 8), shutdownChan)
+	require.NoError(err)
+	bob, err := NewExchange([]byte("yo alice"), logBackend.GetLogger("bob_exchange"), reunionDB, uint64(2), passphrase, srv, epoch, make(chan ReunionUpdate, 8), shutdownChan)
+	require.NoError(err)
+
+	// each T1 bob sends is a distinct peer for alice
+	peers := 2 * t2Workers
+	for i := 0; i < peers; i++ {
+		bob.payload = []byte(fmt.Sprintf("peer %d", i))
+		require.NoError(bob.sendT1(ctx))
+	}
+	require.NoError(alice.sendT1(ctx))
+	require.NoError(alice.fetchState(ctx))
+	require.Len(alice.receivedT1s, peers+1)
+
+	require.NoError(alice.sendT2Messages(ctx))
+	require.Len(alice.repliedT1s, peers)
+	require.Greater(reunionDB.maxInFlight, 1)
+	require.LessOrEqual(reunionDB.maxInFlight, t2Workers)
+}
+
+func TestClientProgress(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	shutdownChan := make(chan struct{})
+	defer close(shutdownChan)
+
+	clock := new(katzenpost.Clock)
+	epoch, _, _ := clock.Now()
+	reunionDB, err := NewMockReunionDB(logBackend.GetLogger("Reunion_DB"), clock)
+	require.NoError(err)
+
+	srv := []byte{1, 2, 3}
+	passphrase := []byte("blah blah motorcycle pencil sharpening gas tank")
+	run := func(ex *Exchange, updateCh chan ReunionUpdate, out *[]ReunionUpdate, wg *sync.WaitGroup) {
+		runDone := make(chan struct{})
+		go func() {
+			ex.Run()
+			close(runDone)
+		}()
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case update := <-updateCh:
+					*out = append(*out, update)
+				case <-runDone:
+					return
+				}
+			}
+		}()
+	}
+
+	aliceUpdateCh := make(chan ReunionUpdate)
+	aliceExchange, err := NewExchange([]byte("sup bobby"), logBackend.GetLogger("alice_exchange"), reunionDB, uint64(1), passphrase, srv, epoch, aliceUpdateCh, shutdownChan)
+	require.NoError(err)
+	bobUpdateCh := make(chan ReunionUpdate)
+	bobExchange, err := NewExchange([]byte("yo alice"), logBackend.GetLogger("bob_exchange"), reunionDB, uint64(2), passphrase, srv, epoch, bobUpdateCh, shutdownChan)
+	require.NoError(err)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	var alice, bob []ReunionUpdate
+	run(aliceExchange, aliceUpdateCh, &alice, &wg)
+	run(bobExchange, bobUpdateCh, &bob, &wg)
+	wg.Wait()
+
+	for _, updates := range [][]ReunionUpdate{alice, bob} {
+		require.NotEmpty(updates)
+		require.Equal(PhaseSentT1, updates[0].Phase)
+		progressOnly := 0
+		for i, update := range updates {
+			require.NoError(update.Error)
+			if i > 0 {
+				require.GreaterOrEqual(update.Phase, updates[i-1].Phase)
+				require.GreaterOrEqual(update.PeersSeen, updates[i-1].PeersSeen)
+				require.GreaterOrEqual(update.T2Sent, updates[i-1].T2Sent)
+				require.GreaterOrEqual(update.T3Received, updates[i-1].T3Received)
+			}
+			if update.Serialized == nil && update.Result == nil && !update.Done {
+				progressOnly++
+				require.NotEqual(updates[i-1].Progress, update.Progress)
+			}
+		}
+		require.NotZero(progressOnly)
+		last := updates[len(updates)-1]
+		require.True(last.Done)
+		require.Equal(Progress{Phase: PhaseComplete, PeersSeen: 1, T2Sent: 1, T3Received: 1}, last.Progress)
+	}
+}
+
+func TestExchangeWipe(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	shutdownChan := make(chan struct{})
+	defer close(shutdownChan)
+
+	clock := new(katzenpost.Clock)
+	epoch, _, _ := clock.Now()
+	reunionDB, err := NewMockReunionDB(logBackend.GetLogger("Reunion_DB"), clock)
+	require.NoError(err)
+
+	srv := []byte{1, 2, 3}
+	passphrase := []byte("blah blah motorcycle pencil sharpening gas tank")
+	alicePayload := []byte("sup bobby")
+	alice, err := NewExchange(alicePayload, logBackend.GetLogger("alice_exchange"), reunionDB, uint64(1), passphrase, srv, epoch, make(chan ReunionUpdate, 8), shutdownChan)
+	require.NoError(err)
+	bob, err := NewExchange([]byte("yo alice"), logBackend.GetLogger("bob_exchange"), reunionDB, uint64(2), passphrase, srv, epoch, make(chan ReunionUpdate, 8), shutdownChan)
+	require.NoError(err)
+
+	ctx := context.Background()
+	for _, step := range []func(ex *Exchange) error{
+		func(ex *Exchange) error { return ex.sendT1(ctx) },
+		func(ex *Exchange) error { return ex.fetchState(ctx) },
+		func(ex *Exchange) error { return ex.sendT2Messages(ctx) },
+		func(ex *Exchange) error { return ex.fetchState(ctx) },
+		func(ex *Exchange) error { return ex.sendT3Messages(ctx) },
+	} {
+		require.NoError(step(alice))
+		require.NoError(step(bob))
+	}
+	require.Len(alice.decryptedT1Betas, 1)
+	var beta *crypto.PublicKey
+	for _, beta = range alice.decryptedT1Betas {
+	}
+	payload := alice.payload
+
+	alice.Wipe()
+	require.Nil(alice.session)
+	require.Empty(alice.decryptedT1Betas)
+	require.Equal(crypto.PublicKey{}, *beta)
+	require.Nil(alice.payload)
+	require.Equal(make([]byte, len(payload)), payload)
+	// the payload given to NewExchange is the caller's
+	require.Equal([]byte("sup bobby"), alicePayload)
+}
+
+// CountingReunionDB is a MockReunionDB counting the FetchState queries.
+type CountingReunionDB struct {
+	*MockReunionDB
+
+	sync.Mutex
+	fetches int
+}
+
+func (m *CountingReunionDB) Query(ctx context.Context, command commands.Command) (commands.Command, error) {
+	if _, ok := command.(*commands.FetchState); ok {
+		m.Lock()
+		m.fetches++
+		m.Unlock()
+	}
+	return m.MockReunionDB.Query(ctx, command)
+}
+
+func TestClientMaxRounds(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	shutdownChan := make(chan struct{})
+	defer close(shutdownChan)
+
+	clock := new(katzenpost.Clock)
+	epoch, _, _ := clock.Now()
+	mockDB, err := NewMockReunionDB(logBackend.GetLogger("Reunion_DB"), clock)
+	require.NoError(err)
+	reunionDB := &CountingReunionDB{MockReunionDB: mockDB}
+
+	// carol has no partner, so only MaxRounds ends her exchange
+	srv := []byte{1, 2, 3}
+	updateCh := make(chan ReunionUpdate, 32)
+	ex, err := NewExchange([]byte("anyone there?"), logBackend.GetLogger("carol_exchange"), reunionDB, uint64(3), []byte("nobody knows this passphrase"), srv, epoch, updateCh, shutdownChan)
+	require.NoError(err)
+	ex.MaxRounds = 3
+	ex.Run()
+	close(updateCh)
+
+	var last ReunionUpdate
+	for update := range updateCh {
+		last = update
+	}
+	require.ErrorIs(last.Error, ErrMaxRounds)
+	require.Equal(3, reunionDB.fetches)
+}
+
+func TestClientGroupResults(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	shutdownChan := make(chan struct{})
+	defer close(shutdownChan)
+
+	clock := new(katzenpost.Clock)
+	epoch, _, _ := clock.Now()
+	reunionDB, err := NewMockReunionDB(logBackend.GetLogger("Reunion_DB"), clock)
+	require.NoError(err)
+
+	srv := []byte{1, 2, 3}
+	passphrase := []byte("blah blah motorcycle pencil sharpening gas tank")
+	names := []string{"alice", "bob", "carol"}
+	results := make([][][]byte, len(names))
+	done := make([][]ReunionUpdate, len(names))
+	errs := make([][]error, len(names))
+
+	// each waits for the results of both others
+	var exchanges []*Exchange
+	var updateChs []chan ReunionUpdate
+	for i, name := range names {
+		updateCh := make(chan ReunionUpdate)
+		ex, err := NewExchange([]byte(name), logBackend.GetLogger(name+"_exchange"), reunionDB, uint64(i), passphrase, srv, epoch, updateCh, shutdownChan)
+		require.NoError(err)
+		ex.Peers = len(names) - 1
+		exchanges = append(exchanges, ex)
+		updateChs = append(updateChs, updateCh)
+	}
+
+	var wg sync.WaitGroup
+	for i, ex := range exchanges {
+		wg.Add(1)
+		runDone := make(chan struct{})
+		go func(ex *Exchange) {
+			ex.Run()
+			close(runDone)
+		}(ex)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				select {
+				case update := <-updateChs[i]:
+					if update.Error != nil {
+						errs[i] = append(errs[i], update.Error)
+					}
+					if len(update.Result) > 0 {
+						results[i] = append(results[i], update.Result)
+					}
+					if update.Done {
+						done[i] = append(done[i], update)
+					}
+				case <-runDone:
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i, name := range names {
+		var want [][]byte
+		for _, other := range names {
+			if other != name {
+				want = append(want, []byte(other))
+			}
+		}
+		require.Empty(errs[i], name)
+		require.ElementsMatch(want, results[i], name)
+		require.Len(done[i], 1)
+		require.Equal(len(names)-1, done[i][0].ResultCount)
+	}
+}
+
+func TestExchangeWithRand(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	shutdownChan := make(chan struct{})
+	defer close(shutdownChan)
+
+	clock := new(katzenpost.Clock)
+	epoch, _, _ := clock.Now()
+	reunionDB, err := NewMockReunionDB(logBackend.GetLogger("Reunion_DB"), clock)
+	require.NoError(err)
+
+	srv := []byte{1, 2, 3}
+	passphrase := []byte("blah blah motorcycle pencil sharpening gas tank")
+	newExchange := func(seed int64) *Exchange {
+		rng := mrand.New(mrand.NewSource(seed))
+		ex, err := NewExchangeWithRand([]byte("sup bobby"), logBackend.GetLogger("alice_exchange"), reunionDB, uint64(1), passphrase, srv, epoch, make(chan ReunionUpdate, 8), shutdownChan, DefaultHash, rng)
+		require.NoError(err)
+		return ex
+	}
+	t1 := func(ex *Exchange) []byte {
+		t1, err := ex.session.GenerateType1Message(ex.payload)
+		require.NoError(err)
+		return t1
+	}
+
+	alice1, alice2, other := newExchange(42), newExchange(42), newExchange(43)
+	require.Equal(alice1.ExchangeID, alice2.ExchangeID)
+	require.Equal(t1(alice1), t1(alice2))
+	require.NotEqual(alice1.ExchangeID, other.ExchangeID)
+	require.NotEqual(t1(alice1), t1(other))
+}
+
+func TestExchangeStatus(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+
+	clock := new(katzenpost.Clock)
+	epoch, _, _ := clock.Now()
+	reunionDB, err := NewMockReunionDB(logBackend.GetLogger("Reunion_DB"), clock)
+	require.NoError(err)
+
+	// the exchange sends its T1 and then stops, while Status is polled
+	const contactID = uint64(7)
+	updateCh := make(chan ReunionUpdate)
+	shutdownChan := make(chan struct{})
+	close(shutdownChan)
+	srv := []byte{1, 2, 3}
+	passphrase := []byte("blah blah motorcycle pencil sharpening gas tank")
+	ex, err := NewExchange([]byte("sup bobby"), logBackend.GetLogger("exchange_status_test"), reunionDB, contactID, passphrase, srv, epoch, updateCh, shutdownChan)
+	require.NoError(err)
+
+	status, id := ex.Status()
+	require.Equal(StatusInitial, status)
+	require.Equal(contactID, id)
+
+	doneCh := make(chan struct{})
+	go func() {
+		ex.Run()
+		close(doneCh)
+	}()
+	for running := true; running; {
+		select {
+		case <-updateCh:
+		case <-doneCh:
+			running = false
+		default:
+			status, id := ex.Status()
+			require.Contains([]int{StatusInitial, StatusT1Sent}, status)
+			require.Equal(contactID, id)
+		}
+	}
+
+	status, id = ex.Status()
+	require.Equal(StatusT1Sent, status)
+	require.Equal(contactID, id)
+}
+
+func TestClientConcurrentMarshal(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	shutdownChan := make(chan struct{})
+	defer close(shutdownChan)
+
+	clock := new(katzenpost.Clock)
+	epoch, _, _ := clock.Now()
+	reunionDB, err := NewMockReunionDB(logBackend.GetLogger("Reunion_DB"), clock)
+	require.NoError(err)
+
+	srv := []byte{1, 2, 3}
+	passphrase := []byte("blah blah motorcycle pencil sharpening gas tank")
+	aliceUpdateCh := make(chan ReunionUpdate)
+	alice, err := NewExchange([]byte("sup bobby"), logBackend.GetLogger("alice_exchange"), reunionDB, uint64(1), passphrase, srv, epoch, aliceUpdateCh, shutdownChan)
+	require.NoError(err)
+	bobUpdateCh := make(chan ReunionUpdate)
+	bob, err := NewExchange([]byte("yo alice"), logBackend.GetLogger("bob_exchange"), reunionDB, uint64(2), passphrase, srv, epoch, bobUpdateCh, shutdownChan)
+	require.NoError(err)
+
+	// snapshots are taken and restored while the exchanges run, which
+	// the race detector checks
+	var wg sync.WaitGroup
+	snapshots := make([]int, 2)
+	for i, ex := range []*Exchange{alice, bob} {
+		ex.PollInterval = 10 * time.Millisecond
+		updateCh := []chan ReunionUpdate{aliceUpdateCh, bobUpdateCh}[i]
+		runDone := make(chan struct{})
+		wg.Add(2)
+		go func(ex *Exchange) {
+			defer wg.Done()
+			ex.Run()
+			close(runDone)
+		}(ex)
+		go func(i int, ex *Exchange) {
+			defer wg.Done()
+			for {
+				select {
+				case <-updateCh:
+				case <-runDone:
+					return
+				default:
+					serialized, err := ex.Marshal()
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					_, err = NewExchangeFromSnapshot(serialized, logBackend.GetLogger("restored_exchange"), reunionDB, make(chan ReunionUpdate), shutdownChan)
+					// a snapshot taken after Run wiped the session is stale
+					if err != nil && !errors.Is(err, ErrStaleSnapshot) {
+						t.Error(err)
+						return
+					}
+					ex.Status()
+					snapshots[i]++
+				}
+			}
+		}(i, ex)
+	}
+	wg.Wait()
+
+	require.NotZero(snapshots[0])
+	require.NotZero(snapshots[1])
+	require.Equal(1, alice.resultCount)
+	require.Equal(1, bob.resultCount)
+}
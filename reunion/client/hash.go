@@ -0,0 +1,77 @@
+// hash.go - Reunion client exchange hashes.
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+var (
+	// DefaultHash is the Hash of the Exchanges made by NewExchange and
+	// NewExchangeFromSnapshot.
+	DefaultHash = sha256.New
+
+	// ErrHashMismatch is the error returned when restoring a snapshot
+	// taken by an Exchange with another Hash.
+	ErrHashMismatch = errors.New("reunion: snapshot was taken with another hash")
+)
+
+// hashIDLabel is hashed to tell apart the Hash of the Exchange a snapshot
+// was taken by.
+const hashIDLabel = "reunion exchange hash"
+
+// hashID returns the digest of hashIDLabel by h, which identifies h in
+// snapshots.
+func hashID(h func() hash.Hash) []byte {
+	hh := h()
+	hh.Write([]byte(hashIDLabel))
+	return hh.Sum(nil)
+}
+
+// checkHash returns an error if h does not make ExchangeHash digests.
+func checkHash(h func() hash.Hash) error {
+	if size := h().Size(); size != len(ExchangeHash{}) {
+		return fmt.Errorf("reunion: hash has %d byte digests, not %d", size, len(ExchangeHash{}))
+	}
+	return nil
+}
+
+// checkHashID returns ErrHashMismatch unless id identifies the Hash of
+// the Exchange.  Snapshots taken before the hash was recorded have no id
+// and used SHA-256.
+func (e *Exchange) checkHashID(id []byte) error {
+	if id == nil {
+		id = hashID(sha256.New)
+	}
+	if !bytes.Equal(id, hashID(e.Hash)) {
+		return ErrHashMismatch
+	}
+	return nil
+}
+
+// hashOf returns the digest of b by the Hash of the Exchange.
+func (e *Exchange) hashOf(b []byte) ExchangeHash {
+	h := e.Hash()
+	h.Write(b)
+	digest := ExchangeHash{}
+	copy(digest[:], h.Sum(nil))
+	return digest
+}
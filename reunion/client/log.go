@@ -0,0 +1,86 @@
+// log.go - Reunion client exchange logging.
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"fmt"
+
+	"gopkg.in/op/go-logging.v1"
+)
+
+// exchangeLogger is the logger of an Exchange.  It prefixes every line
+// with the contact ID, epoch and current FSM phase of the exchange, so that
+// the logs of many concurrent exchanges sharing a logger can be told
+// apart.
+type exchangeLogger struct {
+	log *logging.Logger
+	e   *Exchange
+}
+
+func newExchangeLogger(log *logging.Logger, e *Exchange) *exchangeLogger {
+	return &exchangeLogger{log: log, e: e}
+}
+
+// redactedLen is the number of bytes of a hash or key that redact keeps.
+const redactedLen = 4
+
+// redact returns a short prefix of b in hex and its length, enough to tell
+// messages apart in the logs without printing keys, hashes or payloads in
+// full.
+func redact(b []byte) string {
+	if len(b) <= redactedLen {
+		return fmt.Sprintf("[%d bytes]", len(b))
+	}
+	return fmt.Sprintf("%x…[%d bytes]", b[:redactedLen], len(b))
+}
+
+func phaseName(status int) string {
+	switch status {
+	case initialState:
+		return "initial"
+	case t1MessageSentState:
+		return "t1_sent"
+	default:
+		return fmt.Sprintf("unknown(%d)", status)
+	}
+}
+
+// fields returns the contextual fields of the exchange.  It MUST only be
+// called from the goroutine running the exchange, which owns its status.
+func (l *exchangeLogger) fields() string {
+	epoch := uint64(0)
+	if l.e.session != nil {
+		epoch = l.e.session.Epoch()
+	}
+	return fmt.Sprintf("contact=%d epoch=%d phase=%s", l.e.contactID, epoch, phaseName(l.e.status))
+}
+
+func (l *exchangeLogger) Debug(msg string) {
+	l.log.Debugf("%s: %s", l.fields(), msg)
+}
+
+func (l *exchangeLogger) Debugf(format string, args ...interface{}) {
+	l.Debug(fmt.Sprintf(format, args...))
+}
+
+func (l *exchangeLogger) Error(msg string) {
+	l.log.Errorf("%s: %s", l.fields(), msg)
+}
+
+func (l *exchangeLogger) Errorf(format string, args ...interface{}) {
+	l.Error(fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,140 @@
+// log_test.go - Reunion client exchange logging tests.
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/reunion/epochtime/katzenpost"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExchangeLogFields(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logFile := filepath.Join(t.TempDir(), "reunion.log")
+	logBackend, err := log.New(logFile, "DEBUG", false)
+	require.NoError(err)
+
+	clock := new(katzenpost.Clock)
+	epoch, _, _ := clock.Now()
+	reunionDB, err := NewMockReunionDB(logBackend.GetLogger("Reunion_DB"), clock)
+	require.NoError(err)
+
+	// the exchange sends its T1 and then stops, logging on the way out
+	const contactID = uint64(42)
+	updateCh := make(chan ReunionUpdate)
+	shutdownChan := make(chan struct{})
+	close(shutdownChan)
+	ex, err := NewExchange([]byte("hello"), logBackend.GetLogger("exchange_log_test"), reunionDB, contactID, []byte("passphrase"), []byte{1, 2, 3}, epoch, updateCh, shutdownChan)
+	require.NoError(err)
+
+	doneCh := make(chan struct{})
+	go func() {
+		ex.Run()
+		close(doneCh)
+	}()
+	for running := true; running; {
+		select {
+		case <-updateCh:
+		case <-doneCh:
+			running = false
+		}
+	}
+
+	raw, err := os.ReadFile(logFile)
+	require.NoError(err)
+	lines := 0
+	for _, line := range strings.Split(string(raw), "\n") {
+		if !strings.Contains(line, "exchange_log_test:") {
+			continue
+		}
+		lines++
+		require.Contains(line, fmt.Sprintf("contact=%d", contactID))
+		require.Contains(line, fmt.Sprintf("epoch=%d", epoch))
+		require.Contains(line, "phase=")
+	}
+	require.NotZero(lines)
+	require.Contains(string(raw), "phase=t1_sent")
+}
+
+func TestExchangeLogRedaction(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal("[3 bytes]", redact([]byte{1, 2, 3}))
+	require.Equal("01020304…[5 bytes]", redact([]byte{1, 2, 3, 4, 5}))
+
+	logFile := filepath.Join(t.TempDir(), "reunion.log")
+	logBackend, err := log.New(logFile, "DEBUG", false)
+	require.NoError(err)
+	shutdownChan := make(chan struct{})
+	defer close(shutdownChan)
+
+	clock := new(katzenpost.Clock)
+	epoch, _, _ := clock.Now()
+	reunionDB, err := NewMockReunionDB(logBackend.GetLogger("Reunion_DB"), clock)
+	require.NoError(err)
+
+	// nothing is written to stdout while the exchange runs
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	require.NoError(err)
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	srv := []byte{1, 2, 3}
+	passphrase := []byte("blah blah motorcycle pencil sharpening gas tank")
+	alice, err := NewExchange([]byte("sup bobby"), logBackend.GetLogger("alice_exchange"), reunionDB, uint64(1), passphrase, srv, epoch, make(chan ReunionUpdate, 8), shutdownChan)
+	require.NoError(err)
+	bob, err := NewExchange([]byte("yo alice"), logBackend.GetLogger("bob_exchange"), reunionDB, uint64(2), passphrase, srv, epoch, make(chan ReunionUpdate, 8), shutdownChan)
+	require.NoError(err)
+	ctx := context.Background()
+	for _, step := range []func(ex *Exchange) error{
+		func(ex *Exchange) error { return ex.sendT1(ctx) },
+		func(ex *Exchange) error { return ex.fetchState(ctx) },
+		func(ex *Exchange) error { return ex.sendT2Messages(ctx) },
+		func(ex *Exchange) error { return ex.fetchState(ctx) },
+		func(ex *Exchange) error { return ex.sendT3Messages(ctx) },
+	} {
+		require.NoError(step(alice))
+		require.NoError(step(bob))
+	}
+
+	os.Stdout = stdout
+	require.NoError(w.Close())
+	printed, err := io.ReadAll(r)
+	require.NoError(err)
+	require.Empty(printed)
+
+	// but to the log, with hashes and sessions redacted
+	raw, err := os.ReadFile(logFile)
+	require.NoError(err)
+	t1Hash := alice.hashOf(alice.sentT1)
+	require.Contains(string(raw), "sent T1 "+redact(t1Hash[:]))
+	require.NotContains(string(raw), fmt.Sprintf("%x", t1Hash[:]))
+	require.Contains(string(raw), "sent T2 to T1 ")
+	require.Contains(string(raw), "sent T3 to T1 ")
+	require.Equal(fmt.Sprintf("Session(epoch=%d)", epoch), fmt.Sprint(alice.session))
+}
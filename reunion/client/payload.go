@@ -0,0 +1,110 @@
+// payload.go - Reunion client labeled payloads.
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/katzenpost/katzenpost/reunion/crypto"
+)
+
+var (
+	// ErrPayloadsTooLarge is the error returned when the payloads of an
+	// Exchange do not fit in a T1 message.
+	ErrPayloadsTooLarge = errors.New("reunion: payloads too large")
+
+	// ErrInvalidPayloads is the error returned when the payloads of an
+	// Exchange can not be encoded.
+	ErrInvalidPayloads = errors.New("reunion: invalid payloads")
+)
+
+// payloadsMagic starts the encoded payloads of an Exchange made by
+// NewExchangeWithPayloads.  A single payload is sent as is, so that peers
+// running older clients still receive it, and is told apart by not
+// starting with payloadsMagic.
+var payloadsMagic = []byte{0, 'r', 'p', 1}
+
+// Payload is a labeled payload sent to the peers of an Exchange.
+type Payload struct {
+	// Label tells the payload apart from the others of the Exchange.
+	Label string
+	// Data is the payload itself.
+	Data []byte
+}
+
+// encodePayloads returns payloads encoded as the plaintext of a T1 message.
+func encodePayloads(payloads []Payload) ([]byte, error) {
+	if len(payloads) == 0 || len(payloads) > math.MaxUint8 {
+		return nil, fmt.Errorf("%w: %d payloads", ErrInvalidPayloads, len(payloads))
+	}
+	b := append([]byte(nil), payloadsMagic...)
+	b = append(b, uint8(len(payloads)))
+	for _, payload := range payloads {
+		if len(payload.Label) > math.MaxUint8 {
+			return nil, fmt.Errorf("%w: label of %d bytes", ErrInvalidPayloads, len(payload.Label))
+		}
+		if len(payload.Data) > math.MaxUint16 {
+			return nil, fmt.Errorf("%w: %d bytes", ErrPayloadsTooLarge, len(payload.Data))
+		}
+		b = append(b, uint8(len(payload.Label)))
+		b = append(b, payload.Label...)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(payload.Data)))
+		b = append(b, payload.Data...)
+	}
+	if len(b) > crypto.MaxMessageSize {
+		return nil, fmt.Errorf("%w: %d bytes encoded, %d allowed", ErrPayloadsTooLarge, len(b), crypto.MaxMessageSize)
+	}
+	return b, nil
+}
+
+// decodePayloads returns the payloads of the plaintext of a T1 message.
+// A plaintext that is not encoded by encodePayloads is a single payload
+// without a label.
+func decodePayloads(plaintext []byte) []Payload {
+	single := []Payload{{Data: plaintext}}
+	if !bytes.HasPrefix(plaintext, payloadsMagic) {
+		return single
+	}
+	b := plaintext[len(payloadsMagic):]
+	if len(b) < 1 {
+		return single
+	}
+	payloads := make([]Payload, b[0])
+	b = b[1:]
+	for i := range payloads {
+		if len(b) < 1 || len(b) < 1+int(b[0])+2 {
+			return single
+		}
+		label := string(b[1 : 1+b[0]])
+		b = b[1+int(b[0]):]
+		n := int(binary.BigEndian.Uint16(b))
+		b = b[2:]
+		if len(b) < n {
+			return single
+		}
+		payloads[i] = Payload{Label: label, Data: b[:n:n]}
+		b = b[n:]
+	}
+	if len(b) != 0 {
+		return single
+	}
+	return payloads
+}
@@ -0,0 +1,118 @@
+// payload_test.go - Reunion client labeled payload tests.
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/reunion/crypto"
+	"github.com/katzenpost/katzenpost/reunion/epochtime/katzenpost"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPayloadsEncoding(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	payloads := []Payload{
+		{Label: "provider1", Data: []byte("rendezvous address one")},
+		{Label: "", Data: []byte{}},
+		{Label: "provider2", Data: []byte("rendezvous address two")},
+	}
+	b, err := encodePayloads(payloads)
+	require.NoError(err)
+	require.Equal(payloads, decodePayloads(b))
+
+	// a plaintext not made by encodePayloads is a single payload
+	single := []byte("sup bobby")
+	require.Equal([]Payload{{Data: single}}, decodePayloads(single))
+	truncated := b[:len(b)-1]
+	require.Equal([]Payload{{Data: truncated}}, decodePayloads(truncated))
+
+	_, err = encodePayloads(nil)
+	require.ErrorIs(err, ErrInvalidPayloads)
+	_, err = encodePayloads([]Payload{{Label: string(bytes.Repeat([]byte{'a'}, 256))}})
+	require.ErrorIs(err, ErrInvalidPayloads)
+	_, err = encodePayloads([]Payload{{Data: make([]byte, crypto.MaxMessageSize)}})
+	require.ErrorIs(err, ErrPayloadsTooLarge)
+}
+
+func TestClientPayloads(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	shutdownChan := make(chan struct{})
+	defer close(shutdownChan)
+
+	clock := new(katzenpost.Clock)
+	epoch, _, _ := clock.Now()
+	reunionDB, err := NewMockReunionDB(logBackend.GetLogger("Reunion_DB"), clock)
+	require.NoError(err)
+
+	srv := []byte{1, 2, 3}
+	passphrase := []byte("blah blah motorcycle pencil sharpening gas tank")
+	alicePayloads := []Payload{
+		{Label: "provider1", Data: []byte("rendezvous address one")},
+		{Label: "provider2", Data: []byte("rendezvous address two")},
+	}
+	_, err = NewExchangeWithPayloads([]Payload{{Data: make([]byte, crypto.PayloadSize)}}, logBackend.GetLogger("alice_exchange"), reunionDB, uint64(1), passphrase, srv, epoch, make(chan ReunionUpdate, 8), shutdownChan)
+	require.ErrorIs(err, ErrPayloadsTooLarge)
+	aliceUpdateCh := make(chan ReunionUpdate, 8)
+	alice, err := NewExchangeWithPayloads(alicePayloads, logBackend.GetLogger("alice_exchange"), reunionDB, uint64(1), passphrase, srv, epoch, aliceUpdateCh, shutdownChan)
+	require.NoError(err)
+	bobUpdateCh := make(chan ReunionUpdate, 8)
+	bob, err := NewExchange([]byte("yo alice"), logBackend.GetLogger("bob_exchange"), reunionDB, uint64(2), passphrase, srv, epoch, bobUpdateCh, shutdownChan)
+	require.NoError(err)
+
+	ctx := context.Background()
+	for _, step := range []func(ex *Exchange) error{
+		func(ex *Exchange) error { return ex.sendT1(ctx) },
+		func(ex *Exchange) error { return ex.fetchState(ctx) },
+		func(ex *Exchange) error { return ex.sendT2Messages(ctx) },
+		func(ex *Exchange) error { return ex.fetchState(ctx) },
+		func(ex *Exchange) error { return ex.sendT3Messages(ctx) },
+		func(ex *Exchange) error { return ex.fetchState(ctx) },
+	} {
+		require.NoError(step(alice))
+		require.NoError(step(bob))
+	}
+	require.True(alice.processT3Messages())
+	require.True(bob.processT3Messages())
+
+	result := func(updateCh chan ReunionUpdate) ReunionUpdate {
+		for {
+			update := <-updateCh
+			if update.Result != nil {
+				return update
+			}
+		}
+	}
+
+	// bob receives every payload of alice
+	update := result(bobUpdateCh)
+	require.Equal(alicePayloads, update.Payloads)
+
+	// and alice the single payload of bob, as before
+	update = result(aliceUpdateCh)
+	require.Equal([]byte("yo alice"), update.Result)
+	require.Equal([]Payload{{Data: []byte("yo alice")}}, update.Payloads)
+}
@@ -0,0 +1,59 @@
+// poll.go - Reunion client state polling.
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+)
+
+// DefaultPollInterval is the PollInterval of new Exchanges.
+const DefaultPollInterval = 2 * time.Second
+
+// pollWait returns the time to wait before the next round, a random time
+// between half and one and a half times the PollInterval.
+func (e *Exchange) pollWait() time.Duration {
+	if e.PollInterval <= 0 {
+		return 0
+	}
+	half := e.PollInterval / 2
+	return half + time.Duration(rand.NewMath().Int63n(int64(e.PollInterval)+1))
+}
+
+// poll waits before the next round of fetching the state, and returns
+// false if the Exchange was stopped in the meantime.
+//
+// XXX the StateResponse could carry a hint of when the state is next
+// worth fetching, which poll would wait for instead.
+func (e *Exchange) poll(ctx context.Context) bool {
+	d := e.pollWait()
+	if d == 0 {
+		return !e.shouldStop(ctx)
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-e.shutdownChan:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
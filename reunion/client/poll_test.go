@@ -0,0 +1,85 @@
+// poll_test.go - Reunion client state polling tests.
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/reunion/epochtime/katzenpost"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExchangePollInterval(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	shutdownChan := make(chan struct{})
+
+	clock := new(katzenpost.Clock)
+	epoch, _, _ := clock.Now()
+	mockDB, err := NewMockReunionDB(logBackend.GetLogger("Reunion_DB"), clock)
+	require.NoError(err)
+	reunionDB := &CountingReunionDB{MockReunionDB: mockDB}
+
+	srv := []byte{1, 2, 3}
+	updateCh := make(chan ReunionUpdate, 32)
+	ex, err := NewExchange([]byte("anyone there?"), logBackend.GetLogger("carol_exchange"), reunionDB, uint64(3), []byte("nobody knows this passphrase"), srv, epoch, updateCh, shutdownChan)
+	require.NoError(err)
+	require.Equal(DefaultPollInterval, ex.PollInterval)
+
+	ex.PollInterval = time.Second
+	for i := 0; i < 100; i++ {
+		d := ex.pollWait()
+		require.GreaterOrEqual(d, 500*time.Millisecond)
+		require.LessOrEqual(d, 1500*time.Millisecond)
+	}
+	ex.PollInterval = 0
+	require.Zero(ex.pollWait())
+
+	// a cancelled context interrupts the wait
+	ex.PollInterval = time.Hour
+	ctx, cancelFn := context.WithCancel(context.Background())
+	cancelFn()
+	require.False(ex.poll(ctx))
+
+	// as does the shutdown: carol has no partner, so she fetches the
+	// state once and then waits
+	doneCh := make(chan struct{})
+	go func() {
+		ex.Run()
+		close(doneCh)
+	}()
+	require.Eventually(func() bool {
+		reunionDB.Lock()
+		defer reunionDB.Unlock()
+		return reunionDB.fetches == 1
+	}, 10*time.Second, 10*time.Millisecond)
+	close(shutdownChan)
+	select {
+	case <-doneCh:
+	case <-time.After(10 * time.Second):
+		require.FailNow("Run kept polling after the shutdown")
+	}
+	reunionDB.Lock()
+	require.Equal(1, reunionDB.fetches)
+	reunionDB.Unlock()
+}
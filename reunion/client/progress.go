@@ -0,0 +1,85 @@
+// progress.go - Reunion client exchange progress.
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+// Phase is the phase of an Exchange reported in its updates.
+type Phase int
+
+const (
+	// PhaseStarting is the phase of an Exchange that has not sent its T1.
+	PhaseStarting Phase = iota
+	// PhaseSentT1 is the phase of an Exchange that has sent its T1.
+	PhaseSentT1
+	// PhaseSendingT2 is the phase of an Exchange replying to the T1s of
+	// its peers with T2s.
+	PhaseSendingT2
+	// PhaseSendingT3 is the phase of an Exchange replying to the T2s of
+	// its peers with T3s.
+	PhaseSendingT3
+	// PhaseComplete is the phase of an Exchange that has its results.
+	PhaseComplete
+)
+
+// Progress is how far along an Exchange is, for driving a progress bar.
+type Progress struct {
+	// Phase is the phase of the Exchange.
+	Phase Phase
+	// PeersSeen is the number of T1s of other clients received.
+	PeersSeen int
+	// T2Sent is the number of T2s sent in reply to those T1s.
+	T2Sent int
+	// T3Received is the number of T3s received in reply to our T2s.
+	T3Received int
+}
+
+// progress returns the current Progress of the Exchange.
+func (e *Exchange) progress() Progress {
+	myT1Hash := e.hashOf(e.sentT1)
+	peers := 0
+	for t1Hash := range e.receivedT1s {
+		if t1Hash != myT1Hash {
+			peers++
+		}
+	}
+	return Progress{
+		Phase:      e.phase,
+		PeersSeen:  peers,
+		T2Sent:     len(e.repliedT1s),
+		T3Received: len(e.receivedT3s),
+	}
+}
+
+// sendUpdate sends update with the current Progress.
+func (e *Exchange) sendUpdate(update ReunionUpdate) {
+	update.ContactID = e.contactID
+	update.ExchangeID = e.ExchangeID
+	update.Progress = e.progress()
+	e.reported = update.Progress
+	e.updateChan <- update
+}
+
+// reportProgress enters phase unless a later one was reached, as the
+// Exchange keeps replying to new peers, and sends an update if the
+// Progress changed since the last update.
+func (e *Exchange) reportProgress(phase Phase) {
+	if phase > e.phase {
+		e.phase = phase
+	}
+	if e.progress() != e.reported {
+		e.sendUpdate(ReunionUpdate{})
+	}
+}
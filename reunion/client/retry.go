@@ -0,0 +1,95 @@
+// retry.go - Reunion client query retries.
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/katzenpost/katzenpost/client"
+	"github.com/katzenpost/katzenpost/reunion/commands"
+)
+
+// RetryPolicy is how an Exchange retries the queries to the Reunion DB
+// that fail with a transient error, such as a reply timeout or a network
+// failure.  Other errors abort the exchange at once.
+type RetryPolicy struct {
+	// QueryTimeout limits each attempt of a query, unless it is zero.
+	QueryTimeout time.Duration
+
+	// MaxAttempts is the number of attempts of a query before its error
+	// is returned.  Zero or one means no retries.
+	MaxAttempts int
+
+	// Backoff is the delay before the first retry, which doubles after
+	// each retry up to MaxBackoff.
+	Backoff time.Duration
+
+	// MaxBackoff, unless it is zero, caps the delay between retries.
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is the RetryPolicy of new Exchanges.
+var DefaultRetryPolicy = RetryPolicy{
+	QueryTimeout: 3 * time.Minute,
+	MaxAttempts:  5,
+	Backoff:      time.Second,
+	MaxBackoff:   30 * time.Second,
+}
+
+// isTransient returns true iff a query that failed with err may succeed
+// if retried.
+func isTransient(err error) bool {
+	if errors.Is(err, client.ErrReplyTimeout) || errors.Is(err, client.ErrMessageNotSent) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// query sends command to the Reunion DB, retrying transient failures as
+// set by the RetryPolicy until ctx is done.
+func (e *Exchange) query(ctx context.Context, command commands.Command) (commands.Command, error) {
+	policy := e.RetryPolicy
+	backoff := policy.Backoff
+	for attempt := 1; ; attempt++ {
+		queryCtx, cancelFn := ctx, context.CancelFunc(func() {})
+		if policy.QueryTimeout != 0 {
+			queryCtx, cancelFn = context.WithTimeout(ctx, policy.QueryTimeout)
+		}
+		response, err := e.db.Query(queryCtx, command)
+		cancelFn()
+		if err != nil && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err == nil || !isTransient(err) || attempt >= policy.MaxAttempts {
+			return response, err
+		}
+		e.log.Debugf("query attempt %d failed, retrying in %v: %s", attempt, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+		if policy.MaxBackoff != 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// retry_test.go - Reunion client query retry tests.
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/katzenpost/client"
+	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/reunion/commands"
+	"github.com/katzenpost/katzenpost/reunion/epochtime/katzenpost"
+	"github.com/stretchr/testify/require"
+)
+
+// FlakyReunionDB is a MockReunionDB whose queries fail with err until
+// failures reaches zero.
+type FlakyReunionDB struct {
+	*MockReunionDB
+
+	err      error
+	failures int
+	queries  int
+}
+
+func (m *FlakyReunionDB) Query(ctx context.Context, command commands.Command) (commands.Command, error) {
+	m.queries++
+	if m.failures > 0 {
+		m.failures--
+		return nil, m.err
+	}
+	return m.MockReunionDB.Query(ctx, command)
+}
+
+func TestExchangeQueryRetry(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	shutdownChan := make(chan struct{})
+	defer close(shutdownChan)
+
+	clock := new(katzenpost.Clock)
+	epoch, _, _ := clock.Now()
+	mockDB, err := NewMockReunionDB(logBackend.GetLogger("Reunion_DB"), clock)
+	require.NoError(err)
+
+	srv := []byte{1, 2, 3}
+	passphrase := []byte("blah blah motorcycle pencil sharpening gas tank")
+	newExchange := func(db *FlakyReunionDB) *Exchange {
+		ex, err := NewExchange([]byte("sup bobby"), logBackend.GetLogger("alice_exchange"), db, uint64(1), passphrase, srv, epoch, make(chan ReunionUpdate, 8), shutdownChan)
+		require.NoError(err)
+		ex.RetryPolicy = RetryPolicy{QueryTimeout: time.Second, MaxAttempts: 3, Backoff: time.Millisecond}
+		return ex
+	}
+
+	// transient failures are retried
+	db := &FlakyReunionDB{MockReunionDB: mockDB, err: client.ErrReplyTimeout, failures: 2}
+	require.NoError(newExchange(db).sendT1(context.Background()))
+	require.Equal(3, db.queries)
+
+	// up to MaxAttempts
+	db = &FlakyReunionDB{MockReunionDB: mockDB, err: client.ErrReplyTimeout, failures: 3}
+	require.ErrorIs(newExchange(db).sendT1(context.Background()), client.ErrReplyTimeout)
+	require.Equal(3, db.queries)
+
+	// and other failures are not
+	protocolErr := errors.New("cannot decode command")
+	db = &FlakyReunionDB{MockReunionDB: mockDB, err: protocolErr, failures: 1}
+	require.ErrorIs(newExchange(db).sendT1(context.Background()), protocolErr)
+	require.Equal(1, db.queries)
+}
@@ -18,15 +18,42 @@
 package client
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
 	"github.com/katzenpost/katzenpost/reunion/crypto"
 	"github.com/fxamacker/cbor/v2"
 )
 
+const (
+	// snapshotCBOR is the version byte of uncompressed snapshots.
+	snapshotCBOR byte = 1
+	// snapshotGzip is the version byte of snapshots compressed with gzip.
+	snapshotGzip byte = 2
+
+	// cborMapType is the CBOR major type of the first byte of the
+	// snapshots taken before they had a version byte.
+	cborMapType = 5
+)
+
+// errEmptySnapshot is the error returned when restoring an empty snapshot.
+var errEmptySnapshot = errors.New("reunion: empty snapshot")
+
+// serializableExchange is the state of an Exchange, which MUST have a
+// field for every field of the Exchange other than its configuration, its
+// progress reporting and the channels and database given to
+// NewExchangeFromSnapshot.
 type serializableExchange struct {
 	Status           int
 	ContactID        uint64
 	ExchangeID       uint64
+	HashID           []byte
 	Session          *crypto.Session
+	Payload          []byte
+	ResultCount      int
 	SentT1           []byte
 	SentT2Map        map[ExchangeHash][]byte
 	ReceivedT1s      map[ExchangeHash][]byte
@@ -36,6 +63,7 @@ type serializableExchange struct {
 	RepliedT2s       map[ExchangeHash][]byte
 	ReceivedT1Alphas map[ExchangeHash]*crypto.PublicKey
 	DecryptedT1Betas map[ExchangeHash]*crypto.PublicKey
+	ProcessedT3s     map[ExchangeHash]bool
 }
 
 func (s *serializableExchange) Unmarshal(data []byte) error {
@@ -45,3 +73,51 @@ func (s *serializableExchange) Unmarshal(data []byte) error {
 func (s *serializableExchange) Marshal() ([]byte, error) {
 	return cbor.Marshal(s)
 }
+
+// marshalSnapshot returns a snapshot of s, a version byte followed by the
+// CBOR of s, compressed with gzip if compress is set.
+func marshalSnapshot(s *serializableExchange, compress bool) ([]byte, error) {
+	data, err := s.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	if !compress {
+		return append([]byte{snapshotCBOR}, data...), nil
+	}
+	b := bytes.NewBuffer([]byte{snapshotGzip})
+	w := gzip.NewWriter(b)
+	if _, err = w.Write(data); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// unmarshalSnapshot restores s from a snapshot taken by marshalSnapshot,
+// or from the CBOR of s alone, as snapshots were taken before they had a
+// version byte.
+func unmarshalSnapshot(s *serializableExchange, snapshot []byte) error {
+	if len(snapshot) == 0 {
+		return errEmptySnapshot
+	}
+	switch version := snapshot[0]; {
+	case version == snapshotCBOR:
+		return s.Unmarshal(snapshot[1:])
+	case version == snapshotGzip:
+		r, err := gzip.NewReader(bytes.NewReader(snapshot[1:]))
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return s.Unmarshal(data)
+	case version>>5 == cborMapType:
+		return s.Unmarshal(snapshot)
+	default:
+		return fmt.Errorf("reunion: unknown snapshot version %d", version)
+	}
+}
@@ -18,9 +18,14 @@
 package client
 
 import (
+	"context"
+	"crypto/sha512"
 	"testing"
 
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/log"
 	"github.com/katzenpost/katzenpost/reunion/crypto"
+	"github.com/katzenpost/katzenpost/reunion/epochtime/katzenpost"
 	"github.com/stretchr/testify/require"
 )
 
@@ -92,3 +97,255 @@ func TestSerializableExchange(t *testing.T) {
 
 	require.Equal(xx, zz)
 }
+
+// requireRoundTrip requires that ex restored from its snapshot is equal
+// to ex.
+func requireRoundTrip(t *testing.T, ex *Exchange, db *MockReunionDB) {
+	require := require.New(t)
+
+	serialized, err := ex.Marshal()
+	require.NoError(err)
+	restored, err := NewExchangeFromSnapshot(serialized, ex.log.log, db, ex.updateChan, ex.shutdownChan)
+	require.NoError(err)
+
+	want, got := ex.serializable(), restored.serializable()
+	wantSession, err := want.Session.MarshalBinary()
+	require.NoError(err)
+	gotSession, err := got.Session.MarshalBinary()
+	require.NoError(err)
+	require.Equal(wantSession, gotSession)
+	want.Session, got.Session = nil, nil
+	require.Equal(want, got)
+}
+
+func TestExchangeSnapshotRoundTrip(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	shutdownChan := make(chan struct{})
+	defer close(shutdownChan)
+
+	clock := new(katzenpost.Clock)
+	epoch, _, _ := clock.Now()
+	reunionDB, err := NewMockReunionDB(logBackend.GetLogger("Reunion_DB"), clock)
+	require.NoError(err)
+
+	srv := []byte{1, 2, 3}
+	passphrase := []byte("blah blah motorcycle pencil sharpening gas tank")
+	alice, err := NewExchange([]byte("sup bobby"), logBackend.GetLogger("alice_exchange"), reunionDB, uint64(1), passphrase, srv, epoch, make(chan ReunionUpdate, 8), shutdownChan)
+	require.NoError(err)
+	bob, err := NewExchange([]byte("yo alice"), logBackend.GetLogger("bob_exchange"), reunionDB, uint64(2), passphrase, srv, epoch, make(chan ReunionUpdate, 8), shutdownChan)
+	require.NoError(err)
+
+	ctx := context.Background()
+	requireRoundTrip(t, alice, reunionDB)
+	transitions := []func(ex *Exchange) error{
+		func(ex *Exchange) error {
+			ex.status = t1MessageSentState
+			return ex.sendT1(ctx)
+		},
+		func(ex *Exchange) error { return ex.fetchState(ctx) },
+		func(ex *Exchange) error { return ex.sendT2Messages(ctx) },
+		func(ex *Exchange) error { return ex.fetchState(ctx) },
+		func(ex *Exchange) error { return ex.sendT3Messages(ctx) },
+		func(ex *Exchange) error { return ex.fetchState(ctx) },
+		func(ex *Exchange) error {
+			require.True(ex.processT3Messages())
+			return nil
+		},
+	}
+	for _, transition := range transitions {
+		require.NoError(transition(alice))
+		require.NoError(transition(bob))
+		requireRoundTrip(t, alice, reunionDB)
+		requireRoundTrip(t, bob, reunionDB)
+	}
+	require.Equal(1, alice.resultCount)
+}
+
+func TestExchangeSnapshotHash(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	shutdownChan := make(chan struct{})
+	defer close(shutdownChan)
+
+	clock := new(katzenpost.Clock)
+	epoch, _, _ := clock.Now()
+	reunionDB, err := NewMockReunionDB(logBackend.GetLogger("Reunion_DB"), clock)
+	require.NoError(err)
+
+	srv := []byte{1, 2, 3}
+	passphrase := []byte("blah blah motorcycle pencil sharpening gas tank")
+	updateCh := make(chan ReunionUpdate, 8)
+	_, err = NewExchangeWithHash([]byte("sup bobby"), logBackend.GetLogger("alice_exchange"), reunionDB, uint64(1), passphrase, srv, epoch, updateCh, shutdownChan, sha512.New)
+	require.Error(err)
+
+	alice, err := NewExchangeWithHash([]byte("sup bobby"), logBackend.GetLogger("alice_exchange"), reunionDB, uint64(1), passphrase, srv, epoch, updateCh, shutdownChan, sha512.New512_256)
+	require.NoError(err)
+	serialized, err := alice.Marshal()
+	require.NoError(err)
+
+	_, err = NewExchangeFromSnapshot(serialized, logBackend.GetLogger("alice_exchange"), reunionDB, updateCh, shutdownChan)
+	require.ErrorIs(err, ErrHashMismatch)
+	restored, err := NewExchangeFromSnapshotWithHash(serialized, logBackend.GetLogger("alice_exchange"), reunionDB, updateCh, shutdownChan, sha512.New512_256)
+	require.NoError(err)
+	require.Equal(alice.hashOf([]byte("t1")), restored.hashOf([]byte("t1")))
+}
+
+func TestExchangeStaleSnapshot(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	shutdownChan := make(chan struct{})
+	defer close(shutdownChan)
+
+	clock := new(katzenpost.Clock)
+	epoch, _, _ := clock.Now()
+	reunionDB, err := NewMockReunionDB(logBackend.GetLogger("Reunion_DB"), clock)
+	require.NoError(err)
+
+	passphrase := []byte("blah blah motorcycle pencil sharpening gas tank")
+	updateCh := make(chan ReunionUpdate, 8)
+	snapshot := func(srv []byte, epoch uint64) []byte {
+		ex, err := NewExchange([]byte("sup bobby"), logBackend.GetLogger("alice_exchange"), reunionDB, uint64(1), passphrase, srv, epoch, updateCh, shutdownChan)
+		require.NoError(err)
+		serialized, err := ex.Marshal()
+		require.NoError(err)
+		return serialized
+	}
+
+	_, err = NewExchangeFromSnapshot(snapshot([]byte{1, 2, 3}, epoch), logBackend.GetLogger("alice_exchange"), reunionDB, updateCh, shutdownChan)
+	require.NoError(err)
+	_, err = NewExchangeFromSnapshot(snapshot([]byte{1, 2, 3}, epoch-2), logBackend.GetLogger("alice_exchange"), reunionDB, updateCh, shutdownChan)
+	require.ErrorIs(err, ErrStaleSnapshot)
+	_, err = NewExchangeFromSnapshot(snapshot([]byte{4, 5, 6}, epoch), logBackend.GetLogger("alice_exchange"), reunionDB, updateCh, shutdownChan)
+	require.ErrorIs(err, ErrStaleSnapshot)
+}
+
+func TestExchangeSnapshotCompression(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	shutdownChan := make(chan struct{})
+	defer close(shutdownChan)
+
+	clock := new(katzenpost.Clock)
+	epoch, _, _ := clock.Now()
+	reunionDB, err := NewMockReunionDB(logBackend.GetLogger("Reunion_DB"), clock)
+	require.NoError(err)
+
+	srv := []byte{1, 2, 3}
+	passphrase := []byte("blah blah motorcycle pencil sharpening gas tank")
+	alice, err := NewExchange([]byte("sup bobby"), logBackend.GetLogger("alice_exchange"), reunionDB, uint64(1), passphrase, srv, epoch, make(chan ReunionUpdate, 8), shutdownChan)
+	require.NoError(err)
+	fillPeers(t, alice, 3)
+
+	plain, err := alice.Marshal()
+	require.NoError(err)
+	require.Equal(snapshotCBOR, plain[0])
+	requireRoundTrip(t, alice, reunionDB)
+
+	alice.Compress = true
+	compressed, err := alice.Marshal()
+	require.NoError(err)
+	require.Equal(snapshotGzip, compressed[0])
+	requireRoundTrip(t, alice, reunionDB)
+
+	// snapshots taken before they had a version byte still load
+	legacy, err := alice.serializable().Marshal()
+	require.NoError(err)
+	for _, snapshot := range [][]byte{plain, compressed, legacy} {
+		restored, err := NewExchangeFromSnapshot(snapshot, logBackend.GetLogger("alice_exchange"), reunionDB, alice.updateChan, shutdownChan)
+		require.NoError(err)
+		require.Equal(alice.receivedT1s, restored.receivedT1s)
+	}
+
+	_, err = NewExchangeFromSnapshot([]byte{0x7f}, logBackend.GetLogger("alice_exchange"), reunionDB, alice.updateChan, shutdownChan)
+	require.Error(err)
+	_, err = NewExchangeFromSnapshot(nil, logBackend.GetLogger("alice_exchange"), reunionDB, alice.updateChan, shutdownChan)
+	require.Error(err)
+}
+
+// fillPeers fills the state of ex as if it had exchanged messages with
+// peers other clients.
+func fillPeers(tb testing.TB, ex *Exchange, peers int) {
+	require := require.New(tb)
+
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		_, err := rand.Reader.Read(b)
+		require.NoError(err)
+		return b
+	}
+	publicKey := func() *crypto.PublicKey {
+		k, err := crypto.NewPublicKey(random(crypto.PublicKeyLength))
+		require.NoError(err)
+		return k
+	}
+	ex.sentT1 = random(crypto.Type1MessageSize)
+	ex.status = t1MessageSentState
+	for i := 0; i < peers; i++ {
+		t1 := random(crypto.Type1MessageSize)
+		t1Hash := ex.hashOf(t1)
+		sentT2 := random(crypto.Type2MessageSize)
+		receivedT2 := random(crypto.Type2MessageSize)
+		ex.receivedT1s[t1Hash] = t1
+		ex.receivedT1Alphas[t1Hash] = publicKey()
+		ex.sentT2Map[ex.hashOf(sentT2)] = sentT2
+		ex.repliedT1s[t1Hash] = t1
+		ex.receivedT2s[t1Hash] = receivedT2
+		ex.repliedT2s[ex.hashOf(receivedT2)] = receivedT2
+		ex.decryptedT1Betas[t1Hash] = publicKey()
+		ex.receivedT3s[t1Hash] = random(crypto.Type3MessageSize)
+		ex.processedT3s[t1Hash] = true
+	}
+}
+
+// BenchmarkExchangeSnapshot compares the snapshots of an exchange with 50
+// peers, uncompressed and compressed.
+func BenchmarkExchangeSnapshot(b *testing.B) {
+	require := require.New(b)
+
+	logBackend, err := log.New("", "ERROR", false)
+	require.NoError(err)
+	shutdownChan := make(chan struct{})
+	defer close(shutdownChan)
+
+	clock := new(katzenpost.Clock)
+	epoch, _, _ := clock.Now()
+	reunionDB, err := NewMockReunionDB(logBackend.GetLogger("Reunion_DB"), clock)
+	require.NoError(err)
+
+	srv := []byte{1, 2, 3}
+	passphrase := []byte("blah blah motorcycle pencil sharpening gas tank")
+	ex, err := NewExchange([]byte("sup bobby"), logBackend.GetLogger("alice_exchange"), reunionDB, uint64(1), passphrase, srv, epoch, make(chan ReunionUpdate, 8), shutdownChan)
+	require.NoError(err)
+	fillPeers(b, ex, 50)
+
+	for _, compress := range []bool{false, true} {
+		name := "cbor"
+		if compress {
+			name = "gzip"
+		}
+		b.Run(name, func(b *testing.B) {
+			ex.Compress = compress
+			var snapshot []byte
+			for i := 0; i < b.N; i++ {
+				snapshot, err = ex.Marshal()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(snapshot)), "bytes/snapshot")
+		})
+	}
+}
@@ -40,6 +40,7 @@ const (
 
 	cmdOverhead           = 1
 	fetchStateLength      = cmdOverhead + 8 + 32
+	fetchChunkLength      = fetchStateLength + 4
 	stateResponseLength   = cmdOverhead + 1 + 1 + 4 + crypto.PayloadSize
 	sendT1Length          = cmdOverhead + 8 + crypto.Type1MessageSize
 	sendT2Length          = cmdOverhead + 8 + 32 + 32 + crypto.Type2MessageSize
@@ -68,26 +69,37 @@ type FetchState struct {
 
 	// T1Hash is the hash of the T1 message which is linked with a set of received messages.
 	T1Hash [sha256.Size]byte
+
+	// Chunk is the number of the chunk of a truncated state to fetch.
+	// It is only serialized if non zero, so that servers which do not
+	// truncate still accept the first chunk.
+	Chunk uint32
 }
 
 // ToBytes serializes the SendT1 command and returns the resulting slice.
 func (s *FetchState) ToBytes() []byte {
-	out := make([]byte, fetchStateLength)
+	out := make([]byte, fetchStateLength, fetchChunkLength)
 	out[0] = byte(fetchState)
 	binary.BigEndian.PutUint64(out[1:9], s.Epoch)
 	copy(out[9:], s.T1Hash[:])
+	if s.Chunk != 0 {
+		out = binary.BigEndian.AppendUint32(out, s.Chunk)
+	}
 	return out
 }
 
 func fetchStateFromBytes(b []byte) (Command, error) {
-	if len(b) != fetchStateLength {
+	if len(b) != fetchStateLength && len(b) != fetchChunkLength {
 		return nil, errInvalidCommand
 	}
 	s := new(FetchState)
 	s.Epoch = binary.BigEndian.Uint64(b[1:9])
 	t1Hash := [sha256.Size]byte{}
-	copy(t1Hash[:], b[9:])
+	copy(t1Hash[:], b[9:fetchStateLength])
 	s.T1Hash = t1Hash
+	if len(b) == fetchChunkLength {
+		s.Chunk = binary.BigEndian.Uint32(b[fetchStateLength:])
+	}
 	return s, nil
 }
 
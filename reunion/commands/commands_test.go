@@ -48,6 +48,15 @@ func TestFetchStateCommand(t *testing.T) {
 	cmd2 := c.(*FetchState)
 	require.Equal(cmd.Epoch, cmd2.Epoch)
 	require.Equal(cmd.T1Hash[:], cmd2.T1Hash[:])
+	require.Equal(uint32(0), cmd2.Chunk)
+
+	// later chunks of a truncated state
+	cmd.Chunk = 3
+	b = cmd.ToBytes()
+	require.Equal(len(b), fetchChunkLength)
+	c, err = FromBytes(b)
+	require.NoError(err)
+	require.Equal(cmd, c)
 }
 
 func TestStateResponseCommand(t *testing.T) {
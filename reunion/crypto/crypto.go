@@ -36,6 +36,10 @@ const (
 	// PayloadSize is the size of the Reunion protocol payload.
 	PayloadSize = 1000
 
+	// MaxMessageSize is the size of the largest message a Type 1 Message
+	// can carry, which is padded to PayloadSize.
+	MaxMessageSize = PayloadSize - 4
+
 	// SymmetricKeySize is the size of the symmetric keys we use.
 	SymmetricKeySize = 32
 
@@ -57,7 +61,7 @@ const (
 var ErrInvalidMessageSize = errors.New("invalid message size")
 
 func padMessage(message []byte) (*[PayloadSize]byte, error) {
-	if len(message) > PayloadSize-4 {
+	if len(message) > MaxMessageSize {
 		return nil, ErrInvalidMessageSize
 	}
 	payload := [PayloadSize]byte{}
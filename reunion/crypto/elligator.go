@@ -31,6 +31,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"io"
 
 	"github.com/awnumar/memguard"
 	"github.com/fxamacker/cbor/v2"
@@ -199,20 +200,26 @@ func NewEmptyPrivateKey() *PrivateKey {
 // NewRandomPrivateKey creates a new PrivateKey with the lockedBuffer
 // initialized to PrivateKeyLength random bytes.
 func NewRandomPrivateKey() *PrivateKey {
-	pkb, err := memguard.NewBufferFromReader(rand.Reader, PrivateKeyLength)
+	return NewRandomPrivateKeyWithReader(rand.Reader)
+}
+
+// NewRandomPrivateKeyWithReader creates a new PrivateKey with the
+// lockedBuffer initialized to PrivateKeyLength bytes read from r.
+func NewRandomPrivateKeyWithReader(r io.Reader) *PrivateKey {
+	pkb, err := memguard.NewBufferFromReader(r, PrivateKeyLength)
 	if err != nil {
 		memguard.SafePanic(err)
 	}
 	p := &PrivateKey{
 		privBuf: pkb,
 	}
-	r := p.privBuf.Bytes()
-	digest := sha256.Sum256(r)
+	b := p.privBuf.Bytes()
+	digest := sha256.Sum256(b)
 	digest[0] &= 248
 	digest[31] &= 127
 	digest[31] |= 64
 	p.privBuf.Melt()
-	copy(r, digest[:])
+	copy(b, digest[:])
 	p.privBuf.Freeze()
 	return p
 }
@@ -349,6 +356,11 @@ func (keypair *Keypair) UnmarshalBinary(data []byte) error {
 // NewKeypair generates a new Curve25519 keypair, and optionally also generates
 // an Elligator representative of the public key.
 func NewKeypair(elligator bool) (*Keypair, error) {
+	return NewKeypairWithReader(rand.Reader, elligator)
+}
+
+// NewKeypairWithReader is NewKeypair drawing the private key from r.
+func NewKeypairWithReader(r io.Reader, elligator bool) (*Keypair, error) {
 	keypair := new(Keypair)
 	keypair.public = new(PublicKey)
 	if elligator {
@@ -356,7 +368,7 @@ func NewKeypair(elligator bool) (*Keypair, error) {
 	}
 
 	for {
-		keypair.private = NewRandomPrivateKey()
+		keypair.private = NewRandomPrivateKeyWithReader(r)
 		if elligator {
 			// Apply the Elligator transform.  This fails ~50% of the time.
 			//if !extra25519.ScalarBaseMult(keypair.public.Bytes(),
@@ -17,6 +17,9 @@
 package crypto
 
 import (
+	"fmt"
+	"io"
+
 	"github.com/awnumar/memguard"
 	"github.com/fxamacker/cbor/v2"
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
@@ -62,19 +65,25 @@ type Session struct {
 
 // NewSessionFromKey creates a new client given a shared epoch key.
 func NewSessionFromKey(sharedEpochKey *[SharedEpochKeySize]byte, sharedRandomValue []byte, epoch uint64) (*Session, error) {
-	keypair1, err := NewKeypair(true)
+	return NewSessionFromKeyWithReader(rand.Reader, sharedEpochKey, sharedRandomValue, epoch)
+}
+
+// NewSessionFromKeyWithReader is NewSessionFromKey drawing the session's
+// keys from r.
+func NewSessionFromKeyWithReader(r io.Reader, sharedEpochKey *[SharedEpochKeySize]byte, sharedRandomValue []byte, epoch uint64) (*Session, error) {
+	keypair1, err := NewKeypairWithReader(r, true)
 	if err != nil {
 		return nil, err
 	}
-	keypair2, err := NewKeypair(false)
+	keypair2, err := NewKeypairWithReader(r, false)
 	if err != nil {
 		return nil, err
 	}
-	sk1, err := memguard.NewBufferFromReader(rand.Reader, 32)
+	sk1, err := memguard.NewBufferFromReader(r, 32)
 	if err != nil {
 		memguard.SafePanic(err)
 	}
-	sk2, err := memguard.NewBufferFromReader(rand.Reader, 32)
+	sk2, err := memguard.NewBufferFromReader(r, 32)
 	if err != nil {
 		memguard.SafePanic(err)
 	}
@@ -92,6 +101,11 @@ func NewSessionFromKey(sharedEpochKey *[SharedEpochKeySize]byte, sharedRandomVal
 
 // NewSession creates a new client given a shared passphrase, shared random value and an epoch number.
 func NewSession(passphrase []byte, sharedRandomValue []byte, epoch uint64) (*Session, error) {
+	return NewSessionWithReader(rand.Reader, passphrase, sharedRandomValue, epoch)
+}
+
+// NewSessionWithReader is NewSession drawing the session's keys from r.
+func NewSessionWithReader(r io.Reader, passphrase []byte, sharedRandomValue []byte, epoch uint64) (*Session, error) {
 	salt := getSalt(sharedRandomValue, epoch)
 	// XXX how many iterations should we use?
 	// This makes it run for 2.2s on my crappy laptop.
@@ -102,7 +116,7 @@ func NewSession(passphrase []byte, sharedRandomValue []byte, epoch uint64) (*Ses
 	k := [SharedEpochKeySize]byte{}
 	copy(k[:], key)
 	memguard.WipeBytes(key)
-	return NewSessionFromKey(&k, sharedRandomValue, epoch)
+	return NewSessionFromKeyWithReader(r, &k, sharedRandomValue, epoch)
 }
 
 // Epoch returns the epoch.
@@ -115,6 +129,12 @@ func (c *Session) SharedRandom() []byte {
 	return c.sharedRandomValue
 }
 
+// String returns a description of the Session without its key material,
+// so that formatting a Session never prints its keys.
+func (c *Session) String() string {
+	return fmt.Sprintf("Session(epoch=%d)", c.epoch)
+}
+
 // Destroy destroys all the Session's key material
 // and frees up the memory.
 func (c *Session) Destroy() {
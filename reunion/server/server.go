@@ -35,6 +35,10 @@ import (
 const (
 	writeBackInterval = 10 * time.Second
 	epochGracePeriod  = 3 * time.Minute
+
+	// stateChunkItems is the number of T1, T2 and T3 messages sent in
+	// each chunk of the state, in reply to a FetchState command.
+	stateChunkItems = 64
 )
 
 // Server is a reunion server.
@@ -128,14 +132,15 @@ func (s *Server) fetchState(fetchCmd *commands.FetchState) (*commands.StateRespo
 		T1Map:    t1Map,
 		Messages: t2t3messages,
 	}
-	serialized, err := requested.Marshal()
+	chunk, leftOver := requested.Chunk(fetchCmd.Chunk, stateChunkItems)
+	serialized, err := chunk.Marshal()
 	if err != nil {
 		return nil, err
 	}
 	response := &commands.StateResponse{
 		ErrorCode:          commands.ResponseStatusOK,
-		Truncated:          false,
-		LeftOverChunksHint: 0,
+		Truncated:          leftOver != 0,
+		LeftOverChunksHint: leftOver,
 		Payload:            serialized,
 	}
 	return response, nil
@@ -18,12 +18,15 @@
 package server
 
 import (
+	"bytes"
 	"container/list"
+	"context"
 	"crypto/sha256"
 	"errors"
 	"fmt"
 	"github.com/fxamacker/cbor/v2"
 	"os"
+	"sort"
 	"sync"
 
 	"github.com/katzenpost/katzenpost/reunion/commands"
@@ -34,8 +37,8 @@ import (
 // Reunion DB that protocol clients interact with.
 type ReunionDatabase interface {
 	// Query sends a query command to the Reunion DB and returns the
-	// response command or an error.
-	Query(command commands.Command) (commands.Command, error)
+	// response command or an error, giving up when ctx is done.
+	Query(ctx context.Context, command commands.Command) (commands.Command, error)
 	CurrentSharedRandoms() ([][]byte, error)
 	CurrentEpochs() ([]uint64, error)
 }
@@ -178,6 +181,41 @@ func (s *RequestedReunionState) Unmarshal(data []byte) error {
 	return cbor.Unmarshal(data, s)
 }
 
+// Chunk returns the chunk numbered index of the state split into chunks
+// of up to items T1, T2 and T3 messages, and the number of chunks after
+// it.  The T1 messages come first, ordered by hash, followed by the T2
+// and T3 messages in the order they were received.
+func (s *RequestedReunionState) Chunk(index uint32, items int) (*RequestedReunionState, uint32) {
+	t1Hashes := make([][32]byte, 0, len(s.T1Map))
+	for t1Hash := range s.T1Map {
+		t1Hashes = append(t1Hashes, t1Hash)
+	}
+	sort.Slice(t1Hashes, func(i, j int) bool {
+		return bytes.Compare(t1Hashes[i][:], t1Hashes[j][:]) < 0
+	})
+	total := len(t1Hashes) + len(s.Messages)
+	chunks := (total + items - 1) / items
+	if chunks == 0 {
+		chunks = 1
+	}
+
+	chunk := &RequestedReunionState{
+		T1Map:    make(map[[32]byte][]byte),
+		Messages: make([]*T2T3Message, 0),
+	}
+	if int(index) >= chunks {
+		return chunk, 0
+	}
+	for i := int(index) * items; i < total && i < (int(index)+1)*items; i++ {
+		if i < len(t1Hashes) {
+			chunk.T1Map[t1Hashes[i]] = s.T1Map[t1Hashes[i]]
+		} else {
+			chunk.Messages = append(chunk.Messages, s.Messages[i-len(t1Hashes)])
+		}
+	}
+	return chunk, uint32(chunks - int(index) - 1)
+}
+
 // SerializableReunionState represents the ReunionState in
 // a serializable struct type.
 type SerializableReunionState struct {
@@ -147,3 +147,40 @@ func TestStateSerialization3(t *testing.T) {
 	require.NoError(err)
 	require.Equal(b1, b2)
 }
+
+func TestRequestedReunionStateChunk(t *testing.T) {
+	require := require.New(t)
+
+	state := &RequestedReunionState{
+		T1Map: map[[32]byte][]byte{{2}: []byte("b"), {1}: []byte("a")},
+		Messages: []*T2T3Message{
+			{T2Payload: []byte("t2")},
+			{T3Payload: []byte("t3")},
+			{T2Payload: []byte("t2 again")},
+		},
+	}
+	chunk, leftOver := state.Chunk(0, 2)
+	require.Equal(uint32(2), leftOver)
+	require.Equal(map[[32]byte][]byte{{1}: []byte("a"), {2}: []byte("b")}, chunk.T1Map)
+	require.Empty(chunk.Messages)
+
+	chunk, leftOver = state.Chunk(1, 2)
+	require.Equal(uint32(1), leftOver)
+	require.Empty(chunk.T1Map)
+	require.Equal(state.Messages[:2], chunk.Messages)
+
+	chunk, leftOver = state.Chunk(2, 2)
+	require.Equal(uint32(0), leftOver)
+	require.Equal(state.Messages[2:], chunk.Messages)
+
+	// chunks past the end are empty
+	chunk, leftOver = state.Chunk(3, 2)
+	require.Equal(uint32(0), leftOver)
+	require.Empty(chunk.T1Map)
+	require.Empty(chunk.Messages)
+
+	// as is the only chunk of an empty state
+	chunk, leftOver = (&RequestedReunionState{}).Chunk(0, 2)
+	require.Equal(uint32(0), leftOver)
+	require.Empty(chunk.T1Map)
+}
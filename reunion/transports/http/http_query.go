@@ -19,6 +19,7 @@ package http
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -55,18 +56,18 @@ func (k *Transport) CurrentEpochs() ([]uint64, error) {
 }
 
 // Query sends the command to the destination Reunion DB service over HTTP.
-func (k *Transport) Query(command commands.Command) (commands.Command, error) {
-	request, err := http.NewRequest("POST", k.url, bytes.NewBuffer(command.ToBytes()))
+func (k *Transport) Query(ctx context.Context, command commands.Command) (commands.Command, error) {
+	request, err := http.NewRequestWithContext(ctx, "POST", k.url, bytes.NewBuffer(command.ToBytes()))
 	if err != nil {
-		return nil, fmt.Errorf("HTTPTransport Query error: %s", err.Error())
+		return nil, fmt.Errorf("HTTPTransport Query error: %w", err)
 	}
 	response, err := k.client.Do(request)
 	if err != nil {
-		return nil, fmt.Errorf("HTTPTransport Query error: %s", err.Error())
+		return nil, fmt.Errorf("HTTPTransport Query error: %w", err)
 	}
 	reply, err := io.ReadAll(response.Body)
 	if err != nil {
-		return nil, fmt.Errorf("HTTPTransport Query error: %s", err.Error())
+		return nil, fmt.Errorf("HTTPTransport Query error: %w", err)
 	}
 	return commands.FromBytes(reply)
 }
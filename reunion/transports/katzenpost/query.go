@@ -19,6 +19,7 @@
 package katzenpost
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -83,8 +84,8 @@ func (k *Transport) CurrentEpochs() ([]uint64, error) {
 
 // Query sends the command to the destination Reunion DB service
 // over a Katzenpost mix network.
-func (k *Transport) Query(command commands.Command) (commands.Command, error) {
-	reply, err := k.Session.BlockingSendReliableMessage(k.Recipient, k.Provider, command.ToBytes())
+func (k *Transport) Query(ctx context.Context, command commands.Command) (commands.Command, error) {
+	reply, err := k.Session.BlockingSendReliableMessageWithContext(ctx, k.Recipient, k.Provider, command.ToBytes())
 	if err != nil {
 		return nil, err
 	}